@@ -111,7 +111,7 @@ func generate(version string) error {
 		return fmt.Errorf("%s is not a directory", templatesDir)
 	}
 
-	return filepath.Walk(templatesDir, func(filePath string, fileInfo os.FileInfo, e error) error {
+	if err := filepath.Walk(templatesDir, func(filePath string, fileInfo os.FileInfo, e error) error {
 		if e != nil {
 			return e
 		}
@@ -148,7 +148,32 @@ func generate(version string) error {
 		}
 
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
+
+	return copyEmbeddedFiles(outputDir)
+}
+
+// embeddedFiles are the generated files which are copied into packages that embed them, since go:embed can't
+// reach files outside of the package directory.
+var embeddedFiles = map[string]string{
+	"cockroachdb-parent/charts/cockroachdb/values.yaml":        "pkg/migrate/chart/values.yaml",
+	"cockroachdb-parent/charts/cockroachdb/values.schema.json": "pkg/migrate/chart/values.schema.json",
+}
+
+// copyEmbeddedFiles refreshes the copies of the embedded files, so that they don't drift from the charts.
+func copyEmbeddedFiles(outputDir string) error {
+	for src, dest := range embeddedFiles {
+		data, err := os.ReadFile(filepath.Join(outputDir, src))
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %w", src, err)
+		}
+		if err := os.WriteFile(filepath.Join(outputDir, dest), data, 0644); err != nil {
+			return fmt.Errorf("cannot copy %s -> %s: %w", src, dest, err)
+		}
+	}
+	return nil
 }
 
 // buildTemplateArgs reads the Chart.yaml file and returns the template arguments.
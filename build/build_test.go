@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/Masterminds/semver/v3"
@@ -183,3 +185,34 @@ func TestBumpVersion_DefaultPatch(t *testing.T) {
 		})
 	}
 }
+
+func TestCopyEmbeddedFiles(t *testing.T) {
+	dir := t.TempDir()
+	for src, dest := range embeddedFiles {
+		for _, file := range []string{src, dest} {
+			if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(file)), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, src), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, dest), []byte("stale"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := copyEmbeddedFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for src, dest := range embeddedFiles {
+		data, err := os.ReadFile(filepath.Join(dir, dest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != src {
+			t.Errorf("%s was not refreshed from %s, got %q", dest, src, data)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package cockroachdb_enterprise_operator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/backup"
+	"github.com/cockroachdb/helm-charts/pkg/provision"
+	"github.com/spf13/cobra"
+)
+
+var (
+	backupDatabases   []string
+	backupOptions     []string
+	backupInto        string
+	backupIn          string
+	backupFrom        string
+	backupAsOf        string
+	backupIncremental bool
+	backupWait        bool
+	backupRecurring   string
+	backupFullBackup  string
+	scheduleOptions   []string
+	newDBName         string
+	jobsLimit         int
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Schedule, take, list and restore the backups of a cluster",
+	Long: `Manage the backups of a CockroachDB cluster deployed by the helm chart, in external storage such as
+s3://bucket/path?AUTH=implicit, gs://bucket/path, azure-blob://container/path or nodelocal://1/path.
+
+The backups and the restores run as jobs of the cluster, which keep running if the command is interrupted. Use
+the list command to follow them.`,
+}
+
+var backupScheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Create or update the backup schedules of databases",
+	Long: `Create the backup schedules of databases, or re-create the schedules which don't match the spec, with the
+labels of the schedules created by the init job of the helm chart. Running the command again applies no change.
+
+The schedules are read from the init.provisioning.databases[].backup of a provisioning spec or of a values file
+of the chart, or from --database, --into and --recurring.`,
+	RunE: scheduleBackups,
+}
+
+var backupCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Back up the cluster or databases into a collection",
+	Long: `Back up the whole cluster, or the databases of --database, into the collection of --into. With
+--incremental, an incremental backup is added to the latest full backup of the collection.`,
+	RunE: createBackup,
+}
+
+var backupListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the backups of a collection, and the backup and restore jobs",
+	RunE:  listBackups,
+}
+
+var backupRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore the cluster or databases from a backup",
+	Long: `Restore the whole cluster, or the databases of --database, from a backup of the collection of --in. The
+backup is restored into the cluster of --statefulset-name in --namespace, which can be another cluster than the
+one which was backed up, such as a cluster deployed for a disaster recovery drill.
+
+A cluster can only be restored into an empty cluster, and a database must not exist unless it is restored under
+another name with --new-db-name.`,
+	RunE: restoreBackup,
+}
+
+func init() {
+	addConnectionFlags(backupCmd)
+
+	backupScheduleCmd.Flags().StringVar(&specFile, "spec-file", "", "provisioning spec, or helm values file holding init.provisioning")
+	backupScheduleCmd.Flags().StringSliceVar(&backupDatabases, "database", nil, "database to schedule the backups of, can be repeated")
+	backupScheduleCmd.Flags().StringVar(&backupInto, "into", "", "URI of the collection of the backups")
+	backupScheduleCmd.Flags().StringArrayVar(&backupOptions, "option", nil, "option of the backups, such as revision_history, can be repeated")
+	backupScheduleCmd.Flags().StringVar(&backupRecurring, "recurring", "", "recurrence of the incremental backups, or of the full backups without --full-backup, such as @hourly")
+	backupScheduleCmd.Flags().StringVar(&backupFullBackup, "full-backup", "", "recurrence of the full backups, such as @daily. Every backup is full if it is not set")
+	backupScheduleCmd.Flags().StringArrayVar(&scheduleOptions, "schedule-option", nil, "option of a created schedule, such as first_run = 'now', can be repeated")
+	backupScheduleCmd.Flags().BoolVar(&prune, "prune", false, "drop the schedules of the databases without backup in the spec file")
+	backupScheduleCmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the changes without applying them")
+	backupScheduleCmd.MarkFlagsMutuallyExclusive("spec-file", "database")
+	backupScheduleCmd.MarkFlagsRequiredTogether("database", "into", "recurring")
+
+	backupCreateCmd.Flags().StringSliceVar(&backupDatabases, "database", nil, "database to back up, can be repeated. Defaults to the whole cluster")
+	backupCreateCmd.Flags().StringVar(&backupInto, "into", "", "URI of the collection the backup is added to")
+	backupCreateCmd.Flags().BoolVar(&backupIncremental, "incremental", false, "add an incremental backup to the latest full backup of the collection")
+	backupCreateCmd.Flags().StringVar(&backupAsOf, "as-of", "", "AS OF SYSTEM TIME of the backup, such as -10s")
+	backupCreateCmd.Flags().StringArrayVar(&backupOptions, "option", nil, "option of the backup, such as revision_history, can be repeated")
+	backupCreateCmd.Flags().BoolVar(&backupWait, "wait", true, "wait for the backup to complete and report its progress")
+	_ = backupCreateCmd.MarkFlagRequired("into")
+
+	backupListCmd.Flags().StringVar(&backupIn, "in", "", "URI of the collection to list the backups of. Only the jobs are listed if it is not set")
+	backupListCmd.Flags().IntVar(&jobsLimit, "limit", 20, "number of the latest backup and restore jobs to list")
+
+	backupRestoreCmd.Flags().StringSliceVar(&backupDatabases, "database", nil, "database to restore, can be repeated. Defaults to the whole cluster")
+	backupRestoreCmd.Flags().StringVar(&backupIn, "in", "", "URI of the collection of the backup")
+	backupRestoreCmd.Flags().StringVar(&backupFrom, "from", backup.Latest, "path of the backup in the collection, as listed by the list command")
+	backupRestoreCmd.Flags().StringVar(&newDBName, "new-db-name", "", "name of the restored database, when a single database is restored")
+	backupRestoreCmd.Flags().StringArrayVar(&backupOptions, "option", nil, "option of the restore, such as skip_missing_foreign_keys, can be repeated")
+	backupRestoreCmd.Flags().BoolVar(&backupWait, "wait", true, "wait for the restore to complete and report its progress")
+	_ = backupRestoreCmd.MarkFlagRequired("in")
+
+	backupCmd.AddCommand(backupScheduleCmd, backupCreateCmd, backupListCmd, backupRestoreCmd)
+	rootCmd.AddCommand(backupCmd)
+}
+
+// newBackupManager connects to the cluster of the persistent flags of the backup command.
+func newBackupManager(ctx context.Context) (*backup.Manager, error) {
+	opts := backup.Options{
+		StatefulSetConnection: connection(),
+	}
+	return backup.NewManager(ctx, kubeconfig, opts)
+}
+
+func scheduleBackups(cmd *cobra.Command, args []string) error {
+	var spec provision.Spec
+	switch {
+	case specFile != "":
+		var err error
+		if spec, err = provision.LoadSpec(specFile); err != nil {
+			return err
+		}
+	case len(backupDatabases) > 0:
+		if prune {
+			return errors.New("--prune requires --spec-file")
+		}
+		b := provision.Backup{Into: backupInto, Options: backupOptions, Recurring: backupRecurring, FullBackup: backupFullBackup}
+		if len(scheduleOptions) > 0 {
+			b.Schedule = &provision.BackupSchedule{Options: scheduleOptions}
+		}
+		for _, name := range backupDatabases {
+			b := b
+			spec.Databases = append(spec.Databases, provision.Database{Name: name, Backup: &b})
+		}
+		spec.Normalize()
+		if err := spec.Validate(); err != nil {
+			return err
+		}
+	default:
+		return errors.New("either --spec-file or --database is required")
+	}
+
+	ctx := context.Background()
+	m, err := newBackupManager(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	_, err = m.ApplySchedules(ctx, spec, prune, dryRun)
+	return err
+}
+
+func createBackup(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	m, err := newBackupManager(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	_, err = m.Backup(ctx, backup.BackupOptions{
+		Databases:   backupDatabases,
+		Into:        backupInto,
+		Incremental: backupIncremental,
+		AsOf:        backupAsOf,
+		Options:     backupOptions,
+		Wait:        backupWait,
+	})
+	return err
+}
+
+func listBackups(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	m, err := newBackupManager(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	out := cmd.OutOrStdout()
+	if backupIn != "" {
+		backups, err := m.Backups(ctx, backupIn)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d backups in the collection:\n", len(backups))
+		for _, b := range backups {
+			fmt.Fprintf(out, "  %s\n", b)
+		}
+	}
+
+	jobs, err := m.Jobs(ctx, jobsLimit)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d latest backup and restore jobs:\n", len(jobs))
+	for _, j := range jobs {
+		line := fmt.Sprintf("  %s, created %s: %s", j.Progress(), j.Created.UTC().Format("2006-01-02T15:04:05Z"), j.Description)
+		if j.Error != "" {
+			line += "\n    error: " + j.Error
+		}
+		fmt.Fprintln(out, line)
+	}
+	return nil
+}
+
+func restoreBackup(cmd *cobra.Command, args []string) error {
+	options := backupOptions
+	if newDBName != "" {
+		if len(backupDatabases) != 1 {
+			return errors.New("--new-db-name requires a single --database")
+		}
+		options = append(options, "new_db_name = '"+strings.ReplaceAll(newDBName, "'", "''")+"'")
+	}
+
+	ctx := context.Background()
+	m, err := newBackupManager(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	_, err = m.Restore(ctx, backup.RestoreOptions{
+		Databases: backupDatabases,
+		In:        backupIn,
+		From:      backupFrom,
+		Options:   options,
+		Wait:      backupWait,
+	})
+	return err
+}
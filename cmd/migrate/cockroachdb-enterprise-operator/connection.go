@@ -0,0 +1,49 @@
+package cockroachdb_enterprise_operator
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/cockroachdb/helm-charts/pkg/database"
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/util/homedir"
+)
+
+var (
+	sqlPort     int32
+	insecure    bool
+	inCluster   bool
+	portForward string
+)
+
+// addConnectionFlags registers the flags of the StatefulSet of the command, and of the connection to its pods.
+func addConnectionFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&statefulSetName, "statefulset-name", "", "name of the cockroachdb statefulset resource")
+	cmd.PersistentFlags().StringVar(&namespace, "namespace", "default", "name of the cockroachdb statefulset namespace")
+	cmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", filepath.Join(homedir.HomeDir(), ".kube", "config"), "path to kubeconfig file")
+	cmd.PersistentFlags().StringVar(&clientSecretName, "client-secret", "", "name of the root client secret. Defaults to <statefulset-name>-client-secret")
+	cmd.PersistentFlags().Int32Var(&sqlPort, "sql-port", database.CockroachDBSQLPort, "SQL port of the cockroachdb pods")
+	cmd.PersistentFlags().BoolVar(&insecure, "insecure", false, "connect to an insecure cluster")
+	cmd.PersistentFlags().BoolVar(&inCluster, "in-cluster", false, "connect to the pods directly, when running inside the kubernetes cluster")
+	cmd.PersistentFlags().StringVar(&portForward, "port-forward-protocol", string(kube.PortForwardWebSocketWithFallback), fmt.Sprintf("protocol of the port-forward and of the commands run in the pods, one of %v", kube.PortForwardProtocols))
+	_ = cmd.MarkPersistentFlagRequired("statefulset-name")
+}
+
+// connection returns the connection to the pods of the StatefulSet of the connection flags.
+func connection() database.StatefulSetConnection {
+	conn := database.StatefulSetConnection{
+		StatefulSetName: statefulSetName,
+		Namespace:       namespace,
+		SQLPort:         sqlPort,
+		InCluster:       inCluster,
+		PortForward:     kube.PortForwardProtocol(portForward),
+	}
+	if !insecure {
+		conn.ClientSecret = clientSecretName
+		if conn.ClientSecret == "" {
+			conn.ClientSecret = fmt.Sprintf("%s-client-secret", statefulSetName)
+		}
+	}
+	return conn
+}
@@ -0,0 +1,89 @@
+package cockroachdb_enterprise_operator
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/migrate"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/util/homedir"
+)
+
+var (
+	convertTo        string
+	issuerName       string
+	nodeSecretName   string
+	clientSecretName string
+	caDuration       string
+	valuesFile       string
+)
+
+var convertCertsCmd = &cobra.Command{
+	Use:   "convert-certs",
+	Short: "Convert a CockroachDB Helm chart release between the self-signer and cert-manager TLS modes",
+	Long: `Convert the certificates of a running CockroachDB Helm chart release between the self-signer
+(tls.certs.selfSigner) and cert-manager (tls.certs.certManager) TLS modes, without downtime.
+
+The CA of the cluster is kept, so that the nodes trust each other while the StatefulSet rolls to the new
+secrets:
+- --to cert-manager imports the CA of the self-signer into a CA Issuer, and creates the node and client
+  Certificates of the chart. The Certificates are labelled for the Helm release, which adopts them.
+- --to self-signer exports the CA of the Issuer of the node Certificate into the CA secret of the
+  self-signer, and copies the node and client certificates to the secrets of the self-signer.
+
+The Helm values of the target mode are written to --values-file, to upgrade the release with.`,
+	RunE: convertCerts,
+}
+
+func init() {
+	convertCertsCmd.PersistentFlags().StringVar(&statefulSetName, "statefulset-name", "", "name of the cockroachdb statefulset resource")
+	convertCertsCmd.PersistentFlags().StringVar(&namespace, "namespace", "default", "name of the cockroachdb statefulset namespace")
+	convertCertsCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", filepath.Join(homedir.HomeDir(), ".kube", "config"), "path to kubeconfig file")
+	convertCertsCmd.PersistentFlags().StringVar(&convertTo, "to", "", "TLS mode to convert to, either self-signer or cert-manager")
+	convertCertsCmd.PersistentFlags().StringVar(&caSecret, "ca-secret", "", "name of the secret holding the CA key, found by matching the CA certificate of the cluster if not set")
+	convertCertsCmd.PersistentFlags().StringVar(&issuerName, "issuer-name", "", "name of the CA Issuer created for cert-manager. Defaults to <statefulset-name>-issuer")
+	convertCertsCmd.PersistentFlags().StringVar(&nodeSecretName, "node-secret", "", "name of the node secret issued by cert-manager. Defaults to <statefulset-name>-node")
+	convertCertsCmd.PersistentFlags().StringVar(&clientSecretName, "client-secret", "", "name of the root client secret issued by cert-manager. Defaults to <statefulset-name>-root")
+	convertCertsCmd.PersistentFlags().StringVar(&clusterResourceNamespace, "cluster-resource-namespace", "cert-manager", "namespace of the CA secrets of cert-manager ClusterIssuers")
+	convertCertsCmd.PersistentFlags().StringVar(&clusterDomain, "cluster-domain", "cluster.local", "cluster domain")
+	convertCertsCmd.PersistentFlags().DurationVar(&issueTimeout, "issue-timeout", 5*time.Minute, "how long to wait for cert-manager to issue the Certificates")
+	convertCertsCmd.PersistentFlags().StringVar(&caDuration, "ca-duration", "43800h", "duration of the CA cert configured for the self-signer")
+	convertCertsCmd.PersistentFlags().StringVar(&nodeDuration, "node-duration", "8760h", "duration of Node cert. Defaults to 365h (1 year)")
+	convertCertsCmd.PersistentFlags().StringVar(&clientDuration, "client-duration", "672h", "duration of Client cert. Defaults to 28 days")
+	convertCertsCmd.PersistentFlags().StringVar(&valuesFile, "values-file", "./convert-certs-values.yaml", "file the helm values of the target TLS mode are written to")
+	_ = convertCertsCmd.MarkFlagRequired("statefulset-name")
+	_ = convertCertsCmd.MarkFlagRequired("to")
+	rootCmd.AddCommand(convertCertsCmd)
+}
+
+func convertCerts(cmd *cobra.Command, args []string) error {
+	opts := migrate.ConvertCertsOptions{
+		StatefulSetName:          statefulSetName,
+		Namespace:                namespace,
+		To:                       convertTo,
+		CASecret:                 caSecret,
+		IssuerName:               issuerName,
+		NodeSecret:               nodeSecretName,
+		ClientSecret:             clientSecretName,
+		ClusterResourceNamespace: clusterResourceNamespace,
+		ClusterDomain:            clusterDomain,
+		IssueTimeout:             issueTimeout,
+	}
+	var err error
+	if opts.CADuration, err = time.ParseDuration(caDuration); err != nil {
+		return err
+	}
+	if opts.NodeDuration, err = time.ParseDuration(nodeDuration); err != nil {
+		return err
+	}
+	if opts.ClientDuration, err = time.ParseDuration(clientDuration); err != nil {
+		return err
+	}
+
+	converter, err := migrate.NewCertConverter(kubeconfig, opts)
+	if err != nil {
+		return err
+	}
+	return converter.Run(context.Background(), valuesFile)
+}
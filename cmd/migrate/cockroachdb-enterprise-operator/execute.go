@@ -0,0 +1,109 @@
+package cockroachdb_enterprise_operator
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/migrate"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/util/homedir"
+)
+
+var (
+	releaseName       string
+	chartPath         string
+	pauseBetweenNodes bool
+)
+
+var executeCmd = &cobra.Command{
+	Use:   "execute",
+	Short: "Run the migration with the manifests generated by build-manifest",
+	Long: `Run the migration steps of the migration guide with the manifests generated by build-manifest.
+
+The StatefulSet pods are replaced by CrdbNodes one at a time, starting from the highest ordinal. The
+cluster must be healthy, with every node live and every range fully replicated, before each pod is released,
+and each CrdbNode must become ready and the cluster healthy again before the next pod is migrated. The progress is checkpointed in
+'<manifest-dir>/execute-checkpoint.json', so the command can be run again to resume an interrupted or
+paused migration.
+
+Once all nodes are migrated, the remaining resources are handed over to the Helm release of the
+CockroachDB Enterprise Operator chart.
+`,
+}
+
+var executeHelmCmd = &cobra.Command{
+	Use:   "helm",
+	Short: "Migrate a CockroachDB StatefulSet deployed via the official Helm chart",
+	Long: `Migrate a CockroachDB StatefulSet deployed via the official Helm chart.
+
+This command performs the following operations:
+1. Scales down the StatefulSet by one pod and creates the CrdbNode of the freed ordinal, for every node.
+2. Updates the public Service with the ports of 'public-service.yaml'.
+3. Deletes the PodDisruptionBudget and the StatefulSet.
+4. Upgrades the Helm release to the CockroachDB Enterprise Operator chart with the generated 'values.yaml'.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return executeMigration(migrate.HelmChartSource, statefulSetName)
+	},
+}
+
+var executeOperatorCmd = &cobra.Command{
+	Use:   "operator",
+	Short: "Migrate a CockroachDB cluster managed by the public operator",
+	Long: `Migrate a CockroachDB cluster managed by the public operator.
+
+The public operator must be uninstalled before running this command, so that it doesn't reconcile the
+StatefulSet while it is scaled down.
+
+This command performs the following operations:
+1. Scales down the StatefulSet by one pod and creates the CrdbNode of the freed ordinal, for every node.
+2. Deletes the PodDisruptionBudget.
+3. Annotates the public Service and the Ingresses so that they can be adopted by the Helm release.
+4. Installs the CockroachDB Enterprise Operator chart with the generated 'values.yaml'.
+5. Deletes the StatefulSet.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return executeMigration(migrate.PublicOperatorSource, crdbClusterName)
+	},
+}
+
+func init() {
+	executeCmd.PersistentFlags().StringVar(&manifestDir, "manifest-dir", "./manifests", "directory containing the manifests generated by build-manifest")
+	executeCmd.PersistentFlags().StringVar(&namespace, "namespace", "default", "namespace of cockroachdb statefulset resource")
+	executeCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", filepath.Join(homedir.HomeDir(), ".kube", "config"), "path to kubeconfig file")
+	executeCmd.PersistentFlags().DurationVar(&readinessWait, "readiness-wait", 30*time.Second, "time to wait after each crdbnode becomes ready")
+	executeCmd.PersistentFlags().DurationVar(&podUpdateTimeout, "pod-update-timeout", 10*time.Minute, "time to wait for a pod to be deleted or become ready")
+	executeCmd.PersistentFlags().DurationVar(&healthTimeout, "health-timeout", 10*time.Minute, "time to wait for the nodes to be live and the ranges to be fully replicated before and after each node is migrated")
+	executeCmd.PersistentFlags().BoolVar(&pauseBetweenNodes, "pause-between-nodes", false, "ask for approval before migrating the next node")
+	executeCmd.PersistentFlags().StringVar(&chartPath, "chart", "./cockroachdb-parent/charts/cockroachdb", "path of the cockroachdb chart of the enterprise operator")
+	executeCmd.PersistentFlags().StringVar(&releaseName, "release-name", "", "name of the helm release to upgrade or install (defaults to the existing release)")
+
+	executeHelmCmd.Flags().StringVar(&statefulSetName, "statefulset-name", "", "name of cockroachdb statefulset resource")
+	_ = executeHelmCmd.MarkFlagRequired("statefulset-name")
+	executeOperatorCmd.Flags().StringVar(&crdbClusterName, "crdb-cluster", "", "name of crdbcluster resource")
+	_ = executeOperatorCmd.MarkFlagRequired("crdb-cluster")
+
+	executeCmd.AddCommand(executeHelmCmd, executeOperatorCmd)
+	rootCmd.AddCommand(executeCmd)
+}
+
+func executeMigration(source migrate.MigrationSource, name string) error {
+	executor, err := migrate.NewExecutor(kubeconfig, migrate.ExecutorOptions{
+		Source:            source,
+		Name:              name,
+		Namespace:         namespace,
+		ManifestDir:       manifestDir,
+		ReleaseName:       releaseName,
+		Chart:             chartPath,
+		ReadinessWait:     readinessWait,
+		PodUpdateTimeout:  podUpdateTimeout,
+		PauseBetweenNodes: pauseBetweenNodes,
+		HealthTimeout:     healthTimeout,
+	})
+	if err != nil {
+		return err
+	}
+
+	return executor.Run(context.Background())
+}
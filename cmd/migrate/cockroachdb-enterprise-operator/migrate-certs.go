@@ -3,6 +3,7 @@ package cockroachdb_enterprise_operator
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/cockroachdb/helm-charts/pkg/generator"
 	"github.com/cockroachdb/helm-charts/pkg/migrate"
@@ -22,6 +23,11 @@ var (
 	clientDuration string
 	clientExpiry   string
 	clusterDomain  string
+
+	createTrustBundle        bool
+	trustBundleTimeout       time.Duration
+	issueTimeout             time.Duration
+	clusterResourceNamespace string
 )
 
 var migrateCertsCmd = &cobra.Command{
@@ -29,11 +35,18 @@ var migrateCertsCmd = &cobra.Command{
 	Short: "Migrate certs for the CockroachDB Enterprise Operator",
 	Long: `Migrate and manage certificates for the CockroachDB Enterprise Operator.
 
-This command performs the following operations:
-1. Moves the existing CA certificate from a Kubernetes Secret to a ConfigMap because the operator 
-   expects the CA certificate to be in a ConfigMap.
-2. Regenerates node certificates to include Subject Alternative Names (SAN) for the CockroachDB join service
-3. Generates client certificates if they are not already present in the cluster
+The certificate secrets are read from the volumes of the StatefulSet, and from the nodeTLSSecret and
+clientTLSSecret fields of the CrdbCluster of a public operator cluster. The command then:
+1. Updates the node Certificate to include the DNS names of the CockroachDB join service, if the node
+   secret is issued by cert-manager, and waits for cert-manager to re-issue the node secret. It then prints
+   how to copy the CA of its Issuer to a ConfigMap. With --create-trust-bundle, the trust-manager Bundle
+   is created and the ConfigMap checked instead, or a plain copy of the CA certificate is made if
+   trust-manager isn't installed.
+2. Otherwise, copies the CA certificate of the node secret to a ConfigMap because the operator expects the
+   CA certificate to be in a ConfigMap, and regenerates the node and client certificates with the CA key.
+   The CA key is read from --ca-secret, or from the secret of the namespace which matches the CA certificate.
+3. If the CA key isn't stored in the cluster, copies the existing node and client certificates to the
+   secrets expected by the operator. The node certificate must already include the join service.
 
 The command supports customization of certificate durations and expiry windows for:
 - Node certificates (default: 1 year duration, 7 days expiry window)
@@ -47,7 +60,7 @@ func init() {
 	migrateCertsCmd.PersistentFlags().StringVar(&statefulSetName, "statefulset-name", "", "name of the cockroachdb statefulset resource")
 	migrateCertsCmd.PersistentFlags().StringVar(&namespace, "namespace", "default", "name of the cockroachdb statefulset namespace")
 
-	migrateCertsCmd.PersistentFlags().StringVar(&caSecret, "ca-secret", "", "name of user provided CA secret")
+	migrateCertsCmd.PersistentFlags().StringVar(&caSecret, "ca-secret", "", "name of the secret holding the CA key, found by matching the CA certificate of the cluster if not set")
 
 	migrateCertsCmd.PersistentFlags().StringVar(&nodeDuration, "node-duration", "8760h", "duration of Node cert. Defaults to 365h (1 year)")
 	migrateCertsCmd.PersistentFlags().StringVar(&nodeExpiry, "node-expiry", "168h", "expiry window for Node cert. Defaults to 7 days")
@@ -56,6 +69,10 @@ func init() {
 	migrateCertsCmd.PersistentFlags().StringVar(&clientExpiry, "client-expiry", "48h", "expiry window for Client(root) cert. Defaults to 2 days")
 
 	migrateCertsCmd.PersistentFlags().StringVar(&clusterDomain, "cluster-domain", "cluster.local", "cluster domain")
+	migrateCertsCmd.PersistentFlags().BoolVar(&createTrustBundle, "create-trust-bundle", false, "create the trust-manager Bundle of the CA ConfigMap for cert-manager clusters, instead of printing it")
+	migrateCertsCmd.PersistentFlags().DurationVar(&trustBundleTimeout, "trust-bundle-timeout", 2*time.Minute, "how long to wait for trust-manager to create the CA ConfigMap")
+	migrateCertsCmd.PersistentFlags().DurationVar(&issueTimeout, "issue-timeout", 5*time.Minute, "how long to wait for cert-manager to re-issue the node certificate")
+	migrateCertsCmd.PersistentFlags().StringVar(&clusterResourceNamespace, "cluster-resource-namespace", "cert-manager", "namespace of the CA secrets of cert-manager ClusterIssuers")
 	_ = migrateCertsCmd.MarkFlagRequired("statefulset-name")
 
 	var err error
@@ -88,7 +105,13 @@ func migrateCertsForCockroachEnterpriseOperator(cmd *cobra.Command, args []strin
 	genCerts.PublicServiceName = fmt.Sprintf("%s-public", statefulSetName)
 	genCerts.ClusterDomain = clusterDomain
 
-	if err := migrate.GenerateCertsForOperator(cl, namespace, &genCerts); err != nil {
+	certManager := migrate.CertManagerOptions{
+		CreateTrustBundle:        createTrustBundle,
+		TrustBundleTimeout:       trustBundleTimeout,
+		IssueTimeout:             issueTimeout,
+		ClusterResourceNamespace: clusterResourceNamespace,
+	}
+	if err := migrate.GenerateCertsForOperator(cl, namespace, &genCerts, certManager); err != nil {
 		return err
 	}
 
@@ -2,12 +2,21 @@ package cockroachdb_enterprise_operator
 
 import (
 	"fmt"
+	"os"
+
 	"github.com/cockroachdb/helm-charts/pkg/migrate"
 	"github.com/spf13/cobra"
 )
 
 var (
 	statefulSetName string
+
+	// The other cluster of a physical cluster replication (PCR) pair, migrated along with the statefulset.
+	pcrPeerStatefulSetName string
+	pcrPeerNamespace       string
+	pcrPeerKubeconfig      string
+	pcrPeerCloudRegion     string
+	pcrPeerOutputDir       string
 )
 
 // buildManifestFromHelm only supports migrating the CockroachDB StatefulSet deployed via the official Helm chart.
@@ -27,6 +36,11 @@ by the Cockroach Enterprise Operator.
 Before running this command, ensure that your Helm-based deployment closely follows the official Helm chart 
 structure.
 
+The physical cluster replication (PCR) mode of the cluster is read from its virtual clusters. To migrate a
+primary and standby pair, set --pcr-peer-statefulset-name to the StatefulSet of the other cluster. The
+manifests of both clusters are generated only if they replicate the same virtual cluster and the replication
+stream is healthy.
+
 Always review the generated manifests thoroughly and test in a staging environment before applying changes 
 to a production cluster.
 `,
@@ -37,6 +51,11 @@ func init() {
 	buildManifestFromHelm.PersistentFlags().StringVar(&statefulSetName, "statefulset-name", "", "name of cockroachdb statefulset resource")
 	buildManifestFromHelm.PersistentFlags().StringVar(&namespace, "namespace", "default", "namespace of cockroachdb statefulset resource")
 	_ = buildManifestFromHelm.MarkPersistentFlagRequired("statefulset-name")
+	buildManifestFromHelm.Flags().StringVar(&pcrPeerStatefulSetName, "pcr-peer-statefulset-name", "", "name of the cockroachdb statefulset of the other cluster of a PCR pair")
+	buildManifestFromHelm.Flags().StringVar(&pcrPeerNamespace, "pcr-peer-namespace", "", "namespace of the PCR peer statefulset (defaults to --namespace)")
+	buildManifestFromHelm.Flags().StringVar(&pcrPeerKubeconfig, "pcr-peer-kubeconfig", "", "path to the kubeconfig file of the PCR peer cluster (defaults to --kubeconfig)")
+	buildManifestFromHelm.Flags().StringVar(&pcrPeerCloudRegion, "pcr-peer-cloud-region", "", "name of cloud provider region of the PCR peer cluster (defaults to --cloud-region)")
+	buildManifestFromHelm.Flags().StringVar(&pcrPeerOutputDir, "pcr-peer-output-dir", "./manifests-pcr-peer", "manifest output directory of the PCR peer cluster")
 	buildManifestCmd.AddCommand(buildManifestFromHelm)
 }
 
@@ -46,7 +65,11 @@ func buildManifestFromCockroachDBHelmChart(cmd *cobra.Command, args []string) er
 		return err
 	}
 
-	if err := migration.FromHelmChart(); err != nil {
+	if pcrPeerStatefulSetName != "" {
+		if err := buildManifestForPCRPair(migration); err != nil {
+			return err
+		}
+	} else if err := migration.FromHelmChart(); err != nil {
 		return err
 	}
 
@@ -62,3 +85,31 @@ func buildManifestFromCockroachDBHelmChart(cmd *cobra.Command, args []string) er
 	fmt.Println("   Do not generate the manifests, once you scaled down statefulset.")
 	return nil
 }
+
+// buildManifestForPCRPair generates the manifests of the statefulset and of its PCR peer.
+func buildManifestForPCRPair(migration *migrate.Manifest) error {
+	peerNamespace, peerKubeconfig, peerRegion := pcrPeerNamespace, pcrPeerKubeconfig, pcrPeerCloudRegion
+	if peerNamespace == "" {
+		peerNamespace = namespace
+	}
+	if peerKubeconfig == "" {
+		peerKubeconfig = kubeconfig
+	}
+	if peerRegion == "" {
+		peerRegion = cloudRegion
+	}
+	if err := os.MkdirAll(pcrPeerOutputDir, 0755); err != nil {
+		return err
+	}
+
+	peer, err := migrate.NewManifest(cloudProvider, peerRegion, peerKubeconfig, pcrPeerStatefulSetName, peerNamespace, pcrPeerOutputDir)
+	if err != nil {
+		return err
+	}
+	if err := migration.FromHelmChartPCRPair(peer); err != nil {
+		return err
+	}
+
+	fmt.Printf("📁 Output directory of the PCR peer: %s\n", pcrPeerOutputDir)
+	return nil
+}
@@ -0,0 +1,62 @@
+package cockroachdb_enterprise_operator
+
+import (
+	"context"
+
+	"github.com/cockroachdb/helm-charts/pkg/provision"
+	"github.com/spf13/cobra"
+)
+
+var (
+	specFile      string
+	dryRun        bool
+	prune         bool
+	dropDatabases bool
+)
+
+var provisionCmd = &cobra.Command{
+	Use:   "provision",
+	Short: "Converge the users, roles, grants, databases, cluster settings and backup schedules of a cluster",
+	Long: `Provision a running CockroachDB cluster from a declarative spec, in the format of the init.provisioning
+values of the Helm chart. A values file of the chart can be given as is.
+
+The spec is compared with the live catalog of the cluster, and only the missing users, roles, memberships,
+grants, databases, cluster settings and backup schedules are created or updated. Running the command again
+applies no change, so backup schedules are no longer created twice.
+
+Objects missing from the spec are kept, unless --prune is set to revoke the memberships and grants, and drop
+the users, roles and backup schedules which are not in the spec. Databases are only dropped with
+--drop-databases.`,
+	RunE: provisionCluster,
+}
+
+func init() {
+	addConnectionFlags(provisionCmd)
+	provisionCmd.PersistentFlags().StringVar(&specFile, "spec-file", "", "provisioning spec, or helm values file holding init.provisioning")
+	provisionCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "print the changes without applying them")
+	provisionCmd.PersistentFlags().BoolVar(&prune, "prune", false, "revoke and drop the memberships, grants, users, roles and backup schedules which are not in the spec")
+	provisionCmd.PersistentFlags().BoolVar(&dropDatabases, "drop-databases", false, "drop the databases which are not in the spec, along with their data")
+	_ = provisionCmd.MarkFlagRequired("spec-file")
+	rootCmd.AddCommand(provisionCmd)
+}
+
+func provisionCluster(cmd *cobra.Command, args []string) error {
+	spec, err := provision.LoadSpec(specFile)
+	if err != nil {
+		return err
+	}
+
+	opts := provision.Options{
+		StatefulSetConnection: connection(),
+		DryRun:                dryRun,
+		PlanOptions:           provision.PlanOptions{Prune: prune, DropDatabases: dropDatabases},
+	}
+
+	ctx := context.Background()
+	p, err := provision.NewProvisioner(ctx, kubeconfig, opts)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	return p.Run(ctx, spec)
+}
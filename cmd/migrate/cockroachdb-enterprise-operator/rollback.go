@@ -0,0 +1,61 @@
+package cockroachdb_enterprise_operator
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/migrate"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/util/homedir"
+)
+
+var (
+	manifestDir      string
+	readinessWait    time.Duration
+	podUpdateTimeout time.Duration
+)
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Rollback a partially migrated CockroachDB deployment to the StatefulSet",
+	Long: `Restore the CockroachDB StatefulSet deployed via the official Helm chart or the public operator from the
+snapshot written by build-manifest under the '<output-dir>/rollback' directory.
+
+This command performs the following operations:
+1. Re-creates the backed up Services, PodDisruptionBudget, RBAC resources and Secrets if they are missing,
+   and restores the original ports of the public Service.
+2. Re-creates the StatefulSet if it was already deleted.
+3. Deletes the CrdbNodes one at a time, in the reverse order of their creation, and scales the StatefulSet
+   up to take over each freed pod.
+
+The CockroachDB Enterprise Operator must still be running so that it can remove the CrdbNode finalizers.
+If the Helm release was already upgraded, the original values are available under 'rollback/helm-values.yaml'.
+The CrdbCluster of the public operator is available under 'rollback/crdbcluster.yaml'.
+`,
+	RunE: rollbackToStatefulSet,
+}
+
+func init() {
+	rollbackCmd.PersistentFlags().StringVar(&manifestDir, "manifest-dir", "./manifests", "directory containing the manifests generated by build-manifest")
+	rollbackCmd.PersistentFlags().StringVar(&namespace, "namespace", "default", "namespace of cockroachdb statefulset resource")
+	rollbackCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", filepath.Join(homedir.HomeDir(), ".kube", "config"), "path to kubeconfig file")
+	rollbackCmd.PersistentFlags().DurationVar(&readinessWait, "readiness-wait", 30*time.Second, "time to wait after each statefulset pod becomes ready")
+	rollbackCmd.PersistentFlags().DurationVar(&podUpdateTimeout, "pod-update-timeout", 10*time.Minute, "time to wait for a pod to be deleted or become ready")
+	rootCmd.AddCommand(rollbackCmd)
+}
+
+func rollbackToStatefulSet(cmd *cobra.Command, args []string) error {
+	rollback, err := migrate.NewRollback(kubeconfig, namespace, manifestDir, readinessWait, podUpdateTimeout)
+	if err != nil {
+		return err
+	}
+
+	// Interrupting the command stops the rollback between two steps instead of in the middle of a wait.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return rollback.Run(ctx)
+}
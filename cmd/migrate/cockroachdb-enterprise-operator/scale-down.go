@@ -0,0 +1,65 @@
+package cockroachdb_enterprise_operator
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/scale"
+	"github.com/spf13/cobra"
+)
+
+var (
+	scaleReplicas int32
+	deletePVCs    bool
+)
+
+var scaleDownCmd = &cobra.Command{
+	Use:   "scale-down",
+	Short: "Decommission the nodes of the removed pods before scaling a StatefulSet down",
+	Long: `Scale down the StatefulSet of a cockroachdb helm release without leaving ranges under-replicated.
+
+This command performs the following operations:
+1. Checks the health of the cluster, and that no zone configuration replicates its ranges more than --replicas
+   times, then decommissions the nodes of the pods above --replicas.
+2. Waits for the replicas of the nodes to be moved to the other nodes, and finalizes their decommission.
+3. Waits for the ranges of the cluster to be fully replicated.
+4. Scales the StatefulSet down, and waits for the removed pods to be deleted.
+5. Deletes the PVCs of the removed pods if --delete-pvcs is set.
+
+The state of the nodes is read from the cluster, an interrupted scale-down is resumed by running the command again.
+Use --dry-run to print the decommission state of the nodes. Set statefulset.replicas in the values of the helm
+release afterwards, or the next helm upgrade scales the StatefulSet back up.`,
+	RunE: scaleDown,
+}
+
+func init() {
+	addConnectionFlags(scaleDownCmd)
+	scaleDownCmd.PersistentFlags().Int32Var(&scaleReplicas, "replicas", 0, "number of replicas to scale the statefulset down to")
+	scaleDownCmd.PersistentFlags().BoolVar(&deletePVCs, "delete-pvcs", false, "delete the PVCs of the removed pods")
+	scaleDownCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "print the decommission state of the nodes of the removed pods without changing them")
+	scaleDownCmd.PersistentFlags().DurationVar(&podUpdateTimeout, "pod-update-timeout", 10*time.Minute, "time to wait for the removed pods to be deleted")
+	scaleDownCmd.PersistentFlags().DurationVar(&healthTimeout, "health-timeout", 10*time.Minute, "time to wait for the nodes to be decommissioned and for the ranges of the cluster to be fully replicated")
+	scaleDownCmd.PersistentFlags().DurationVar(&decommissionTimeout, "decommission-timeout", 2*time.Hour, "time to wait for the replicas of the nodes to be moved to the other nodes")
+	_ = scaleDownCmd.MarkFlagRequired("replicas")
+	rootCmd.AddCommand(scaleDownCmd)
+}
+
+func scaleDown(cmd *cobra.Command, args []string) error {
+	opts := scale.Options{
+		StatefulSetConnection: connection(),
+		Replicas:              scaleReplicas,
+		DeletePVCs:            deletePVCs,
+		DryRun:                dryRun,
+		DecommissionTimeout:   decommissionTimeout,
+		HealthTimeout:         healthTimeout,
+		PodUpdateTimeout:      podUpdateTimeout,
+	}
+
+	s, err := scale.NewScaleDowner(kubeconfig, opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.Run(context.Background())
+}
@@ -0,0 +1,81 @@
+package cockroachdb_enterprise_operator
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/upgrade"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pvcChart            string
+	chartVersion        string
+	valuesFiles         []string
+	checkpointDir       string
+	pauseBetweenPods    bool
+	decommissionTimeout time.Duration
+)
+
+var upgradePVCCmd = &cobra.Command{
+	Use:   "upgrade-pvc",
+	Short: "Upgrade a helm release which changes the volume claim templates of its StatefulSet",
+	Long: `Upgrade a helm release of the cockroachdb chart which changes the volume claim templates of its StatefulSet,
+such as a new storage class or size of the data volume, or a new volume for the logs or the WAL failover. The volume
+claim templates of a StatefulSet can't be updated, so its pods are replaced one at a time, from the highest ordinal.
+
+For each pod, this command performs the following operations:
+1. Drains the node of the pod, or decommissions it if its existing volumes are recreated, since its store is lost.
+2. Deletes the StatefulSet, leaving its pods running.
+3. Deletes the pod, and the volumes whose storage class, size, access modes or volume mode change.
+4. Upgrades the helm release, which recreates the StatefulSet, the pod and its volumes.
+5. Waits for the pod to be ready, and for the ranges of the cluster to be fully replicated.
+
+The StatefulSet only recreates the deleted pods until every pod is replaced, then the release is upgraded with its
+own update strategy. The progress is checkpointed, an interrupted upgrade is resumed by running the command again.
+Volumes are only recreated if the ranges of the cluster can be fully replicated on the other nodes while a node is
+decommissioned. Use --dry-run to print the changes of each pod.`,
+	RunE: upgradePVCs,
+}
+
+func init() {
+	addConnectionFlags(upgradePVCCmd)
+	upgradePVCCmd.PersistentFlags().StringVar(&releaseName, "release-name", "", "helm release of the statefulset. Defaults to the release the statefulset is annotated with")
+	upgradePVCCmd.PersistentFlags().StringVar(&pvcChart, "chart", "cockroachdb/cockroachdb", "helm chart to upgrade the release to, from a repository or a local directory")
+	upgradePVCCmd.PersistentFlags().StringVar(&chartVersion, "chart-version", "", "version of the helm chart. Defaults to the latest version")
+	upgradePVCCmd.PersistentFlags().StringArrayVarP(&valuesFiles, "values", "f", nil, "values file of the upgraded release, can be repeated")
+	upgradePVCCmd.PersistentFlags().StringVar(&checkpointDir, "checkpoint-dir", ".", "directory of the checkpoint of the upgrade")
+	upgradePVCCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "print the changes of the volumes of each pod without applying them")
+	upgradePVCCmd.PersistentFlags().BoolVar(&pauseBetweenPods, "pause-between-pods", false, "ask for approval before replacing the next pod")
+	upgradePVCCmd.PersistentFlags().DurationVar(&readinessWait, "readiness-wait", 30*time.Second, "time to wait after each pod becomes ready, before checking the health of the cluster")
+	upgradePVCCmd.PersistentFlags().DurationVar(&podUpdateTimeout, "pod-update-timeout", 10*time.Minute, "time to wait for a pod to be deleted, and to be recreated and become ready")
+	upgradePVCCmd.PersistentFlags().DurationVar(&healthTimeout, "health-timeout", 10*time.Minute, "time to wait for the ranges of the cluster to be fully replicated after each pod is replaced")
+	upgradePVCCmd.PersistentFlags().DurationVar(&decommissionTimeout, "decommission-timeout", 2*time.Hour, "time to wait for a node to be decommissioned before its volumes are recreated")
+	_ = upgradePVCCmd.MarkFlagRequired("values")
+	rootCmd.AddCommand(upgradePVCCmd)
+}
+
+func upgradePVCs(cmd *cobra.Command, args []string) error {
+	opts := upgrade.PVCOptions{
+		StatefulSetConnection: connection(),
+		ReleaseName:           releaseName,
+		Chart:                 pvcChart,
+		ChartVersion:          chartVersion,
+		ValuesFiles:           valuesFiles,
+		CheckpointDir:         checkpointDir,
+		DryRun:                dryRun,
+		PauseBetweenPods:      pauseBetweenPods,
+		ReadinessWait:         readinessWait,
+		PodUpdateTimeout:      podUpdateTimeout,
+		HealthTimeout:         healthTimeout,
+		DecommissionTimeout:   decommissionTimeout,
+	}
+
+	u, err := upgrade.NewPVCUpgrader(kubeconfig, opts)
+	if err != nil {
+		return err
+	}
+	defer u.Close()
+
+	return u.Run(context.Background())
+}
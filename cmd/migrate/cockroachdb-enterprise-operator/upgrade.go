@@ -0,0 +1,87 @@
+package cockroachdb_enterprise_operator
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/upgrade"
+	"github.com/spf13/cobra"
+)
+
+var (
+	targetVersion     string
+	targetImage       string
+	preserveDowngrade bool
+	finalizeUpgrade   bool
+	rollbackOnFailure bool
+	skipVersionCheck  bool
+	healthTimeout     time.Duration
+	finalizeTimeout   time.Duration
+	confirmImage      bool
+)
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Upgrade the CockroachDB version of a StatefulSet one pod at a time, and finalize the upgrade",
+	Long: `Upgrade the CockroachDB release run by the pods of a StatefulSet deployed via the Helm chart.
+
+This command performs the following operations:
+1. Checks that the cluster is healthy, and that its cluster version can be upgraded to the release in a single
+   upgrade. Innovation releases can be skipped, other release series can't.
+2. Sets cluster.preserve_downgrade_option during a major upgrade, so that it can be rolled back until it is
+   finalized.
+3. Rolls the pods to the new image from the highest ordinal, through the partition of the rolling update. Each
+   pod must become ready, and the cluster must be healthy, before the next pod is restarted.
+4. Verifies that every node runs the release.
+5. Finalizes the upgrade, or rolls the pods back to the previous image if a step failed.
+
+A cluster left with mixed versions by a failed upgrade is upgraded again with the same --version, or rolled back
+with the previous version.
+
+The image of the StatefulSet is patched outside of its Helm release, so the command refuses to run unless
+--confirm-release-image is set. Once upgraded, set the image of the Helm release to the new version, or the next
+helm upgrade rolls the pods back.`,
+	RunE: upgradeCluster,
+}
+
+func init() {
+	addConnectionFlags(upgradeCmd)
+	upgradeCmd.PersistentFlags().StringVar(&targetVersion, "version", "", "cockroachdb release to upgrade to, such as v24.1.3")
+	upgradeCmd.PersistentFlags().StringVar(&targetImage, "image", "", "image of the release. Defaults to the repository of the current image, tagged with --version")
+	upgradeCmd.PersistentFlags().BoolVar(&preserveDowngrade, "preserve-downgrade", true, "set cluster.preserve_downgrade_option during a major upgrade, so that it can be rolled back until finalized")
+	upgradeCmd.PersistentFlags().BoolVar(&finalizeUpgrade, "finalize", true, "finalize a major upgrade once every node runs the release")
+	upgradeCmd.PersistentFlags().BoolVar(&rollbackOnFailure, "rollback", true, "roll the pods back to the previous image if the upgrade fails before it is finalized")
+	upgradeCmd.PersistentFlags().BoolVar(&skipVersionCheck, "skip-version-check", false, "skip the check that the cluster version can be upgraded to the release")
+	upgradeCmd.PersistentFlags().DurationVar(&readinessWait, "readiness-wait", 30*time.Second, "time to wait after each pod becomes ready, before checking the health of the cluster")
+	upgradeCmd.PersistentFlags().DurationVar(&podUpdateTimeout, "pod-update-timeout", 10*time.Minute, "time to wait for a pod to be recreated and become ready")
+	upgradeCmd.PersistentFlags().DurationVar(&healthTimeout, "health-timeout", 10*time.Minute, "time to wait for the cluster to be healthy after each pod is restarted")
+	upgradeCmd.PersistentFlags().DurationVar(&finalizeTimeout, "finalize-timeout", 30*time.Minute, "time to wait for the cluster version to be finalized")
+	upgradeCmd.PersistentFlags().BoolVar(&confirmImage, "confirm-release-image", false, "confirm that the image value of the helm release of the statefulset is set to the release once the upgrade completes")
+	_ = upgradeCmd.MarkFlagRequired("version")
+	rootCmd.AddCommand(upgradeCmd)
+}
+
+func upgradeCluster(cmd *cobra.Command, args []string) error {
+	opts := upgrade.Options{
+		StatefulSetConnection: connection(),
+		Version:               targetVersion,
+		Image:                 targetImage,
+		PreserveDowngrade:     preserveDowngrade,
+		Finalize:              finalizeUpgrade,
+		Rollback:              rollbackOnFailure,
+		SkipVersionCheck:      skipVersionCheck,
+		ReadinessWait:         readinessWait,
+		PodUpdateTimeout:      podUpdateTimeout,
+		HealthTimeout:         healthTimeout,
+		FinalizeTimeout:       finalizeTimeout,
+		ConfirmReleaseImage:   confirmImage,
+	}
+
+	u, err := upgrade.NewUpgrader(kubeconfig, opts)
+	if err != nil {
+		return err
+	}
+	defer u.Close()
+
+	return u.Run(context.Background())
+}
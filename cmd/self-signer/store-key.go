@@ -0,0 +1,161 @@
+/*
+Copyright 2021 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package self_signer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cockroachdb/helm-charts/pkg/generator"
+)
+
+// storeKeyCmd represents the store-key command
+var storeKeyCmd = &cobra.Command{
+	Use:   "store-key",
+	Short: "generates/rotates the encryption at rest store key",
+	Long: `store-key sub-command generates or rotates the encryption at rest store key of the CockroachDB stores,
+and prints the --enterprise-encryption spec the nodes must run with.
+
+The store key is kept in the <statefulset>-store-key secret and, after a rotation, the previous store key in the
+<statefulset>-old-store-key secret. Both secrets must be mounted into the cockroachdb pods, at --key-path and
+--old-key-path.`,
+}
+
+// storeKeyGenerateCmd represents the store-key generate command
+var storeKeyGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "generates the store key if it doesn't exist",
+	Long: `generate sub-command generates the store key if its secret doesn't exist yet, and copies it into the old
+store key secret. The old key of the spec printed when the store key is generated is plain, so that a store which
+is not encrypted yet gets encrypted. The nodes must then switch to the spec printed by the next runs, whose old key
+is --old-key-path, before the first rotation.`,
+	Run: generateStoreKey,
+}
+
+// storeKeyRotateCmd represents the store-key rotate command
+var storeKeyRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "rotates the store key",
+	Long: `rotate sub-command moves the store key into the old store key secret and generates a new store key.
+With --cron, which is the schedule of the CronJob running the command, the store key is only rotated when it
+expires before the next run.
+
+The rotation is refused unless every pod of the statefulset runs with the printed spec and was restarted since
+the store key was generated, since a node whose active store key is neither the new nor the old store key fails
+to start. --restart does a rolling restart of the statefulset after a rotation.`,
+	Run: rotateStoreKey,
+}
+
+var (
+	storeKeySize                   int
+	storeKeyDuration               string
+	storeKeyCron                   string
+	keySecret, oldKeySecret        string
+	storePath, keyPath, oldKeyPath string
+	restart                        bool
+)
+
+func init() {
+	rootCmd.AddCommand(storeKeyCmd)
+	storeKeyCmd.AddCommand(storeKeyGenerateCmd, storeKeyRotateCmd)
+
+	storeKeyCmd.PersistentFlags().IntVar(&storeKeySize, "key-size", 128, "AES size of the store key in bits, one of 128, 192 or 256")
+	storeKeyCmd.PersistentFlags().StringVar(&storeKeyDuration, "key-duration", "2160h", "duration of the store key. Defaults to 2160h (90 days)")
+	storeKeyCmd.PersistentFlags().StringVar(&keySecret, "key-secret", "", "name of the store key secret. Defaults to <statefulset>-store-key")
+	storeKeyCmd.PersistentFlags().StringVar(&oldKeySecret, "old-key-secret", "", "name of the old store key secret. Defaults to <statefulset>-old-store-key")
+	storeKeyCmd.PersistentFlags().StringVar(&storePath, "store-path", "cockroach-data", "path of the encrypted store")
+	storeKeyCmd.PersistentFlags().StringVar(&keyPath, "key-path", "/cockroach/store-key/StoreKeyData", "path the store key secret is mounted at in the cockroachdb pods")
+	storeKeyCmd.PersistentFlags().StringVar(&oldKeyPath, "old-key-path", "/cockroach/old-store-key/StoreKeyData", "path the old store key secret is mounted at in the cockroachdb pods")
+
+	storeKeyRotateCmd.Flags().StringVar(&storeKeyCron, "cron", "", "cron of the store key rotation cron. The store key is always rotated if not set")
+	storeKeyRotateCmd.Flags().BoolVar(&restart, "restart", false, "if set restarts the statefulset after a rotation")
+	storeKeyRotateCmd.Flags().StringVar(&readinessWait, "readiness-wait", "30s", "readiness wait for each replica of crdb cluster")
+	storeKeyRotateCmd.Flags().StringVar(&podUpdateTimeout, "pod-update-timeout", "2m", "time to wait for statefulset pod to restart and get to running state")
+}
+
+func generateStoreKey(cmd *cobra.Command, args []string) {
+	doStoreKey(cmd, false)
+}
+
+func rotateStoreKey(cmd *cobra.Command, args []string) {
+	doStoreKey(cmd, true)
+}
+
+func doStoreKey(cmd *cobra.Command, rotate bool) {
+	namespace, exists := os.LookupEnv("NAMESPACE")
+	if !exists {
+		log.Panic("Required NAMESPACE env not found")
+	}
+
+	// STATEFULSET_NAME is derived from {{ template "cockroachdb.fullname" . }} in helm chart.
+	stsName, exists := os.LookupEnv("STATEFULSET_NAME")
+	if !exists && (keySecret == "" || oldKeySecret == "" || rotate) {
+		log.Panic("Required STATEFULSET_NAME env not found")
+	}
+
+	duration, err := time.ParseDuration(storeKeyDuration)
+	if err != nil {
+		log.Panicf("failed to parse key-duration %s", err.Error())
+	}
+
+	genKey := generator.NewGenerateStoreKey(cl)
+	genKey.KeySecret = keySecret
+	if genKey.KeySecret == "" {
+		genKey.KeySecret = stsName + "-store-key"
+	}
+	genKey.OldKeySecret = oldKeySecret
+	if genKey.OldKeySecret == "" {
+		genKey.OldKeySecret = stsName + "-old-store-key"
+	}
+	genKey.KeySize = storeKeySize
+	genKey.Duration = duration
+	genKey.StorePath = storePath
+	genKey.KeyPath = keyPath
+	genKey.OldKeyPath = oldKeyPath
+
+	if rotate {
+		genKey.Rotate = true
+		genKey.CronSchedule = storeKeyCron
+		genKey.StatefulSetName = stsName
+
+		if restart {
+			timeout, err := time.ParseDuration(readinessWait)
+			if err != nil {
+				log.Panicf("failed to parse readiness-wait duration %s", err.Error())
+			}
+			podTimeout, err := time.ParseDuration(podUpdateTimeout)
+			if err != nil {
+				log.Panicf("failed to parse pod-update-timeout duration %s", err.Error())
+			}
+
+			genKey.Restart = true
+			genKey.ReadinessWait = timeout
+			genKey.PodUpdateTimeout = podTimeout
+		}
+	}
+
+	spec, err := genKey.Do(ctx, namespace)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Fprintln(cmd.OutOrStdout(), spec)
+}
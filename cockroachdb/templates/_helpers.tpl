@@ -398,3 +398,41 @@ app.kubernetes.io/managed-by: {{ .Release.Service }}
 app.kubernetes.io/name: {{ include "cockroachdb.clusterfullname" . }}
 app.kubernetes.io/instance: {{ .Release.Name }}
 {{- end }}
+
+{{/*
+Return true if the init job provisions the cluster with `migration-helper provision`, rather than with SQL
+statements.
+*/}}
+{{- define "cockroachdb.init.provisioner.enabled" -}}
+{{- if and .Values.init.provisioning.enabled .Values.init.provisioning.provisioner.enabled (not .Values.operator.enabled) -}}
+    {{ print true }}
+{{- else -}}
+    {{ print false }}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Environment variables of the init job holding the passwords and cluster settings of init.provisioning, which are
+read from the init secret.
+*/}}
+{{- define "cockroachdb.init.provisioningEnv" -}}
+{{- $secretName := printf "%s-init" (include "cockroachdb.fullname" .) }}
+{{- range $user := .Values.init.provisioning.users }}
+{{- if $user.password }}
+- name: {{ $user.name }}_PASSWORD
+  valueFrom:
+    secretKeyRef:
+      name: {{ $secretName }}
+      key: {{ $user.name }}-password
+{{- end }}
+{{- end }}
+{{- range $clusterSetting, $clusterSettingValue := .Values.init.provisioning.clusterSettings }}
+{{- if $clusterSettingValue }}
+- name: {{ $clusterSetting | replace "." "_" }}_CLUSTER_SETTING
+  valueFrom:
+    secretKeyRef:
+      name: {{ $secretName }}
+      key: {{ $clusterSetting | replace "." "-" }}-cluster-setting
+{{- end }}
+{{- end }}
+{{- end -}}
@@ -0,0 +1,223 @@
+// Package backup schedules, takes, lists and restores the backups of a CockroachDB cluster deployed by the Helm
+// chart, into and from external storage such as S3, GCS, Azure or nodelocal.
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/database"
+	"github.com/jackc/pgx/v4"
+)
+
+// Latest restores the latest backup of a collection.
+const Latest = "LATEST"
+
+// Options are the options of the connection to the cluster.
+type Options struct {
+	database.StatefulSetConnection
+}
+
+// Manager runs the backups and the restores of a cluster as detached jobs, and reports their progress.
+type Manager struct {
+	db  *sql.DB
+	out io.Writer
+	// pollInterval is the interval between the checks of the progress of a job.
+	pollInterval time.Duration
+}
+
+// NewManager connects to the ready pods of the StatefulSet as the root user.
+func NewManager(ctx context.Context, kubeconfig string, opts Options) (*Manager, error) {
+	_, _, db, err := opts.Connect(ctx, kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{db: db, out: os.Stdout, pollInterval: 5 * time.Second}, nil
+}
+
+// Close closes the connection to the cluster.
+func (m *Manager) Close() error {
+	return m.db.Close()
+}
+
+// BackupOptions are the target and the destination of a backup.
+type BackupOptions struct {
+	// Databases are backed up. The whole cluster is backed up if it is empty.
+	Databases []string
+	// Into is the URI of the collection the backup is added to, such as s3://bucket/path?AUTH=implicit.
+	Into string
+	// Incremental adds an incremental backup to the latest full backup of the collection.
+	Incremental bool
+	// AsOf is the AS OF SYSTEM TIME of the backup, such as -10s. The backup is taken at the current time if it
+	// is empty.
+	AsOf string
+	// Options are the options of the BACKUP statement, such as revision_history.
+	Options []string
+	// Wait waits for the backup to complete, and reports its progress.
+	Wait bool
+}
+
+// Backup starts a backup job, and waits for it to complete if Wait is set. It returns the ID of the job.
+func (m *Manager) Backup(ctx context.Context, opts BackupOptions) (int64, error) {
+	if err := validateURI(opts.Into); err != nil {
+		return 0, err
+	}
+
+	statement := func(into string) string {
+		var b strings.Builder
+		b.WriteString("BACKUP ")
+		if len(opts.Databases) > 0 {
+			b.WriteString("DATABASE " + idents(opts.Databases) + " ")
+		}
+		if opts.Incremental {
+			b.WriteString("INTO LATEST IN " + database.QuoteLiteral(into))
+		} else {
+			b.WriteString("INTO " + database.QuoteLiteral(into))
+		}
+		if opts.AsOf != "" {
+			b.WriteString(" AS OF SYSTEM TIME " + database.QuoteLiteral(opts.AsOf))
+		}
+		b.WriteString(" WITH " + strings.Join(append([]string{"detached"}, opts.Options...), ", "))
+		return b.String()
+	}
+	return m.start(ctx, statement(opts.Into), statement(redactURI(opts.Into)), opts.Wait)
+}
+
+// RestoreOptions are the source and the target of a restore.
+type RestoreOptions struct {
+	// Databases are restored. The whole cluster is restored if it is empty, which requires the cluster to be
+	// empty.
+	Databases []string
+	// In is the URI of the collection of the backup.
+	In string
+	// From is the path of the backup in the collection, as listed by Backups, or Latest.
+	From string
+	// Options are the options of the RESTORE statement, such as new_db_name = 'restored'.
+	Options []string
+	// Wait waits for the restore to complete, and reports its progress.
+	Wait bool
+}
+
+// Restore starts a restore job, and waits for it to complete if Wait is set. It returns the ID of the job.
+func (m *Manager) Restore(ctx context.Context, opts RestoreOptions) (int64, error) {
+	if err := validateURI(opts.In); err != nil {
+		return 0, err
+	}
+	from := opts.From
+	if from == "" || strings.EqualFold(from, Latest) {
+		from = Latest
+	} else {
+		from = database.QuoteLiteral(from)
+	}
+
+	statement := func(in string) string {
+		var b strings.Builder
+		b.WriteString("RESTORE ")
+		if len(opts.Databases) > 0 {
+			b.WriteString("DATABASE " + idents(opts.Databases) + " ")
+		}
+		b.WriteString("FROM " + from + " IN " + database.QuoteLiteral(in))
+		b.WriteString(" WITH " + strings.Join(append([]string{"detached"}, opts.Options...), ", "))
+		return b.String()
+	}
+	return m.start(ctx, statement(opts.In), statement(redactURI(opts.In)), opts.Wait)
+}
+
+// start runs a detached BACKUP or RESTORE statement, which returns the ID of its job, and waits for the job.
+func (m *Manager) start(ctx context.Context, statement, display string, wait bool) (int64, error) {
+	fmt.Fprintf(m.out, "Running %s;\n", display)
+	var id int64
+	if err := m.db.QueryRowContext(ctx, statement).Scan(&id); err != nil {
+		return 0, errors.Wrapf(err, "running %s", display)
+	}
+	if !wait {
+		fmt.Fprintf(m.out, "Started job %d, follow its progress with the list command.\n", id)
+		return id, nil
+	}
+	return id, m.Wait(ctx, id)
+}
+
+// Wait reports the progress of a job until it succeeds, and returns an error if it fails or is canceled. The
+// job keeps running in the cluster if the wait is interrupted.
+func (m *Manager) Wait(ctx context.Context, id int64) error {
+	var last string
+	for {
+		job, err := m.Job(ctx, id)
+		if err != nil {
+			return err
+		}
+		if progress := job.Progress(); progress != last {
+			fmt.Fprintf(m.out, "%s\n", progress)
+			last = progress
+		}
+		switch job.Status {
+		case JobSucceeded:
+			fmt.Fprintf(m.out, "✅ %s job %d succeeded.\n", job.Type, id)
+			return nil
+		case JobFailed, JobCanceled, JobRevertFailed:
+			if job.Error != "" {
+				return errors.Newf("%s job %d is %s: %s", job.Type, id, job.Status, job.Error)
+			}
+			return errors.Newf("%s job %d is %s", job.Type, id, job.Status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "waiting for job %d, which keeps running", id)
+		case <-time.After(m.pollInterval):
+		}
+	}
+}
+
+// validateURI returns an error unless the destination is an external storage URI.
+func validateURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" {
+		return errors.Newf("%q is not an external storage URI such as s3://bucket/path or nodelocal://1/path", redactURI(uri))
+	}
+	return nil
+}
+
+// redactedParams are the words found in the names of the query parameters of external storage URIs which hold
+// secrets, such as AWS_SECRET_ACCESS_KEY, AZURE_ACCOUNT_KEY or the sig of an Azure SAS token.
+var redactedParams = []string{"SECRET", "TOKEN", "CREDENTIALS", "PASSWORD", "ACCOUNT_KEY", "SIG"}
+
+// redactedURI replaces the external storage URIs which can't be parsed, and so can't be redacted.
+const redactedURI = "<redacted>"
+
+// redactURI redacts the password and the secret query parameters of an external storage URI, so that it can
+// be printed. A URI which can't be parsed is replaced altogether.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return redactedURI
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "redacted")
+	}
+	query := u.Query()
+	for key := range query {
+		for _, secret := range redactedParams {
+			if strings.Contains(strings.ToUpper(key), secret) {
+				query.Set(key, "redacted")
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func idents(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = pgx.Identifier{name}.Sanitize()
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/cockroachdb/helm-charts/pkg/database"
+)
+
+// Statuses of a job.
+const (
+	JobPending      = "pending"
+	JobRunning      = "running"
+	JobPaused       = "paused"
+	JobSucceeded    = "succeeded"
+	JobFailed       = "failed"
+	JobCanceled     = "canceled"
+	JobRevertFailed = "revert-failed"
+)
+
+// jobColumns are the columns of crdb_internal.jobs which are scanned into a Job.
+const jobColumns = "job_id, job_type, status, created, COALESCE(fraction_completed, 0), COALESCE(error, ''), description"
+
+// Job is a backup or a restore job.
+type Job struct {
+	ID      int64
+	Type    string
+	Status  string
+	Created time.Time
+	// FractionCompleted is the progress of the job, between 0 and 1.
+	FractionCompleted float64
+	Error             string
+	// Description is the statement of the job, whose secrets are redacted by the cluster.
+	Description string
+}
+
+// Progress describes the status and the progress of the job.
+func (j Job) Progress() string {
+	if j.Status == JobRunning {
+		return fmt.Sprintf("%s job %d is %s, %.0f%% complete", j.Type, j.ID, j.Status, j.FractionCompleted*100)
+	}
+	return fmt.Sprintf("%s job %d is %s", j.Type, j.ID, j.Status)
+}
+
+// Job returns a job of the cluster.
+func (m *Manager) Job(ctx context.Context, id int64) (Job, error) {
+	row := m.db.QueryRowContext(ctx, "SELECT "+jobColumns+" FROM crdb_internal.jobs WHERE job_id = $1", id)
+	job, err := scanJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, errors.Newf("job %d not found", id)
+	}
+	return job, errors.Wrapf(err, "reading job %d", id)
+}
+
+// Jobs returns the latest backup and restore jobs of the cluster, the latest first.
+func (m *Manager) Jobs(ctx context.Context, limit int) ([]Job, error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT "+jobColumns+" FROM crdb_internal.jobs WHERE job_type IN ('BACKUP', 'RESTORE') ORDER BY created DESC LIMIT $1", limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing jobs")
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning job")
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, errors.Wrap(rows.Err(), "listing jobs")
+}
+
+// scanner is a sql.Row or sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row scanner) (Job, error) {
+	var j Job
+	err := row.Scan(&j.ID, &j.Type, &j.Status, &j.Created, &j.FractionCompleted, &j.Error, &j.Description)
+	return j, err
+}
+
+// Info describes a backup of a collection, and the incremental backups added to it.
+type Info struct {
+	// Path is the path of the backup in the collection, which Restore restores from.
+	Path string
+	// EndTime is the time of the latest layer of the backup.
+	EndTime time.Time
+	// Layers is the number of layers of the backup, the full backup and its incremental backups.
+	Layers    int
+	SizeBytes int64
+	// FullCluster is set on the backups of the whole cluster.
+	FullCluster bool
+	// Databases are the databases of the backup.
+	Databases []string
+}
+
+func (i Info) String() string {
+	target := "databases " + strings.Join(i.Databases, ", ")
+	if i.FullCluster {
+		target = "full cluster"
+	}
+	return fmt.Sprintf("%s: %s, %d layers, %d bytes, as of %s", i.Path, target, i.Layers, i.SizeBytes, i.EndTime.UTC().Format(time.RFC3339))
+}
+
+// Backups returns the backups of a collection, the oldest first.
+func (m *Manager) Backups(ctx context.Context, in string) ([]Info, error) {
+	if err := validateURI(in); err != nil {
+		return nil, err
+	}
+
+	// SHOW BACKUPS takes no placeholder for the collection.
+	rows, err := m.db.QueryContext(ctx, "SHOW BACKUPS IN "+database.QuoteLiteral(in))
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing the backups in %s", redactURI(in))
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "scanning backup")
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "listing the backups in %s", redactURI(in))
+	}
+
+	backups := make([]Info, 0, len(paths))
+	for _, path := range paths {
+		info := Info{Path: path}
+		var endTime sql.NullTime
+		var databases string
+		err := m.db.QueryRowContext(ctx, "SELECT max(end_time), count(DISTINCT end_time), COALESCE(sum(size_bytes), 0)::INT8, "+
+			"COALESCE(bool_or(is_full_cluster), false), COALESCE(string_agg(DISTINCT object_name, ',') FILTER (WHERE object_type = 'database'), '') "+
+			"FROM [SHOW BACKUP FROM "+database.QuoteLiteral(path)+" IN "+database.QuoteLiteral(in)+"]").
+			Scan(&endTime, &info.Layers, &info.SizeBytes, &info.FullCluster, &databases)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading backup %s", path)
+		}
+		info.EndTime = endTime.Time
+		if databases != "" {
+			info.Databases = strings.Split(databases, ",")
+			sort.Strings(info.Databases)
+		}
+		backups = append(backups, info)
+	}
+	return backups, nil
+}
@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobs(t *testing.T) {
+	created := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	script := testutils.NewSQLScript(testutils.SQLStep{
+		Query:   "FROM crdb_internal.jobs WHERE job_type IN ('BACKUP', 'RESTORE') ORDER BY created DESC LIMIT $1",
+		Args:    []driver.Value{int64(20)},
+		Columns: jobTestColumns,
+		Rows: [][]driver.Value{
+			{int64(2), "RESTORE", JobRunning, created, 0.4, "", "RESTORE DATABASE appdb FROM ..."},
+			{int64(1), "BACKUP", JobSucceeded, created, 1.0, "", "BACKUP DATABASE appdb INTO ..."},
+		},
+	})
+	m, _ := newTestManager(script)
+
+	jobs, err := m.Jobs(context.Background(), 20)
+	require.NoError(t, err)
+	require.NoError(t, script.Verify())
+	require.Len(t, jobs, 2)
+	assert.Equal(t, "RESTORE job 2 is running, 40% complete", jobs[0].Progress())
+	assert.Equal(t, "BACKUP job 1 is succeeded", jobs[1].Progress())
+	assert.Equal(t, created, jobs[1].Created)
+}
+
+func TestJobNotFound(t *testing.T) {
+	script := testutils.NewSQLScript(testutils.SQLStep{Query: "FROM crdb_internal.jobs WHERE job_id = $1", Columns: jobTestColumns})
+	m, _ := newTestManager(script)
+
+	_, err := m.Job(context.Background(), 3)
+	assert.ErrorContains(t, err, "job 3 not found")
+}
+
+func TestBackups(t *testing.T) {
+	first := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	second := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	script := testutils.NewSQLScript(
+		testutils.SQLStep{
+			Query:   "SHOW BACKUPS IN 'nodelocal://1/backups'",
+			Columns: []string{"path"},
+			Rows:    [][]driver.Value{{"/2026/10/18-000000.00"}, {"/2026/10/19-000000.00"}},
+		},
+		testutils.SQLStep{
+			Query:   "FROM [SHOW BACKUP FROM '/2026/10/18-000000.00' IN 'nodelocal://1/backups']",
+			Columns: []string{"max", "count", "sum", "bool_or", "string_agg"},
+			Rows:    [][]driver.Value{{first, int64(3), int64(4096), false, "other,appdb"}},
+		},
+		testutils.SQLStep{
+			Query:   "FROM [SHOW BACKUP FROM '/2026/10/19-000000.00' IN 'nodelocal://1/backups']",
+			Columns: []string{"max", "count", "sum", "bool_or", "string_agg"},
+			Rows:    [][]driver.Value{{second, int64(1), int64(8192), true, "appdb,defaultdb,other,postgres,system"}},
+		},
+	)
+	m, _ := newTestManager(script)
+
+	backups, err := m.Backups(context.Background(), "nodelocal://1/backups")
+	require.NoError(t, err)
+	require.NoError(t, script.Verify())
+	assert.Equal(t, []Info{
+		{Path: "/2026/10/18-000000.00", EndTime: first, Layers: 3, SizeBytes: 4096, Databases: []string{"appdb", "other"}},
+		{Path: "/2026/10/19-000000.00", EndTime: second, Layers: 1, SizeBytes: 8192, FullCluster: true, Databases: []string{"appdb", "defaultdb", "other", "postgres", "system"}},
+	}, backups)
+	assert.Equal(t, "/2026/10/18-000000.00: databases appdb, other, 3 layers, 4096 bytes, as of 2026-10-18T00:00:00Z", backups[0].String())
+	assert.Equal(t, "/2026/10/19-000000.00: full cluster, 1 layers, 8192 bytes, as of 2026-10-19T00:00:00Z", backups[1].String())
+}
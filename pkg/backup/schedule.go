@@ -0,0 +1,42 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/provision"
+)
+
+// ApplySchedules creates the backup schedules of the databases of the spec, or re-creates the schedules which
+// don't match it, with the labels of the schedules of the init job of the Helm chart. Prune drops the schedules
+// of the databases without backup. It returns the applied changes, or the planned changes if dryRun is set, and
+// applies no change once the schedules match the spec.
+func (m *Manager) ApplySchedules(ctx context.Context, spec provision.Spec, prune, dryRun bool) ([]provision.Change, error) {
+	schedules, err := provision.ReadSchedules(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := provision.PlanSchedules(spec, schedules, prune)
+	if len(changes) == 0 {
+		fmt.Fprintln(m.out, "✅ The backup schedules already match the spec.")
+		return nil, nil
+	}
+	if dryRun {
+		fmt.Fprintf(m.out, "%d changes would be applied:\n", len(changes))
+		for _, c := range changes {
+			fmt.Fprintf(m.out, "  %s;\n", c)
+		}
+		return changes, nil
+	}
+
+	for _, c := range changes {
+		fmt.Fprintf(m.out, "Applying %s;\n", c)
+		if _, err := m.db.ExecContext(ctx, c.SQL); err != nil {
+			return nil, errors.Wrapf(err, "applying %s", c)
+		}
+	}
+	fmt.Fprintf(m.out, "✅ Applied %d changes.\n", len(changes))
+	return changes, nil
+}
@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/cockroachdb/helm-charts/pkg/provision"
+	"github.com/cockroachdb/helm-charts/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func schedulesStep(rows ...[]driver.Value) testutils.SQLStep {
+	return testutils.SQLStep{
+		Query:   "FROM [SHOW SCHEDULES] WHERE label LIKE '%_scheduled_backup'",
+		Columns: []string{"id", "label", "recurrence", "command"},
+		Rows:    rows,
+	}
+}
+
+func TestApplySchedules(t *testing.T) {
+	spec := provision.Spec{Databases: []provision.Database{{
+		Name:   "appdb",
+		Backup: &provision.Backup{Into: "nodelocal://1/appdb", Recurring: "@hourly", FullBackup: "@daily"},
+	}}}
+	created := "CREATE SCHEDULE IF NOT EXISTS 'appdb_scheduled_backup' FOR BACKUP DATABASE \"appdb\" INTO 'nodelocal://1/appdb' " +
+		"RECURRING '@hourly' FULL BACKUP '@daily'"
+	script := testutils.NewSQLScript(
+		schedulesStep([]driver.Value{int64(5), "olddb_scheduled_backup", "@daily", `{"backup_statement": "BACKUP DATABASE olddb INTO 'nodelocal://1/olddb'", "backup_type": "FULL"}`}),
+		testutils.SQLStep{Query: created},
+		testutils.SQLStep{Query: "DROP SCHEDULE 5"},
+		schedulesStep(
+			[]driver.Value{int64(6), "appdb_scheduled_backup", "@daily", `{"backup_statement": "BACKUP DATABASE appdb INTO 'nodelocal://1/appdb' WITH detached", "backup_type": 0}`},
+			[]driver.Value{int64(7), "appdb_scheduled_backup", "@hourly", `{"backup_statement": "BACKUP DATABASE appdb INTO LATEST IN 'nodelocal://1/appdb' WITH detached", "backup_type": 1}`},
+		),
+	)
+	m, out := newTestManager(script)
+
+	changes, err := m.ApplySchedules(context.Background(), spec, true, false)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, created, changes[0].SQL)
+
+	// Applying the spec again changes nothing.
+	changes, err = m.ApplySchedules(context.Background(), spec, true, false)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+	require.NoError(t, script.Verify())
+	assert.Contains(t, out.String(), "✅ The backup schedules already match the spec.")
+}
+
+func TestApplySchedulesDryRun(t *testing.T) {
+	spec := provision.Spec{Databases: []provision.Database{{
+		Name:   "appdb",
+		Backup: &provision.Backup{Into: "nodelocal://1/appdb", Recurring: "@daily"},
+	}}}
+	script := testutils.NewSQLScript(schedulesStep())
+	m, out := newTestManager(script)
+
+	changes, err := m.ApplySchedules(context.Background(), spec, false, true)
+	require.NoError(t, err)
+	require.NoError(t, script.Verify())
+	require.Len(t, changes, 1)
+	assert.Contains(t, out.String(), "1 changes would be applied:")
+	assert.Contains(t, out.String(), "FULL BACKUP ALWAYS;")
+}
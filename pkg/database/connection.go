@@ -5,13 +5,19 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/helm-charts/pkg/resource"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -25,6 +31,21 @@ const (
 	RootSQLUser        = "root"
 )
 
+// DefaultConnectTimeout restricts the connection process when DBConnection.ConnectTimeout isn't set.
+const DefaultConnectTimeout = 15 * time.Second
+
+// DefaultPasswordSecretKey is the key of the password in DBConnection.PasswordSecretName.
+const DefaultPasswordSecretKey = "password"
+
+// SSL modes of a database connection.
+const (
+	// SSLModeVerifyFull verifies the certificate of the server, and that it is issued for the host connected to.
+	SSLModeVerifyFull = "verify-full"
+	// SSLModeVerifyCA only verifies that the certificate of the server is issued by the CA. It allows connecting
+	// through addresses the certificate isn't issued for, such as a port-forward.
+	SSLModeVerifyCA = "verify-ca"
+)
+
 // DBConnection represents a database connection into a CR Database
 type DBConnection struct {
 	Ctx context.Context
@@ -32,8 +53,14 @@ type DBConnection struct {
 	Client client.Client
 	// RestConfig is the Kubernetes rest configuration
 	RestConfig *rest.Config
-	// ServiceName to connect to
+	// ServiceName to connect to. The certificate of the server is verified for this name.
 	ServiceName string
+	// StatefulSetName spreads the connections across the ready pods of the StatefulSet, rather than connecting
+	// to ServiceName alone. A connection which fails is retried against the other pods, so that the connections
+	// keep working while the pods are restarted. ServiceName defaults to the public service of the StatefulSet.
+	StatefulSetName string
+	// PodSelector spreads the connections across the ready pods matching the selector, as StatefulSetName does.
+	PodSelector labels.Selector
 	// Namespace that the pod is running in
 	Namespace string
 	// Database name that we connect to
@@ -43,32 +70,83 @@ type DBConnection struct {
 	// RunningInsideK8s allows the database connection proxying
 	// via a kube-proxy implementation
 	RunningInsideK8s bool
+	// PortForwardProtocol is the protocol of the port-forward to the pods, when not running inside k8s. It
+	// defaults to kube.PortForwardWebSocketWithFallback.
+	PortForwardProtocol kube.PortForwardProtocol
 	// UseSSL controls if the database connection utilizes SSL
 	UseSSL bool
-	// ClientCertificateSecretName is the name of the secret that contains the client CA and Key
+	// SSLMode is either SSLModeVerifyFull or SSLModeVerifyCA. It defaults to SSLModeVerifyFull.
+	SSLMode string
+	// User is the SQL user to connect as. It defaults to RootSQLUser.
+	User string
+	// ClientCertificateSecretName is the name of the secret that contains the client certificate and key of User.
+	// The connection is made without client certificate if it is empty, which requires a password.
 	ClientCertificateSecretName string
 	// RootCertificateSecretName is the name of the secret that contains the rootCA
 	RootCertificateSecretName string
+	// PasswordSecretName is the name of the secret that contains the password of User, for clusters which
+	// don't authenticate with client certificates.
+	PasswordSecretName string
+	// PasswordSecretKey is the key of the password in the secret. It defaults to DefaultPasswordSecretKey.
+	PasswordSecretKey string
+	// VirtualCluster is the virtual cluster the connection is routed to. It defaults to the
+	// server.controller.default_target_cluster of the cluster.
+	VirtualCluster string
+	// ApplicationName is reported by the connection, to be told apart in the sessions and statement
+	// statistics of the cluster.
+	ApplicationName string
+	// ConnectTimeout restricts the whole connection process. It defaults to DefaultConnectTimeout.
+	ConnectTimeout time.Duration
+	// StatementTimeout cancels the statements which run for longer. No timeout is set if it is zero.
+	StatementTimeout time.Duration
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime size the connection pool of the returned sql.DB. The
+	// defaults of database/sql are kept if they are zero.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// SkipConnectionCheck returns the sql.DB without connecting, the connection is made by the first query.
+	SkipConnectionCheck bool
 }
 
 // NewDbConnection returns a new sql.DB instance to the corresponding CockroachDB pod.
 // The DBConnection struct contains the information required to make the connection.
 func NewDbConnection(dbConn *DBConnection) (*sql.DB, error) {
 
+	serviceName := dbConn.ServiceName
+	if serviceName == "" && dbConn.StatefulSetName != "" {
+		serviceName = dbConn.StatefulSetName + "-public"
+	}
+
 	c := &dbConfig{
-		User: RootSQLUser,
-		Host: dbConn.ServiceName,
-		// ConnectTimeout was picked arbitrarily.
-		// TODO have a way to set this
-		ConnectTimeout: 15 * time.Second,
-		Namespace:      dbConn.Namespace,
-		Context:        dbConn.Ctx,
-		Client:         dbConn.Client,
-		Port:           int(*dbConn.Port),
-		Database:       dbConn.DatabaseName,
+		User:             dbConn.User,
+		Host:             serviceName,
+		ConnectTimeout:   dbConn.ConnectTimeout,
+		StatementTimeout: dbConn.StatementTimeout,
+		ApplicationName:  dbConn.ApplicationName,
+		Namespace:        dbConn.Namespace,
+		Context:          dbConn.Ctx,
+		Client:           dbConn.Client,
+		Port:             int(*dbConn.Port),
+		Database:         dbConn.DatabaseName,
+		VirtualCluster:   dbConn.VirtualCluster,
 
 		RunningInsideK8s: dbConn.RunningInsideK8s,
 	}
+	if c.User == "" {
+		c.User = RootSQLUser
+	}
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = DefaultConnectTimeout
+	}
+	if dbConn.StatefulSetName != "" || dbConn.PodSelector != nil {
+		c.Resolver = &podResolver{
+			client:          dbConn.Client,
+			namespace:       dbConn.Namespace,
+			statefulSetName: dbConn.StatefulSetName,
+			selector:        dbConn.PodSelector,
+			podIPs:          dbConn.RunningInsideK8s,
+		}
+	}
 
 	if dbConn.UseSSL {
 		clientBundle, err := c.getClientTLSConfig(dbConn.ClientCertificateSecretName, dbConn.RootCertificateSecretName)
@@ -76,42 +154,85 @@ func NewDbConnection(dbConn *DBConnection) (*sql.DB, error) {
 			return nil, errors.Wrap(err, "getting TLS certificate failed")
 		}
 
-		clientBundle.ServerName = dbConn.ServiceName
+		clientBundle.ServerName = serviceName
+		switch dbConn.SSLMode {
+		case "", SSLModeVerifyFull:
+		case SSLModeVerifyCA:
+			verifyCAOnly(clientBundle)
+		default:
+			return nil, errors.Newf("unsupported ssl mode %q", dbConn.SSLMode)
+		}
 		c.TLSConfig = clientBundle
 	}
 
+	if dbConn.PasswordSecretName != "" {
+		password, err := c.getPassword(dbConn.PasswordSecretName, dbConn.PasswordSecretKey)
+		if err != nil {
+			return nil, err
+		}
+		c.Password = password
+	}
+
 	// We are Not Running Inside of K8s so use the dialer
 	if !dbConn.RunningInsideK8s {
-		podDialer, err := kube.NewPodDialer(dbConn.RestConfig, dbConn.Namespace)
+		podDialer, err := kube.NewPodDialer(dbConn.RestConfig, dbConn.Namespace, dbConn.PortForwardProtocol)
 		if err != nil {
 			return nil, errors.Wrap(err, "creating new pod dialer failed")
 		}
 		dialerFunc := podDialer.DialContext
 		c.DialFunc = &dialerFunc
 		c.LookupFunc = lookupFunc
+		c.Closer = podDialer
 	}
 
 	db, err := c.openDB()
 	if err != nil {
 		return nil, fmt.Errorf("opening a DB connection failed %s", err)
 	}
+	db.SetMaxOpenConns(dbConn.MaxOpenConns)
+	if dbConn.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(dbConn.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(dbConn.ConnMaxLifetime)
+
+	if dbConn.SkipConnectionCheck {
+		return db, nil
+	}
+
+	// Test the database connection. Each pod connected to is bounded by ConnectTimeout.
+	if err := db.PingContext(c.context()); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "testing db connection failed")
+	}
+
 	return db, nil
 }
 
 type dbConfig struct {
 	Host string
 	User string
+	// Password authenticates User, for clusters which don't authenticate with client certificates.
+	Password string
 	// Port defaults to CockroachDBSQLPort
 	Port int
 	// Database is the database being connected to.
 	// it defaults to "system". This is the only database guaranteed to exist in CRDB clusters.
 	Database string
+	// VirtualCluster routes the connection to the given virtual cluster. Use SystemVirtualCluster
+	// to inspect the virtual clusters of the cluster.
+	VirtualCluster string
+	// ApplicationName sets the application_name session variable.
+	ApplicationName string
 	// DialFunc defaults to net.Dialer.DialContext. Set to kube.PodDailer.DialContext
 	// if connecting to a k8s pod.
 	DialFunc *func(context.Context, string, string) (net.Conn, error)
 	// LookupFunc defaults to a stub, which is suitable for use with
 	// kube.Dialer
 	LookupFunc func(context.Context, string) ([]string, error)
+	// Resolver resolves Host to the ready pods to connect to, in turn. Host is resolved as is if it is nil.
+	Resolver *podResolver
+	// Closer is closed along with the pool of connections, such as the kube.PodDialer behind DialFunc.
+	Closer io.Closer
 	// TLSConfig describes the TLS configuration for this database connection.
 	// nil disabled TLS connections.
 	// CA certs should be specified via RootCAs
@@ -119,6 +240,8 @@ type dbConfig struct {
 	TLSConfig *tls.Config
 	// ConnectTimeout restricts the whole connection process.
 	ConnectTimeout time.Duration
+	// StatementTimeout sets the statement_timeout session variable.
+	StatementTimeout time.Duration
 	// Namespace that we are connecting to
 	Namespace string
 	// Context for the process
@@ -130,17 +253,30 @@ type dbConfig struct {
 	RunningInsideK8s bool
 }
 
+func (c dbConfig) context() context.Context {
+	if c.Context == nil {
+		return context.Background()
+	}
+	return c.Context
+}
+
+// getClientTLSConfig loads the CA from the root secret, and the client certificate from the client secret. The
+// client certificate is left out if the client secret isn't set.
 func (c dbConfig) getClientTLSConfig(clientCertificateSecretName string, rootCertificateSecretName string) (tlsConfig *tls.Config, err error) {
 	r := resource.NewKubeResource(c.Context, c.Client, c.Namespace, kube.DefaultPersister)
 
-	tlsSecret, err := resource.LoadTLSSecret(clientCertificateSecretName, r)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to load client tls secret")
-	}
+	var certificates []tls.Certificate
+	if clientCertificateSecretName != "" {
+		tlsSecret, err := resource.LoadTLSSecret(clientCertificateSecretName, r)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load client tls secret")
+		}
 
-	keyPair, err := tls.X509KeyPair(tlsSecret.TLSCert(), tlsSecret.TLSPrivateKey())
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to create key pair")
+		keyPair, err := tls.X509KeyPair(tlsSecret.TLSCert(), tlsSecret.TLSPrivateKey())
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to create key pair")
+		}
+		certificates = append(certificates, keyPair)
 	}
 
 	root, err := resource.LoadTLSSecret(rootCertificateSecretName, r)
@@ -155,26 +291,86 @@ func (c dbConfig) getClientTLSConfig(clientCertificateSecretName string, rootCer
 
 	// Construct a tls.config
 	return &tls.Config{
-		Certificates: []tls.Certificate{keyPair},
+		Certificates: certificates,
 		RootCAs:      pool,
 	}, nil
 }
 
+// getPassword reads the password of the user from the given key of the secret.
+func (c dbConfig) getPassword(secretName, key string) (string, error) {
+	if key == "" {
+		key = DefaultPasswordSecretKey
+	}
+
+	var secret corev1.Secret
+	if err := c.Client.Get(c.context(), types.NamespacedName{Name: secretName, Namespace: c.Namespace}, &secret); err != nil {
+		return "", errors.Wrapf(err, "unable to load password secret %s", secretName)
+	}
+	password, ok := secret.Data[key]
+	if !ok {
+		return "", errors.Newf("password secret %s has no key %s", secretName, key)
+	}
+	return string(password), nil
+}
+
+// verifyCAOnly replaces the verification of the server certificate by a verification of its chain alone, without
+// the check of the host name.
+func verifyCAOnly(tlsConfig *tls.Config) {
+	roots := tlsConfig.RootCAs
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
+
 func (c dbConfig) sslMode() string {
 	if c.TLSConfig == nil {
 		return "disable"
 	}
 
-	// TODO this is not used
 	if c.TLSConfig.InsecureSkipVerify {
-		return "verify-ca"
+		return SSLModeVerifyCA
 	}
 
-	return "verify-full"
+	return SSLModeVerifyFull
 }
 
-// openDB connects to a CockroachDB instance and verifies the connection
+// openDB returns the pool of connections to a CockroachDB instance
 func (c dbConfig) openDB() (*sql.DB, error) {
+	pgCfg, err := c.pgConfig()
+	if err != nil {
+		return nil, err
+	}
+	if c.Closer == nil {
+		return stdlib.OpenDB(*pgCfg), nil
+	}
+	return sql.OpenDB(closingConnector{Connector: stdlib.GetConnector(*pgCfg), closer: c.Closer}), nil
+}
+
+// closingConnector closes the closer once the pool of connections is closed, as sql.DB closes connectors which
+// implement io.Closer.
+type closingConnector struct {
+	driver.Connector
+	closer io.Closer
+}
+
+func (c closingConnector) Close() error {
+	return c.closer.Close()
+}
+
+// pgConfig builds the configuration of the connections.
+func (c dbConfig) pgConfig() (*pgx.ConnConfig, error) {
 	if c.Port == 0 {
 		c.Port = CockroachDBSQLPort
 	}
@@ -186,6 +382,15 @@ func (c dbConfig) openDB() (*sql.DB, error) {
 	connOptions := url.Values{
 		"sslmode": {c.sslMode()},
 	}
+	if c.VirtualCluster != "" {
+		connOptions.Set("options", "-ccluster="+c.VirtualCluster)
+	}
+	if c.ApplicationName != "" {
+		connOptions.Set("application_name", c.ApplicationName)
+	}
+	if c.StatementTimeout > 0 {
+		connOptions.Set("statement_timeout", strconv.FormatInt(c.StatementTimeout.Milliseconds(), 10))
+	}
 
 	pgURL := url.URL{
 		Scheme:   "postgresql",
@@ -198,6 +403,9 @@ func (c dbConfig) openDB() (*sql.DB, error) {
 	// otherwise connect will panic.
 	if c.User != "" {
 		pgURL.User = url.User(c.User)
+		if c.Password != "" {
+			pgURL.User = url.UserPassword(c.User, c.Password)
+		}
 	}
 
 	pgCfg, err := pgx.ParseConfig(pgURL.String())
@@ -212,18 +420,14 @@ func (c dbConfig) openDB() (*sql.DB, error) {
 		pgCfg.DialFunc = *c.DialFunc
 		pgCfg.LookupFunc = c.LookupFunc
 	}
+	if c.Resolver != nil {
+		pgCfg.LookupFunc = c.Resolver.lookup
+	}
 
 	pgCfg.TLSConfig = c.TLSConfig
 	pgCfg.ConnectTimeout = c.ConnectTimeout
 
-	db := stdlib.OpenDB(*pgCfg)
-
-	// Test the database connection
-	if _, err := db.Exec("SELECT 1"); err != nil {
-		return nil, errors.Wrap(err, "testing db connection failed")
-	}
-
-	return db, nil
+	return pgCfg, nil
 }
 
 // lookupFunc is a stub for net.Resolver.Lookup. It's useful when connecting
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// testCertificate is a certificate and its key, signed by parent or self-signed.
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+func newTestCertificate(t *testing.T, parent *testCertificate, isCA bool, dnsNames ...string) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCertificate{cert: cert, key: key, certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *testCertificate) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// handshake connects a client with the given config to a server presenting the certificate.
+func handshake(t *testing.T, server *testCertificate, config *tls.Config) error {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{server.cert.Raw},
+		PrivateKey:  server.key,
+	}}})
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestVerifyCAOnly(t *testing.T) {
+	ca := newTestCertificate(t, nil, true)
+	// The certificate isn't issued for the host connected to, as through a port-forward.
+	server := newTestCertificate(t, ca, false, "crdb-public")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	config := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	require.Error(t, handshake(t, server, config.Clone()))
+
+	verifyCA := config.Clone()
+	verifyCAOnly(verifyCA)
+	require.NoError(t, handshake(t, server, verifyCA))
+	assert.Equal(t, SSLModeVerifyCA, dbConfig{TLSConfig: verifyCA}.sslMode())
+
+	// A certificate of another CA is still rejected.
+	other := newTestCertificate(t, newTestCertificate(t, nil, true), false, "localhost")
+	require.Error(t, handshake(t, other, verifyCA))
+}
+
+func TestPgConfig(t *testing.T) {
+	c := dbConfig{
+		Host:             "crdb-0.crdb",
+		User:             "app",
+		Password:         "p@ss word",
+		ApplicationName:  "migration-helper",
+		StatementTimeout: 30 * time.Second,
+		ConnectTimeout:   5 * time.Second,
+		TLSConfig:        &tls.Config{},
+		RunningInsideK8s: true,
+	}
+
+	cfg, err := c.pgConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "crdb-0.crdb", cfg.Host)
+	assert.Equal(t, uint16(CockroachDBSQLPort), cfg.Port)
+	assert.Equal(t, "system", cfg.Database)
+	assert.Equal(t, "app", cfg.User)
+	assert.Equal(t, "p@ss word", cfg.Password)
+	assert.Equal(t, 5*time.Second, cfg.ConnectTimeout)
+	assert.Equal(t, "migration-helper", cfg.RuntimeParams["application_name"])
+	assert.Equal(t, "30000", cfg.RuntimeParams["statement_timeout"])
+	assert.Same(t, c.TLSConfig, cfg.TLSConfig)
+
+	// The pod dialer is required outside of the cluster.
+	c.RunningInsideK8s = false
+	_, err = c.pgConfig()
+	require.Error(t, err)
+}
+
+func TestClientTLSConfigWithPassword(t *testing.T) {
+	ca := newTestCertificate(t, nil, true)
+	client := newTestCertificate(t, ca, false)
+	cl := fakeclient.NewClientBuilder().WithObjects(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "crdb-ca", Namespace: "default"},
+			Data:       map[string][]byte{"ca.crt": ca.certPEM},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "crdb-client-secret", Namespace: "default"},
+			Data:       map[string][]byte{"ca.crt": ca.certPEM, "tls.crt": client.certPEM, "tls.key": client.keyPEM(t)},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "app-password", Namespace: "default"},
+			Data:       map[string][]byte{"password": []byte("secret"), "other": []byte("other")},
+		},
+	).Build()
+	c := dbConfig{Context: context.Background(), Client: cl, Namespace: "default"}
+
+	// Clusters authenticating with passwords only need the CA.
+	tlsConfig, err := c.getClientTLSConfig("", "crdb-ca")
+	require.NoError(t, err)
+	assert.Empty(t, tlsConfig.Certificates)
+	assert.NotNil(t, tlsConfig.RootCAs)
+
+	tlsConfig, err = c.getClientTLSConfig("crdb-client-secret", "crdb-client-secret")
+	require.NoError(t, err)
+	assert.Len(t, tlsConfig.Certificates, 1)
+
+	password, err := c.getPassword("app-password", "")
+	require.NoError(t, err)
+	assert.Equal(t, "secret", password)
+	password, err = c.getPassword("app-password", "other")
+	require.NoError(t, err)
+	assert.Equal(t, "other", password)
+	_, err = c.getPassword("app-password", "missing")
+	require.Error(t, err)
+}
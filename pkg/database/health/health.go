@@ -0,0 +1,330 @@
+// Package health inspects the health of a CockroachDB cluster through SQL: the liveness of its nodes, the
+// replication of its ranges, its cluster version and its license. It lets commands make safety decisions, such
+// as whether a node can be restarted, from the state of the cluster rather than from the state of its pods.
+package health
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/database"
+	"sigs.k8s.io/yaml"
+)
+
+// Memberships of the nodes, as reported by their liveness record.
+const (
+	MembershipActive          = "active"
+	MembershipDecommissioning = "decommissioning"
+	MembershipDecommissioned  = "decommissioned"
+)
+
+const (
+	nodesQuery = `SELECT n.node_id, n.address, n.build_tag, n.is_live,
+	COALESCE(l.draining, false), COALESCE(l.membership, 'active')
+FROM crdb_internal.gossip_nodes AS n
+LEFT JOIN crdb_internal.gossip_liveness AS l USING (node_id)
+ORDER BY n.node_id`
+
+	// The range metrics are only counted by the leaseholder of each range, so they are summed across the stores.
+	rangesQuery = `SELECT
+	COALESCE(sum((metrics->>'ranges.underreplicated')::FLOAT8), 0)::INT8,
+	COALESCE(sum((metrics->>'ranges.unavailable')::FLOAT8), 0)::INT8,
+	COALESCE(sum((metrics->>'ranges.overreplicated')::FLOAT8), 0)::INT8
+FROM crdb_internal.kv_store_status`
+
+	// range_count is the number of replicas held by a store, the stores of decommissioned nodes aren't listed.
+	replicasQuery = `SELECT node_id, sum(range_count)::INT8
+FROM crdb_internal.kv_store_status
+GROUP BY node_id`
+
+	// The system ranges and database are replicated 5 times by default, CockroachDB lowers their replication
+	// factor on smaller clusters, so they don't hold a scale-down.
+	zonesQuery = `SELECT target, full_config_yaml
+FROM crdb_internal.zones
+WHERE COALESCE(database_name, '') != 'system' AND COALESCE(range_name, '') NOT IN ('meta', 'liveness', 'system')`
+
+	versionQuery                 = "SHOW CLUSTER SETTING version"
+	preserveDowngradeOptionQuery = "SHOW CLUSTER SETTING cluster.preserve_downgrade_option"
+	organizationQuery            = "SHOW CLUSTER SETTING cluster.organization"
+	licenseQuery                 = "SHOW CLUSTER SETTING enterprise.license"
+)
+
+// Node is a node of the cluster, as gossiped to the node connected to.
+type Node struct {
+	ID      int32
+	Address string
+	// BuildTag is the version of the binary of the node, such as v24.1.3.
+	BuildTag string
+	IsLive   bool
+	Draining bool
+	// Membership is one of MembershipActive, MembershipDecommissioning or MembershipDecommissioned.
+	Membership string
+}
+
+// Decommissioned returns whether the node was removed from the cluster.
+func (n Node) Decommissioned() bool {
+	return n.Membership == MembershipDecommissioned
+}
+
+// RangeCounts are the numbers of ranges of the cluster which are not replicated as configured.
+type RangeCounts struct {
+	UnderReplicated int64
+	// Unavailable ranges lost their quorum, and can't serve reads nor writes.
+	Unavailable    int64
+	OverReplicated int64
+}
+
+// ClusterVersion is the active version of the cluster, which gates the features of the binaries of its nodes.
+type ClusterVersion struct {
+	// Version is the version the cluster was finalized to, such as 24.1. It is an internal version, such as
+	// 24.1-upgrading-to-24.2-step-010, while an upgrade is being finalized.
+	Version string
+	// PreserveDowngradeOption holds the cluster at the version, rather than finalizing the upgrade of its nodes.
+	PreserveDowngradeOption string
+}
+
+// License is the enterprise license of the cluster. The license key isn't decoded.
+type License struct {
+	Organization string
+	// HasKey is whether a license key is set.
+	HasKey bool
+}
+
+// Status is the health of the cluster.
+type Status struct {
+	Nodes   []Node
+	Ranges  RangeCounts
+	Version ClusterVersion
+	License License
+}
+
+// BuildVersions returns the build tag of each node which is not decommissioned, by node ID.
+func (s Status) BuildVersions() map[int32]string {
+	versions := map[int32]string{}
+	for _, n := range s.Nodes {
+		if !n.Decommissioned() {
+			versions[n.ID] = n.BuildTag
+		}
+	}
+	return versions
+}
+
+// NodeOnHost returns the node which is not decommissioned and advertises the host, or a subdomain of it such as
+// the pod DNS name crdb-0.crdb.default.svc.cluster.local for the host crdb-0.
+func (s Status) NodeOnHost(host string) (Node, bool) {
+	for _, n := range s.NodesOnHost(host) {
+		if !n.Decommissioned() {
+			return n, true
+		}
+	}
+	return Node{}, false
+}
+
+// NodesOnHost returns the nodes which advertise the host, or a subdomain of it, including the nodes which were
+// decommissioned before their pod was recreated with an empty store, by ID.
+func (s Status) NodesOnHost(host string) []Node {
+	var nodes []Node
+	for _, n := range s.Nodes {
+		addr := n.Address
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			addr = h
+		}
+		if addr == host || strings.HasPrefix(addr, host+".") {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// Upgrade returns the state of the upgrade of the cluster, from its version and the builds of its nodes.
+func (s Status) Upgrade() UpgradeState {
+	return upgradeState(s.Version, s.BuildVersions())
+}
+
+// Healthy returns an error if a node of the cluster is down or draining, or if ranges are unavailable or
+// under-replicated, for instance as a node is being restarted. Decommissioned nodes are ignored.
+func (s Status) Healthy() error {
+	var problems []string
+	for _, n := range s.Nodes {
+		switch {
+		case n.Decommissioned():
+		case !n.IsLive:
+			problems = append(problems, fmt.Sprintf("node %d is not live", n.ID))
+		case n.Draining:
+			problems = append(problems, fmt.Sprintf("node %d is draining", n.ID))
+		}
+	}
+	if s.Ranges.Unavailable > 0 {
+		problems = append(problems, fmt.Sprintf("%d ranges are unavailable", s.Ranges.Unavailable))
+	}
+	if s.Ranges.UnderReplicated > 0 {
+		problems = append(problems, fmt.Sprintf("%d ranges are under-replicated", s.Ranges.UnderReplicated))
+	}
+	if len(problems) > 0 {
+		return errors.Newf("cluster is unhealthy: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Checker inspects the health of a cluster.
+type Checker struct {
+	db *sql.DB
+}
+
+// NewChecker returns a Checker querying the cluster through the given connection, which must be made as a user
+// with the admin role.
+func NewChecker(db *sql.DB) *Checker {
+	return &Checker{db: db}
+}
+
+// Connect connects to the cluster with database.NewDbConnection, and returns a Checker querying it.
+func Connect(dbConn *database.DBConnection) (*Checker, error) {
+	db, err := database.NewDbConnection(dbConn)
+	if err != nil {
+		return nil, err
+	}
+	return NewChecker(db), nil
+}
+
+// Close closes the connection to the cluster.
+func (c *Checker) Close() error {
+	return c.db.Close()
+}
+
+// Status returns the health of the cluster.
+func (c *Checker) Status(ctx context.Context) (Status, error) {
+	var s Status
+	var err error
+	if s.Nodes, err = c.Nodes(ctx); err != nil {
+		return s, err
+	}
+	if s.Ranges, err = c.Ranges(ctx); err != nil {
+		return s, err
+	}
+	if s.Version, err = c.ClusterVersion(ctx); err != nil {
+		return s, err
+	}
+	if s.License, err = c.License(ctx); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// Nodes returns the nodes of the cluster by ID, with their liveness and their build.
+func (c *Checker) Nodes(ctx context.Context) ([]Node, error) {
+	rows, err := c.db.QueryContext(ctx, nodesQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing nodes")
+	}
+	defer rows.Close()
+
+	var nodes []Node
+	for rows.Next() {
+		var n Node
+		if err := rows.Scan(&n.ID, &n.Address, &n.BuildTag, &n.IsLive, &n.Draining, &n.Membership); err != nil {
+			return nil, errors.Wrap(err, "scanning node")
+		}
+		nodes = append(nodes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "listing nodes")
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+// Ranges returns the numbers of ranges which are not replicated as configured.
+func (c *Checker) Ranges(ctx context.Context) (RangeCounts, error) {
+	var r RangeCounts
+	if err := c.db.QueryRowContext(ctx, rangesQuery).Scan(&r.UnderReplicated, &r.Unavailable, &r.OverReplicated); err != nil {
+		return r, errors.Wrap(err, "counting ranges")
+	}
+	return r, nil
+}
+
+// Replicas returns the number of range replicas held by the stores of each node, by node ID. The nodes whose
+// stores aren't listed, such as decommissioned nodes, hold no replicas.
+func (c *Checker) Replicas(ctx context.Context) (map[int32]int64, error) {
+	rows, err := c.db.QueryContext(ctx, replicasQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "counting replicas")
+	}
+	defer rows.Close()
+
+	replicas := map[int32]int64{}
+	for rows.Next() {
+		var id int32
+		var count int64
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, errors.Wrap(err, "scanning replicas")
+		}
+		replicas[id] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "counting replicas")
+	}
+	return replicas, nil
+}
+
+// ReplicationFactor returns the highest num_replicas of the zone configurations, and the target of its zone
+// configuration. The ranges of the zone can't be fully replicated on fewer nodes.
+func (c *Checker) ReplicationFactor(ctx context.Context) (int32, string, error) {
+	rows, err := c.db.QueryContext(ctx, zonesQuery)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "reading zone configurations")
+	}
+	defer rows.Close()
+
+	var factor int32
+	var target string
+	for rows.Next() {
+		var zone, config string
+		if err := rows.Scan(&zone, &config); err != nil {
+			return 0, "", errors.Wrap(err, "scanning zone configurations")
+		}
+		var zoneConfig struct {
+			NumReplicas int32 `json:"num_replicas"`
+		}
+		if err := yaml.Unmarshal([]byte(config), &zoneConfig); err != nil {
+			return 0, "", errors.Wrapf(err, "decoding zone configuration of %s", zone)
+		}
+		if zoneConfig.NumReplicas > factor {
+			factor, target = zoneConfig.NumReplicas, zone
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, "", errors.Wrap(err, "reading zone configurations")
+	}
+	return factor, target, nil
+}
+
+// ClusterVersion returns the active version of the cluster.
+func (c *Checker) ClusterVersion(ctx context.Context) (ClusterVersion, error) {
+	var v ClusterVersion
+	if err := c.db.QueryRowContext(ctx, versionQuery).Scan(&v.Version); err != nil {
+		return v, errors.Wrap(err, "reading cluster version")
+	}
+	if err := c.db.QueryRowContext(ctx, preserveDowngradeOptionQuery).Scan(&v.PreserveDowngradeOption); err != nil {
+		return v, errors.Wrap(err, "reading cluster.preserve_downgrade_option")
+	}
+	return v, nil
+}
+
+// License returns the license of the cluster.
+func (c *Checker) License(ctx context.Context) (License, error) {
+	var l License
+	if err := c.db.QueryRowContext(ctx, organizationQuery).Scan(&l.Organization); err != nil {
+		return l, errors.Wrap(err, "reading cluster.organization")
+	}
+	var key string
+	if err := c.db.QueryRowContext(ctx, licenseQuery).Scan(&key); err != nil {
+		return l, errors.Wrap(err, "reading enterprise.license")
+	}
+	l.HasKey = key != ""
+	return l, nil
+}
@@ -0,0 +1,177 @@
+package health
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/cockroachdb/helm-charts/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var nodeColumns = []string{"node_id", "address", "build_tag", "is_live", "draining", "membership"}
+
+func setting(query string, value string) testutils.SQLStep {
+	return testutils.SQLStep{Query: query, Columns: []string{"setting"}, Rows: [][]driver.Value{{value}}}
+}
+
+func TestCheckerStatus(t *testing.T) {
+	script := testutils.NewSQLScript(
+		testutils.SQLStep{
+			Query:   "FROM crdb_internal.gossip_nodes",
+			Columns: nodeColumns,
+			Rows: [][]driver.Value{
+				{int64(2), "crdb-1.crdb:26257", "v24.1.3", true, false, "active"},
+				{int64(1), "crdb-0.crdb:26257", "v24.1.3", true, false, "active"},
+				{int64(3), "crdb-2.crdb:26257", "v23.2.9", false, false, "decommissioned"},
+			},
+		},
+		testutils.SQLStep{
+			Query:   "FROM crdb_internal.kv_store_status",
+			Columns: []string{"under", "unavailable", "over"},
+			Rows:    [][]driver.Value{{int64(0), int64(0), int64(2)}},
+		},
+		setting(versionQuery, "23.2"),
+		setting(preserveDowngradeOptionQuery, "23.2"),
+		setting(organizationQuery, "Cockroach Labs"),
+		setting(licenseQuery, "crl-0-xyz"),
+	)
+	db := script.DB()
+	defer db.Close()
+
+	status, err := NewChecker(db).Status(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, script.Verify())
+
+	assert.Equal(t, []Node{
+		{ID: 1, Address: "crdb-0.crdb:26257", BuildTag: "v24.1.3", IsLive: true, Membership: MembershipActive},
+		{ID: 2, Address: "crdb-1.crdb:26257", BuildTag: "v24.1.3", IsLive: true, Membership: MembershipActive},
+		{ID: 3, Address: "crdb-2.crdb:26257", BuildTag: "v23.2.9", Membership: MembershipDecommissioned},
+	}, status.Nodes)
+	assert.Equal(t, RangeCounts{OverReplicated: 2}, status.Ranges)
+	assert.Equal(t, ClusterVersion{Version: "23.2", PreserveDowngradeOption: "23.2"}, status.Version)
+	assert.Equal(t, License{Organization: "Cockroach Labs", HasKey: true}, status.License)
+
+	assert.Equal(t, map[int32]string{1: "v24.1.3", 2: "v24.1.3"}, status.BuildVersions())
+	assert.Equal(t, UpgradePendingFinalization, status.Upgrade())
+	// The decommissioned node and the over-replicated ranges don't make the cluster unhealthy.
+	assert.NoError(t, status.Healthy())
+}
+
+func TestCheckerStatusError(t *testing.T) {
+	script := testutils.NewSQLScript(
+		testutils.SQLStep{Query: "FROM crdb_internal.gossip_nodes", Columns: nodeColumns},
+		testutils.SQLStep{Query: "FROM crdb_internal.kv_store_status", Err: assert.AnError},
+	)
+	db := script.DB()
+	defer db.Close()
+
+	_, err := NewChecker(db).Status(context.Background())
+	require.ErrorIs(t, err, assert.AnError)
+	assert.Contains(t, err.Error(), "counting ranges")
+	assert.NoError(t, script.Verify())
+}
+
+func TestStatusHealthy(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  Status
+		wantErr string
+	}{
+		{
+			name:   "healthy",
+			status: Status{Nodes: []Node{{ID: 1, IsLive: true}, {ID: 2, IsLive: true}}},
+		},
+		{
+			name: "node restarting",
+			status: Status{
+				Nodes:  []Node{{ID: 1, IsLive: true}, {ID: 2}, {ID: 3, IsLive: true, Draining: true}},
+				Ranges: RangeCounts{UnderReplicated: 12},
+			},
+			wantErr: "cluster is unhealthy: node 2 is not live, node 3 is draining, 12 ranges are under-replicated",
+		},
+		{
+			name: "quorum lost",
+			status: Status{
+				Nodes:  []Node{{ID: 1, IsLive: true}},
+				Ranges: RangeCounts{Unavailable: 3, UnderReplicated: 5},
+			},
+			wantErr: "cluster is unhealthy: 3 ranges are unavailable, 5 ranges are under-replicated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.status.Healthy()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestStatusNodeOnHost(t *testing.T) {
+	status := Status{Nodes: []Node{
+		{ID: 1, Address: "crdb-0.crdb.default.svc.cluster.local:26257", Membership: MembershipDecommissioned},
+		{ID: 2, Address: "crdb-1.crdb.default.svc.cluster.local:26257", Membership: MembershipActive},
+		{ID: 4, Address: "crdb-0.crdb.default.svc.cluster.local:26257", Membership: MembershipActive},
+		{ID: 5, Address: "crdb-10:26257", Membership: MembershipActive},
+	}}
+
+	node, ok := status.NodeOnHost("crdb-0")
+	require.True(t, ok)
+	// The node decommissioned before the pod was recreated with an empty store is ignored.
+	assert.Equal(t, int32(4), node.ID)
+
+	node, ok = status.NodeOnHost("crdb-10")
+	require.True(t, ok)
+	assert.Equal(t, int32(5), node.ID)
+
+	var ids []int32
+	for _, n := range status.NodesOnHost("crdb-0") {
+		ids = append(ids, n.ID)
+	}
+	assert.Equal(t, []int32{1, 4}, ids)
+
+	_, ok = status.NodeOnHost("crdb-2")
+	assert.False(t, ok)
+	_, ok = status.NodeOnHost("crdb-1.crdb.default")
+	assert.True(t, ok)
+}
+
+func TestCheckerReplicas(t *testing.T) {
+	script := testutils.NewSQLScript(testutils.SQLStep{
+		Query:   "FROM crdb_internal.kv_store_status GROUP BY node_id",
+		Columns: []string{"node_id", "replicas"},
+		Rows:    [][]driver.Value{{int64(1), int64(120)}, {int64(2), int64(0)}},
+	})
+	db := script.DB()
+	defer db.Close()
+
+	replicas, err := NewChecker(db).Replicas(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, script.Verify())
+	assert.Equal(t, map[int32]int64{1: 120, 2: 0}, replicas)
+}
+
+func TestCheckerReplicationFactor(t *testing.T) {
+	script := testutils.NewSQLScript(testutils.SQLStep{
+		Query:   "FROM crdb_internal.zones",
+		Columns: []string{"target", "full_config_yaml"},
+		Rows: [][]driver.Value{
+			{"RANGE default", "range_min_bytes: 134217728\nnum_replicas: 3\nconstraints: []\n"},
+			{"DATABASE bank", "range_min_bytes: 134217728\nnum_replicas: 5\ngc:\n  ttlseconds: 14400\n"},
+			{"TABLE bank.public.accounts", "num_replicas: 4\n"},
+		},
+	})
+	db := script.DB()
+	defer db.Close()
+
+	factor, target, err := NewChecker(db).ReplicationFactor(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, script.Verify())
+	assert.Equal(t, int32(5), factor)
+	assert.Equal(t, "DATABASE bank", target)
+}
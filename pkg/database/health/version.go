@@ -0,0 +1,60 @@
+package health
+
+import (
+	"strings"
+)
+
+// UpgradeState is the state of the upgrade of a cluster to a new major version.
+type UpgradeState string
+
+const (
+	// UpgradeFinalized is a cluster whose version is the release series of the binaries of all its nodes.
+	UpgradeFinalized UpgradeState = "finalized"
+	// UpgradeMixedVersions is a cluster whose nodes run binaries of different release series, while the nodes
+	// are being upgraded or rolled back.
+	UpgradeMixedVersions UpgradeState = "mixed-versions"
+	// UpgradePendingFinalization is a cluster whose nodes were all upgraded, and which is held at the previous
+	// version by cluster.preserve_downgrade_option. It can still be rolled back.
+	UpgradePendingFinalization UpgradeState = "pending-finalization"
+	// UpgradeFinalizing is a cluster whose nodes were all upgraded, and whose version is being upgraded. It can't
+	// be rolled back anymore.
+	UpgradeFinalizing UpgradeState = "finalizing"
+)
+
+// ReleaseSeries returns the release series of a build tag or of a version, such as 24.1 for v24.1.3. It
+// returns the version as is if it has no minor version.
+func ReleaseSeries(version string) string {
+	version = strings.TrimPrefix(version, "v")
+	version, _, _ = strings.Cut(version, "-")
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// upgradeState compares the version of the cluster with the release series of the builds of its nodes.
+func upgradeState(version ClusterVersion, builds map[int32]string) UpgradeState {
+	series := map[string]bool{}
+	for _, build := range builds {
+		series[ReleaseSeries(build)] = true
+	}
+	if len(series) > 1 {
+		return UpgradeMixedVersions
+	}
+
+	// The cluster version is an internal version, such as 24.1-upgrading-to-24.2-step-010, during the
+	// finalization.
+	if strings.Contains(version.Version, "-") {
+		return UpgradeFinalizing
+	}
+	for s := range series {
+		if s != ReleaseSeries(version.Version) {
+			if version.PreserveDowngradeOption != "" {
+				return UpgradePendingFinalization
+			}
+			return UpgradeFinalizing
+		}
+	}
+	return UpgradeFinalized
+}
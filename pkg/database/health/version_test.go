@@ -0,0 +1,66 @@
+package health
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReleaseSeries(t *testing.T) {
+	for version, want := range map[string]string{
+		"v24.1.3":                         "24.1",
+		"v24.2.0-beta.1":                  "24.2",
+		"24.1":                            "24.1",
+		"24.1-upgrading-to-24.2-step-010": "24.1",
+		"23.2-12":                         "23.2",
+		"24":                              "24",
+		"":                                "",
+	} {
+		assert.Equal(t, want, ReleaseSeries(version), version)
+	}
+}
+
+func TestUpgradeState(t *testing.T) {
+	tests := []struct {
+		name    string
+		version ClusterVersion
+		builds  map[int32]string
+		want    UpgradeState
+	}{
+		{
+			name:    "finalized",
+			version: ClusterVersion{Version: "24.1"},
+			builds:  map[int32]string{1: "v24.1.3", 2: "v24.1.4"},
+			want:    UpgradeFinalized,
+		},
+		{
+			name:    "rolling",
+			version: ClusterVersion{Version: "23.2", PreserveDowngradeOption: "23.2"},
+			builds:  map[int32]string{1: "v24.1.3", 2: "v23.2.9"},
+			want:    UpgradeMixedVersions,
+		},
+		{
+			name:    "preserved",
+			version: ClusterVersion{Version: "23.2", PreserveDowngradeOption: "23.2"},
+			builds:  map[int32]string{1: "v24.1.3", 2: "v24.1.3"},
+			want:    UpgradePendingFinalization,
+		},
+		{
+			name:    "auto-finalizing",
+			version: ClusterVersion{Version: "23.2"},
+			builds:  map[int32]string{1: "v24.1.3", 2: "v24.1.3"},
+			want:    UpgradeFinalizing,
+		},
+		{
+			name:    "finalizing",
+			version: ClusterVersion{Version: "23.2-upgrading-to-24.1-step-022"},
+			builds:  map[int32]string{1: "v24.1.3", 2: "v24.1.3"},
+			want:    UpgradeFinalizing,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, upgradeState(tt.version, tt.builds))
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+const (
+	// CockroachBinary is the cockroach binary of the CockroachDB image.
+	CockroachBinary = "/cockroach/cockroach"
+	// CertsDir is the directory of the node and root client certificates in the CockroachDB container of the
+	// Helm chart.
+	CertsDir = "/cockroach/cockroach-certs"
+	// DBContainerName is the name of the CockroachDB container of the StatefulSet of the Helm chart.
+	DBContainerName = "db"
+)
+
+// ExecFunc runs a command in the CockroachDB container of a pod, and copies its output to stdout and stderr.
+type ExecFunc func(ctx context.Context, podName string, command []string, stdout, stderr io.Writer) error
+
+// NodeCLI runs the node commands of the cockroach CLI, which have no SQL equivalent, in the CockroachDB
+// container of a pod. The CLI connects to the node of the pod, which runs the command against the given nodes.
+type NodeCLI struct {
+	Exec ExecFunc
+	// Port is the RPC port of the nodes, which the Helm chart also serves SQL on. It defaults to
+	// CockroachDBSQLPort.
+	Port     int32
+	Insecure bool
+	// CertsDir defaults to the CertsDir of the Helm chart.
+	CertsDir string
+	// Out receives the output of the commands, such as the progress of a decommission. It is discarded if nil.
+	Out io.Writer
+}
+
+// Decommission decommissions the nodes, and waits for their replicas to be moved to the other nodes. A
+// decommission which was interrupted is resumed by decommissioning the nodes again.
+func (c *NodeCLI) Decommission(ctx context.Context, podName string, nodeIDs ...int32) error {
+	return c.run(ctx, podName, append(append([]string{"node", "decommission"}, nodeArgs(nodeIDs)...), "--wait=all")...)
+}
+
+// StartDecommission marks the nodes as decommissioning, and returns without waiting for their replicas to be
+// moved. The decommission is finalized by Decommission once the nodes hold no replicas.
+func (c *NodeCLI) StartDecommission(ctx context.Context, podName string, nodeIDs ...int32) error {
+	return c.run(ctx, podName, append(append([]string{"node", "decommission"}, nodeArgs(nodeIDs)...), "--wait=none")...)
+}
+
+// Recommission cancels the decommission of the nodes which are still decommissioning.
+func (c *NodeCLI) Recommission(ctx context.Context, podName string, nodeIDs ...int32) error {
+	return c.run(ctx, podName, append([]string{"node", "recommission"}, nodeArgs(nodeIDs)...)...)
+}
+
+// Drain moves the leases of the node to the other nodes, and stops it from accepting SQL connections, so that
+// it can be restarted without disrupting the clients.
+func (c *NodeCLI) Drain(ctx context.Context, podName string, nodeID int32) error {
+	return c.run(ctx, podName, "node", "drain", strconv.Itoa(int(nodeID)))
+}
+
+func (c *NodeCLI) run(ctx context.Context, podName string, args ...string) error {
+	port := c.Port
+	if port == 0 {
+		port = CockroachDBSQLPort
+	}
+	command := append([]string{CockroachBinary}, args...)
+	command = append(command, fmt.Sprintf("--host=localhost:%d", port))
+	if c.Insecure {
+		command = append(command, "--insecure")
+	} else {
+		certsDir := c.CertsDir
+		if certsDir == "" {
+			certsDir = CertsDir
+		}
+		command = append(command, "--certs-dir="+certsDir)
+	}
+
+	out := c.Out
+	if out == nil {
+		out = io.Discard
+	}
+	var stderr bytes.Buffer
+	if err := c.Exec(ctx, podName, command, out, io.MultiWriter(out, &stderr)); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.Wrapf(err, "cockroach %s in pod %s: %s", strings.Join(args, " "), podName, msg)
+		}
+		return errors.Wrapf(err, "cockroach %s in pod %s", strings.Join(args, " "), podName)
+	}
+	return nil
+}
+
+func nodeArgs(nodeIDs []int32) []string {
+	args := make([]string, len(nodeIDs))
+	for i, id := range nodeIDs {
+		args[i] = strconv.Itoa(int(id))
+	}
+	return args
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type execCall struct {
+	pod     string
+	command []string
+}
+
+func TestNodeCLI(t *testing.T) {
+	var calls []execCall
+	exec := func(_ context.Context, pod string, command []string, stdout, _ io.Writer) error {
+		calls = append(calls, execCall{pod: pod, command: command})
+		_, _ = fmt.Fprintln(stdout, "ok")
+		return nil
+	}
+
+	var out bytes.Buffer
+	cli := &NodeCLI{Exec: exec, Out: &out}
+	require.NoError(t, cli.Decommission(context.Background(), "crdb-0", 4, 5))
+	require.NoError(t, cli.Drain(context.Background(), "crdb-1", 2))
+	require.NoError(t, cli.StartDecommission(context.Background(), "crdb-0", 6))
+
+	secure := &NodeCLI{Exec: exec, Port: 26258, Insecure: true}
+	require.NoError(t, secure.Recommission(context.Background(), "crdb-2", 4))
+
+	assert.Equal(t, []execCall{
+		{pod: "crdb-0", command: []string{"/cockroach/cockroach", "node", "decommission", "4", "5", "--wait=all", "--host=localhost:26257", "--certs-dir=/cockroach/cockroach-certs"}},
+		{pod: "crdb-1", command: []string{"/cockroach/cockroach", "node", "drain", "2", "--host=localhost:26257", "--certs-dir=/cockroach/cockroach-certs"}},
+		{pod: "crdb-0", command: []string{"/cockroach/cockroach", "node", "decommission", "6", "--wait=none", "--host=localhost:26257", "--certs-dir=/cockroach/cockroach-certs"}},
+		{pod: "crdb-2", command: []string{"/cockroach/cockroach", "node", "recommission", "4", "--host=localhost:26258", "--insecure"}},
+	}, calls)
+	assert.Equal(t, "ok\nok\nok\n", out.String())
+}
+
+func TestNodeCLIError(t *testing.T) {
+	exec := func(_ context.Context, _ string, _ []string, _, stderr io.Writer) error {
+		_, _ = fmt.Fprintln(stderr, "ERROR: node 7 does not exist")
+		return assert.AnError
+	}
+
+	cli := &NodeCLI{Exec: exec}
+	err := cli.Decommission(context.Background(), "crdb-0", 7)
+	require.ErrorIs(t, err, assert.AnError)
+	assert.Contains(t, err.Error(), "cockroach node decommission 7 --wait=all in pod crdb-0: ERROR: node 7 does not exist")
+}
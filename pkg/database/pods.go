@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// podResolver resolves the host of a connection to the ready pods of a StatefulSet, or of a label selector. The
+// pods are listed on each connection, so that pods being restarted are skipped, and returned in turn so that the
+// connections are spread across them. The connection falls back to the next pods if a pod can't be connected to.
+type podResolver struct {
+	client          client.Client
+	namespace       string
+	statefulSetName string
+	selector        labels.Selector
+	// podIPs resolves to the IPs of the pods, to connect to them directly from inside the cluster. The names of
+	// the pods are resolved otherwise, to be port-forwarded to by the PodDialer.
+	podIPs bool
+
+	mu   sync.Mutex
+	next int
+}
+
+// lookup returns the addresses of the ready pods, starting with a different pod on each call.
+func (r *podResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	pods, err := r.readyPods(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(pods) == 0 {
+		return nil, errors.Newf("no ready pod of %s", r.target())
+	}
+
+	r.mu.Lock()
+	start := r.next % len(pods)
+	r.next++
+	r.mu.Unlock()
+
+	addrs := make([]string, 0, len(pods))
+	for i := range pods {
+		pod := pods[(start+i)%len(pods)]
+		if r.podIPs {
+			addrs = append(addrs, pod.Status.PodIP)
+		} else {
+			addrs = append(addrs, pod.Name)
+		}
+	}
+	return addrs, nil
+}
+
+// readyPods lists the ready pods which are not being deleted, by name.
+func (r *podResolver) readyPods(ctx context.Context) ([]corev1.Pod, error) {
+	selector := r.selector
+	if r.statefulSetName != "" {
+		var sts appsv1.StatefulSet
+		if err := r.client.Get(ctx, types.NamespacedName{Name: r.statefulSetName, Namespace: r.namespace}, &sts); err != nil {
+			return nil, errors.Wrapf(err, "getting statefulset %s", r.statefulSetName)
+		}
+		var err error
+		if selector, err = metav1.LabelSelectorAsSelector(sts.Spec.Selector); err != nil {
+			return nil, errors.Wrapf(err, "parsing the selector of statefulset %s", r.statefulSetName)
+		}
+	}
+
+	var podList corev1.PodList
+	if err := r.client.List(ctx, &podList, client.InNamespace(r.namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, errors.Wrapf(err, "listing pods of %s", r.target())
+	}
+
+	var pods []corev1.Pod
+	for _, pod := range podList.Items {
+		if pod.DeletionTimestamp == nil && podReady(pod) && (!r.podIPs || pod.Status.PodIP != "") {
+			pods = append(pods, pod)
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods, nil
+}
+
+func (r *podResolver) target() string {
+	if r.statefulSetName != "" {
+		return "statefulset " + r.statefulSetName
+	}
+	return "selector " + r.selector.String()
+}
+
+func podReady(pod corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func testPod(name, ip string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "crdb"}},
+		Status: corev1.PodStatus{
+			PodIP:      ip,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func newPodsTestClient() client.Client {
+	return fakeclient.NewClientBuilder().WithObjects(
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "crdb", Namespace: "default"},
+			Spec:       appsv1.StatefulSetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "crdb"}}},
+		},
+		testPod("crdb-0", "10.0.0.1", true),
+		// The pod is being restarted.
+		testPod("crdb-1", "10.0.0.2", false),
+		testPod("crdb-2", "10.0.0.3", true),
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"}},
+	).Build()
+}
+
+func TestPodResolver(t *testing.T) {
+	ctx := context.Background()
+	cl := newPodsTestClient()
+
+	r := &podResolver{client: cl, namespace: "default", statefulSetName: "crdb"}
+	addrs, err := r.lookup(ctx, "crdb-public")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"crdb-0", "crdb-2"}, addrs)
+	// The next connection starts with the next pod.
+	addrs, err = r.lookup(ctx, "crdb-public")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"crdb-2", "crdb-0"}, addrs)
+
+	r = &podResolver{client: cl, namespace: "default", selector: labels.SelectorFromSet(labels.Set{"app": "crdb"}), podIPs: true}
+	addrs, err = r.lookup(ctx, "crdb-public")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.3"}, addrs)
+
+	r = &podResolver{client: cl, namespace: "default", selector: labels.SelectorFromSet(labels.Set{"app": "missing"})}
+	_, err = r.lookup(ctx, "crdb-public")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no ready pod of selector app=missing")
+}
+
+func TestConnectionFailsOver(t *testing.T) {
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, &net.OpError{Op: "dial", Net: network, Err: assert.AnError}
+	}
+	c := dbConfig{
+		Host:           "crdb-public",
+		User:           RootSQLUser,
+		ConnectTimeout: time.Second,
+		DialFunc:       &dial,
+		LookupFunc:     lookupFunc,
+		Resolver:       &podResolver{client: newPodsTestClient(), namespace: "default", statefulSetName: "crdb"},
+	}
+
+	db, err := c.openDB()
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Every ready pod is tried before the connection fails.
+	require.Error(t, db.PingContext(context.Background()))
+	assert.Equal(t, []string{"crdb-0:26257", "crdb-2:26257"}, dialed)
+}
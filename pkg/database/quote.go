@@ -0,0 +1,8 @@
+package database
+
+import "strings"
+
+// QuoteLiteral quotes a value as a SQL string literal.
+func QuoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// StatefulSetConnection is the connection of the commands of the migration helper to the ready pods of a
+// StatefulSet, as the root user.
+type StatefulSetConnection struct {
+	StatefulSetName string
+	Namespace       string
+	SQLPort         int32
+	// ClientSecret is the secret of the client certificate of the root user, and of the CA. The cluster is
+	// connected to insecurely if it is empty.
+	ClientSecret string
+	// InCluster connects to the pods directly, rather than through a port-forward to the pods.
+	InCluster bool
+	// PortForward is the protocol of the port-forward to the pods, when not in cluster.
+	PortForward kube.PortForwardProtocol
+}
+
+// KubeClient returns the config of the Kubernetes cluster, read from the kubeconfig file unless InCluster is
+// set, and a client of the cluster.
+func (c StatefulSetConnection) KubeClient(kubeconfig string) (*rest.Config, client.Client, error) {
+	var config *rest.Config
+	var err error
+	if c.InCluster {
+		config, err = rest.InClusterConfig()
+	} else {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "building k8s config")
+	}
+	cl, err := client.New(config, client.Options{})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "building k8s client")
+	}
+	return config, cl, nil
+}
+
+// DBConnection returns the DBConnection to the ready pods of the StatefulSet.
+func (c StatefulSetConnection) DBConnection(ctx context.Context, cl client.Client, config *rest.Config) *DBConnection {
+	port := c.SQLPort
+	return &DBConnection{
+		Ctx:                         ctx,
+		Client:                      cl,
+		RestConfig:                  config,
+		StatefulSetName:             c.StatefulSetName,
+		Namespace:                   c.Namespace,
+		Port:                        &port,
+		RunningInsideK8s:            c.InCluster,
+		PortForwardProtocol:         c.PortForward,
+		UseSSL:                      c.ClientSecret != "",
+		ClientCertificateSecretName: c.ClientSecret,
+		RootCertificateSecretName:   c.ClientSecret,
+		ApplicationName:             "migration-helper",
+	}
+}
+
+// Connect connects to the Kubernetes cluster, and to the ready pods of the StatefulSet.
+func (c StatefulSetConnection) Connect(ctx context.Context, kubeconfig string) (*rest.Config, client.Client, *sql.DB, error) {
+	config, cl, err := c.KubeClient(kubeconfig)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	db, err := NewDbConnection(c.DBConnection(ctx, cl, config))
+	if err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "connecting to statefulset %s", c.StatefulSetName)
+	}
+	return config, cl, db, nil
+}
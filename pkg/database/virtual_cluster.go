@@ -0,0 +1,184 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgx/v4"
+)
+
+// SystemVirtualCluster is the virtual cluster which manages the other virtual clusters of a
+// virtualized cluster. It is the only virtual cluster of a cluster which isn't virtualized.
+const SystemVirtualCluster = "system"
+
+// VirtualizationMode is the physical cluster replication (PCR) role of a cluster.
+type VirtualizationMode string
+
+const (
+	// VirtualizationDisabled is a cluster which serves no application virtual cluster.
+	VirtualizationDisabled VirtualizationMode = "disabled"
+	// VirtualizationPrimary is a cluster which serves an application virtual cluster, which may be
+	// replicated to a standby cluster.
+	VirtualizationPrimary VirtualizationMode = "primary"
+	// VirtualizationStandby is a cluster which replicates an application virtual cluster from a
+	// primary cluster.
+	VirtualizationStandby VirtualizationMode = "standby"
+)
+
+// Data states and service modes of SHOW VIRTUAL CLUSTERS.
+const (
+	dataStateReady       = "ready"
+	dataStateReplicating = "replicating"
+	serviceModeNone      = "none"
+)
+
+// replicatingStatus is the status of a healthy replication stream.
+const replicatingStatus = "replicating"
+
+// VirtualCluster is a virtual cluster as listed by SHOW VIRTUAL CLUSTERS.
+type VirtualCluster struct {
+	ID          int64
+	Name        string
+	DataState   string
+	ServiceMode string
+}
+
+// Virtualization is the virtualization setup of a cluster.
+type Virtualization struct {
+	Mode VirtualizationMode
+	// VirtualCluster is the application virtual cluster served by the primary, or replicated
+	// by the standby.
+	VirtualCluster string
+}
+
+// ReplicationStatus is the state of the replication stream of a standby virtual cluster, as listed
+// by SHOW VIRTUAL CLUSTER ... WITH REPLICATION STATUS.
+type ReplicationStatus struct {
+	VirtualCluster string
+	// SourceVirtualCluster is the virtual cluster of the primary cluster being replicated.
+	SourceVirtualCluster string
+	Status               string
+	// ReplicatedTime is the time up to which the data of the primary was replicated.
+	ReplicatedTime time.Time
+}
+
+// ShowVirtualClusters lists the virtual clusters of the cluster. The connection must be made to
+// the system virtual cluster.
+func ShowVirtualClusters(ctx context.Context, db *sql.DB) ([]VirtualCluster, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, name, data_state, service_mode FROM [SHOW VIRTUAL CLUSTERS]")
+	if err != nil {
+		return nil, errors.Wrap(err, "listing virtual clusters")
+	}
+	defer rows.Close()
+
+	var clusters []VirtualCluster
+	for rows.Next() {
+		var c VirtualCluster
+		if err := rows.Scan(&c.ID, &c.Name, &c.DataState, &c.ServiceMode); err != nil {
+			return nil, errors.Wrap(err, "scanning virtual cluster")
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, errors.Wrap(rows.Err(), "listing virtual clusters")
+}
+
+// ShowReplicationStatus returns the state of the replication stream of the given standby virtual
+// cluster. The connection must be made to the system virtual cluster of the standby cluster.
+//
+// The columns of the statement were renamed across CockroachDB versions, so they are looked up by
+// name rather than by position.
+func ShowReplicationStatus(ctx context.Context, db *sql.DB, virtualCluster string) (ReplicationStatus, error) {
+	status := ReplicationStatus{VirtualCluster: virtualCluster}
+
+	query := fmt.Sprintf("SHOW VIRTUAL CLUSTER %s WITH REPLICATION STATUS", pgx.Identifier{virtualCluster}.Sanitize())
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return status, errors.Wrapf(err, "fetching replication status of virtual cluster %s", virtualCluster)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return status, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return status, err
+		}
+		return status, errors.Newf("virtual cluster %s not found", virtualCluster)
+	}
+
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return status, errors.Wrap(err, "scanning replication status")
+	}
+
+	for i, column := range columns {
+		switch column {
+		case "source_tenant_name", "source_virtual_cluster":
+			status.SourceVirtualCluster = stringValue(values[i])
+		case "status":
+			status.Status = stringValue(values[i])
+		case "replicated_time":
+			if t, ok := values[i].(time.Time); ok {
+				status.ReplicatedTime = t
+			}
+		}
+	}
+	return status, nil
+}
+
+// DetectVirtualization returns the PCR role of a cluster from its virtual clusters. A cluster with
+// a virtual cluster being replicated is a standby, while a cluster serving an application virtual
+// cluster is a primary.
+//
+// A standby initialized with --virtualized-empty which doesn't replicate yet can't be told apart
+// from a cluster which isn't virtualized, both are reported as disabled.
+func DetectVirtualization(clusters []VirtualCluster) Virtualization {
+	for _, c := range clusters {
+		if c.Name != SystemVirtualCluster && c.DataState == dataStateReplicating {
+			return Virtualization{Mode: VirtualizationStandby, VirtualCluster: c.Name}
+		}
+	}
+	for _, c := range clusters {
+		if c.Name != SystemVirtualCluster && c.DataState == dataStateReady && c.ServiceMode != serviceModeNone {
+			return Virtualization{Mode: VirtualizationPrimary, VirtualCluster: c.Name}
+		}
+	}
+	return Virtualization{Mode: VirtualizationDisabled}
+}
+
+// Healthy returns an error if the replication stream is not running, or if the replicated time
+// lags behind the given time by more than maxLag.
+func (s ReplicationStatus) Healthy(now time.Time, maxLag time.Duration) error {
+	if s.Status != replicatingStatus {
+		return errors.Newf("replication of virtual cluster %s is %q", s.VirtualCluster, s.Status)
+	}
+	if s.ReplicatedTime.IsZero() {
+		return errors.Newf("virtual cluster %s has not replicated any data yet", s.VirtualCluster)
+	}
+	if lag := now.Sub(s.ReplicatedTime); lag > maxLag {
+		return errors.Newf("replication of virtual cluster %s lags by %s, more than %s", s.VirtualCluster, lag.Round(time.Second), maxLag)
+	}
+	return nil
+}
+
+func stringValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectVirtualization(t *testing.T) {
+	system := VirtualCluster{ID: 1, Name: SystemVirtualCluster, DataState: dataStateReady, ServiceMode: "shared"}
+
+	tests := []struct {
+		name     string
+		clusters []VirtualCluster
+		expected Virtualization
+	}{
+		{
+			name:     "not virtualized",
+			clusters: []VirtualCluster{system},
+			expected: Virtualization{Mode: VirtualizationDisabled},
+		},
+		{
+			name:     "primary",
+			clusters: []VirtualCluster{system, {ID: 3, Name: "main", DataState: dataStateReady, ServiceMode: "shared"}},
+			expected: Virtualization{Mode: VirtualizationPrimary, VirtualCluster: "main"},
+		},
+		{
+			name: "standby",
+			clusters: []VirtualCluster{
+				system,
+				{ID: 2, Name: "template", DataState: dataStateReady, ServiceMode: serviceModeNone},
+				{ID: 3, Name: "main", DataState: dataStateReplicating, ServiceMode: serviceModeNone},
+			},
+			expected: Virtualization{Mode: VirtualizationStandby, VirtualCluster: "main"},
+		},
+		{
+			name:     "stopped virtual cluster",
+			clusters: []VirtualCluster{system, {ID: 3, Name: "main", DataState: dataStateReady, ServiceMode: serviceModeNone}},
+			expected: Virtualization{Mode: VirtualizationDisabled},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, DetectVirtualization(tt.clusters))
+		})
+	}
+}
+
+func TestReplicationStatusHealthy(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	status := ReplicationStatus{VirtualCluster: "main", Status: replicatingStatus, ReplicatedTime: now.Add(-10 * time.Second)}
+	require.NoError(t, status.Healthy(now, time.Minute))
+
+	err := status.Healthy(now, 5*time.Second)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "lags by 10s")
+
+	status.Status = "replication paused"
+	require.Error(t, status.Healthy(now, time.Minute))
+
+	require.Error(t, ReplicationStatus{VirtualCluster: "main", Status: replicatingStatus}.Healthy(now, time.Minute))
+}
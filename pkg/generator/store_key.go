@@ -0,0 +1,232 @@
+/*
+Copyright 2021 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package generator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+	"github.com/cockroachdb/helm-charts/pkg/resource"
+	"github.com/cockroachdb/helm-charts/pkg/security"
+)
+
+// plainStoreKey is the key of the --enterprise-encryption spec of a store which is not encrypted yet.
+const plainStoreKey = "plain"
+
+// GenerateStoreKey is the structure containing all the encryption at rest store key related info. The current
+// store key is kept in KeySecret and the previous one in OldKeySecret, both under the resource.StoreKeyData key.
+// Until the first rotation, OldKeySecret holds the current store key as well, so that the nodes can run with the
+// old key path before rotating.
+type GenerateStoreKey struct {
+	client       client.Client
+	KeySecret    string
+	OldKeySecret string
+	KeySize      int
+	Duration     time.Duration
+	// Rotate rotates the store key when IsRotationRequired reports it for CronSchedule, or unconditionally when
+	// CronSchedule is empty.
+	Rotate       bool
+	CronSchedule string
+	// StorePath, KeyPath and OldKeyPath are the store directory and the paths the secrets are mounted at in the
+	// cockroachdb pods, which make up the --enterprise-encryption spec.
+	StorePath  string
+	KeyPath    string
+	OldKeyPath string
+	// StatefulSetName is the statefulset whose pods must run with the spec before a rotation.
+	StatefulSetName string
+	// Restart restarts the statefulset after a rotation.
+	Restart          bool
+	ReadinessWait    time.Duration
+	PodUpdateTimeout time.Duration
+}
+
+func NewGenerateStoreKey(cl client.Client) GenerateStoreKey {
+	return GenerateStoreKey{client: cl}
+}
+
+// Do generates the store key if it doesn't exist, or rotates it, and returns the --enterprise-encryption spec the
+// cockroachdb nodes must run with.
+func (g *GenerateStoreKey) Do(ctx context.Context, namespace string) (string, error) {
+	logrus.SetLevel(logrus.InfoLevel)
+
+	r := resource.NewKubeResource(ctx, g.client, namespace, kube.DefaultPersister)
+
+	secret, err := resource.LoadStoreKeySecret(g.KeySecret, r)
+	if client.IgnoreNotFound(err) != nil {
+		return "", errors.Wrap(err, "failed to get store key secret")
+	}
+
+	oldSecret, err := resource.LoadStoreKeySecret(g.OldKeySecret, r)
+	if client.IgnoreNotFound(err) != nil {
+		return "", errors.Wrap(err, "failed to get old store key secret")
+	}
+
+	// The nodes can only switch to the old key path once the old store key secret holds a key.
+	if secret.Ready() && !oldSecret.Ready() {
+		if err := g.copyStoreKey(secret, oldSecret); err != nil {
+			return "", err
+		}
+	}
+
+	switch {
+	case !secret.Ready():
+		if err := g.generate(secret); err != nil {
+			return "", err
+		}
+		if err := g.copyStoreKey(secret, oldSecret); err != nil {
+			return "", err
+		}
+		// The store may not be encrypted yet, so the nodes first start with a plain old key.
+		return g.spec(plainStoreKey), nil
+	case g.Rotate:
+		if g.CronSchedule != "" {
+			isRequired, reason := secret.IsRotationRequired(g.Duration, g.CronSchedule)
+			if !isRequired {
+				logrus.Infof("Store key secret [%s] doesn't need to be rotated", g.KeySecret)
+				return g.spec(g.OldKeyPath), nil
+			}
+			logrus.Infof("Store key: %s", reason)
+		}
+
+		if err := g.checkPods(ctx, namespace, secret); err != nil {
+			return "", err
+		}
+
+		if err := g.copyStoreKey(secret, oldSecret); err != nil {
+			return "", err
+		}
+		if err := g.generate(secret); err != nil {
+			return "", err
+		}
+
+		if g.Restart {
+			if err := kube.RollingUpdate(ctx, g.client, g.StatefulSetName, namespace, g.ReadinessWait, g.PodUpdateTimeout); err != nil {
+				return "", err
+			}
+		}
+	default:
+		logrus.Infof("Store key secret [%s] is found in ready state, skipping store key generation", g.KeySecret)
+	}
+
+	return g.spec(g.OldKeyPath), nil
+}
+
+// checkPods returns an error unless every pod of the statefulset runs with the spec printed after a rotation, and
+// was started with the current store key, which becomes the old key. Otherwise a node restarted after the rotation
+// would find its active store key in neither key file, and fail to start.
+func (g *GenerateStoreKey) checkPods(ctx context.Context, namespace string, secret *resource.StoreKeySecret) error {
+	if g.StatefulSetName == "" {
+		return errors.New("the statefulset is required to rotate the store key")
+	}
+
+	validFrom, err := time.Parse(time.RFC3339, secret.Secret().Annotations[resource.CertValidFrom])
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse the %s annotation of secret [%s]", resource.CertValidFrom, g.KeySecret)
+	}
+
+	var sts appsv1.StatefulSet
+	if err := g.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: g.StatefulSetName}, &sts); err != nil {
+		return errors.Wrapf(err, "failed to get statefulset [%s]", g.StatefulSetName)
+	}
+
+	spec := g.spec(g.OldKeyPath)
+	if !hasArg(sts.Spec.Template.Spec.Containers, spec) {
+		return errors.Errorf("statefulset [%s] doesn't run with %s, update it before rotating the store key",
+			g.StatefulSetName, spec)
+	}
+
+	for i := int32(0); i < sts.Status.Replicas; i++ {
+		name := g.StatefulSetName + "-" + strconv.Itoa(int(i))
+		var pod corev1.Pod
+		if err := g.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &pod); err != nil {
+			return errors.Wrapf(err, "failed to get pod [%s]", name)
+		}
+		if !hasArg(pod.Spec.Containers, spec) {
+			return errors.Errorf("pod [%s] doesn't run with %s, restart it before rotating the store key", name, spec)
+		}
+		if pod.Status.StartTime == nil || pod.Status.StartTime.Time.Before(validFrom) {
+			return errors.Errorf("pod [%s] was not restarted since the store key was generated at %s, restart it "+
+				"before rotating the store key", name, validFrom.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// hasArg reports whether one of the containers runs with the argument, passed on its own or within a shell
+// command.
+func hasArg(containers []corev1.Container, arg string) bool {
+	for _, c := range containers {
+		for _, s := range append(append([]string{}, c.Command...), c.Args...) {
+			for _, field := range strings.Fields(s) {
+				if field == arg {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// copyStoreKey copies the current store key into the old store key secret.
+func (g *GenerateStoreKey) copyStoreKey(secret, oldSecret *resource.StoreKeySecret) error {
+	if err := oldSecret.UpdateStoreKey(secret.StoreKey(), secret.Secret().Annotations); err != nil {
+		return errors.Wrap(err, "failed to update old store key secret")
+	}
+	logrus.Infof("Copied the store key into secret [%s]", g.OldKeySecret)
+	return nil
+}
+
+// generate generates a new store key and stores it in the secret.
+func (g *GenerateStoreKey) generate(secret *resource.StoreKeySecret) error {
+	key, err := security.GenerateStoreKey(g.KeySize)
+	if err != nil {
+		return err
+	}
+
+	id, err := security.StoreKeyID(key)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	annotations := resource.GetSecretAnnotations(now.Format(time.RFC3339), now.Add(g.Duration).Format(time.RFC3339),
+		g.Duration.String())
+	annotations[resource.StoreKeyID] = id
+
+	if err := secret.UpdateStoreKey(key, annotations); err != nil {
+		return errors.Wrap(err, "failed to update store key secret")
+	}
+
+	logrus.Infof("Generated and saved store key [%s] in secret [%s]", id, g.KeySecret)
+	return nil
+}
+
+// spec returns the --enterprise-encryption spec of the store.
+func (g *GenerateStoreKey) spec(oldKey string) string {
+	return fmt.Sprintf("--enterprise-encryption=path=%s,key=%s,old-key=%s", g.StorePath, g.KeyPath, oldKey)
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2021 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package generator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+	"github.com/cockroachdb/helm-charts/pkg/resource"
+	"github.com/cockroachdb/helm-charts/pkg/testutils"
+)
+
+func TestGenerateStoreKey(t *testing.T) {
+	ctx := context.TODO()
+	namespace := "test-namespace"
+	cl := testutils.NewFakeClient(testutils.InitScheme(t))
+	r := resource.NewKubeResource(ctx, cl, namespace, kube.DefaultPersister)
+
+	g := NewGenerateStoreKey(cl)
+	g.KeySecret = "crdb-store-key"
+	g.OldKeySecret = "crdb-old-store-key"
+	g.KeySize = 256
+	g.Duration = 24 * time.Hour
+	g.StorePath = "cockroach-data"
+	g.KeyPath = "/cockroach/store-key/StoreKeyData"
+	g.OldKeyPath = "/cockroach/old-store-key/StoreKeyData"
+
+	load := func(name string) *resource.StoreKeySecret {
+		secret, err := resource.LoadStoreKeySecret(name, r)
+		require.NoError(t, err)
+		return secret
+	}
+
+	// The first key encrypts a plain store, and is copied into the old key secret so that the nodes can switch to
+	// the old key path.
+	spec, err := g.Do(ctx, namespace)
+	require.NoError(t, err)
+	assert.Equal(t, "--enterprise-encryption=path=cockroach-data,key=/cockroach/store-key/StoreKeyData,old-key=plain", spec)
+	first := load(g.KeySecret)
+	assert.Len(t, first.StoreKey(), 64)
+	assert.True(t, first.ValidateAnnotations())
+	assert.Equal(t, first.StoreKey(), load(g.OldKeySecret).StoreKey())
+
+	rotated := "--enterprise-encryption=path=cockroach-data,key=/cockroach/store-key/StoreKeyData," +
+		"old-key=/cockroach/old-store-key/StoreKeyData"
+	spec, err = g.Do(ctx, namespace)
+	require.NoError(t, err)
+	assert.Equal(t, rotated, spec)
+	assert.Equal(t, first.StoreKey(), load(g.KeySecret).StoreKey())
+
+	// A cron running before the key expires doesn't rotate it.
+	g.Rotate = true
+	g.CronSchedule = "@every 1h"
+	_, err = g.Do(ctx, namespace)
+	require.NoError(t, err)
+	assert.Equal(t, first.StoreKey(), load(g.KeySecret).StoreKey())
+
+	// The key isn't rotated unless the pods run with the old key path and were started with the current key.
+	g.CronSchedule = ""
+	_, err = g.Do(ctx, namespace)
+	require.ErrorContains(t, err, "the statefulset is required")
+
+	g.StatefulSetName = "crdb"
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "crdb", Namespace: namespace},
+		Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "db", Args: []string{"shell", "exec /cockroach/cockroach start " +
+				"--enterprise-encryption=path=cockroach-data,key=/cockroach/store-key/StoreKeyData,old-key=plain"}}},
+		}}},
+		Status: appsv1.StatefulSetStatus{Replicas: 1},
+	}
+	require.NoError(t, cl.Create(ctx, sts))
+	_, err = g.Do(ctx, namespace)
+	require.ErrorContains(t, err, "statefulset [crdb] doesn't run with "+rotated)
+
+	sts.Spec.Template.Spec.Containers[0].Args[1] = "exec /cockroach/cockroach start " + rotated
+	require.NoError(t, cl.Update(ctx, sts))
+	startPod := func(at time.Time) {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "crdb-0", Namespace: namespace},
+			Spec:       sts.Spec.Template.Spec,
+			Status:     corev1.PodStatus{StartTime: &metav1.Time{Time: at}},
+		}
+		require.NoError(t, client.IgnoreNotFound(cl.Delete(ctx, pod)))
+		require.NoError(t, cl.Create(ctx, pod))
+	}
+	startPod(time.Now().Add(-time.Hour))
+	_, err = g.Do(ctx, namespace)
+	require.ErrorContains(t, err, "pod [crdb-0] was not restarted since the store key was generated")
+	assert.Equal(t, first.StoreKey(), load(g.KeySecret).StoreKey())
+
+	// Rotating copies the key into the old key secret.
+	startPod(time.Now().Add(time.Minute))
+	spec, err = g.Do(ctx, namespace)
+	require.NoError(t, err)
+	assert.Equal(t, rotated, spec)
+
+	old, current := load(g.OldKeySecret), load(g.KeySecret)
+	assert.Equal(t, first.StoreKey(), old.StoreKey())
+	assert.Equal(t, first.Secret().Annotations[resource.StoreKeyID], old.Secret().Annotations[resource.StoreKeyID])
+	assert.NotEqual(t, first.StoreKey(), current.StoreKey())
+	assert.NotEqual(t, first.Secret().Annotations[resource.StoreKeyID], current.Secret().Annotations[resource.StoreKeyID])
+
+	// A cron running after the key expires rotates it, once the pods were restarted with the new key.
+	g.CronSchedule = "@every 48h"
+	startPod(time.Now().Add(-time.Hour))
+	_, err = g.Do(ctx, namespace)
+	require.ErrorContains(t, err, "pod [crdb-0] was not restarted")
+
+	startPod(time.Now().Add(2 * time.Minute))
+	_, err = g.Do(ctx, namespace)
+	require.NoError(t, err)
+	assert.Equal(t, current.StoreKey(), load(g.OldKeySecret).StoreKey())
+}
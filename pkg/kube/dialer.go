@@ -7,10 +7,14 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/httpstream"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -18,35 +22,86 @@ import (
 	"k8s.io/client-go/transport/spdy"
 )
 
+// errorStreamTimeout bounds the wait for the error stream of a closed connection, in case the pod never closes it.
+const errorStreamTimeout = 5 * time.Second
+
+// ErrPodDialerClosed is returned by the dials of a closed PodDialer.
+var ErrPodDialerClosed = errors.New("pod dialer is closed")
+
+// PortForwardProtocol is the protocol of the port-forward connections to the pods.
+type PortForwardProtocol string
+
+const (
+	// PortForwardWebSocketWithFallback tunnels the connections over a WebSocket, and falls back to SPDY if the API
+	// server, or a proxy in front of it, doesn't upgrade the request to a WebSocket. It is the default.
+	PortForwardWebSocketWithFallback PortForwardProtocol = "websocket-fallback"
+	// PortForwardWebSocket tunnels the connections over a WebSocket.
+	PortForwardWebSocket PortForwardProtocol = "websocket"
+	// PortForwardSPDY upgrades the connections to SPDY.
+	PortForwardSPDY PortForwardProtocol = "spdy"
+)
+
+// PortForwardProtocols are the supported port-forward protocols.
+var PortForwardProtocols = []PortForwardProtocol{PortForwardWebSocketWithFallback, PortForwardWebSocket, PortForwardSPDY}
+
 // PodDialer uses kubernetes' portforwarding protocol to create a net.Conn
-// to a pod in the given kubernetes clusters
+// to a pod in the given kubernetes clusters.
+//
+// The connections to a pod are multiplexed as pairs of streams over a single SPDY connection, which is
+// re-created when the pod is recreated or when the connection is lost. The SPDY connection is tunneled over a
+// WebSocket depending on the Protocol. Close tears down every connection.
 type PodDialer struct {
 	Namespace string
 	Config    *rest.Config
 	ClientSet kubernetes.Interface
+	Protocol  PortForwardProtocol
+	// Transport and Upgrader upgrade the SPDY connections which aren't tunneled over a WebSocket.
 	Transport http.RoundTripper
 	Upgrader  spdy.Upgrader
 
 	mu             sync.Mutex
 	requestCounter int
-	dialers        map[string]httpstream.Dialer
+	conns          map[string]*podStreamConn
+	closed         bool
+}
+
+// podStreamConn is the SPDY connection to a pod.
+type podStreamConn struct {
+	httpstream.Connection
+	// uid is the UID of the pod the connection was made to.
+	uid types.UID
 }
 
 // NewPodDialer creates a PodDailer that allows for a database connection to flow
-// through a connection created by a kube-proxy like connection.
-func NewPodDialer(config *rest.Config, namespace string) (*PodDialer, error) {
+// through a connection created by a kube-proxy like connection. The protocol defaults to
+// PortForwardWebSocketWithFallback.
+func NewPodDialer(config *rest.Config, namespace string, protocol PortForwardProtocol) (*PodDialer, error) {
+	switch protocol {
+	case "":
+		protocol = PortForwardWebSocketWithFallback
+	case PortForwardWebSocketWithFallback, PortForwardWebSocket, PortForwardSPDY:
+	default:
+		return nil, fmt.Errorf("unsupported port-forward protocol %q, expected one of %v", protocol, PortForwardProtocols)
+	}
+
 	transport, upgrader, err := spdy.RoundTripperFor(config)
 	if err != nil {
 		return nil, err
 	}
 
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
 	return &PodDialer{
 		Config:    config,
 		Namespace: namespace,
-		ClientSet: kubernetes.NewForConfigOrDie(config),
+		ClientSet: clientSet,
+		Protocol:  protocol,
 		Transport: transport,
 		Upgrader:  upgrader,
-		dialers:   make(map[string]httpstream.Dialer),
+		conns:     make(map[string]*podStreamConn),
 	}, nil
 }
 
@@ -57,57 +112,175 @@ func (k *PodDialer) nextRequestID() int {
 	return k.requestCounter
 }
 
-func (d *PodDialer) dialerForPod(podName string) httpstream.Dialer {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// connForPod returns the SPDY connection to the pod, reusing the cached one if it was made to the same pod and
+// is still open.
+func (k *PodDialer) connForPod(ctx context.Context, podName string) (*podStreamConn, error) {
+	pod, err := k.ClientSet.CoreV1().Pods(k.Namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
 
-	// Reuse any dialers that are already created
-	if dialer, ok := d.dialers[podName]; ok {
-		return dialer
+	k.mu.Lock()
+	if k.closed {
+		k.mu.Unlock()
+		return nil, ErrPodDialerClosed
+	}
+	if conn, ok := k.conns[podName]; ok {
+		if conn.uid == pod.UID && !isClosed(conn) {
+			k.mu.Unlock()
+			return conn, nil
+		}
+		// The pod was recreated, or the connection was lost.
+		delete(k.conns, podName)
+		_ = conn.Close()
 	}
+	k.mu.Unlock()
 
-	podShortName := strings.Split(podName, ".")
+	conn, err := k.connect(ctx, podName)
+	if err != nil {
+		return nil, err
+	}
+	streamConn := &podStreamConn{Connection: conn, uid: pod.UID}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed {
+		_ = conn.Close()
+		return nil, ErrPodDialerClosed
+	}
+	if existing, ok := k.conns[podName]; ok && existing.uid == pod.UID && !isClosed(existing) {
+		// Another dial connected to the pod in the meantime.
+		_ = conn.Close()
+		return existing, nil
+	}
+	k.conns[podName] = streamConn
+	go k.evictOnClose(podName, streamConn)
+	return streamConn, nil
+}
 
+// connect opens a SPDY connection to the portforward subresource of the pod. The connection is closed if the
+// context is done before it is established.
+func (k *PodDialer) connect(ctx context.Context, podName string) (httpstream.Connection, error) {
 	// Build a raw request so we can extract the URL
-	req := d.ClientSet.CoreV1().RESTClient().Post().
+	req := k.ClientSet.CoreV1().RESTClient().Post().
 		Resource("pods").
-		Namespace(d.Namespace).
-		Name(podShortName[0]).
+		Namespace(k.Namespace).
+		Name(podName).
 		SubResource("portforward")
 
-	dialer := spdy.NewDialer(d.Upgrader, &http.Client{Transport: d.Transport}, "POST", req.URL())
+	dialer, err := k.dialerFor(req.URL())
+	if err != nil {
+		return nil, err
+	}
 
-	d.dialers[podName] = dialer
+	type result struct {
+		conn httpstream.Connection
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+		done <- result{conn: conn, err: err}
+	}()
 
-	return dialer
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
 }
 
-func (k *PodDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	return k.Dial(network, addr)
+// dialerFor returns the dialer of the SPDY connections to the portforward URL of a pod, for the protocol.
+func (k *PodDialer) dialerFor(portForwardURL *url.URL) (httpstream.Dialer, error) {
+	spdyDialer := spdy.NewDialer(k.Upgrader, &http.Client{Transport: k.Transport}, "POST", portForwardURL)
+	if k.Protocol == PortForwardSPDY {
+		return spdyDialer, nil
+	}
+
+	websocketDialer, err := portforward.NewSPDYOverWebsocketDialer(portForwardURL, k.Config)
+	if err != nil {
+		return nil, err
+	}
+	if k.Protocol == PortForwardWebSocket {
+		return websocketDialer, nil
+	}
+	// The request isn't upgraded by API servers which don't support the WebSocket protocol, nor by proxies which
+	// don't support WebSockets.
+	return portforward.NewFallbackDialer(websocketDialer, spdyDialer, httpstream.IsUpgradeFailure), nil
 }
 
-// Dial connects to a port in a kubernetes pod specified by addr. network must be TCP
+// evictOnClose removes the connection from the cache once it is closed.
+func (k *PodDialer) evictOnClose(podName string, conn *podStreamConn) {
+	<-conn.CloseChan()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.conns[podName] == conn {
+		delete(k.conns, podName)
+	}
+}
+
+func isClosed(conn httpstream.Connection) bool {
+	select {
+	case <-conn.CloseChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// DialContext connects to a port in a kubernetes pod specified by addr. network must be TCP. The dial is
+// abandoned when the context is done.
+//
 // Implmentation adapted from:
 //
 //	https://github.com/kubernetes/kubernetes/blob/27c70773add99e43464a4e525e3bddfc8b602a3d/staging/src/k8s.io/client-go/tools/portforward/portforward.go
 //	https://github.com/kubernetes/kubernetes/blob/27c70773add99e43464a4e525e3bddfc8b602a3d/staging/src/k8s.io/kubectl/pkg/cmd/portforward/portforward.go
-func (k *PodDialer) Dial(network, addr string) (net.Conn, error) {
+func (k *PodDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	if network != "tcp" {
 		return nil, errors.New("only tcp networks are currently supported")
 	}
 
-	podName, port, err := net.SplitHostPort(addr)
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
+	podName := strings.Split(host, ".")[0]
 
-	dialer := k.dialerForPod(podName)
-
-	streamConn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	streamConn, err := k.connForPod(ctx, podName)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := k.openStreams(streamConn, podName, port)
+	if err != nil && isClosed(streamConn) {
+		// The cached connection was lost since it was checked, retry with a new connection.
+		if streamConn, err = k.connForPod(ctx, podName); err != nil {
+			return nil, err
+		}
+		conn, err = k.openStreams(streamConn, podName, port)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if err := ctx.Err(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Dial connects to a port in a kubernetes pod specified by addr. network must be TCP
+func (k *PodDialer) Dial(network, addr string) (net.Conn, error) {
+	return k.DialContext(context.Background(), network, addr)
+}
 
+// openStreams creates the error and data streams of a new connection to the port of the pod.
+func (k *PodDialer) openStreams(streamConn *podStreamConn, podName, port string) (net.Conn, error) {
 	requestID := k.nextRequestID()
 
 	headers := http.Header{}
@@ -123,13 +296,14 @@ func (k *PodDialer) Dial(network, addr string) (net.Conn, error) {
 	// we're not writing to this stream
 	_ = errStream.Close()
 
-	errorChan := make(chan error)
+	// The channel is buffered, so that the reader never blocks if the connection is never closed.
+	errorChan := make(chan error, 1)
 	go func() {
 		message, err := io.ReadAll(errStream)
-		if err != nil {
+		switch {
+		case err != nil:
 			errorChan <- err
-		}
-		if len(message) > 0 {
+		case len(message) > 0:
 			errorChan <- fmt.Errorf("%s", message)
 		}
 		close(errorChan)
@@ -139,6 +313,7 @@ func (k *PodDialer) Dial(network, addr string) (net.Conn, error) {
 	headers.Set(corev1.StreamType, corev1.StreamTypeData)
 	dataStream, err := streamConn.CreateStream(headers)
 	if err != nil {
+		streamConn.RemoveStreams(errStream)
 		return nil, err
 	}
 
@@ -146,33 +321,67 @@ func (k *PodDialer) Dial(network, addr string) (net.Conn, error) {
 	// We're leaving open the option to use other transports as long as they implement net.Conn as well.
 	if conn, ok := dataStream.(net.Conn); ok {
 		return &podConn{
-			Conn:      conn,
-			PodName:   podName,
-			Port:      port,
-			errorChan: errorChan,
+			Conn:       conn,
+			PodName:    podName,
+			Port:       port,
+			errorChan:  errorChan,
+			streamConn: streamConn,
+			streams:    []httpstream.Stream{errStream, dataStream},
 		}, nil
 	}
 
 	// Ignore error from Close() as we're just trying to clean up
 	_ = dataStream.Close()
+	streamConn.RemoveStreams(errStream, dataStream)
 
 	return nil, errors.New("datastream does not implement net.Conn")
 }
 
+// Close closes the connections to every pod, along with the connections dialed through them. Dials fail once
+// the dialer is closed.
+func (k *PodDialer) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.closed = true
+
+	var errs []error
+	for podName, conn := range k.conns {
+		if err := conn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(k.conns, podName)
+	}
+	return errors.Join(errs...)
+}
+
 type podConn struct {
 	net.Conn
 
-	errorChan <-chan error
+	errorChan  <-chan error
+	streamConn httpstream.Connection
+	streams    []httpstream.Stream
+	closeOnce  sync.Once
+	closeErr   error
 
 	PodName string
 	Port    string
 }
 
 func (c *podConn) Close() error {
-	if err := c.Conn.Close(); err != nil {
-		return err
-	}
+	c.closeOnce.Do(func() {
+		defer c.streamConn.RemoveStreams(c.streams...)
 
-	// Ensure that this connection hasn't terminated abnormally
-	return <-c.errorChan
+		if err := c.Conn.Close(); err != nil {
+			c.closeErr = err
+			return
+		}
+
+		// Ensure that this connection hasn't terminated abnormally
+		select {
+		case c.closeErr = <-c.errorChan:
+		case <-c.streamConn.CloseChan():
+		case <-time.After(errorStreamTimeout):
+		}
+	})
+	return c.closeErr
 }
@@ -0,0 +1,262 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gwebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	constants "k8s.io/apimachinery/pkg/util/portforward"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+)
+
+// failingPort is the port on which the fake API server reports an error for the connection.
+const failingPort = "666"
+
+// fakePortForwardServer is an API server serving the pods, and their portforward subresource which echoes the
+// data of each connection.
+type fakePortForwardServer struct {
+	*httptest.Server
+
+	// websocket accepts the SPDY connections tunneled over a WebSocket. Only SPDY upgrades are accepted otherwise,
+	// as by API servers older than 1.30.
+	websocket bool
+	uid       atomic.Value
+	// upgrades and websocketUpgrades count the connections upgraded to SPDY, and the ones tunneled over a
+	// WebSocket.
+	upgrades          atomic.Int32
+	websocketUpgrades atomic.Int32
+	// block holds the upgrades until it is closed, if set.
+	block chan struct{}
+}
+
+func newFakePortForwardServer(t *testing.T) *fakePortForwardServer {
+	s := &fakePortForwardServer{}
+	s.uid.Store(types.UID("uid-1"))
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakePortForwardServer) serve(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/api/v1/namespaces/default/pods/")
+	if !strings.HasSuffix(name, "/portforward") {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: s.uid.Load().(types.UID)},
+		})
+		return
+	}
+	if s.block != nil {
+		<-s.block
+	}
+
+	switch {
+	case req.Method == http.MethodGet && s.websocket && httpstream.IsUpgradeRequest(req):
+		upgrader := gwebsocket.Upgrader{Subprotocols: []string{constants.WebsocketsSPDYTunnelingPortForwardV1}}
+		wsConn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer wsConn.Close() //nolint:errcheck
+		s.websocketUpgrades.Add(1)
+		conn, err := spdy.NewServerConnection(portforward.NewTunnelingConnection("server", wsConn), s.newStreamHandler())
+		if err != nil {
+			return
+		}
+		<-conn.CloseChan()
+	case req.Method == http.MethodPost:
+		if _, err := httpstream.Handshake(req, w, []string{portforward.PortForwardProtocolV1Name}); err != nil {
+			return
+		}
+		s.upgrades.Add(1)
+		conn := spdy.NewResponseUpgrader().UpgradeResponse(w, req, s.newStreamHandler())
+		if conn != nil {
+			<-conn.CloseChan()
+		}
+	default:
+		http.Error(w, "upgrade request required", http.StatusBadRequest)
+	}
+}
+
+// newStreamHandler pairs the error and data streams of each connection, and echoes the data stream.
+func (s *fakePortForwardServer) newStreamHandler() httpstream.NewStreamHandler {
+	var mu sync.Mutex
+	errStreams := map[string]httpstream.Stream{}
+	return func(stream httpstream.Stream, _ <-chan struct{}) error {
+		requestID := stream.Headers().Get(corev1.PortForwardRequestIDHeader)
+		mu.Lock()
+		defer mu.Unlock()
+		if stream.Headers().Get(corev1.StreamType) == corev1.StreamTypeError {
+			errStreams[requestID] = stream
+			return nil
+		}
+		errStream := errStreams[requestID]
+		go func() {
+			if stream.Headers().Get(corev1.PortHeader) == failingPort {
+				_, _ = errStream.Write([]byte("connection refused"))
+			} else {
+				_, _ = io.Copy(stream, stream)
+			}
+			_ = stream.Close()
+			_ = errStream.Close()
+		}()
+		return nil
+	}
+}
+
+func newTestPodDialer(t *testing.T, s *fakePortForwardServer, protocol PortForwardProtocol) *PodDialer {
+	d, err := NewPodDialer(&rest.Config{Host: s.URL}, "default", protocol)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = d.Close() })
+	return d
+}
+
+func echo(t *testing.T, d *PodDialer, addr string) {
+	conn, err := d.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	require.NoError(t, conn.Close())
+}
+
+func TestPodDialerMultiplexesConnections(t *testing.T) {
+	s := newFakePortForwardServer(t)
+	d := newTestPodDialer(t, s, PortForwardSPDY)
+
+	echo(t, d, "crdb-0.crdb.default:26257")
+	echo(t, d, "crdb-0:26257")
+	assert.Equal(t, int32(1), s.upgrades.Load())
+
+	// Another pod gets its own connection.
+	echo(t, d, "crdb-1:26257")
+	assert.Equal(t, int32(2), s.upgrades.Load())
+}
+
+func TestPodDialerReconnectsToRecreatedPod(t *testing.T) {
+	s := newFakePortForwardServer(t)
+	d := newTestPodDialer(t, s, PortForwardSPDY)
+
+	echo(t, d, "crdb-0:26257")
+	d.mu.Lock()
+	old := d.conns["crdb-0"]
+	d.mu.Unlock()
+
+	s.uid.Store(types.UID("uid-2"))
+	echo(t, d, "crdb-0:26257")
+	assert.Equal(t, int32(2), s.upgrades.Load())
+	assert.True(t, isClosed(old))
+}
+
+func TestPodDialerReportsConnectionErrors(t *testing.T) {
+	s := newFakePortForwardServer(t)
+	d := newTestPodDialer(t, s, PortForwardSPDY)
+
+	conn, err := d.Dial("tcp", "crdb-0:"+failingPort)
+	require.NoError(t, err)
+	err = conn.Close()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "connection refused")
+	// Closing again doesn't block.
+	assert.Equal(t, err, conn.Close())
+
+	_, err = d.Dial("udp", "crdb-0:26257")
+	assert.Error(t, err)
+}
+
+func TestPodDialerClose(t *testing.T) {
+	s := newFakePortForwardServer(t)
+	d := newTestPodDialer(t, s, PortForwardSPDY)
+
+	conn, err := d.Dial("tcp", "crdb-0:26257")
+	require.NoError(t, err)
+
+	require.NoError(t, d.Close())
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Empty(t, d.conns)
+
+	_, err = d.Dial("tcp", "crdb-0:26257")
+	assert.ErrorIs(t, err, ErrPodDialerClosed)
+}
+
+func TestPodDialerDialContextCancellation(t *testing.T) {
+	s := newFakePortForwardServer(t)
+	s.block = make(chan struct{})
+	d := newTestPodDialer(t, s, PortForwardSPDY)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := d.DialContext(ctx, "tcp", "crdb-0:26257")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The upgrade completing late doesn't leave a connection behind.
+	close(s.block)
+	assert.Eventually(t, func() bool { return s.upgrades.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	d.mu.Lock()
+	assert.Empty(t, d.conns)
+	d.mu.Unlock()
+
+	echo(t, d, "crdb-0:26257")
+}
+
+func TestPodDialerProtocols(t *testing.T) {
+	tests := []struct {
+		name      string
+		protocol  PortForwardProtocol
+		websocket bool
+		// upgrades and websocketUpgrades are the expected connections of each protocol.
+		upgrades          int32
+		websocketUpgrades int32
+		wantErr           bool
+	}{
+		{name: "websocket", protocol: PortForwardWebSocket, websocket: true, websocketUpgrades: 1},
+		{name: "websocket unsupported", protocol: PortForwardWebSocket, wantErr: true},
+		{name: "spdy", protocol: PortForwardSPDY, websocket: true, upgrades: 1},
+		{name: "fallback to websocket", protocol: PortForwardWebSocketWithFallback, websocket: true, websocketUpgrades: 1},
+		{name: "fallback to spdy", protocol: PortForwardWebSocketWithFallback, upgrades: 1},
+		{name: "default", websocket: true, websocketUpgrades: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakePortForwardServer(t)
+			s.websocket = tt.websocket
+			d := newTestPodDialer(t, s, tt.protocol)
+
+			if tt.wantErr {
+				_, err := d.Dial("tcp", "crdb-0:26257")
+				assert.True(t, httpstream.IsUpgradeFailure(err), "unexpected error %v", err)
+				return
+			}
+			echo(t, d, "crdb-0:26257")
+			echo(t, d, "crdb-0:26257")
+			// Another port is forwarded over the same connection.
+			echo(t, d, "crdb-0:8080")
+			assert.Equal(t, tt.upgrades, s.upgrades.Load())
+			assert.Equal(t, tt.websocketUpgrades, s.websocketUpgrades.Load())
+		})
+	}
+
+	_, err := NewPodDialer(&rest.Config{}, "default", "http3")
+	assert.ErrorContains(t, err, `unsupported port-forward protocol "http3"`)
+}
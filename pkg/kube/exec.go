@@ -0,0 +1,91 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// PodExecutor runs commands in the containers of pods, as kubectl exec does. The commands are streamed over a
+// WebSocket, or over SPDY, depending on the Protocol.
+type PodExecutor struct {
+	Namespace string
+	Config    *rest.Config
+	ClientSet kubernetes.Interface
+	Protocol  PortForwardProtocol
+}
+
+// NewPodExecutor creates a PodExecutor for the pods of the namespace. The protocol defaults to
+// PortForwardWebSocketWithFallback.
+func NewPodExecutor(config *rest.Config, namespace string, protocol PortForwardProtocol) (*PodExecutor, error) {
+	switch protocol {
+	case "":
+		protocol = PortForwardWebSocketWithFallback
+	case PortForwardWebSocketWithFallback, PortForwardWebSocket, PortForwardSPDY:
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q, expected one of %v", protocol, PortForwardProtocols)
+	}
+
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PodExecutor{
+		Namespace: namespace,
+		Config:    config,
+		ClientSet: clientSet,
+		Protocol:  protocol,
+	}, nil
+}
+
+// Exec runs the command in the container of the pod, and copies its output to stdout and stderr. It returns an
+// error if the command exits with a non-zero status.
+func (e *PodExecutor) Exec(ctx context.Context, podName, container string, command []string, stdout, stderr io.Writer) error {
+	req := e.ClientSet.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(e.Namespace).
+		Name(podName).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    stdout != nil,
+			Stderr:    stderr != nil,
+		}, scheme.ParameterCodec)
+
+	executor, err := e.executorFor(req)
+	if err != nil {
+		return err
+	}
+	if err := executor.StreamWithContext(ctx, remotecommand.StreamOptions{Stdout: stdout, Stderr: stderr}); err != nil {
+		return fmt.Errorf("running %v in pod %s: %w", command, podName, err)
+	}
+	return nil
+}
+
+func (e *PodExecutor) executorFor(req *rest.Request) (remotecommand.Executor, error) {
+	spdyExecutor, err := remotecommand.NewSPDYExecutor(e.Config, "POST", req.URL())
+	if err != nil {
+		return nil, err
+	}
+	if e.Protocol == PortForwardSPDY {
+		return spdyExecutor, nil
+	}
+
+	websocketExecutor, err := remotecommand.NewWebSocketExecutor(e.Config, "GET", req.URL().String())
+	if err != nil {
+		return nil, err
+	}
+	if e.Protocol == PortForwardWebSocket {
+		return websocketExecutor, nil
+	}
+	return remotecommand.NewFallbackExecutor(websocketExecutor, spdyExecutor, httpstream.IsUpgradeFailure)
+}
@@ -27,8 +27,10 @@ import (
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	ctrlutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -153,24 +155,101 @@ func RollingUpdate(ctx context.Context, cl client.Client, stsName, namespace str
 	return nil
 }
 
-func WaitForPodReady(ctx context.Context, cl client.Client, name, namespace string, podUpdateTimeout,
-	podMaxPollingInterval time.Duration) error {
-	f := func() error {
+// PodGetter gets a pod by name.
+type PodGetter func(ctx context.Context, name string) (*corev1.Pod, error)
+
+// ClientPods returns a PodGetter of the namespace backed by a controller-runtime client.
+func ClientPods(cl client.Client, namespace string) PodGetter {
+	return func(ctx context.Context, name string) (*corev1.Pod, error) {
 		var pod corev1.Pod
 		if err := cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &pod); err != nil {
+			return nil, err
+		}
+		return &pod, nil
+	}
+}
+
+// ClientsetPods returns a PodGetter of the namespace backed by a clientset.
+func ClientsetPods(clientset kubernetes.Interface, namespace string) PodGetter {
+	return func(ctx context.Context, name string) (*corev1.Pod, error) {
+		return clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+}
+
+func WaitForPodReady(ctx context.Context, cl client.Client, name, namespace string, podUpdateTimeout,
+	podMaxPollingInterval time.Duration) error {
+	return WaitForPodReadyWith(ctx, ClientPods(cl, namespace), name, podUpdateTimeout, podMaxPollingInterval)
+}
+
+// WaitForPodReadyWith waits until the pod is running and ready, and isn't being deleted.
+func WaitForPodReadyWith(ctx context.Context, pods PodGetter, name string, podUpdateTimeout,
+	podMaxPollingInterval time.Duration) error {
+	return Retry(ctx, podUpdateTimeout, podMaxPollingInterval, func() error {
+		pod, err := pods(ctx, name)
+		if err != nil {
 			return err
 		}
 
-		if pod.Status.Phase == corev1.PodPending || !IsPodReady(&pod) {
+		if pod.Status.Phase == corev1.PodPending || pod.DeletionTimestamp != nil || !IsPodReady(pod) {
 			return fmt.Errorf("Pod %s not in ready state", name)
 		}
 
 		logrus.Infof("Pod %s in ready state now", name)
 		return nil
-	}
+	})
+}
+
+// WaitForPodDeleted waits until the pod is not found.
+func WaitForPodDeleted(ctx context.Context, pods PodGetter, name string, podUpdateTimeout,
+	podMaxPollingInterval time.Duration) error {
+	return Retry(ctx, podUpdateTimeout, podMaxPollingInterval, func() error {
+		_, err := pods(ctx, name)
+		if apierrors.IsNotFound(err) {
+			logrus.Infof("Pod %s is deleted", name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Pod %s is not deleted yet", name)
+	})
+}
+
+// WaitForDeleted waits until the object is not found.
+func WaitForDeleted(ctx context.Context, cl client.Client, obj client.Object, timeout,
+	maxPollingInterval time.Duration) error {
+	return Retry(ctx, timeout, maxPollingInterval, func() error {
+		err := cl.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%T %s is not deleted yet", obj, obj.GetName())
+	})
+}
 
+// Retry calls f with an exponential backoff capped at maxPollingInterval, until it succeeds, the timeout elapses
+// or the context is done.
+func Retry(ctx context.Context, timeout, maxPollingInterval time.Duration, f func() error) error {
 	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = podUpdateTimeout
-	b.MaxInterval = podMaxPollingInterval
-	return backoff.Retry(f, b)
+	b.MaxElapsedTime = timeout
+	b.MaxInterval = maxPollingInterval
+	if b.InitialInterval > maxPollingInterval {
+		b.InitialInterval = maxPollingInterval
+	}
+	return backoff.Retry(f, backoff.WithContext(b, ctx))
+}
+
+// Sleep waits for the duration, or until the context is done.
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
@@ -3,9 +3,8 @@ package migrate
 import (
 	"context"
 	"fmt"
-	"path/filepath"
-	"strings"
 
+	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -26,6 +25,13 @@ type Manifest struct {
 	outputDir     string
 	clientset     kubernetes.Interface
 	dynamicClient dynamic.Interface
+	// newPCRInspector connects to the running cluster to read its PCR state. The PCR mode is detected from
+	// the init job only if it is nil.
+	newPCRInspector func(ctx context.Context, sts *appsv1.StatefulSet, input parsedMigrationInput) (pcrInspector, error)
+	// pcr is the PCR state of the cluster, detected once.
+	pcr *pcrState
+	// pcrPeer is the other cluster of a PCR pair migrated along with this one.
+	pcrPeer string
 }
 
 // NewManifest constructs a Manifest with required fields and functional options
@@ -56,12 +62,16 @@ func NewManifest(cloudProvider, cloudRegion, kubeconfig, objectName, namespace,
 		outputDir:     outputDir,
 		clientset:     clientset,
 		dynamicClient: dynamicClient,
+		newPCRInspector: func(ctx context.Context, sts *appsv1.StatefulSet, input parsedMigrationInput) (pcrInspector, error) {
+			return newSQLPCRInspector(ctx, config, sts.Namespace, sts.Name, input.sqlPort, input.clientSecretName)
+		},
 	}, nil
 }
 
 func (m *Manifest) FromPublicOperator() error {
 	var crdbCluster string
 	ctx := context.TODO()
+	out := &outputFiles{dir: m.outputDir}
 
 	publicCluster := publicv1.CrdbCluster{}
 	gvr := schema.GroupVersionResource{
@@ -83,15 +93,36 @@ func (m *Manifest) FromPublicOperator() error {
 		return errors.Wrap(err, "fetching statefulset")
 	}
 
+	if err := backupPublicOperatorForRollback(ctx, m.clientset, publicCluster, sts, out); err != nil {
+		return errors.Wrap(err, "backing up resources for rollback")
+	}
+
 	if publicCluster.Spec.LogConfigMap != "" {
 		if err := moveConfigMapKey(ctx, m.clientset, m.namespace, publicCluster.Spec.LogConfigMap); err != nil {
 			return errors.Wrap(err, "moving config map key")
 		}
 	}
-	input := parsedMigrationInput{tlsEnabled: publicCluster.Spec.TLSEnabled}
-	if err := extractJoinStringAndFlags(&input, strings.Fields(sts.Spec.Template.Spec.Containers[0].Command[2])); err != nil {
+	podSpec, err := generatePodSpecInput(sts)
+	if err != nil {
+		return err
+	}
+	input := parsedMigrationInput{tlsEnabled: publicCluster.Spec.TLSEnabled, podSpec: podSpec}
+	args, err := cockroachStartArgs(podSpec.container)
+	if err != nil {
+		return err
+	}
+	if err := extractJoinStringAndFlags(&input, args, containerEnv(podSpec.container)); err != nil {
 		return errors.Wrap(err, "extracting join string and flags")
 	}
+	if err := mapStoreFlags(ctx, m.clientset, sts, &input); err != nil {
+		return errors.Wrap(err, "mapping store flags")
+	}
+	if err := mapVolumeClaimTemplates(sts, &input); err != nil {
+		return err
+	}
+
+	helmValues := buildHelmValuesFromOperator(publicCluster, sts, m.cloudProvider, m.cloudRegion, m.namespace, input)
+	notMigrated := mapPublicOperatorSpec(publicCluster, &helmValues, &input)
 
 	for nodeIdx := int32(0); nodeIdx < publicCluster.Spec.Nodes; nodeIdx++ {
 		podName := fmt.Sprintf("%s-%d", crdbCluster, nodeIdx)
@@ -104,7 +135,7 @@ func (m *Manifest) FromPublicOperator() error {
 			return errors.Newf("pod %s isn't scheduled to a node", podName)
 		}
 
-		nodeSpec := buildNodeSpecFromOperator(publicCluster, sts, pod.Spec.NodeName, input.startFlags)
+		nodeSpec := buildNodeSpecFromOperator(publicCluster, sts, pod.Spec.NodeName, podName, input)
 		crdbNode := v1alpha1.CrdbNode{
 			TypeMeta: metav1.TypeMeta{
 				Kind:       "CrdbNode",
@@ -126,52 +157,101 @@ func (m *Manifest) FromPublicOperator() error {
 			},
 			Spec: nodeSpec,
 		}
-		if err := yamlToDisk(filepath.Join(m.outputDir, fmt.Sprintf("crdbnode-%d.yaml", nodeIdx)), []any{crdbNode}); err != nil {
+		if err := out.write(fmt.Sprintf("crdbnode-%d.yaml", nodeIdx), []any{crdbNode}); err != nil {
 			return errors.Wrap(err, "writing crdbnode manifest to disk")
 		}
 	}
 
-	helmValues := buildHelmValuesFromOperator(publicCluster, sts, m.cloudProvider, m.cloudRegion, m.namespace, input.startFlags)
-
-	if err := yamlToDisk(filepath.Join(m.outputDir, "values.yaml"), []any{helmValues}); err != nil {
+	if err := validateHelmValues(helmValues); err != nil {
+		return errors.Wrap(err, "validating helm values")
+	}
+	if err := out.write("values.yaml", []any{helmValues}); err != nil {
 		return errors.Wrap(err, "writing helm values to disk")
 	}
 
-	if err := buildRBACFromPublicOperator(publicCluster, m.outputDir); err != nil {
+	if err := buildRBACFromPublicOperator(publicCluster, out); err != nil {
 		return errors.Wrap(err, "building rbac from public operator")
 	}
 
+	if len(notMigrated) > 0 {
+		if err := out.write(notMigratedYaml, []any{notMigrated}); err != nil {
+			return errors.Wrap(err, "writing not migrated fields to disk")
+		}
+	}
+
+	warnings := append(migrationWarnings(input), notMigratedWarnings(notMigrated)...)
+	printWarnings(warnings)
+
+	report := newPublicOperatorReport(publicCluster, sts, input, warnings)
+	if err := writeMigrationReport(out, report); err != nil {
+		return errors.Wrap(err, "writing migration report")
+	}
+
 	return nil
 }
 
-func (m *Manifest) FromHelmChart() error {
+// FromHelmChartPCRPair generates the manifests of both clusters of a physical cluster replication (PCR) setup
+// deployed via the Helm chart. The clusters must be the primary and the standby of the same replication
+// stream, which must be healthy, before any manifest is generated.
+func (m *Manifest) FromHelmChartPCRPair(peer *Manifest) error {
 	ctx := context.TODO()
 
-	sts, err := m.clientset.AppsV1().StatefulSets(m.namespace).Get(ctx, m.objectName, metav1.GetOptions{})
-	if err != nil {
-		return errors.Wrap(err, "fetching statefulset")
+	// Each side is parsed once, parsing creates the log ConfigMap and copies the store keys.
+	var (
+		statefulSets []*appsv1.StatefulSet
+		inputs       []parsedMigrationInput
+		states       []pcrState
+	)
+	for _, side := range []*Manifest{m, peer} {
+		sts, input, err := side.helmChartInput(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "reading statefulset %s/%s", side.namespace, side.objectName)
+		}
+		statefulSets = append(statefulSets, sts)
+		inputs = append(inputs, input)
+		states = append(states, side.helmChartPCR(ctx, sts, input))
+	}
+	if err := validatePCRPair(states[0], states[1]); err != nil {
+		return errors.Wrap(err, "validating PCR pair")
 	}
 
-	input, err := generateParsedMigrationInput(ctx, m.clientset, sts)
-	if err != nil {
+	m.pcrPeer = fmt.Sprintf("%s/%s", peer.namespace, peer.objectName)
+	peer.pcrPeer = fmt.Sprintf("%s/%s", m.namespace, m.objectName)
+	if err := m.helmChartManifests(ctx, statefulSets[0], inputs[0], states[0]); err != nil {
 		return err
 	}
+	return errors.Wrap(peer.helmChartManifests(ctx, statefulSets[1], inputs[1], states[1]), "building manifests of the PCR peer")
+}
 
-	if err := certificatesInput(ctx, m.dynamicClient, &input, sts); err != nil {
+func (m *Manifest) FromHelmChart() error {
+	ctx := context.TODO()
+
+	sts, input, err := m.helmChartInput(ctx)
+	if err != nil {
 		return err
 	}
+	return m.helmChartManifests(ctx, sts, input, m.helmChartPCR(ctx, sts, input))
+}
+
+// helmChartManifests writes the manifests of the StatefulSet deployed via the Helm chart from its parsed input.
+func (m *Manifest) helmChartManifests(ctx context.Context, sts *appsv1.StatefulSet, input parsedMigrationInput, pcr pcrState) error {
+	out := &outputFiles{dir: m.outputDir}
+
+	if err := backupForRollback(ctx, m.clientset, sts, input, out); err != nil {
+		return errors.Wrap(err, "backing up resources for rollback")
+	}
 
 	if input.certManagerInput != nil {
-		if err := backupCAIssuerAndCert(ctx, m.dynamicClient, sts, m.outputDir); err != nil {
+		if err := backupCAIssuerAndCert(ctx, m.dynamicClient, sts, out); err != nil {
 			return errors.Wrap(err, "backing up CA issuer and cert")
 		}
 	}
 
-	if err := generateUpdatedPublicServiceConfig(ctx, m.clientset, sts.Namespace, fmt.Sprintf("%s-public", sts.Name), m.outputDir); err != nil {
+	if err := generateUpdatedPublicServiceConfig(ctx, m.clientset, sts.Namespace, fmt.Sprintf("%s-public", sts.Name), out); err != nil {
 		return err
 	}
 
-	input.pcrSpec = detectPCRFromInitJob(m.clientset, sts.Name, m.namespace)
+	input.pcrSpec = pcr.spec
 	for nodeIdx := int32(0); nodeIdx < *sts.Spec.Replicas; nodeIdx++ {
 		podName := fmt.Sprintf("%s-%d", sts.Name, nodeIdx)
 		pod, err := m.clientset.CoreV1().Pods(m.namespace).Get(ctx, podName, metav1.GetOptions{})
@@ -183,7 +263,7 @@ func (m *Manifest) FromHelmChart() error {
 			return errors.Newf("pod %s isn't scheduled to a node", podName)
 		}
 
-		nodeSpec := buildNodeSpecFromHelm(sts, pod.Spec.NodeName, input)
+		nodeSpec := buildNodeSpecFromHelm(sts, pod.Spec.NodeName, podName, input)
 		crdbNode := v1alpha1.CrdbNode{
 			TypeMeta: metav1.TypeMeta{
 				Kind:       "CrdbNode",
@@ -205,14 +285,17 @@ func (m *Manifest) FromHelmChart() error {
 			},
 			Spec: nodeSpec,
 		}
-		if err := yamlToDisk(filepath.Join(m.outputDir, fmt.Sprintf("crdbnode-%d.yaml", nodeIdx)), []any{crdbNode}); err != nil {
+		if err := out.write(fmt.Sprintf("crdbnode-%d.yaml", nodeIdx), []any{crdbNode}); err != nil {
 			return errors.Wrap(err, "writing crdbnode manifest to disk")
 		}
 	}
 
 	newHelmValues := buildHelmValuesFromHelm(sts, m.cloudProvider, m.cloudRegion, m.namespace, input)
 
-	if err := yamlToDisk(filepath.Join(m.outputDir, "values.yaml"), []any{newHelmValues}); err != nil {
+	if err := validateHelmValues(newHelmValues); err != nil {
+		return errors.Wrap(err, "validating helm values")
+	}
+	if err := out.write("values.yaml", []any{newHelmValues}); err != nil {
 		return errors.Wrap(err, "writing helm values to disk")
 	}
 
@@ -224,5 +307,37 @@ func (m *Manifest) FromHelmChart() error {
 		fmt.Println("\n❗ If the required locality labels are missing from kubernetes nodes, the CockroachDB pods will not start.")
 	}
 
+	warnings := migrationWarnings(input)
+	if pcr.warning != "" {
+		warnings = append(warnings, pcr.warning)
+	}
+	printWarnings(warnings)
+
+	report := newHelmChartReport(sts, input, pcr, m.pcrPeer, warnings)
+	if err := writeMigrationReport(out, report); err != nil {
+		return errors.Wrap(err, "writing migration report")
+	}
+
 	return nil
 }
+
+// helmChartInput reads the StatefulSet deployed via the Helm chart and parses its migration input.
+func (m *Manifest) helmChartInput(ctx context.Context) (*appsv1.StatefulSet, parsedMigrationInput, error) {
+	sts, err := m.clientset.AppsV1().StatefulSets(m.namespace).Get(ctx, m.objectName, metav1.GetOptions{})
+	if err != nil {
+		return nil, parsedMigrationInput{}, errors.Wrap(err, "fetching statefulset")
+	}
+
+	input, err := generateParsedMigrationInput(ctx, m.clientset, sts)
+	if err != nil {
+		return nil, input, err
+	}
+
+	// Insecure clusters have no certificates to carry over.
+	if input.tlsEnabled {
+		if err := certificatesInput(ctx, m.dynamicClient, &input, sts); err != nil {
+			return nil, input, err
+		}
+	}
+	return sts, input, nil
+}
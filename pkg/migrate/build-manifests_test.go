@@ -7,7 +7,9 @@ import (
 	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	appsv1 "k8s.io/api/apps/v1"
@@ -28,15 +30,88 @@ func TestFromHelmChart(t *testing.T) {
 	// Setup fake Kubernetes client
 	clientset := fake.NewSimpleClientset()
 	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
-	ctx := context.TODO()
 	namespace := "default"
 	outputDir := t.TempDir()
 
+	sts := createHelmChartCluster(t, clientset, namespace)
+	// Create a Manifest instance
+	m := &Manifest{
+		cloudProvider: "gcp",
+		cloudRegion:   "us-central1",
+		objectName:    sts.Name,
+		namespace:     sts.Namespace,
+		outputDir:     outputDir,
+		clientset:     clientset,
+		dynamicClient: dynamicClient,
+	}
+
+	// Run the FromHelmChart function
+	err := m.FromHelmChart()
+	require.NoError(t, err)
+
+	// Validate generated files against golden files
+	validateGoldenFile(t, filepath.Join(outputDir, "values.yaml"), "testdata/helm/allInput/values.yaml.golden")
+	validateGoldenFile(t, filepath.Join(outputDir, migrationReportJSON), "testdata/helm/allInput/migration-report.json.golden")
+	for i := 0; i < 3; i++ {
+		validateGoldenFile(t, filepath.Join(outputDir, "crdbnode-"+strconv.Itoa(i)+".yaml"), "testdata/helm/allInput/crdbnode-"+strconv.Itoa(i)+".yaml.golden")
+	}
+}
+
+func TestFromHelmChartPCRPair(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	newManifest := func(namespace string, inspector *fakePCRInspector) *Manifest {
+		sts := createHelmChartCluster(t, clientset, namespace)
+		return &Manifest{
+			cloudProvider: "gcp",
+			cloudRegion:   "us-central1",
+			objectName:    sts.Name,
+			namespace:     namespace,
+			outputDir:     t.TempDir(),
+			clientset:     clientset,
+			dynamicClient: dynamicClient,
+			newPCRInspector: func(ctx context.Context, sts *appsv1.StatefulSet, input parsedMigrationInput) (pcrInspector, error) {
+				return inspector, nil
+			},
+		}
+	}
+	primary := newManifest("primary", primaryInspector())
+	standby := newManifest("standby", standbyInspector(time.Now()))
+
+	require.NoError(t, primary.FromHelmChartPCRPair(standby))
+
+	for _, tt := range []struct {
+		manifest *Manifest
+		mode     v1alpha1.CrdbVirtualClusterMode
+		peer     string
+	}{
+		{manifest: primary, mode: v1alpha1.VirtualClusterPrimary, peer: "standby/cockroachdb"},
+		{manifest: standby, mode: v1alpha1.VirtualClusterStandby, peer: "primary/cockroachdb"},
+	} {
+		report, err := readMigrationReport(tt.manifest.outputDir)
+		require.NoError(t, err)
+		require.NotNil(t, report)
+		require.NotNil(t, report.PCR)
+		assert.Equal(t, tt.mode, report.PCR.Mode)
+		assert.Equal(t, tt.peer, report.PCR.Peer)
+		assert.Equal(t, tt.manifest.namespace, report.Namespace)
+		_, err = os.Stat(filepath.Join(tt.manifest.outputDir, "crdbnode-2.yaml"))
+		assert.NoError(t, err)
+	}
+}
+
+// createHelmChartCluster creates the resources of the cluster deployed via the Helm chart in testdata in the
+// given namespace.
+func createHelmChartCluster(t *testing.T, clientset *fake.Clientset, namespace string) appsv1.StatefulSet {
+	ctx := context.TODO()
+
 	job := &batchv1.Job{}
 	manifestBytes, err := os.ReadFile("testdata/helm/allInput/cockroachdb-init.yaml")
 	require.NoError(t, err)
 	err = yaml.Unmarshal(manifestBytes, &job)
 	require.NoError(t, err)
+	job.Namespace = namespace
 	_, err = clientset.BatchV1().Jobs(namespace).Create(ctx, job, metav1.CreateOptions{})
 	require.NoError(t, err)
 
@@ -45,6 +120,7 @@ func TestFromHelmChart(t *testing.T) {
 	require.NoError(t, err)
 	err = yaml.Unmarshal(manifestBytes, &sts)
 	require.NoError(t, err)
+	sts.Namespace = namespace
 	// Create a StatefulSet
 	_, err = clientset.AppsV1().StatefulSets(namespace).Create(ctx, &sts, metav1.CreateOptions{})
 	require.NoError(t, err)
@@ -68,40 +144,22 @@ func TestFromHelmChart(t *testing.T) {
 	require.NoError(t, err)
 	err = yaml.Unmarshal(manifestBytes, &svc)
 	require.NoError(t, err)
+	svc.Namespace = namespace
 	_, err = clientset.CoreV1().Services(namespace).Create(ctx, svc, metav1.CreateOptions{})
 	require.NoError(t, err)
 	// Create the Logging Config Secret
 	loggingConfigSecret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "cockroachdb-log-config",
-			Namespace: sts.Namespace,
+			Namespace: namespace,
 		},
 		Immutable: nil,
 		Data:      map[string][]byte{"log-config.yaml": []byte("testdata")},
 	}
-
 	_, err = clientset.CoreV1().Secrets(namespace).Create(ctx, loggingConfigSecret, metav1.CreateOptions{})
 	require.NoError(t, err)
-	// Create a Manifest instance
-	m := &Manifest{
-		cloudProvider: "gcp",
-		cloudRegion:   "us-central1",
-		objectName:    sts.Name,
-		namespace:     sts.Namespace,
-		outputDir:     outputDir,
-		clientset:     clientset,
-		dynamicClient: dynamicClient,
-	}
-
-	// Run the FromHelmChart function
-	err = m.FromHelmChart()
-	require.NoError(t, err)
 
-	// Validate generated files against golden files
-	validateGoldenFile(t, filepath.Join(outputDir, "values.yaml"), "testdata/helm/allInput/values.yaml.golden")
-	for i := 0; i < 3; i++ {
-		validateGoldenFile(t, filepath.Join(outputDir, "crdbnode-"+strconv.Itoa(i)+".yaml"), "testdata/helm/allInput/crdbnode-"+strconv.Itoa(i)+".yaml.golden")
-	}
+	return sts
 }
 
 func TestFromOperator(t *testing.T) {
@@ -173,12 +231,17 @@ func TestFromOperator(t *testing.T) {
 		dynamicClient: dynamicClient,
 	}
 
+	// A file left in the output dir by an earlier run isn't listed in the migration report.
+	require.NoError(t, os.WriteFile(filepath.Join(outputDir, publicSvcYaml), []byte("stale"), 0644))
+
 	// Run FromPublicOperator
 	err = m.FromPublicOperator()
 	require.NoError(t, err)
 
 	// Validate generated files against golden files
 	validateGoldenFile(t, filepath.Join(outputDir, "values.yaml"), "testdata/operator/allInput/values.yaml.golden")
+	validateGoldenFile(t, filepath.Join(outputDir, notMigratedYaml), "testdata/operator/allInput/not-migrated.yaml.golden")
+	validateGoldenFile(t, filepath.Join(outputDir, migrationReportJSON), "testdata/operator/allInput/migration-report.json.golden")
 	for i := 0; i < 3; i++ {
 		validateGoldenFile(t, filepath.Join(outputDir, "crdbnode-"+strconv.Itoa(i)+".yaml"), "testdata/operator/allInput/crdbnode-"+strconv.Itoa(i)+".yaml.golden")
 	}
@@ -0,0 +1,421 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+	"github.com/cockroachdb/helm-charts/pkg/resource"
+	"github.com/cockroachdb/helm-charts/pkg/security"
+	certv1 "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// Chart defaults of the certificate durations. The self-signer rotates the certificates whose duration
+// annotation doesn't match its configured duration.
+const (
+	defaultCACertDuration     = 43800 * time.Hour
+	defaultNodeCertDuration   = 8760 * time.Hour
+	defaultClientCertDuration = 672 * time.Hour
+
+	// Expiry windows of the Certificates of the chart.
+	nodeCertExpiryWindow   = 168 * time.Hour
+	clientCertExpiryWindow = 48 * time.Hour
+)
+
+// ConvertCertsOptions configures the conversion of a Helm chart release between the self-signer and cert-manager
+// TLS modes.
+type ConvertCertsOptions struct {
+	StatefulSetName string
+	Namespace       string
+	// To is the TLS mode to convert to, either self-signer or cert-manager.
+	To string
+	// CASecret is the secret holding the CA key of the self-signer, found by matching the CA certificate if not set.
+	CASecret string
+	// IssuerName is the CA Issuer created with the CA of the self-signer.
+	IssuerName string
+	// NodeSecret and ClientSecret are the secrets of the Certificates created for cert-manager.
+	NodeSecret   string
+	ClientSecret string
+	// ClusterResourceNamespace is the namespace of the CA secrets of ClusterIssuers.
+	ClusterResourceNamespace string
+	ClusterDomain            string
+	// IssueTimeout is how long to wait for cert-manager to issue the Certificates.
+	IssueTimeout time.Duration
+	// CADuration, NodeDuration and ClientDuration are the durations configured for the self-signer.
+	CADuration     time.Duration
+	NodeDuration   time.Duration
+	ClientDuration time.Duration
+}
+
+// CertConverter converts the certificates of a running Helm chart release between the self-signer and cert-manager
+// TLS modes. The CA is kept, so that the nodes trust each other while the StatefulSet rolls to the new secrets.
+type CertConverter struct {
+	cl   client.Client
+	opts ConvertCertsOptions
+	// releaseName is the Helm release of the StatefulSet.
+	releaseName string
+}
+
+// NewCertConverter constructs a CertConverter for the StatefulSet of the options.
+func NewCertConverter(kubeconfig string, opts ConvertCertsOptions) (*CertConverter, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "building k8s config")
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := certv1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	cl, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, errors.Wrap(err, "building k8s client")
+	}
+
+	return newCertConverter(cl, opts), nil
+}
+
+func newCertConverter(cl client.Client, opts ConvertCertsOptions) *CertConverter {
+	name := opts.StatefulSetName
+	if opts.IssuerName == "" {
+		opts.IssuerName = fmt.Sprintf("%s-issuer", name)
+	}
+	if opts.NodeSecret == "" {
+		opts.NodeSecret = fmt.Sprintf("%s-node", name)
+	}
+	if opts.ClientSecret == "" {
+		opts.ClientSecret = fmt.Sprintf("%s-root", name)
+	}
+	if opts.ClusterDomain == "" {
+		opts.ClusterDomain = "cluster.local"
+	}
+	if opts.CADuration == 0 {
+		opts.CADuration = defaultCACertDuration
+	}
+	if opts.NodeDuration == 0 {
+		opts.NodeDuration = defaultNodeCertDuration
+	}
+	if opts.ClientDuration == 0 {
+		opts.ClientDuration = defaultClientCertDuration
+	}
+	return &CertConverter{cl: cl, opts: opts}
+}
+
+// Run converts the certificates and writes the values to upgrade the Helm release with to valuesFile.
+func (c *CertConverter) Run(ctx context.Context, valuesFile string) error {
+	values, err := c.convert(ctx)
+	if err != nil {
+		return err
+	}
+	if err := yamlToDisk(valuesFile, []any{values}); err != nil {
+		return errors.Wrapf(err, "writing %s", valuesFile)
+	}
+
+	fmt.Printf("✅ Created the %s certificates of statefulset %s.\n", c.opts.To, c.opts.StatefulSetName)
+	fmt.Println("Upgrade the helm release with the values written to", valuesFile)
+	fmt.Printf("helm upgrade %s cockroachdb/cockroachdb --namespace %s --reuse-values -f %s\n", c.releaseName, c.opts.Namespace, valuesFile)
+	return nil
+}
+
+// convert creates the CA, Issuer, Certificates or secrets of the target TLS mode, and returns the Helm values to
+// upgrade the release with.
+func (c *CertConverter) convert(ctx context.Context) (map[string]interface{}, error) {
+	var sts appsv1.StatefulSet
+	if err := c.cl.Get(ctx, types.NamespacedName{Name: c.opts.StatefulSetName, Namespace: c.opts.Namespace}, &sts); err != nil {
+		return nil, errors.Wrapf(err, "getting statefulset %s", c.opts.StatefulSetName)
+	}
+	c.releaseName = sts.Annotations[helmReleaseNameKey]
+	layout, err := detectCertificateLayout(c.cl, sts.Name, sts.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if layout.source != helmCertSource {
+		return nil, errors.Newf("statefulset %s isn't managed by helm", sts.Name)
+	}
+
+	var nodeSecret corev1.Secret
+	if err := c.cl.Get(ctx, types.NamespacedName{Name: layout.nodeSecret, Namespace: sts.Namespace}, &nodeSecret); err != nil {
+		return nil, errors.Wrapf(err, "getting node secret %s", layout.nodeSecret)
+	}
+	from := selfSignerCertificates
+	if nodeSecret.Annotations[certv1.CertificateNameKey] != "" {
+		from = certManagerCertificates
+	}
+
+	switch {
+	case c.opts.To == from:
+		return nil, errors.Newf("statefulset %s already uses %s certificates", sts.Name, from)
+	case c.opts.To == certManagerCertificates:
+		return c.toCertManager(ctx, sts, nodeSecret)
+	case c.opts.To == selfSignerCertificates:
+		return c.toSelfSigner(ctx, sts, layout, nodeSecret)
+	default:
+		return nil, errors.Newf("unsupported certificate mode %s, expected %s or %s", c.opts.To, selfSignerCertificates, certManagerCertificates)
+	}
+}
+
+// toCertManager imports the CA of the self-signer into a CA Issuer, and creates the node and client Certificates
+// of the chart. The Certificates are labelled for the Helm release, so that the upgrade adopts them.
+func (c *CertConverter) toCertManager(ctx context.Context, sts appsv1.StatefulSet, nodeSecret corev1.Secret) (map[string]interface{}, error) {
+	caSecretName, caKey, err := findCAKey(c.cl, sts.Namespace, c.opts.CASecret, nodeSecret.Data[resource.CaCert])
+	if err != nil {
+		return nil, err
+	}
+	if caKey == nil {
+		return nil, errors.Newf("the CA key of the node certificate isn't stored in namespace %s, pass its secret with --ca-secret", sts.Namespace)
+	}
+	var caSecret corev1.Secret
+	if err := c.cl.Get(ctx, types.NamespacedName{Name: caSecretName, Namespace: sts.Namespace}, &caSecret); err != nil {
+		return nil, errors.Wrapf(err, "getting CA secret %s", caSecretName)
+	}
+	caCert, err := caCertForKey(caSecret.Data[resource.CaCert], caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// A CA Issuer reads the CA from a TLS secret. ca.crt keeps the whole bundle, so that the certificates signed
+	// by a rotated CA stay trusted.
+	issuerSecret := &corev1.Secret{ObjectMeta: c.objectMeta(fmt.Sprintf("%s-ca", c.opts.IssuerName))}
+	if _, err := controllerutil.CreateOrUpdate(ctx, c.cl, issuerSecret, func() error {
+		issuerSecret.Type = corev1.SecretTypeTLS
+		issuerSecret.Data = map[string][]byte{
+			corev1.TLSCertKey:       caCert,
+			corev1.TLSPrivateKeyKey: caKey,
+			resource.CaCert:         caSecret.Data[resource.CaCert],
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "creating issuer secret %s", issuerSecret.Name)
+	}
+
+	issuer := &certv1.Issuer{ObjectMeta: c.objectMeta(c.opts.IssuerName)}
+	if _, err := controllerutil.CreateOrUpdate(ctx, c.cl, issuer, func() error {
+		issuer.Spec.CA = &certv1.CAIssuer{SecretName: issuerSecret.Name}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "creating issuer %s", issuer.Name)
+	}
+	logrus.Infof("Imported the CA of secret [%s] into Issuer [%s]", caSecretName, issuer.Name)
+
+	issuerRef := cmmeta.ObjectReference{Name: issuer.Name, Kind: certv1.IssuerKind, Group: "cert-manager.io"}
+	for _, certificate := range c.chartCertificates(sts, issuerRef) {
+		certificate := certificate
+		spec := certificate.Spec
+		if _, err := controllerutil.CreateOrUpdate(ctx, c.cl, &certificate, func() error {
+			certificate.Labels = c.helmLabels(sts, certificate.Labels)
+			certificate.Annotations = c.helmAnnotations(sts, certificate.Annotations)
+			certificate.Spec = spec
+			return nil
+		}); err != nil {
+			return nil, errors.Wrapf(err, "creating certificate %s", certificate.Name)
+		}
+		if err := waitForCertificate(c.cl, certificate, nil, nil, c.opts.IssueTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	return map[string]interface{}{
+		"tls": map[string]interface{}{
+			"certs": map[string]interface{}{
+				"selfSigner":  map[string]interface{}{"enabled": false},
+				"certManager": true,
+				"certManagerIssuer": map[string]interface{}{
+					"group":                  issuerRef.Group,
+					"kind":                   issuerRef.Kind,
+					"name":                   issuerRef.Name,
+					"isSelfSignedIssuer":     false,
+					"nodeCertDuration":       durationValue(c.opts.NodeDuration),
+					"nodeCertExpiryWindow":   durationValue(nodeCertExpiryWindow),
+					"clientCertDuration":     durationValue(c.opts.ClientDuration),
+					"clientCertExpiryWindow": durationValue(clientCertExpiryWindow),
+				},
+				"nodeSecret":       c.opts.NodeSecret,
+				"clientRootSecret": c.opts.ClientSecret,
+			},
+		},
+	}, nil
+}
+
+// chartCertificates returns the node and client Certificates rendered by the chart in cert-manager mode.
+func (c *CertConverter) chartCertificates(sts appsv1.StatefulSet, issuerRef cmmeta.ObjectReference) []certv1.Certificate {
+	name, namespace := sts.Name, sts.Namespace
+	clusterDomain := c.opts.ClusterDomain
+	subject := &certv1.X509Subject{Organizations: []string{"Cockroach"}}
+	privateKey := &certv1.CertificatePrivateKey{Algorithm: certv1.RSAKeyAlgorithm, Size: 2048}
+
+	return []certv1.Certificate{
+		{
+			ObjectMeta: c.objectMeta(fmt.Sprintf("%s-node", name)),
+			Spec: certv1.CertificateSpec{
+				Duration:    &metav1.Duration{Duration: c.opts.NodeDuration},
+				RenewBefore: &metav1.Duration{Duration: nodeCertExpiryWindow},
+				Usages:      []certv1.KeyUsage{certv1.UsageDigitalSignature, certv1.UsageKeyEncipherment, certv1.UsageServerAuth, certv1.UsageClientAuth},
+				PrivateKey:  privateKey,
+				CommonName:  "node",
+				Subject:     subject,
+				DNSNames: []string{
+					"localhost",
+					"127.0.0.1",
+					fmt.Sprintf("%s-public", name),
+					fmt.Sprintf("%s-public.%s", name, namespace),
+					fmt.Sprintf("%s-public.%s.svc.%s", name, namespace, clusterDomain),
+					fmt.Sprintf("*.%s", name),
+					fmt.Sprintf("*.%s.%s", name, namespace),
+					fmt.Sprintf("*.%s.%s.svc.%s", name, namespace, clusterDomain),
+				},
+				SecretName: c.opts.NodeSecret,
+				IssuerRef:  issuerRef,
+			},
+		},
+		{
+			ObjectMeta: c.objectMeta(fmt.Sprintf("%s-root-client", name)),
+			Spec: certv1.CertificateSpec{
+				Duration:    &metav1.Duration{Duration: c.opts.ClientDuration},
+				RenewBefore: &metav1.Duration{Duration: clientCertExpiryWindow},
+				Usages:      []certv1.KeyUsage{certv1.UsageDigitalSignature, certv1.UsageKeyEncipherment, certv1.UsageClientAuth},
+				PrivateKey:  privateKey,
+				CommonName:  "root",
+				Subject:     subject,
+				SecretName:  c.opts.ClientSecret,
+				IssuerRef:   issuerRef,
+			},
+		},
+	}
+}
+
+// toSelfSigner exports the CA of the issuer of the node Certificate into the CA secret of the self-signer, and
+// copies the node and client certificates to the secrets of the self-signer. The secrets are annotated like the
+// self-signer does, so that its pre-upgrade job keeps them rather than generating a new CA.
+func (c *CertConverter) toSelfSigner(ctx context.Context, sts appsv1.StatefulSet, layout certificateLayout, nodeSecret corev1.Secret) (map[string]interface{}, error) {
+	var certificate certv1.Certificate
+	certificateName := nodeSecret.Annotations[certv1.CertificateNameKey]
+	if err := c.cl.Get(ctx, types.NamespacedName{Name: certificateName, Namespace: sts.Namespace}, &certificate); err != nil {
+		return nil, errors.Wrapf(err, "getting certificate %s", certificateName)
+	}
+
+	caSecretName := types.NamespacedName{Name: c.opts.CASecret, Namespace: sts.Namespace}
+	if caSecretName.Name == "" {
+		var err error
+		if caSecretName, err = issuerCASecret(c.cl, sts.Namespace, certificate.Spec.IssuerRef, c.opts.ClusterResourceNamespace); err != nil {
+			return nil, err
+		}
+	}
+	var issuerSecret corev1.Secret
+	if err := c.cl.Get(ctx, caSecretName, &issuerSecret); err != nil {
+		return nil, errors.Wrapf(err, "getting CA secret %s/%s", caSecretName.Namespace, caSecretName.Name)
+	}
+	caCert, caKey := issuerSecret.Data[corev1.TLSCertKey], issuerSecret.Data[corev1.TLSPrivateKeyKey]
+	if matches, err := keyMatchesCert(caKey, caCert); err != nil || !matches {
+		return nil, errors.Newf("CA secret %s/%s doesn't contain a CA certificate and its key", caSecretName.Namespace, caSecretName.Name)
+	}
+
+	kubeResource := resource.NewKubeResource(ctx, c.cl, sts.Namespace, kube.DefaultPersister)
+	annotations, err := certAnnotations(caCert, c.opts.CADuration)
+	if err != nil {
+		return nil, err
+	}
+	caSecret := resource.CreateTLSSecret(fmt.Sprintf("%s-ca-secret", sts.Name), corev1.SecretTypeOpaque, kubeResource)
+	if err := caSecret.UpdateCASecret(caKey, caCert, annotations); err != nil {
+		return nil, errors.Wrap(err, "creating the CA secret of the self-signer")
+	}
+	logrus.Infof("Exported the CA of secret [%s/%s] into secret [%s-ca-secret]", caSecretName.Namespace, caSecretName.Name, sts.Name)
+
+	if layout.clientSecret == "" {
+		return nil, errors.Newf("statefulset %s doesn't mount a client certificate secret", sts.Name)
+	}
+	var clientSecret corev1.Secret
+	if err := c.cl.Get(ctx, types.NamespacedName{Name: layout.clientSecret, Namespace: sts.Namespace}, &clientSecret); err != nil {
+		return nil, errors.Wrapf(err, "getting client secret %s", layout.clientSecret)
+	}
+
+	for _, s := range []struct {
+		from     corev1.Secret
+		name     string
+		to       string
+		duration time.Duration
+	}{
+		{from: nodeSecret, name: "node", to: fmt.Sprintf("%s-node-secret", sts.Name), duration: c.opts.NodeDuration},
+		{from: clientSecret, name: "client.root", to: fmt.Sprintf("%s-client-secret", sts.Name), duration: c.opts.ClientDuration},
+	} {
+		cert, key := certAndKey(s.from, s.name)
+		annotations, err := certAnnotations(cert, s.duration)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading the certificate of secret %s", s.from.Name)
+		}
+		secret := resource.CreateTLSSecret(s.to, corev1.SecretTypeTLS, kubeResource)
+		if err := secret.UpdateTLSSecret(cert, key, caCert, annotations); err != nil {
+			return nil, errors.Wrapf(err, "copying secret %s to %s", s.from.Name, s.to)
+		}
+		logrus.Infof("Copied the certificate of secret [%s] to [%s]", s.from.Name, s.to)
+	}
+
+	return map[string]interface{}{
+		"tls": map[string]interface{}{
+			"certs": map[string]interface{}{
+				"certManager": false,
+				"selfSigner": map[string]interface{}{
+					"enabled":            true,
+					"caProvided":         false,
+					"caCertDuration":     durationValue(c.opts.CADuration),
+					"nodeCertDuration":   durationValue(c.opts.NodeDuration),
+					"clientCertDuration": durationValue(c.opts.ClientDuration),
+				},
+			},
+		},
+	}, nil
+}
+
+// certAnnotations returns the annotations of the self-signer for a certificate with the given duration.
+func certAnnotations(pemCert []byte, duration time.Duration) (map[string]string, error) {
+	cert, err := security.GetCertObj(pemCert)
+	if err != nil {
+		return nil, err
+	}
+	return resource.GetSecretAnnotations(cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339), duration.String()), nil
+}
+
+// durationValue formats a duration in hours, like the durations of the chart values.
+func durationValue(d time.Duration) string {
+	return fmt.Sprintf("%dh", int64(d.Hours()))
+}
+
+func (c *CertConverter) objectMeta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Name: name, Namespace: c.opts.Namespace}
+}
+
+// helmLabels adds the labels which let Helm adopt a resource into the release of the StatefulSet.
+func (c *CertConverter) helmLabels(sts appsv1.StatefulSet, labels map[string]string) map[string]string {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[helmManagedByLabel] = "Helm"
+	if instance := sts.Labels[helmInstanceLabel]; instance != "" {
+		labels[helmInstanceLabel] = instance
+	}
+	return labels
+}
+
+// helmAnnotations adds the annotations which let Helm adopt a resource into the release of the StatefulSet.
+func (c *CertConverter) helmAnnotations(sts appsv1.StatefulSet, annotations map[string]string) map[string]string {
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[helmReleaseNameKey] = sts.Annotations[helmReleaseNameKey]
+	annotations[helmReleaseNsKey] = sts.Namespace
+	return annotations
+}
@@ -0,0 +1,206 @@
+package migrate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+	"github.com/cockroachdb/helm-charts/pkg/resource"
+	certv1 "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// newCertManagerTestClient returns a client on which cert-manager issues the Certificates created with the CA.
+func newCertManagerTestClient(t *testing.T, ca testCA, objects ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, certv1.AddToScheme(scheme))
+	return fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).WithInterceptorFuncs(interceptor.Funcs{
+		Create: func(ctx context.Context, cl client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			if err := cl.Create(ctx, obj, opts...); err != nil {
+				return err
+			}
+			certificate, ok := obj.(*certv1.Certificate)
+			if !ok {
+				return nil
+			}
+
+			cert, key := ca.issue(t, certificate.Spec.DNSNames...)
+			require.NoError(t, cl.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        certificate.Spec.SecretName,
+					Namespace:   certificate.Namespace,
+					Annotations: map[string]string{certv1.CertificateNameKey: certificate.Name},
+				},
+				Data: map[string][]byte{"ca.crt": ca.certPEM, "tls.crt": cert, "tls.key": key},
+			}))
+			certificate.Status.Revision = To(1)
+			certificate.Status.Conditions = []certv1.CertificateCondition{{Type: certv1.CertificateConditionReady, Status: cmmeta.ConditionTrue}}
+			return cl.Update(ctx, certificate)
+		},
+	}).Build()
+}
+
+func TestConvertCertsToCertManager(t *testing.T) {
+	ctx := context.Background()
+	ca := newTestCA(t)
+	nodeCert, nodeKey := ca.issue(t, "crdb-public")
+	sts := helmStatefulSet("crdb", "crdb-node-secret", "crdb-client-secret")
+	sts.Labels = map[string]string{helmInstanceLabel: "crdb"}
+
+	cl := newCertManagerTestClient(t, ca,
+		sts,
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "crdb-node-secret", Namespace: certsTestNamespace},
+			Data:       map[string][]byte{"ca.crt": ca.certPEM, "tls.crt": nodeCert, "tls.key": nodeKey},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "crdb-ca-secret", Namespace: certsTestNamespace},
+			// The CA was rotated, the bundle holds the previous CA first.
+			Data: map[string][]byte{"ca.crt": append(newTestCA(t).certPEM, ca.certPEM...), "ca.key": ca.keyPEM},
+		},
+	)
+	converter := newCertConverter(cl, ConvertCertsOptions{
+		StatefulSetName: "crdb",
+		Namespace:       certsTestNamespace,
+		To:              certManagerCertificates,
+		IssueTimeout:    time.Second,
+	})
+
+	values, err := converter.convert(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"tls": map[string]interface{}{
+			"certs": map[string]interface{}{
+				"selfSigner":  map[string]interface{}{"enabled": false},
+				"certManager": true,
+				"certManagerIssuer": map[string]interface{}{
+					"group":                  "cert-manager.io",
+					"kind":                   "Issuer",
+					"name":                   "crdb-issuer",
+					"isSelfSignedIssuer":     false,
+					"nodeCertDuration":       "8760h",
+					"nodeCertExpiryWindow":   "168h",
+					"clientCertDuration":     "672h",
+					"clientCertExpiryWindow": "48h",
+				},
+				"nodeSecret":       "crdb-node",
+				"clientRootSecret": "crdb-root",
+			},
+		},
+	}, values)
+
+	var issuerSecret corev1.Secret
+	require.NoError(t, cl.Get(ctx, types.NamespacedName{Name: "crdb-issuer-ca", Namespace: certsTestNamespace}, &issuerSecret))
+	assert.Equal(t, ca.certPEM, issuerSecret.Data["tls.crt"])
+	assert.Equal(t, ca.keyPEM, issuerSecret.Data["tls.key"])
+
+	var issuer certv1.Issuer
+	require.NoError(t, cl.Get(ctx, types.NamespacedName{Name: "crdb-issuer", Namespace: certsTestNamespace}, &issuer))
+	assert.Equal(t, "crdb-issuer-ca", issuer.Spec.CA.SecretName)
+
+	var certificate certv1.Certificate
+	require.NoError(t, cl.Get(ctx, types.NamespacedName{Name: "crdb-node", Namespace: certsTestNamespace}, &certificate))
+	assert.Equal(t, "crdb-node", certificate.Spec.SecretName)
+	assert.Contains(t, certificate.Spec.DNSNames, "*.crdb.cockroachdb.svc.cluster.local")
+	assert.Equal(t, "crdb", certificate.Annotations[helmReleaseNameKey])
+	assert.Equal(t, "Helm", certificate.Labels[helmManagedByLabel])
+	require.NoError(t, cl.Get(ctx, types.NamespacedName{Name: "crdb-root-client", Namespace: certsTestNamespace}, &certificate))
+	assert.Equal(t, "root", certificate.Spec.CommonName)
+
+	// The cluster now uses cert-manager.
+	sts.Spec.Template.Spec.Volumes[1].Secret.SecretName = "crdb-node"
+	require.NoError(t, cl.Update(ctx, sts))
+	_, err = converter.convert(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "already uses cert-manager certificates")
+}
+
+func TestConvertCertsToSelfSigner(t *testing.T) {
+	ctx := context.Background()
+	ca := newTestCA(t)
+	nodeCert, nodeKey := ca.issue(t, "crdb-public")
+	clientCert, clientKey := ca.issue(t)
+
+	cl := newCertsTestClient(t,
+		helmStatefulSet("crdb", "crdb-node", "crdb-root"),
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "crdb-node",
+				Namespace:   certsTestNamespace,
+				Annotations: map[string]string{certv1.CertificateNameKey: "crdb-node"},
+			},
+			Data: map[string][]byte{"ca.crt": ca.certPEM, "tls.crt": nodeCert, "tls.key": nodeKey},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "crdb-root", Namespace: certsTestNamespace},
+			Data:       map[string][]byte{"ca.crt": ca.certPEM, "tls.crt": clientCert, "tls.key": clientKey},
+		},
+		&certv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Name: "crdb-node", Namespace: certsTestNamespace},
+			Spec: certv1.CertificateSpec{
+				SecretName: "crdb-node",
+				IssuerRef:  cmmeta.ObjectReference{Name: "crdb-ca-issuer", Kind: certv1.IssuerKind},
+			},
+		},
+		&certv1.Issuer{
+			ObjectMeta: metav1.ObjectMeta{Name: "crdb-ca-issuer", Namespace: certsTestNamespace},
+			Spec:       certv1.IssuerSpec{IssuerConfig: certv1.IssuerConfig{CA: &certv1.CAIssuer{SecretName: "cockroach-ca"}}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "cockroach-ca", Namespace: certsTestNamespace},
+			Data:       map[string][]byte{"ca.crt": ca.certPEM, "tls.crt": ca.certPEM, "tls.key": ca.keyPEM},
+		},
+	)
+
+	values, err := newCertConverter(cl, ConvertCertsOptions{
+		StatefulSetName: "crdb",
+		Namespace:       certsTestNamespace,
+		To:              selfSignerCertificates,
+	}).convert(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"tls": map[string]interface{}{
+			"certs": map[string]interface{}{
+				"certManager": false,
+				"selfSigner": map[string]interface{}{
+					"enabled":            true,
+					"caProvided":         false,
+					"caCertDuration":     "43800h",
+					"nodeCertDuration":   "8760h",
+					"clientCertDuration": "672h",
+				},
+			},
+		},
+	}, values)
+
+	// The secrets are kept by the self-signer, rather than re-generated with a new CA.
+	kubeResource := resource.NewKubeResource(ctx, cl, certsTestNamespace, kube.DefaultPersister)
+	caSecret, err := resource.LoadTLSSecret("crdb-ca-secret", kubeResource)
+	require.NoError(t, err)
+	assert.True(t, caSecret.ReadyCA())
+	assert.True(t, caSecret.ValidateAnnotations())
+	assert.Equal(t, ca.keyPEM, caSecret.CAKey())
+	// The test CA expires within the hour, so only its expiry requires a rotation.
+	_, reason := caSecret.IsRotationRequired(defaultCACertDuration, "0 0 1 */11 *")
+	assert.Equal(t, "Certificate about to expire, rotating certificate", reason)
+
+	for name, cert := range map[string][]byte{"crdb-node-secret": nodeCert, "crdb-client-secret": clientCert} {
+		secret, err := resource.LoadTLSSecret(name, kubeResource)
+		require.NoError(t, err)
+		assert.True(t, secret.Ready())
+		assert.True(t, secret.ValidateAnnotations())
+		assert.Equal(t, cert, secret.TLSCert())
+	}
+}
@@ -0,0 +1,637 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/database"
+	"github.com/cockroachdb/helm-charts/pkg/database/health"
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	util "github.com/cockroachdb/helm-charts/pkg/utils"
+)
+
+const (
+	executeCheckpointJSON = "execute-checkpoint.json"
+	helmManagedByLabel    = "app.kubernetes.io/managed-by"
+	helmReleaseNsKey      = "meta.helm.sh/release-namespace"
+
+	// Steps run by the executor once every CrdbNode is migrated.
+	publicServiceStep  = "update-public-service"
+	adoptResourcesStep = "adopt-resources"
+	deletePDBStep      = "delete-pdb"
+	deleteStsStep      = "delete-statefulset"
+	helmStep           = "helm"
+)
+
+// MigrationSource is the deployment method of the CockroachDB cluster being migrated.
+type MigrationSource string
+
+const (
+	HelmChartSource      MigrationSource = "helm"
+	PublicOperatorSource MigrationSource = "operator"
+)
+
+var crdbNodeManifestRegex = regexp.MustCompile(`^crdbnode-(\d+)\.yaml$`)
+
+// executeCheckpoint records the progress of the executor, so that an interrupted or paused migration can be
+// resumed by running the executor again.
+type executeCheckpoint struct {
+	StatefulSet string `json:"statefulSet"`
+	// Release is the helm release of the CrdbCluster, which is recorded since the StatefulSet it is read from
+	// is deleted during the migration.
+	Release string `json:"release"`
+	// MigratedNodes are the ordinals of the StatefulSet pods which were replaced by CrdbNodes.
+	MigratedNodes []int32 `json:"migratedNodes,omitempty"`
+	// CompletedSteps are the steps run after the CrdbNodes were migrated.
+	CompletedSteps []string `json:"completedSteps,omitempty"`
+}
+
+func (c *executeCheckpoint) nodeMigrated(ordinal int32) bool {
+	for _, o := range c.MigratedNodes {
+		if o == ordinal {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *executeCheckpoint) stepCompleted(step string) bool {
+	for _, s := range c.CompletedSteps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// Executor replaces the StatefulSet pods with the CrdbNodes generated by build-manifest one at a time, and then
+// hands the cluster over to the cockroachdb chart of the CockroachDB Enterprise Operator.
+type Executor struct {
+	source            MigrationSource
+	stsName           string
+	namespace         string
+	manifestDir       string
+	releaseName       string
+	chart             string
+	readinessWait     time.Duration
+	podUpdateTimeout  time.Duration
+	pauseBetweenNodes bool
+	clientset         kubernetes.Interface
+	dynamicClient     dynamic.Interface
+	// in is read for the approval to continue with the next node.
+	in *bufio.Reader
+	// runHelm runs the helm CLI with the given arguments.
+	runHelm func(ctx context.Context, args ...string) error
+	// pcrMode is the PCR mode the cluster was migrated with, as recorded in the migration report.
+	pcrMode v1alpha1.CrdbVirtualClusterMode
+	// newPCRInspector connects to the cluster to check its PCR state. It is nil if the cluster isn't virtualized.
+	newPCRInspector func(ctx context.Context) (pcrInspector, error)
+	// newHealthChecker connects to the cluster to check that its nodes are live and its ranges fully replicated.
+	newHealthChecker func(ctx context.Context) (healthChecker, error)
+	healthTimeout    time.Duration
+}
+
+// healthChecker reports the health of the cluster, as health.Checker does.
+type healthChecker interface {
+	Status(ctx context.Context) (health.Status, error)
+	Close() error
+}
+
+// ExecutorOptions configures an Executor.
+type ExecutorOptions struct {
+	Source      MigrationSource
+	Name        string
+	Namespace   string
+	ManifestDir string
+	// ReleaseName is the helm release to upgrade or install. It defaults to the release of the StatefulSet for
+	// the Helm chart, and to the name of the CrdbCluster for the public operator.
+	ReleaseName       string
+	Chart             string
+	ReadinessWait     time.Duration
+	PodUpdateTimeout  time.Duration
+	PauseBetweenNodes bool
+	// HealthTimeout bounds the wait for the nodes to be live and the ranges to be fully replicated, before and
+	// after each node is migrated.
+	HealthTimeout time.Duration
+}
+
+// NewExecutor constructs an Executor for the manifests generated under opts.ManifestDir.
+func NewExecutor(kubeconfig string, opts ExecutorOptions) (*Executor, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "building k8s config")
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "building k8s clientset")
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "building k8s dynamic client")
+	}
+
+	report, err := readMigrationReport(opts.ManifestDir)
+	if err != nil {
+		return nil, err
+	}
+	if report == nil {
+		return nil, errors.Newf("no %s in %s, generate the manifests again to record the connection to the cluster", migrationReportJSON, opts.ManifestDir)
+	}
+
+	e := &Executor{
+		source:            opts.Source,
+		stsName:           opts.Name,
+		namespace:         opts.Namespace,
+		manifestDir:       opts.ManifestDir,
+		releaseName:       opts.ReleaseName,
+		chart:             opts.Chart,
+		readinessWait:     opts.ReadinessWait,
+		podUpdateTimeout:  opts.PodUpdateTimeout,
+		pauseBetweenNodes: opts.PauseBetweenNodes,
+		healthTimeout:     opts.HealthTimeout,
+		clientset:         clientset,
+		dynamicClient:     dynamicClient,
+		in:                bufio.NewReader(os.Stdin),
+		runHelm:           runHelmCLI,
+	}
+	// The health of a virtualized cluster is only reported by its system virtual cluster.
+	var virtualCluster string
+	if report.PCR != nil && report.PCR.Mode != v1alpha1.VirtualClusterDisabled {
+		virtualCluster = database.SystemVirtualCluster
+		e.pcrMode = report.PCR.Mode
+		e.newPCRInspector = func(ctx context.Context) (pcrInspector, error) {
+			return newSQLPCRInspector(ctx, config, opts.Namespace, opts.Name, report.SQLPort, report.Certificates.ClientSecret)
+		}
+	}
+	e.newHealthChecker = func(ctx context.Context) (healthChecker, error) {
+		db, err := connectToCluster(ctx, config, opts.Namespace, opts.Name, report.SQLPort, report.Certificates.ClientSecret, virtualCluster)
+		if err != nil {
+			return nil, errors.Wrap(err, "connecting to the cluster")
+		}
+		return health.NewChecker(db), nil
+	}
+	return e, nil
+}
+
+// Run migrates the StatefulSet pods to CrdbNodes, starting from the highest ordinal, and checkpoints the
+// progress after each node. Once all nodes are migrated, it runs the remaining steps of the migration guide
+// and upgrades the helm release. Run can be called again to resume an interrupted migration.
+//
+// The replication stream of a PCR standby, or the virtual cluster of a PCR primary, is checked before the
+// migration starts and once the cluster is handed over to the helm release.
+func (e *Executor) Run(ctx context.Context) error {
+	checkpoint, err := e.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	if err := e.checkPCR(ctx); err != nil {
+		return errors.Wrap(err, "checking PCR before the migration")
+	}
+
+	if e.releaseName == "" {
+		e.releaseName = checkpoint.Release
+	}
+	if e.releaseName == "" {
+		if e.releaseName, err = e.defaultRelease(ctx); err != nil {
+			return err
+		}
+	}
+	checkpoint.Release = e.releaseName
+
+	ordinals, err := crdbNodeManifestOrdinals(e.manifestDir)
+	if err != nil {
+		return err
+	}
+	if len(ordinals) == 0 {
+		return errors.Newf("no crdbnode manifests found in %s, run build-manifest first", e.manifestDir)
+	}
+
+	var pending []int32
+	for _, ordinal := range ordinals {
+		if !checkpoint.nodeMigrated(ordinal) {
+			pending = append(pending, ordinal)
+		}
+	}
+
+	for i, ordinal := range pending {
+		if err := e.migrateNode(ctx, ordinal); err != nil {
+			return errors.Wrapf(err, "migrating %s-%d, re-run the command to resume", e.stsName, ordinal)
+		}
+
+		checkpoint.MigratedNodes = append(checkpoint.MigratedNodes, ordinal)
+		if err := e.saveCheckpoint(checkpoint); err != nil {
+			return err
+		}
+
+		if i < len(pending)-1 && e.pauseBetweenNodes {
+			next := fmt.Sprintf("%s-%d", e.stsName, pending[i+1])
+			if !util.Approve(e.in, fmt.Sprintf("Check the cluster health, including under-replicated ranges. Continue with %s?", next)) {
+				fmt.Printf("⏸️  Migration paused before %s. Re-run the command to resume.\n", next)
+				return nil
+			}
+		}
+	}
+
+	for _, step := range e.finalSteps() {
+		if checkpoint.stepCompleted(step.name) {
+			continue
+		}
+		if err := step.run(ctx); err != nil {
+			return errors.Wrapf(err, "%s, re-run the command to resume", step.name)
+		}
+
+		checkpoint.CompletedSteps = append(checkpoint.CompletedSteps, step.name)
+		if err := e.saveCheckpoint(checkpoint); err != nil {
+			return err
+		}
+	}
+
+	if err := e.retry(ctx, func() error { return e.checkPCR(ctx) }); err != nil {
+		return errors.Wrap(err, "checking PCR after the migration")
+	}
+
+	fmt.Println("✅ Migration to the CockroachDB Enterprise Operator completed.")
+	return nil
+}
+
+// checkPCR checks that the cluster still has the PCR mode it was migrated with, and that the replication
+// stream of a standby is healthy.
+func (e *Executor) checkPCR(ctx context.Context) error {
+	if e.newPCRInspector == nil {
+		return nil
+	}
+
+	inspector, err := e.newPCRInspector(ctx)
+	if err != nil {
+		return err
+	}
+	defer inspector.Close()
+
+	if err := checkPCRHealth(ctx, inspector, e.pcrMode); err != nil {
+		return err
+	}
+	fmt.Printf("PCR %s cluster is healthy\n", e.pcrMode)
+	return nil
+}
+
+// migrateNode scales the StatefulSet down to the given ordinal and replaces the freed pod with its CrdbNode.
+// The cluster must be healthy before the pod is released, and again once its CrdbNode is ready.
+func (e *Executor) migrateNode(ctx context.Context, ordinal int32) error {
+	nodeName := fmt.Sprintf("%s-%d", e.stsName, ordinal)
+
+	_, err := e.dynamicClient.Resource(crdbNodeGVR).Namespace(e.namespace).Get(ctx, nodeName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		if err := e.waitForHealthyCluster(ctx); err != nil {
+			return errors.Wrapf(err, "refusing to release pod %s", nodeName)
+		}
+		if err := e.scaleDown(ctx, ordinal); err != nil {
+			return err
+		}
+		if err := kube.WaitForPodDeleted(ctx, e.pods(), nodeName, e.podUpdateTimeout, 5*time.Second); err != nil {
+			return errors.Wrapf(err, "waiting for pod %s to be deleted", nodeName)
+		}
+
+		node, err := readCrdbNodeManifest(filepath.Join(e.manifestDir, fmt.Sprintf("crdbnode-%d.yaml", ordinal)))
+		if err != nil {
+			return err
+		}
+		node.SetNamespace(e.namespace)
+		if _, err := e.dynamicClient.Resource(crdbNodeGVR).Namespace(e.namespace).Create(ctx, node, metav1.CreateOptions{}); err != nil {
+			return errors.Wrapf(err, "creating crdbnode %s", nodeName)
+		}
+		fmt.Printf("Created crdbnode %s\n", nodeName)
+	case err != nil:
+		return errors.Wrapf(err, "fetching crdbnode %s", nodeName)
+	default:
+		// The node was created before the previous run was interrupted.
+		fmt.Printf("Crdbnode %s already exists\n", nodeName)
+	}
+
+	if err := kube.WaitForPodReadyWith(ctx, e.pods(), nodeName, e.podUpdateTimeout, 5*time.Second); err != nil {
+		return err
+	}
+	if err := e.waitForCrdbNodeReady(ctx, nodeName); err != nil {
+		return err
+	}
+
+	fmt.Printf("Waiting for %s for pod %s to become stable\n", e.readinessWait.String(), nodeName)
+	if err := kube.Sleep(ctx, e.readinessWait); err != nil {
+		return err
+	}
+	return e.waitForHealthyCluster(ctx)
+}
+
+func (e *Executor) pods() kube.PodGetter {
+	return kube.ClientsetPods(e.clientset, e.namespace)
+}
+
+// waitForHealthyCluster waits for every node to be live, and for every range to be fully replicated.
+func (e *Executor) waitForHealthyCluster(ctx context.Context) error {
+	checker, err := e.newHealthChecker(ctx)
+	if err != nil {
+		return err
+	}
+	defer checker.Close()
+
+	err = kube.Retry(ctx, e.healthTimeout, 5*time.Second, func() error {
+		status, err := checker.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return status.Healthy()
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Cluster is healthy")
+	return nil
+}
+
+func (e *Executor) scaleDown(ctx context.Context, replicas int32) error {
+	sts, err := e.clientset.AppsV1().StatefulSets(e.namespace).Get(ctx, e.stsName, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrap(err, "fetching statefulset")
+	}
+	if *sts.Spec.Replicas <= replicas {
+		return nil
+	}
+
+	sts.Spec.Replicas = &replicas
+	if _, err := e.clientset.AppsV1().StatefulSets(e.namespace).Update(ctx, sts, metav1.UpdateOptions{}); err != nil {
+		return errors.Wrapf(err, "scaling statefulset %s to %d replicas", e.stsName, replicas)
+	}
+	fmt.Printf("Scaled statefulset %s to %d replicas\n", e.stsName, replicas)
+	return nil
+}
+
+// waitForCrdbNodeReady waits until the CrdbNode controller reports the pod of the node as ready.
+func (e *Executor) waitForCrdbNodeReady(ctx context.Context, name string) error {
+	f := func() error {
+		node, err := e.dynamicClient.Resource(crdbNodeGVR).Namespace(e.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		conditions, _, err := unstructured.NestedSlice(node.Object, "status", "conditions")
+		if err != nil {
+			return err
+		}
+		for _, c := range conditions {
+			condition, ok := c.(map[string]interface{})
+			if ok && condition["type"] == string(v1alpha1.PodReady) && condition["status"] == string(metav1.ConditionTrue) {
+				fmt.Printf("Crdbnode %s in ready state now\n", name)
+				return nil
+			}
+		}
+		return fmt.Errorf("crdbnode %s not in ready state", name)
+	}
+
+	return e.retry(ctx, f)
+}
+
+func (e *Executor) retry(ctx context.Context, f func() error) error {
+	return kube.Retry(ctx, e.podUpdateTimeout, 5*time.Second, f)
+}
+
+type executeStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// finalSteps returns the steps which hand the cluster over to the helm release once every CrdbNode is
+// migrated. The Helm chart release is upgraded in place after its StatefulSet is deleted, while the cluster
+// of the public operator is installed as a new release which adopts the existing public service and ingresses.
+func (e *Executor) finalSteps() []executeStep {
+	if e.source == PublicOperatorSource {
+		return []executeStep{
+			{name: deletePDBStep, run: func(ctx context.Context) error { return e.deletePDB(ctx, e.stsName) }},
+			{name: adoptResourcesStep, run: e.adoptResources},
+			{name: helmStep, run: func(ctx context.Context) error { return e.helm(ctx, "install") }},
+			{name: deleteStsStep, run: e.deleteStatefulSet},
+		}
+	}
+
+	return []executeStep{
+		{name: publicServiceStep, run: e.updatePublicService},
+		{name: deletePDBStep, run: func(ctx context.Context) error { return e.deletePDB(ctx, e.stsName+"-budget") }},
+		{name: deleteStsStep, run: e.deleteStatefulSet},
+		{name: helmStep, run: func(ctx context.Context) error { return e.helm(ctx, "upgrade") }},
+	}
+}
+
+// updatePublicService applies the ports of the public service generated by build-manifest, which exposes
+// the gRPC port used by the CockroachDB Enterprise Operator.
+func (e *Executor) updatePublicService(ctx context.Context) error {
+	objs, err := readManifests(filepath.Join(e.manifestDir, publicSvcYaml))
+	if err != nil {
+		return errors.Wrapf(err, "reading %s", publicSvcYaml)
+	}
+	if len(objs) != 1 {
+		return errors.Newf("expected a single service in %s", publicSvcYaml)
+	}
+	svc, ok := objs[0].(*corev1.Service)
+	if !ok {
+		return errors.Newf("%s doesn't contain a service", publicSvcYaml)
+	}
+
+	existing, err := e.clientset.CoreV1().Services(e.namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "fetching service %s", svc.Name)
+	}
+	existing.Spec.Ports = svc.Spec.Ports
+	if _, err := e.clientset.CoreV1().Services(e.namespace).Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return errors.Wrapf(err, "updating service %s", svc.Name)
+	}
+	fmt.Printf("Updated ports of service %s\n", svc.Name)
+	return nil
+}
+
+// deletePDB deletes the pod disruption budget of the StatefulSet, which conflicts with the one created by
+// the CockroachDB Enterprise Operator.
+func (e *Executor) deletePDB(ctx context.Context, name string) error {
+	err := e.clientset.PolicyV1().PodDisruptionBudgets(e.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "deleting pod disruption budget %s", name)
+	}
+	fmt.Printf("Deleted pod disruption budget %s\n", name)
+	return nil
+}
+
+func (e *Executor) deleteStatefulSet(ctx context.Context) error {
+	sts, err := e.clientset.AppsV1().StatefulSets(e.namespace).Get(ctx, e.stsName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "fetching statefulset")
+	}
+	if *sts.Spec.Replicas != 0 {
+		return errors.Newf("statefulset %s still has %d replicas", e.stsName, *sts.Spec.Replicas)
+	}
+
+	if err := e.clientset.AppsV1().StatefulSets(e.namespace).Delete(ctx, e.stsName, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "deleting statefulset %s", e.stsName)
+	}
+	fmt.Printf("Deleted statefulset %s\n", e.stsName)
+	return nil
+}
+
+// adoptResources annotates the public service and ingresses created by the public operator, so that they
+// can be managed by the helm release.
+func (e *Executor) adoptResources(ctx context.Context) error {
+	release := e.releaseName
+	adopt := func(meta *metav1.ObjectMeta) {
+		if meta.Annotations == nil {
+			meta.Annotations = map[string]string{}
+		}
+		if meta.Labels == nil {
+			meta.Labels = map[string]string{}
+		}
+		meta.Annotations[helmReleaseNameKey] = release
+		meta.Annotations[helmReleaseNsKey] = e.namespace
+		meta.Labels[helmManagedByLabel] = "Helm"
+	}
+
+	svcName := e.stsName + "-public"
+	svc, err := e.clientset.CoreV1().Services(e.namespace).Get(ctx, svcName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "fetching service %s", svcName)
+	}
+	if err == nil {
+		adopt(&svc.ObjectMeta)
+		if _, err := e.clientset.CoreV1().Services(e.namespace).Update(ctx, svc, metav1.UpdateOptions{}); err != nil {
+			return errors.Wrapf(err, "annotating service %s", svcName)
+		}
+		fmt.Printf("Annotated service %s for helm release %s\n", svcName, release)
+	}
+
+	for _, name := range []string{"ui-" + e.stsName, "sql-" + e.stsName} {
+		ingress, err := e.clientset.NetworkingV1().Ingresses(e.namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "fetching ingress %s", name)
+		}
+		adopt(&ingress.ObjectMeta)
+		if _, err := e.clientset.NetworkingV1().Ingresses(e.namespace).Update(ctx, ingress, metav1.UpdateOptions{}); err != nil {
+			return errors.Wrapf(err, "annotating ingress %s", name)
+		}
+		fmt.Printf("Annotated ingress %s for helm release %s\n", name, release)
+	}
+
+	return nil
+}
+
+func (e *Executor) helm(ctx context.Context, action string) error {
+	return e.runHelm(ctx, action, e.releaseName, e.chart,
+		"--namespace", e.namespace,
+		"--values", filepath.Join(e.manifestDir, "values.yaml"))
+}
+
+// defaultRelease returns the helm release which manages the CrdbCluster. The release of the Helm chart is
+// upgraded in place, while the cluster of the public operator is installed as a release named after it.
+func (e *Executor) defaultRelease(ctx context.Context) (string, error) {
+	if e.source == PublicOperatorSource {
+		return e.stsName, nil
+	}
+
+	sts, err := e.clientset.AppsV1().StatefulSets(e.namespace).Get(ctx, e.stsName, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrap(err, "fetching statefulset")
+	}
+	release := sts.Annotations[helmReleaseNameKey]
+	if release == "" {
+		return "", errors.Newf("statefulset %s has no %s annotation, set the helm release name", e.stsName, helmReleaseNameKey)
+	}
+	return release, nil
+}
+
+func runHelmCLI(ctx context.Context, args ...string) error {
+	fmt.Printf("Running helm %s\n", strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, "helm", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (e *Executor) loadCheckpoint() (*executeCheckpoint, error) {
+	checkpoint := &executeCheckpoint{StatefulSet: e.stsName}
+
+	found, err := util.LoadCheckpoint(filepath.Join(e.manifestDir, executeCheckpointJSON), checkpoint)
+	if err != nil || !found {
+		return checkpoint, err
+	}
+	if checkpoint.StatefulSet != e.stsName {
+		return nil, errors.Newf("checkpoint in %s belongs to statefulset %s", e.manifestDir, checkpoint.StatefulSet)
+	}
+	if len(checkpoint.MigratedNodes) > 0 || len(checkpoint.CompletedSteps) > 0 {
+		fmt.Printf("Resuming migration, migrated nodes: %v, completed steps: %v\n", checkpoint.MigratedNodes, checkpoint.CompletedSteps)
+	}
+
+	return checkpoint, nil
+}
+
+func (e *Executor) saveCheckpoint(checkpoint *executeCheckpoint) error {
+	return util.SaveCheckpoint(filepath.Join(e.manifestDir, executeCheckpointJSON), checkpoint)
+}
+
+// crdbNodeManifestOrdinals returns the ordinals of the crdbnode manifests in the directory, highest first,
+// which is the order in which the StatefulSet releases its pods when it is scaled down.
+func crdbNodeManifestOrdinals(dir string) ([]int32, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading manifest directory")
+	}
+
+	var ordinals []int32
+	for _, entry := range entries {
+		match := crdbNodeManifestRegex.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		ordinal, err := strconv.ParseInt(match[1], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing ordinal of %s", entry.Name())
+		}
+		ordinals = append(ordinals, int32(ordinal))
+	}
+
+	sort.Slice(ordinals, func(i, j int) bool { return ordinals[i] > ordinals[j] })
+	return ordinals, nil
+}
+
+func readCrdbNodeManifest(path string) (*unstructured.Unstructured, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading crdbnode manifest")
+	}
+
+	obj := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &obj); err != nil {
+		return nil, errors.Wrapf(err, "decoding %s", path)
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
@@ -0,0 +1,287 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/database/health"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const executeTestNamespace = "default"
+
+func readyPod(name string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: executeTestNamespace},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+// newExecuteTestEnv returns fake clients which emulate the StatefulSet controller deleting the pods above the
+// replica count, and the CockroachDB Enterprise Operator starting a ready pod for every CrdbNode.
+func newExecuteTestEnv(t *testing.T, sts *appsv1.StatefulSet, objs ...runtime.Object) (*fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	objs = append(objs, sts)
+	for i := int32(0); i < *sts.Spec.Replicas; i++ {
+		objs = append(objs, readyPod(fmt.Sprintf("%s-%d", sts.Name, i)))
+	}
+	clientset := fake.NewSimpleClientset(objs...)
+	podsGVR := corev1.SchemeGroupVersion.WithResource("pods")
+
+	clientset.PrependReactor("update", "statefulsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updated := action.(k8stesting.UpdateAction).GetObject().(*appsv1.StatefulSet)
+		for i := *updated.Spec.Replicas; i < *sts.Spec.Replicas; i++ {
+			err := clientset.Tracker().Delete(podsGVR, executeTestNamespace, fmt.Sprintf("%s-%d", updated.Name, i))
+			if err != nil && !apierrors.IsNotFound(err) {
+				return true, nil, err
+			}
+		}
+		return false, nil, nil
+	})
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{crdbNodeGVR: "CrdbNodeList"})
+	dynamicClient.PrependReactor("create", "crdbnodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		node := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		require.NoError(t, unstructured.SetNestedSlice(node.Object, []interface{}{
+			map[string]interface{}{"type": "PodReady", "status": "True"},
+		}, "status", "conditions"))
+		return false, nil, clientset.Tracker().Add(readyPod(node.GetName()))
+	})
+
+	return clientset, dynamicClient
+}
+
+func writeExecuteManifests(t *testing.T, dir, stsName string, replicas int) {
+	for i := 0; i < replicas; i++ {
+		manifest := fmt.Sprintf("apiVersion: crdb.cockroachlabs.com/v1alpha1\nkind: CrdbNode\nmetadata:\n  name: %s-%d\n  namespace: default\nspec:\n  nodeName: node-%d\n", stsName, i, i)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("crdbnode-%d.yaml", i)), []byte(manifest), 0644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "values.yaml"), []byte("cockroachdb: {}\n"), 0644))
+}
+
+// fakeHealthChecker reports the nodes of the pods of the clientset as live, with the given under-replicated
+// ranges.
+type fakeHealthChecker struct {
+	underReplicated int64
+	checks          *int
+}
+
+func (c *fakeHealthChecker) Status(context.Context) (health.Status, error) {
+	*c.checks++
+	return health.Status{Ranges: health.RangeCounts{UnderReplicated: c.underReplicated}}, nil
+}
+
+func (c *fakeHealthChecker) Close() error {
+	return nil
+}
+
+func newTestExecutor(source MigrationSource, stsName, dir, input string, clientset *fake.Clientset, dynamicClient *dynamicfake.FakeDynamicClient, helmCalls *[][]string) *Executor {
+	return &Executor{
+		source:           source,
+		stsName:          stsName,
+		namespace:        executeTestNamespace,
+		manifestDir:      dir,
+		chart:            "./cockroachdb-parent/charts/cockroachdb",
+		podUpdateTimeout: 10 * time.Second,
+		healthTimeout:    10 * time.Second,
+		clientset:        clientset,
+		dynamicClient:    dynamicClient,
+		in:               bufio.NewReader(strings.NewReader(input)),
+		runHelm: func(ctx context.Context, args ...string) error {
+			*helmCalls = append(*helmCalls, args)
+			return nil
+		},
+		newHealthChecker: func(context.Context) (healthChecker, error) {
+			return &fakeHealthChecker{checks: new(int)}, nil
+		},
+	}
+}
+
+func readCheckpoint(t *testing.T, dir string) executeCheckpoint {
+	data, err := os.ReadFile(filepath.Join(dir, executeCheckpointJSON))
+	require.NoError(t, err)
+	var checkpoint executeCheckpoint
+	require.NoError(t, json.Unmarshal(data, &checkpoint))
+	return checkpoint
+}
+
+func TestExecutorFromHelmChart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeExecuteManifests(t, dir, "cockroachdb", 3)
+
+	publicSvc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb-public", Namespace: executeTestNamespace},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "grpc", Port: 26257}}},
+	}
+	migratedSvc := publicSvc.DeepCopy()
+	migratedSvc.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Service"}
+	migratedSvc.Spec.Ports = []corev1.ServicePort{{Name: "grpc", Port: 26258}, {Name: "sql", Port: 26257}}
+	require.NoError(t, yamlToDisk(filepath.Join(dir, publicSvcYaml), []any{migratedSvc}))
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "cockroachdb",
+			Namespace:   executeTestNamespace,
+			Annotations: map[string]string{helmReleaseNameKey: "crdb"},
+		},
+		Spec: appsv1.StatefulSetSpec{Replicas: To(int32(3))},
+	}
+	pdb := &policyv1.PodDisruptionBudget{ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb-budget", Namespace: executeTestNamespace}}
+	clientset, dynamicClient := newExecuteTestEnv(t, sts, publicSvc, pdb)
+
+	// The first run is paused after the first node.
+	var helmCalls [][]string
+	e := newTestExecutor(HelmChartSource, "cockroachdb", dir, "n\n", clientset, dynamicClient, &helmCalls)
+	e.pauseBetweenNodes = true
+	require.NoError(t, e.Run(ctx))
+
+	assert.Equal(t, executeCheckpoint{StatefulSet: "cockroachdb", Release: "crdb", MigratedNodes: []int32{2}}, readCheckpoint(t, dir))
+	current, err := clientset.AppsV1().StatefulSets(executeTestNamespace).Get(ctx, "cockroachdb", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), *current.Spec.Replicas)
+	assert.Empty(t, helmCalls)
+
+	// The second run resumes from the checkpoint.
+	e = newTestExecutor(HelmChartSource, "cockroachdb", dir, "y\n", clientset, dynamicClient, &helmCalls)
+	e.pauseBetweenNodes = true
+	require.NoError(t, e.Run(ctx))
+
+	nodes, err := dynamicClient.Resource(crdbNodeGVR).Namespace(executeTestNamespace).List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, nodes.Items, 3)
+
+	_, err = clientset.AppsV1().StatefulSets(executeTestNamespace).Get(ctx, "cockroachdb", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = clientset.PolicyV1().PodDisruptionBudgets(executeTestNamespace).Get(ctx, "cockroachdb-budget", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	svc, err := clientset.CoreV1().Services(executeTestNamespace).Get(ctx, "cockroachdb-public", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, migratedSvc.Spec.Ports, svc.Spec.Ports)
+
+	assert.Equal(t, [][]string{{"upgrade", "crdb", "./cockroachdb-parent/charts/cockroachdb",
+		"--namespace", executeTestNamespace, "--values", filepath.Join(dir, "values.yaml")}}, helmCalls)
+	assert.Equal(t, executeCheckpoint{
+		StatefulSet:    "cockroachdb",
+		Release:        "crdb",
+		MigratedNodes:  []int32{2, 1, 0},
+		CompletedSteps: []string{publicServiceStep, deletePDBStep, deleteStsStep, helmStep},
+	}, readCheckpoint(t, dir))
+
+	// Running the completed migration again is a no-op.
+	require.NoError(t, e.Run(ctx))
+	assert.Len(t, helmCalls, 1)
+}
+
+func TestExecutorFromPublicOperator(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeExecuteManifests(t, dir, "cockroachdb", 2)
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb", Namespace: executeTestNamespace},
+		Spec:       appsv1.StatefulSetSpec{Replicas: To(int32(2))},
+	}
+	publicSvc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb-public", Namespace: executeTestNamespace}}
+	ingress := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ui-cockroachdb", Namespace: executeTestNamespace}}
+	pdb := &policyv1.PodDisruptionBudget{ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb", Namespace: executeTestNamespace}}
+	clientset, dynamicClient := newExecuteTestEnv(t, sts, publicSvc, ingress, pdb)
+
+	var helmCalls [][]string
+	e := newTestExecutor(PublicOperatorSource, "cockroachdb", dir, "", clientset, dynamicClient, &helmCalls)
+	runHelm := e.runHelm
+	e.runHelm = func(ctx context.Context, args ...string) error {
+		// The StatefulSet is only deleted once the release is installed.
+		_, err := clientset.AppsV1().StatefulSets(executeTestNamespace).Get(ctx, "cockroachdb", metav1.GetOptions{})
+		require.NoError(t, err)
+		return runHelm(ctx, args...)
+	}
+	require.NoError(t, e.Run(ctx))
+
+	assert.Equal(t, [][]string{{"install", "cockroachdb", "./cockroachdb-parent/charts/cockroachdb",
+		"--namespace", executeTestNamespace, "--values", filepath.Join(dir, "values.yaml")}}, helmCalls)
+
+	svc, err := clientset.CoreV1().Services(executeTestNamespace).Get(ctx, "cockroachdb-public", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "cockroachdb", svc.Annotations[helmReleaseNameKey])
+	assert.Equal(t, executeTestNamespace, svc.Annotations[helmReleaseNsKey])
+	assert.Equal(t, "Helm", svc.Labels[helmManagedByLabel])
+	ui, err := clientset.NetworkingV1().Ingresses(executeTestNamespace).Get(ctx, "ui-cockroachdb", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "cockroachdb", ui.Annotations[helmReleaseNameKey])
+
+	_, err = clientset.AppsV1().StatefulSets(executeTestNamespace).Get(ctx, "cockroachdb", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = clientset.PolicyV1().PodDisruptionBudgets(executeTestNamespace).Get(ctx, "cockroachdb", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestExecutorUnhealthyCluster(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeExecuteManifests(t, dir, "cockroachdb", 3)
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "cockroachdb",
+			Namespace:   executeTestNamespace,
+			Annotations: map[string]string{helmReleaseNameKey: "crdb"},
+		},
+		Spec: appsv1.StatefulSetSpec{Replicas: To(int32(3))},
+	}
+	clientset, dynamicClient := newExecuteTestEnv(t, sts)
+
+	var helmCalls [][]string
+	checks := 0
+	e := newTestExecutor(HelmChartSource, "cockroachdb", dir, "", clientset, dynamicClient, &helmCalls)
+	e.healthTimeout = 100 * time.Millisecond
+	e.newHealthChecker = func(context.Context) (healthChecker, error) {
+		return &fakeHealthChecker{underReplicated: 4, checks: &checks}, nil
+	}
+
+	err := e.Run(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "refusing to release pod cockroachdb-2: cluster is unhealthy: 4 ranges are under-replicated")
+	assert.Positive(t, checks)
+
+	current, err := clientset.AppsV1().StatefulSets(executeTestNamespace).Get(ctx, "cockroachdb", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), *current.Spec.Replicas)
+	nodes, err := dynamicClient.Resource(crdbNodeGVR).Namespace(executeTestNamespace).List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, nodes.Items)
+}
+
+func TestCrdbNodeManifestOrdinals(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"crdbnode-0.yaml", "crdbnode-10.yaml", "crdbnode-2.yaml", "values.yaml", "crdbnode-x.yaml"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+
+	ordinals, err := crdbNodeManifestOrdinals(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []int32{10, 2, 0}, ordinals)
+}
@@ -31,13 +31,6 @@ import (
 const (
 	logConfigVolumeName            = "log-config"
 	crdbContainerName              = "db"
-	joinStrPrefix                  = "--join="
-	portPrefix                     = "--port="
-	httpPortPrefix                 = "--http-port="
-	insecureFlag                   = "--insecure"
-	localityFlag                   = "--locality"
-	logtostderrFlag                = "--logtostderr"
-	logFlag                        = "--log"
 	grpcName                       = "grpc"
 	grpcPort                       = 26258
 	sqlName                        = "sql"
@@ -65,7 +58,24 @@ type parsedMigrationInput struct {
 	caConfigMap      string
 	nodeSecretName   string
 	clientSecretName string
+	// providedCerts is set if the certificates are provided by the user rather than generated by the self-signer.
+	providedCerts    bool
 	pcrSpec          *v1alpha1.CrdbVirtualClusterSpec
+	podSpec          podSpecInput
+	walFailover      *startFlagValue
+	encryptionFlags  []startFlagValue
+	walFailoverSpec  *v1alpha1.CrdbWalFailoverSpec
+	dataStore        dataStoreInput
+	encryptionAtRest *v1alpha1.EncryptionAtRest
+	clusterSettings  map[string]string
+	// unrecognizedFlags holds the cockroach start arguments which aren't known start flags.
+	unrecognizedFlags []string
+	// unmappedFlags holds the start flags which couldn't be mapped to CrdbNode fields, with the reason.
+	unmappedFlags []string
+	// droppedFlags holds the flags which can't be carried over to the CrdbNodes, with the reason.
+	droppedFlags []string
+	// flagRoutes records where each parsed start flag was carried over to.
+	flagRoutes []flagRoute
 }
 
 type certManagerInput struct {
@@ -79,10 +89,21 @@ func To[T any](v T) *T {
 
 // yamlToDisk marshals the given data to YAML and writes it to the given path.
 func yamlToDisk(path string, data []any) error {
-	file, err := os.Create(path)
+	return yamlToDiskWithMode(path, 0644, data)
+}
+
+// yamlToDiskWithMode writes the objects as a multi document yaml file with the given permissions, which are also
+// applied to a file that already exists.
+func yamlToDiskWithMode(path string, mode os.FileMode, data []any) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return errors.Wrap(err, "creating file")
 	}
+	defer file.Close()
+
+	if err := file.Chmod(mode); err != nil {
+		return errors.Wrap(err, "setting file permissions")
+	}
 
 	for i := range data {
 		bytes, err := yaml.Marshal(data[i])
@@ -111,37 +132,19 @@ func yamlToDisk(path string, data []any) error {
 }
 
 // buildNodeSpecFromOperator builds a CrdbNodeSpec from a publicv1.CrdbCluster and a StatefulSet created by the public operator.
-func buildNodeSpecFromOperator(cluster publicv1.CrdbCluster, sts *appsv1.StatefulSet, nodeName string, startFlags *v1alpha1.Flags) v1alpha1.CrdbNodeSpec {
-	return v1alpha1.CrdbNodeSpec{
-		NodeName:                  nodeName,
+// The certificates are only set for clusters with TLS enabled.
+func buildNodeSpecFromOperator(cluster publicv1.CrdbCluster, sts *appsv1.StatefulSet, nodeName, podName string, input parsedMigrationInput) v1alpha1.CrdbNodeSpec {
+	spec := v1alpha1.CrdbNodeSpec{
+		NodeName: nodeName,
 		PodTemplate: &v1alpha1.PodTemplateSpec{
 			Metadata: v1alpha1.PodMeta{
 				Annotations: sts.Spec.Template.Annotations,
 				Labels:      sts.Spec.Template.Labels,
 			},
 			Spec: corev1.PodSpec{
-				Containers: []corev1.Container{
-					{
-						Image:     sts.Spec.Template.Spec.Containers[0].Image,
-						Name:      "cockroachdb",
-						Resources: sts.Spec.Template.Spec.Containers[0].Resources,
-						Env: append(sts.Spec.Template.Spec.Containers[0].Env, []corev1.EnvVar{
-							{
-								Name: "HOST_IP",
-								ValueFrom: &corev1.EnvVarSource{
-									FieldRef: &corev1.ObjectFieldSelector{
-										APIVersion: "v1",
-										FieldPath:  "status.hostIP",
-									},
-								},
-							},
-							{
-								Name:  "GODEBUG",
-								Value: "disablethp=1",
-							},
-						}...),
-					},
-				},
+				Containers:                    []corev1.Container{input.podSpec.crdbContainer()},
+				ImagePullSecrets:              input.podSpec.imagePullSecrets,
+				SecurityContext:               input.podSpec.securityContext,
 				ServiceAccountName:            cluster.Name,
 				Affinity:                      sts.Spec.Template.Spec.Affinity,
 				NodeSelector:                  sts.Spec.Template.Spec.NodeSelector,
@@ -150,167 +153,145 @@ func buildNodeSpecFromOperator(cluster publicv1.CrdbCluster, sts *appsv1.Statefu
 				TopologySpreadConstraints:     sts.Spec.Template.Spec.TopologySpreadConstraints,
 			},
 		},
-		StartFlags: startFlags,
-		DataStore: v1alpha1.DataStore{
-			VolumeClaimTemplate: &corev1.PersistentVolumeClaim{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: "datadir",
-				},
-				Spec: sts.Spec.VolumeClaimTemplates[0].Spec,
-			},
-		},
+		StartFlags:           input.startFlags,
+		SideCars:             input.podSpec.sideCars,
+		WALFailoverSpec:      input.walFailoverSpec,
+		EncryptionAtRest:     input.encryptionAtRest,
+		DataStore:            input.dataStore.crdbNodeDataStore(),
 		Domain:               "",
 		LoggingConfigMapName: cluster.Spec.LogConfigMap,
-		Image:                sts.Spec.Template.Spec.Containers[0].Image,
+		Image:                input.podSpec.container.Image,
 		GRPCPort:             cluster.Spec.GRPCPort,
 		SQLPort:              cluster.Spec.SQLPort,
 		HTTPPort:             cluster.Spec.HTTPPort,
-		Certificates: v1alpha1.Certificates{
+		PersistentVolumeClaimRetentionPolicy: &v1alpha1.CrdbNodePersistentVolumeClaimRetentionPolicy{
+			WhenDeleted: appsv1.RetainPersistentVolumeClaimRetentionPolicyType,
+		},
+	}
+	if input.tlsEnabled {
+		spec.Certificates = v1alpha1.Certificates{
 			ExternalCertificates: &v1alpha1.ExternalCertificates{
 				CAConfigMapName:         cluster.Name + "-ca-crt",
 				NodeSecretName:          cluster.Name + "-node-secret",
 				RootSQLClientSecretName: cluster.Name + "-client-secret",
 			},
-		},
-		PersistentVolumeClaimRetentionPolicy: &v1alpha1.CrdbNodePersistentVolumeClaimRetentionPolicy{
-			WhenDeleted: appsv1.RetainPersistentVolumeClaimRetentionPolicyType,
-		},
+		}
 	}
+	applyPublicOperatorPodSettings(cluster, spec.PodTemplate)
+	input.dataStore.addNodeVolumes(spec.PodTemplate, podName)
+
+	return spec
 }
 
-// buildHelmValuesFromOperator builds a map of values for the CockroachDB Helm chart from a publicv1.CrdbCluster and a StatefulSet created by the public operator.
+// buildHelmValuesFromOperator builds the values for the CockroachDB Helm chart from a publicv1.CrdbCluster and a StatefulSet created by the public operator.
 func buildHelmValuesFromOperator(
 	cluster publicv1.CrdbCluster,
 	sts *appsv1.StatefulSet,
 	cloudProvider string,
 	cloudRegion string,
 	namespace string,
-	flags *v1alpha1.Flags) map[string]interface{} {
-
-	ingressValue := buildIngressValue(cluster)
-	envVars := append(sts.Spec.Template.Spec.Containers[0].Env, []corev1.EnvVar{
-		{
-			Name: "HOST_IP",
-			ValueFrom: &corev1.EnvVarSource{
-				FieldRef: &corev1.ObjectFieldSelector{
-					APIVersion: "v1",
-					FieldPath:  "status.hostIP",
-				},
-			},
-		},
-		{
-			Name:  "GODEBUG",
-			Value: "disablethp=1",
-		},
-	}...)
-
-	return map[string]interface{}{
-		"cockroachdb": map[string]interface{}{
-			"tls": map[string]interface{}{
-				"enabled": cluster.Spec.TLSEnabled,
-				"selfSigner": map[string]interface{}{
-					"enabled": false,
-				},
-				"externalCertificates": map[string]interface{}{
-					"enabled": true,
-					"certificates": map[string]interface{}{
-						"caConfigMapName":         cluster.Name + "-ca-crt",
-						"nodeSecretName":          cluster.Name + "-node-secret",
-						"rootSqlClientSecretName": cluster.Name + "-client-secret",
+	input parsedMigrationInput) helmValues {
+
+	container := input.podSpec.crdbContainer()
+	container.Image = publicOperatorImage(cluster, input.podSpec.container)
+
+	values := helmValues{
+		CockroachDB: cockroachDBValues{
+			TLS: tlsValues{
+				Enabled: true,
+				ExternalCertificates: &externalCertificatesValues{
+					Enabled: true,
+					Certificates: v1alpha1.ExternalCertificates{
+						CAConfigMapName:         cluster.Name + "-ca-crt",
+						NodeSecretName:          cluster.Name + "-node-secret",
+						RootSQLClientSecretName: cluster.Name + "-client-secret",
 					},
 				},
 			},
-			"crdbCluster": map[string]interface{}{
-				"image": map[string]interface{}{
-					"name": cluster.Spec.Image.Name,
+			CrdbCluster: crdbClusterValues{
+				Image: imageValues{
+					Name: container.Image,
 				},
-				"startFlags": flags,
-				"regions": []map[string]interface{}{
+				StartFlags: startFlagsValue(input.startFlags),
+				Regions: []v1alpha1.CrdbClusterRegion{
 					{
-						"namespace":     namespace,
-						"cloudProvider": cloudProvider,
-						"code":          cloudRegion,
-						"nodes":         cluster.Spec.Nodes,
-						"domain":        "",
+						Namespace:     namespace,
+						CloudProvider: cloudProvider,
+						Code:          cloudRegion,
+						Nodes:         cluster.Spec.Nodes,
 					},
 				},
-				"dataStore": map[string]interface{}{
-					"volumeClaimTemplate": map[string]interface{}{
-						"metadata": map[string]interface{}{
-							"name": "datadir",
+				DataStore: dataStoreValues{
+					VolumeClaimTemplate: volumeClaimTemplateValues{
+						Metadata: objectNameValues{
+							Name: input.dataStore.volumeClaimTemplate.Name,
 						},
-						"spec": sts.Spec.VolumeClaimTemplates[0].Spec,
+						Spec: input.dataStore.volumeClaimTemplate.Spec,
 					},
 				},
-				"service": map[string]interface{}{
-					"ports": map[string]interface{}{
-						"grpc": map[string]interface{}{
-							"port": cluster.Spec.GRPCPort,
-						},
-						"http": map[string]interface{}{
-							"port": cluster.Spec.HTTPPort,
-						},
-						"sql": map[string]interface{}{
-							"port": cluster.Spec.SQLPort,
-						},
+				Service: serviceValues{
+					Ports: servicePortsValues{
+						GRPC: portValues{Port: cluster.Spec.GRPCPort},
+						HTTP: portValues{Port: cluster.Spec.HTTPPort},
+						SQL:  portValues{Port: cluster.Spec.SQLPort},
 					},
-					"public": map[string]interface{}{
-						"name": cluster.Name + "-public",
+					Public: &publicServiceValues{
+						Name: cluster.Name + "-public",
 					},
-					"ingress": ingressValue,
+					Ingress: buildIngressValue(cluster),
 				},
-				"loggingConfigMapName":      cluster.Spec.LogConfigMap,
-				"podLabels":                 sts.Spec.Template.Labels,
-				"podTemplate": map[string]interface{}{
-					"metadata": map[string]interface{}{
-						"labels":      sts.Spec.Template.Labels,
-						"annotations": sts.Spec.Template.Annotations,
+				LoggingConfigMapName: cluster.Spec.LogConfigMap,
+				PodLabels:            sts.Spec.Template.Labels,
+				PodTemplate: &v1alpha1.PodTemplateSpec{
+					Metadata: v1alpha1.PodMeta{
+						Labels:      sts.Spec.Template.Labels,
+						Annotations: sts.Spec.Template.Annotations,
 					},
-					"spec": map[string]interface{}{
-						"containers": []map[string]interface{}{
-							{
-								"image":     cluster.Spec.Image.Name,
-								"env":       envVars,
-								"resources": sts.Spec.Template.Spec.Containers[0].Resources,
-								"name":      "cockroachdb",
-							},
-						},
-						"affinity":                      sts.Spec.Template.Spec.Affinity,
-						"nodeSelector":                  sts.Spec.Template.Spec.NodeSelector,
-						"tolerations":                   sts.Spec.Template.Spec.Tolerations,
-						"terminationGracePeriodSeconds": cluster.Spec.TerminationGracePeriodSecs,
-						"topologySpreadConstraints":     sts.Spec.Template.Spec.TopologySpreadConstraints,
+					Spec: corev1.PodSpec{
+						Containers:                    []corev1.Container{container},
+						Affinity:                      sts.Spec.Template.Spec.Affinity,
+						NodeSelector:                  sts.Spec.Template.Spec.NodeSelector,
+						Tolerations:                   sts.Spec.Template.Spec.Tolerations,
+						TerminationGracePeriodSeconds: To(cluster.Spec.TerminationGracePeriodSecs),
+						TopologySpreadConstraints:     sts.Spec.Template.Spec.TopologySpreadConstraints,
 					},
 				},
 			},
 		},
-		"k8s": map[string]interface{}{
-			"fullnameOverride": cluster.Name,
+		K8s: &k8sValues{
+			FullnameOverride: cluster.Name,
 		},
 	}
+	if !input.tlsEnabled {
+		values.CockroachDB.TLS = tlsValues{}
+	}
+	addPodSpecValues(&values, input.podSpec)
+	addStoreValues(&values, input)
+
+	return values
 }
 
 // buildIngressValue constructs the ingress section of the Helm values
-func buildIngressValue(cluster publicv1.CrdbCluster) map[string]interface{} {
+func buildIngressValue(cluster publicv1.CrdbCluster) *ingressValues {
 	spec := cluster.Spec.Ingress
 	if spec == nil {
-		return map[string]interface{}{"enabled": false}
+		return &ingressValues{Enabled: false}
 	}
 
-	result := map[string]interface{}{"enabled": true}
+	result := &ingressValues{Enabled: true}
 
 	if spec.UI != nil {
-		result["ui"] = map[string]interface{}{
-			"ingressClassName": spec.UI.IngressClassName,
-			"annotations":      spec.UI.Annotations,
-			"host":             spec.UI.Host,
+		result.UI = &ingressHostValues{
+			IngressClassName: spec.UI.IngressClassName,
+			Annotations:      spec.UI.Annotations,
+			Host:             spec.UI.Host,
 		}
 	}
 	if spec.SQL != nil {
-		result["sql"] = map[string]interface{}{
-			"ingressClassName": spec.SQL.IngressClassName,
-			"annotations":      spec.SQL.Annotations,
-			"host":             spec.SQL.Host,
+		result.SQL = &ingressHostValues{
+			IngressClassName: spec.SQL.IngressClassName,
+			Annotations:      spec.SQL.Annotations,
+			Host:             spec.SQL.Host,
 		}
 	}
 	return result
@@ -359,41 +340,24 @@ func detectPCRFromInitJob(clientset kubernetes.Interface, stsName, namespace str
 }
 
 // buildNodeSpecFromHelm builds a CrdbNodeSpec from a StatefulSet created by the CockroachDB Helm chart.
+// The certificates are only set for clusters which aren't started with --insecure.
 func buildNodeSpecFromHelm(
 	sts *appsv1.StatefulSet,
 	nodeName string,
+	podName string,
 	input parsedMigrationInput) v1alpha1.CrdbNodeSpec {
 
-	return v1alpha1.CrdbNodeSpec{
-		NodeName:                  nodeName,
+	spec := v1alpha1.CrdbNodeSpec{
+		NodeName: nodeName,
 		PodTemplate: &v1alpha1.PodTemplateSpec{
 			Metadata: v1alpha1.PodMeta{
 				Labels:      sts.Spec.Template.Labels,
 				Annotations: sts.Spec.Template.Annotations,
 			},
 			Spec: corev1.PodSpec{
-				Containers: []corev1.Container{
-					{
-						Image:     sts.Spec.Template.Spec.Containers[0].Image,
-						Name:      "cockroachdb",
-						Resources: sts.Spec.Template.Spec.Containers[0].Resources,
-						Env: append(sts.Spec.Template.Spec.Containers[0].Env, []corev1.EnvVar{
-							{
-								Name: "HOST_IP",
-								ValueFrom: &corev1.EnvVarSource{
-									FieldRef: &corev1.ObjectFieldSelector{
-										APIVersion: "v1",
-										FieldPath:  "status.hostIP",
-									},
-								},
-							},
-							{
-								Name:  "GODEBUG",
-								Value: "disablethp=1",
-							},
-						}...),
-					},
-				},
+				Containers:                    []corev1.Container{input.podSpec.crdbContainer()},
+				ImagePullSecrets:              input.podSpec.imagePullSecrets,
+				SecurityContext:               input.podSpec.securityContext,
 				ServiceAccountName:            sts.Name,
 				Affinity:                      sts.Spec.Template.Spec.Affinity,
 				NodeSelector:                  sts.Spec.Template.Spec.NodeSelector,
@@ -402,35 +366,36 @@ func buildNodeSpecFromHelm(
 				TopologySpreadConstraints:     sts.Spec.Template.Spec.TopologySpreadConstraints,
 			},
 		},
-		StartFlags: input.startFlags,
-		DataStore: v1alpha1.DataStore{
-			VolumeClaimTemplate: &corev1.PersistentVolumeClaim{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: "datadir",
-				},
-				Spec: sts.Spec.VolumeClaimTemplates[0].Spec,
-			},
-		},
+		StartFlags:           input.startFlags,
+		SideCars:             input.podSpec.sideCars,
+		WALFailoverSpec:      input.walFailoverSpec,
+		EncryptionAtRest:     input.encryptionAtRest,
+		DataStore:            input.dataStore.crdbNodeDataStore(),
 		Domain:               "",
 		LocalityLabels:       input.localityLabels,
 		LoggingConfigMapName: input.loggingConfigMap,
-		Image:                sts.Spec.Template.Spec.Containers[0].Image,
+		Image:                input.podSpec.container.Image,
 		GRPCPort:             &input.grpcPort,
 		SQLPort:              &input.sqlPort,
 		HTTPPort:             &input.httpPort,
-		Certificates: v1alpha1.Certificates{
+		PersistentVolumeClaimRetentionPolicy: &v1alpha1.CrdbNodePersistentVolumeClaimRetentionPolicy{
+			WhenDeleted: appsv1.RetainPersistentVolumeClaimRetentionPolicyType,
+		},
+		VirtualCluster: input.pcrSpec,
+	}
+	if input.tlsEnabled {
+		spec.Certificates = v1alpha1.Certificates{
 			ExternalCertificates: &v1alpha1.ExternalCertificates{
 				CAConfigMapName:         input.caConfigMap,
 				NodeSecretName:          input.nodeSecretName,
 				RootSQLClientSecretName: input.clientSecretName,
 				HTTPSecretName:          input.clientSecretName,
 			},
-		},
-		PersistentVolumeClaimRetentionPolicy: &v1alpha1.CrdbNodePersistentVolumeClaimRetentionPolicy{
-			WhenDeleted: appsv1.RetainPersistentVolumeClaimRetentionPolicyType,
-		},
-		VirtualCluster: input.pcrSpec,
+		}
 	}
+	input.dataStore.addNodeVolumes(spec.PodTemplate, podName)
+
+	return spec
 }
 
 // buildHelmValuesFromHelm builds a values.yaml for the CockroachDB Enterprise Operator Helm chart from a StatefulSet created by the CockroachDB Helm chart.
@@ -439,122 +404,96 @@ func buildHelmValuesFromHelm(
 	cloudProvider string,
 	cloudRegion string,
 	namespace string,
-	input parsedMigrationInput) map[string]interface{} {
-
-	tls := map[string]interface{}{
-		"enabled": input.tlsEnabled,
-		"selfSigner": map[string]interface{}{
-			"enabled": false,
-		},
-		"externalCertificates": map[string]interface{}{
-			"enabled": true,
-			"certificates": map[string]interface{}{
-				"caConfigMapName":         input.caConfigMap,
-				"nodeSecretName":          input.nodeSecretName,
-				"rootSqlClientSecretName": input.clientSecretName,
-				"httpSecretName":          input.clientSecretName,
+	input parsedMigrationInput) helmValues {
+
+	container := input.podSpec.crdbContainer()
+	tls := tlsValues{
+		Enabled: true,
+		ExternalCertificates: &externalCertificatesValues{
+			Enabled: true,
+			Certificates: v1alpha1.ExternalCertificates{
+				CAConfigMapName:         input.caConfigMap,
+				NodeSecretName:          input.nodeSecretName,
+				RootSQLClientSecretName: input.clientSecretName,
+				HTTPSecretName:          input.clientSecretName,
 			},
 		},
 	}
-	if input.certManagerInput != nil {
-		tls = map[string]interface{}{
-			"enabled": input.tlsEnabled,
-			"selfSigner": map[string]interface{}{
-				"enabled": false,
-			},
-			"certManager": map[string]interface{}{
-				"enabled":          true,
-				"caConfigMap":      input.caConfigMap,
-				"nodeSecret":       input.nodeSecretName,
-				"clientRootSecret": input.clientSecretName,
-				"issuer": map[string]interface{}{
-					"name": input.certManagerInput.issuerName,
-					"kind": input.certManagerInput.issuerKind,
+	switch {
+	case !input.tlsEnabled:
+		tls = tlsValues{}
+	case input.certManagerInput != nil:
+		tls = tlsValues{
+			Enabled: true,
+			CertManager: &certManagerValues{
+				Enabled:          true,
+				CAConfigMap:      input.caConfigMap,
+				NodeSecret:       input.nodeSecretName,
+				ClientRootSecret: input.clientSecretName,
+				Issuer: issuerValues{
+					Name: input.certManagerInput.issuerName,
+					Kind: input.certManagerInput.issuerKind,
 				},
 			},
 		}
 	}
 
-	return map[string]interface{}{
-		"cockroachdb": map[string]interface{}{
-			"tls": tls,
-			"crdbCluster": map[string]interface{}{
-				"image": map[string]interface{}{
-					"name": sts.Spec.Template.Spec.Containers[0].Image,
+	values := helmValues{
+		CockroachDB: cockroachDBValues{
+			TLS: tls,
+			CrdbCluster: crdbClusterValues{
+				Image: imageValues{
+					Name: container.Image,
 				},
-				"localityLabels": input.localityLabels,
-				"startFlags":     input.startFlags,
-				"regions": []map[string]interface{}{
+				LocalityLabels: input.localityLabels,
+				StartFlags:     startFlagsValue(input.startFlags),
+				Regions: []v1alpha1.CrdbClusterRegion{
 					{
-						"namespace":     namespace,
-						"cloudProvider": cloudProvider,
-						"code":          cloudRegion,
-						"nodes":         sts.Spec.Replicas,
-						"domain":        "",
+						Namespace:     namespace,
+						CloudProvider: cloudProvider,
+						Code:          cloudRegion,
+						Nodes:         *sts.Spec.Replicas,
 					},
 				},
-				"dataStore": map[string]interface{}{
-					"volumeClaimTemplate": map[string]interface{}{
-						"metadata": map[string]interface{}{
-							"name": "datadir",
+				DataStore: dataStoreValues{
+					VolumeClaimTemplate: volumeClaimTemplateValues{
+						Metadata: objectNameValues{
+							Name: input.dataStore.volumeClaimTemplate.Name,
 						},
-						"spec": sts.Spec.VolumeClaimTemplates[0].Spec,
+						Spec: input.dataStore.volumeClaimTemplate.Spec,
 					},
 				},
-				"virtualCluster": input.pcrSpec,
-				"service": map[string]interface{}{
-					"ports": map[string]interface{}{
-						"grpc": map[string]interface{}{
-							"port": input.grpcPort,
-						},
-						"http": map[string]interface{}{
-							"port": input.httpPort,
-						},
-						"sql": map[string]interface{}{
-							"port": input.sqlPort,
-						},
+				VirtualCluster: input.pcrSpec,
+				Service: serviceValues{
+					Ports: servicePortsValues{
+						GRPC: portValues{Port: &input.grpcPort},
+						HTTP: portValues{Port: &input.httpPort},
+						SQL:  portValues{Port: &input.sqlPort},
 					},
 				},
-				"loggingConfigMapName":      input.loggingConfigMap,
-				"podLabels":                 sts.Spec.Template.Labels,
-				"podTemplate": map[string]interface{}{
-					"metadata": map[string]interface{}{
-						"labels":      sts.Spec.Template.Labels,
-						"annotations": sts.Spec.Template.Annotations,
+				LoggingConfigMapName: input.loggingConfigMap,
+				PodLabels:            sts.Spec.Template.Labels,
+				PodTemplate: &v1alpha1.PodTemplateSpec{
+					Metadata: v1alpha1.PodMeta{
+						Labels:      sts.Spec.Template.Labels,
+						Annotations: sts.Spec.Template.Annotations,
 					},
-					"spec": map[string]interface{}{
-						"affinity":                      sts.Spec.Template.Spec.Affinity,
-						"nodeSelector":                  sts.Spec.Template.Spec.NodeSelector,
-						"tolerations":                   sts.Spec.Template.Spec.Tolerations,
-						"terminationGracePeriodSeconds": *sts.Spec.Template.Spec.TerminationGracePeriodSeconds,
-						"topologySpreadConstraints":     sts.Spec.Template.Spec.TopologySpreadConstraints,
-						"containers": []map[string]interface{}{
-							{
-								"image": sts.Spec.Template.Spec.Containers[0].Image,
-								"env": append(sts.Spec.Template.Spec.Containers[0].Env, []corev1.EnvVar{
-									{
-										Name: "HOST_IP",
-										ValueFrom: &corev1.EnvVarSource{
-											FieldRef: &corev1.ObjectFieldSelector{
-												APIVersion: "v1",
-												FieldPath:  "status.hostIP",
-											},
-										},
-									},
-									{
-										Name:  "GODEBUG",
-										Value: "disablethp=1",
-									},
-								}...),
-								"resources": sts.Spec.Template.Spec.Containers[0].Resources,
-								"name":      "cockroachdb",
-							},
-						},
+					Spec: corev1.PodSpec{
+						Affinity:                      sts.Spec.Template.Spec.Affinity,
+						NodeSelector:                  sts.Spec.Template.Spec.NodeSelector,
+						Tolerations:                   sts.Spec.Template.Spec.Tolerations,
+						TerminationGracePeriodSeconds: sts.Spec.Template.Spec.TerminationGracePeriodSeconds,
+						TopologySpreadConstraints:     sts.Spec.Template.Spec.TopologySpreadConstraints,
+						Containers:                    []corev1.Container{container},
 					},
 				},
 			},
 		},
 	}
+	addPodSpecValues(&values, input.podSpec)
+	addStoreValues(&values, input)
+
+	return values
 }
 
 // generateParsedMigrationInput parses the command arguments, extracts the --join string, and replaces env variables.
@@ -562,7 +501,6 @@ func generateParsedMigrationInput(
 	ctx context.Context,
 	clientset kubernetes.Interface,
 	sts *appsv1.StatefulSet) (parsedMigrationInput, error) {
-	var startCmd string
 	var parsedInput = parsedMigrationInput{
 		tlsEnabled: true,
 	}
@@ -580,13 +518,27 @@ func generateParsedMigrationInput(
 		}
 	}
 
-	for _, c := range sts.Spec.Template.Spec.Containers {
-		if c.Name == crdbContainerName {
-			startCmd = c.Args[2]
-		}
+	podSpec, err := generatePodSpecInput(sts)
+	if err != nil {
+		return parsedInput, err
+	}
+	parsedInput.podSpec = podSpec
+
+	args, err := cockroachStartArgs(podSpec.container)
+	if err != nil {
+		return parsedInput, err
+	}
+	if err := extractJoinStringAndFlags(&parsedInput, args, containerEnv(podSpec.container)); err != nil {
+		return parsedInput, err
+	}
+	if err := mapStoreFlags(ctx, clientset, sts, &parsedInput); err != nil {
+		return parsedInput, err
+	}
+	if err := mapVolumeClaimTemplates(sts, &parsedInput); err != nil {
+		return parsedInput, err
 	}
 
-	if err := extractJoinStringAndFlags(&parsedInput, strings.Fields(startCmd)); err != nil {
+	if parsedInput.clusterSettings, err = clusterSettingsFromInitSecret(ctx, clientset, sts); err != nil {
 		return parsedInput, err
 	}
 
@@ -595,7 +547,7 @@ func generateParsedMigrationInput(
 
 // certificatesInput checks if the node certificate exists in the cluster and adds the certificate input based on
 // the presence of the node certificate. If the node certificate is present, it means the cert-manager manages the certificates.
-// If not, then certs are managed by self-signer utility
+// If not, then certs are managed by self-signer utility, unless the pods mount secrets provided by the user.
 func certificatesInput(ctx context.Context, dynamicClient dynamic.Interface, parsedInput *parsedMigrationInput, sts *appsv1.StatefulSet) error {
 	var (
 		err error
@@ -609,6 +561,11 @@ func certificatesInput(ctx context.Context, dynamicClient dynamic.Interface, par
 		parsedInput.caConfigMap = fmt.Sprintf("%s-ca-secret-crt", sts.Name)
 		parsedInput.nodeSecretName = fmt.Sprintf("%s-node-secret", sts.Name)
 		parsedInput.clientSecretName = fmt.Sprintf("%s-client-secret", sts.Name)
+		// The self-signer generates the secrets named after the StatefulSet, other secrets were provided through
+		// tls.certs.provided. They are copied to the secrets above when the certificates are migrated.
+		nodeSecret, clientSecret := certificateSecrets(sts.Spec.Template.Spec.Volumes)
+		parsedInput.providedCerts = (nodeSecret != "" && nodeSecret != parsedInput.nodeSecretName) ||
+			(clientSecret != "" && clientSecret != parsedInput.clientSecretName)
 		return nil
 	}
 
@@ -629,66 +586,6 @@ func certificatesInput(ctx context.Context, dynamicClient dynamic.Interface, par
 	return nil
 }
 
-// extractJoinStringAndFlags parses the command arguments, extracts the --join string, and replaces env variables.
-func extractJoinStringAndFlags(
-	parsedInput *parsedMigrationInput,
-	args []string) error {
-
-	flags := &v1alpha1.Flags{}
-	// Regular expression to match flags (e.g., --advertise-host=something)
-	flagRegex := regexp.MustCompile(`--([\w-]+)=(.*)`)
-
-	for _, arg := range args {
-		switch {
-		case strings.HasPrefix(arg, joinStrPrefix):
-			flags.Upsert = append(flags.Upsert, arg)
-		case strings.HasPrefix(arg, portPrefix):
-			num, err := parseInt32(strings.TrimPrefix(arg, portPrefix))
-			if err != nil {
-				return fmt.Errorf("invalid --port value: %w", err)
-			}
-			parsedInput.sqlPort = num
-
-		case strings.HasPrefix(arg, httpPortPrefix):
-			num, err := parseInt32(strings.TrimPrefix(arg, httpPortPrefix))
-			if err != nil {
-				return fmt.Errorf("invalid --http-port value: %w", err)
-			}
-			parsedInput.httpPort = num
-
-		case strings.HasPrefix(arg, insecureFlag):
-			parsedInput.tlsEnabled = false
-
-		case strings.HasPrefix(arg, localityFlag):
-			value := strings.TrimPrefix(arg, localityFlag+"=")
-			labels := strings.Split(value, ",")
-			for i := range labels {
-				parsedInput.localityLabels = append(parsedInput.localityLabels, strings.Split(labels[i], "=")[0])
-			}
-
-		// CockroachDB Enterprise Operator automatically adds "--logs" flag if it is not present.
-		case strings.HasPrefix(arg, logtostderrFlag):
-			continue
-
-		case strings.HasPrefix(arg, logFlag):
-			continue
-
-		default:
-			if matches := flagRegex.FindStringSubmatch(arg); len(matches) == 3 {
-				flags.Upsert = append(flags.Upsert, fmt.Sprintf("--%s=%s", matches[1], matches[2]))
-			}
-			parsedInput.startFlags = flags
-		}
-	}
-
-	// The helm chart configures crdb to listen for grpc and sql on one port and for http on another.
-	// The cloud operator uses three distinct ports for grpc, sql, and http.
-	// Default port for grpc is 26258
-	parsedInput.grpcPort = 26258
-
-	return nil
-}
-
 // parseInt32 safely converts a string to int32
 func parseInt32(value string) (int32, error) {
 	num, err := strconv.ParseInt(value, 10, 32) // Base 10, 32-bit size
@@ -758,7 +655,7 @@ func moveConfigMapKey(ctx context.Context, clientset kubernetes.Interface, names
 }
 
 // generateUpdatedPublicServiceConfig updates the "cockroachdb-public" service with separate sql and grpc ports.
-func generateUpdatedPublicServiceConfig(ctx context.Context, clientset kubernetes.Interface, namespace, name, outputDir string) error {
+func generateUpdatedPublicServiceConfig(ctx context.Context, clientset kubernetes.Interface, namespace, name string, out *outputFiles) error {
 	var (
 		grpcFound, sqlFound bool
 	)
@@ -804,7 +701,7 @@ func generateUpdatedPublicServiceConfig(ctx context.Context, clientset kubernete
 		Kind:       "Service",
 	}
 
-	err = yamlToDisk(filepath.Join(outputDir, publicSvcYaml), []any{svc})
+	err = out.write(publicSvcYaml, []any{svc})
 	if err != nil {
 		panic(err)
 	}
@@ -813,7 +710,7 @@ func generateUpdatedPublicServiceConfig(ctx context.Context, clientset kubernete
 }
 
 // buildRBACFromPublicOperator builds the RBAC resources from the public operator which is used by the cockroachdb enterprise operator.
-func buildRBACFromPublicOperator(cluster publicv1.CrdbCluster, outputDir string) error {
+func buildRBACFromPublicOperator(cluster publicv1.CrdbCluster, out *outputFiles) error {
 	clusterRole := &rbacv1.ClusterRole{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: "rbac.authorization.k8s.io/v1",
@@ -945,11 +842,11 @@ func buildRBACFromPublicOperator(cluster publicv1.CrdbCluster, outputDir string)
 		},
 	}
 
-	return yamlToDisk(filepath.Join(outputDir, "rbac.yaml"), []any{clusterRole, clusterRoleBinding, role, roleBinding, serviceAccount})
+	return out.write("rbac.yaml", []any{clusterRole, clusterRoleBinding, role, roleBinding, serviceAccount})
 }
 
 // backupCAIssuerAndCert if generated by the previous helm chart.
-func backupCAIssuerAndCert(ctx context.Context, dynamicClient dynamic.Interface, sts *appsv1.StatefulSet, outputDir string) error {
+func backupCAIssuerAndCert(ctx context.Context, dynamicClient dynamic.Interface, sts *appsv1.StatefulSet, out *outputFiles) error {
 	certManagerResources := []struct {
 		name     string
 		resource string
@@ -989,10 +886,10 @@ func backupCAIssuerAndCert(ctx context.Context, dynamicClient dynamic.Interface,
 			continue
 		}
 
-		if err := yamlToDisk(filepath.Join(outputDir, resourceName+".yaml"), []any{resource}); err != nil {
+		if err := out.write(resourceName+".yaml", []any{resource}); err != nil {
 			return fmt.Errorf("failed to write %s to disk: %w", resourceType, err)
 		}
-		fmt.Printf("📁Backed up %s %s to %s\n", resourceType, resourceName, filepath.Join(outputDir, resourceName+".yaml"))
+		fmt.Printf("📁Backed up %s %s to %s\n", resourceType, resourceName, filepath.Join(out.dir, resourceName+".yaml"))
 	}
 
 	fmt.Println("⚙️ After helm upgrade, the backed up resources will be removed. Please recreate these resource after upgrade.")
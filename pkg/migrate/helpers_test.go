@@ -16,6 +16,8 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
 	"sigs.k8s.io/yaml"
 )
@@ -120,7 +122,7 @@ func TestExtractJoinStringAndFlags(t *testing.T) {
 		"--max-sql-memory=25%",
 	}
 
-	err := extractJoinStringAndFlags(&input, args)
+	err := extractJoinStringAndFlags(&input, args, nil)
 
 	assert.NoError(t, err)
 	assert.Equal(t, int32(26257), input.sqlPort)
@@ -175,6 +177,34 @@ func TestGenerateParsedMigrationInput(t *testing.T) {
 	assert.Equal(t, expectedFlags, input.startFlags.Upsert)
 }
 
+func TestCertificatesInput(t *testing.T) {
+	sts := appsv1.StatefulSet{}
+	manifestBytes, err := os.ReadFile("testdata/helm/allInput/cockroachdb-statefulset.yaml")
+	require.NoError(t, err)
+	require.NoError(t, yaml.Unmarshal(manifestBytes, &sts))
+	// Without a node Certificate, the certificates are not issued by cert-manager.
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	input := parsedMigrationInput{tlsEnabled: true}
+	require.NoError(t, certificatesInput(context.TODO(), dynamicClient, &input, &sts))
+	assert.False(t, input.providedCerts)
+	assert.Equal(t, selfSignerCertificates, newHelmChartReport(&sts, input, pcrState{}, "", nil).Certificates.Mode)
+
+	// Certificates provided with tls.certs.provided are mounted from the secrets of the user.
+	for _, volume := range sts.Spec.Template.Spec.Volumes {
+		if volume.Projected != nil {
+			volume.Projected.Sources[0].Secret.Name = "cockroachdb-node"
+		}
+	}
+	input = parsedMigrationInput{tlsEnabled: true}
+	require.NoError(t, certificatesInput(context.TODO(), dynamicClient, &input, &sts))
+	assert.True(t, input.providedCerts)
+	assert.Equal(t, "cockroachdb-node-secret", input.nodeSecretName)
+	report := newHelmChartReport(&sts, input, pcrState{}, "", nil)
+	assert.Equal(t, externalCertificates, report.Certificates.Mode)
+	assert.Equal(t, "cockroachdb-node-secret", report.Certificates.NodeSecret)
+}
+
 func TestUpdatePublicService(t *testing.T) {
 	var grpcFound, sqlFound bool
 	clientset := fake.NewSimpleClientset()
@@ -191,7 +221,7 @@ func TestUpdatePublicService(t *testing.T) {
 	_, err = clientset.CoreV1().Services(namespace).Create(ctx, svc, metav1.CreateOptions{})
 	require.NoError(t, err)
 
-	err = generateUpdatedPublicServiceConfig(ctx, clientset, namespace, serviceName, ".")
+	err = generateUpdatedPublicServiceConfig(ctx, clientset, namespace, serviceName, &outputFiles{dir: "."})
 	require.NoError(t, err)
 
 	svcBytes, err := os.ReadFile(publicSvcYaml)
@@ -225,7 +255,7 @@ func TestBuildRBACFromPublicOperator(t *testing.T) {
 		},
 	}
 
-	err := buildRBACFromPublicOperator(cluster, ".")
+	err := buildRBACFromPublicOperator(cluster, &outputFiles{dir: "."})
 	require.NoError(t, err)
 
 	// Read and parse the generated RBAC yaml file
@@ -1,17 +1,31 @@
 package migrate
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/cenkalti/backoff"
 	certv1 "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	"github.com/cockroachdb/helm-charts/pkg/generator"
 	"github.com/cockroachdb/helm-charts/pkg/kube"
@@ -23,85 +37,101 @@ import (
 
 var ctx = context.Background()
 
-func GenerateCertsForOperator(cl client.Client, namespace string, rc *generator.GenerateCert) error {
+// Sources of the certificates of a cluster.
+const (
+	helmCertSource     = "helm"
+	operatorCertSource = "operator"
+)
+
+// CertManagerOptions configures the migration of the certificates of a cluster using cert-manager.
+type CertManagerOptions struct {
+	// CreateTrustBundle creates a trust-manager Bundle, or a plain ConfigMap if trust-manager isn't installed,
+	// instead of printing the Bundle to apply.
+	CreateTrustBundle bool
+	// TrustBundleTimeout is how long to wait for trust-manager to sync the Bundle to the ConfigMap.
+	TrustBundleTimeout time.Duration
+	// IssueTimeout is how long to wait for cert-manager to re-issue the node certificate.
+	IssueTimeout time.Duration
+	// ClusterResourceNamespace is the namespace of the CA secrets of ClusterIssuers.
+	ClusterResourceNamespace string
+}
+
+// bundleGVK is the trust-manager Bundle, which copies CA certificates to ConfigMaps.
+var bundleGVK = schema.GroupVersionKind{Group: "trust.cert-manager.io", Version: "v1alpha1", Kind: "Bundle"}
+
+// certificateLayout is where the certificates of a cluster are stored. The secrets are read from the volumes of
+// the StatefulSet and from the CrdbCluster, rather than derived from the naming conventions of the deployment.
+type certificateLayout struct {
+	source string
+	// nodeSecret and clientSecret are the secrets mounted by the cockroach pods.
+	nodeSecret   string
+	clientSecret string
+}
+
+// caConfigMapPrefix returns the name of the CA ConfigMap without its -crt suffix, as referenced by the manifests
+// generated by build-manifest.
+func (l certificateLayout) caConfigMapPrefix(stsName string) string {
+	if l.source == operatorCertSource {
+		return fmt.Sprintf("%s-ca", stsName)
+	}
+	return fmt.Sprintf("%s-ca-secret", stsName)
+}
+
+// GenerateCertsForOperator issues the certificates required by the CockroachDB Enterprise Operator:
+//
+//   - if the node certificate is issued by cert-manager, the join service is added to the DNS names of its
+//     Certificate;
+//   - if the CA key is stored in the cluster, or provided with rc.CaSecret, new node and client certificates
+//     are signed with it;
+//   - otherwise, the existing certificates are reused if they are already valid for the join service.
+func GenerateCertsForOperator(cl client.Client, namespace string, rc *generator.GenerateCert, certManager CertManagerOptions) error {
 	certsDir, cleanup := util.CreateTempDir("certsDir")
 	defer cleanup()
 	rc.CertsDir = certsDir
 
 	rc.CAKey = filepath.Join(certsDir, "ca.key")
 
-	operatorType, err := identifyHelmOrPublicOperator(cl, rc.DiscoveryServiceName, namespace)
+	layout, err := detectCertificateLayout(cl, rc.DiscoveryServiceName, namespace)
 	if err != nil {
 		return err
 	}
 
-	if operatorType == "helm" {
-		isCertManager, err := updateCertsForCertManager(cl, rc, namespace)
-		if err != nil {
-			return err
-		}
-		if isCertManager {
-			var caSecret = "cockroach-ca"
-			if rc.CaSecret != "" {
-				caSecret = rc.CaSecret
-			}
-			// If the cert-manager is used, we don't need to generate the certs.
-			fmt.Println("✅ Successfully updated the cockroachdb-node certificate to include the new DNS names.")
-
-			fmt.Println()
-			fmt.Println("ℹ️  Note: By default, cert-manager stores the CA certificate in a Secret, which is used by the Issuer.")
-			fmt.Println()
-			fmt.Println("🔁 To provide the CA certificate in a ConfigMap (required by some applications like CockroachDB), you can use the trust-manager project:")
-			fmt.Println("   [trust-manager] https://cert-manager.io/docs/trust/trust-manager/")
-			fmt.Println()
-			fmt.Println("⚙️  The trust-manager can be configured to automatically copy the CA certificate from a Secret to a ConfigMap.")
-			fmt.Println()
-			fmt.Println("📦 If your CA Secret is in the 'cockroachdb' namespace, make sure your trust-manager is configured to reference it.")
-			fmt.Println("   You can do this by setting the trust namespace via Helm:")
-			fmt.Printf("helm upgrade trust-manager jetstack/trust-manager --install --namespace cert-manager --set app.trust.namespace=%s\n", namespace)
-			fmt.Println()
-			fmt.Println("ℹ️  You can use the following command to generate the required ConfigMap:")
-			fmt.Printf(`cat <<EOF | kubectl apply -f -
-apiVersion: trust.cert-manager.io/v1alpha1
-kind: Bundle
-metadata:
-  name: %s-ca-crt
-spec:
-  sources:
-    - secret:
-        name: %s
-        key: ca.crt
-  target:
-    configMap:
-      key: ca.crt
-    namespaceSelector:
-      matchLabels:
-       kubernetes.io/metadata.name: %s
-EOF`, rc.DiscoveryServiceName, caSecret, namespace)
-			fmt.Println()
-			fmt.Printf("Configmap name will be %s-ca-crt in %s namespace \n", rc.DiscoveryServiceName, namespace)
+	var nodeSecret corev1.Secret
+	if err := cl.Get(ctx, types.NamespacedName{Name: layout.nodeSecret, Namespace: namespace}, &nodeSecret); err != nil {
+		return errors.Wrapf(err, "failed to get node secret %s", layout.nodeSecret)
+	}
 
-			return nil
-		}
+	if certificateName := nodeSecret.Annotations[certv1.CertificateNameKey]; certificateName != "" {
+		return updateCertsForCertManager(cl, rc, namespace, nodeSecret, certManager)
 	}
 
-	if rc.CaSecret == "" {
-		if operatorType == "operator" {
-			rc.CaSecret = fmt.Sprintf("%s-ca", rc.DiscoveryServiceName)
-		} else {
-			rc.CaSecret = fmt.Sprintf("%s-ca-secret", rc.DiscoveryServiceName)
-		}
+	caCert := nodeSecret.Data[resource.CaCert]
+	if len(caCert) == 0 {
+		return errors.Errorf("node secret %s doesn't contain %s", layout.nodeSecret, resource.CaCert)
 	}
 
 	nodeSecretName := fmt.Sprintf("%s-node-secret", rc.DiscoveryServiceName)
 	clientSecretName := fmt.Sprintf("%s-client-secret", rc.DiscoveryServiceName)
+	caConfigMapPrefix := layout.caConfigMapPrefix(rc.DiscoveryServiceName)
 
-	// Load the CA secret from the CA secret or the node secret
-	// CA secret will have ca.crt in the official helm chart and not in the public operator managed secret
-	// Node secret will have ca.crt in the public operator managed secret.
-	if err := loadCASecret(cl, rc, fmt.Sprintf("%s-node", rc.DiscoveryServiceName), namespace); err != nil {
+	caSecretName, caKey, err := findCAKey(cl, namespace, rc.CaSecret, caCert)
+	if err != nil {
 		return err
 	}
+	if caKey == nil {
+		return reuseProvidedCerts(cl, rc, namespace, layout, nodeSecret, caConfigMapPrefix, nodeSecretName, clientSecretName)
+	}
+	logrus.Infof("Using the CA key of secret [%s]", caSecretName)
+
+	if err := saveCAConfigMap(cl, namespace, caConfigMapPrefix, caCert); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(rc.CertsDir, resource.CaCert), caCert, security.CertFileMode); err != nil {
+		return errors.Wrap(err, "failed to write CA cert")
+	}
+	if err := os.WriteFile(rc.CAKey, caKey, security.KeyFileMode); err != nil {
+		return errors.Wrap(err, "failed to write CA key")
+	}
 
 	if err := rc.GenerateNodeCert(ctx, nodeSecretName, namespace); err != nil {
 		return err
@@ -114,93 +144,548 @@ EOF`, rc.DiscoveryServiceName, caSecret, namespace)
 	return nil
 }
 
-func identifyHelmOrPublicOperator(cl client.Client, name, namespace string) (string, error) {
+// detectCertificateLayout reads the certificate secrets of the StatefulSet. The CrdbCluster of a public operator
+// cluster takes precedence over the volumes, since it records the user provided secrets.
+func detectCertificateLayout(cl client.Client, name, namespace string) (certificateLayout, error) {
 	var sts appsv1.StatefulSet
-	if err := cl.Get(context.Background(), types.NamespacedName{Name: name, Namespace: namespace}, &sts); err != nil {
-		return "", err
+	if err := cl.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, &sts); err != nil {
+		return certificateLayout{}, err
 	}
 
-	if len(sts.OwnerReferences) > 0 && sts.OwnerReferences[0].Kind == "CrdbCluster" {
-		return "operator", nil
+	layout := certificateLayout{}
+	layout.nodeSecret, layout.clientSecret = certificateSecrets(sts.Spec.Template.Spec.Volumes)
+
+	switch {
+	case ownerCrdbCluster(sts) != "":
+		layout.source = operatorCertSource
+		nodeTLSSecret, clientTLSSecret, err := crdbClusterTLSSecrets(cl, ownerCrdbCluster(sts), namespace)
+		if err != nil {
+			return layout, err
+		}
+		if nodeTLSSecret != "" {
+			layout.nodeSecret = nodeTLSSecret
+		}
+		if clientTLSSecret != "" {
+			layout.clientSecret = clientTLSSecret
+		}
+	case sts.Annotations[helmReleaseNameKey] != "" || sts.Labels[helmManagedByLabel] == "Helm":
+		layout.source = helmCertSource
+	default:
+		return layout, errors.Errorf("statefulset %s is neither owned by a CrdbCluster nor managed by helm", name)
 	}
 
-	if strings.Contains(sts.Name, sts.Annotations["meta.helm.sh/release-name"]) {
-		return "helm", nil
+	if layout.nodeSecret == "" {
+		return layout, errors.Errorf("statefulset %s doesn't mount a node certificate secret, is the cluster insecure?", name)
 	}
+	return layout, nil
+}
 
-	return "", fmt.Errorf("unknown statefulset deployment")
+// ownerCrdbCluster returns the name of the public operator CrdbCluster owning the StatefulSet.
+func ownerCrdbCluster(sts appsv1.StatefulSet) string {
+	for _, owner := range sts.OwnerReferences {
+		if owner.Kind == "CrdbCluster" {
+			return owner.Name
+		}
+	}
+	return ""
 }
 
-// updateCertsForCertManager updates the node certificate for cert-manager
-func updateCertsForCertManager(cl client.Client, rc *generator.GenerateCert, namespace string) (bool, error) {
+// crdbClusterTLSSecrets returns the user provided node and client secrets of the public operator CrdbCluster.
+func crdbClusterTLSSecrets(cl client.Client, name, namespace string) (string, string, error) {
+	cluster := &unstructured.Unstructured{}
+	cluster.SetGroupVersionKind(schema.GroupVersionKind{Group: "crdb.cockroachlabs.com", Version: "v1alpha1", Kind: "CrdbCluster"})
+	if err := cl.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, cluster); err != nil {
+		return "", "", errors.Wrapf(err, "failed to get crdbcluster %s", name)
+	}
+
+	nodeTLSSecret, _, _ := unstructured.NestedString(cluster.Object, "spec", "nodeTLSSecret")
+	clientTLSSecret, _, _ := unstructured.NestedString(cluster.Object, "spec", "clientTLSSecret")
+	return nodeTLSSecret, clientTLSSecret, nil
+}
+
+// certificateSecrets returns the node and client secrets mounted by the volumes. The secrets are told apart by
+// the file they are projected to, or by the volume name of the Helm chart if the whole secret is mounted.
+func certificateSecrets(volumes []corev1.Volume) (nodeSecret, clientSecret string) {
+	classify := func(volumeName, secretName string, items []corev1.KeyToPath) {
+		kind := ""
+		for _, item := range items {
+			switch item.Path {
+			case "node.crt":
+				kind = "node"
+			case "client.root.crt":
+				kind = "client"
+			}
+		}
+		if len(items) == 0 {
+			switch volumeName {
+			case "certs-secret":
+				kind = "node"
+			case "client-secret":
+				kind = "client"
+			}
+		}
+
+		if kind == "node" && nodeSecret == "" {
+			nodeSecret = secretName
+		}
+		if kind == "client" && clientSecret == "" {
+			clientSecret = secretName
+		}
+	}
+
+	for _, volume := range volumes {
+		if volume.Secret != nil {
+			classify(volume.Name, volume.Secret.SecretName, volume.Secret.Items)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil {
+					classify(volume.Name, source.Secret.Name, source.Secret.Items)
+				}
+			}
+		}
+	}
+	return nodeSecret, clientSecret
+}
+
+// findCAKey returns the secret holding the key of the CA certificate. If caSecretName is set, the key must be
+// stored in that secret. Otherwise the secrets of the namespace are searched, so that the CA secret of the
+// Helm chart self-signer, the public operator or the user is found without relying on its name. A nil key is
+// returned if the CA key isn't stored in the namespace.
+func findCAKey(cl client.Client, namespace, caSecretName string, caCert []byte) (string, []byte, error) {
+	var secrets []corev1.Secret
+	if caSecretName != "" {
+		var secret corev1.Secret
+		if err := cl.Get(ctx, types.NamespacedName{Name: caSecretName, Namespace: namespace}, &secret); err != nil {
+			return "", nil, errors.Wrap(err, "failed to get CA key secret")
+		}
+		secrets = append(secrets, secret)
+	} else {
+		var list corev1.SecretList
+		if err := cl.List(ctx, &list, client.InNamespace(namespace)); err != nil {
+			return "", nil, errors.Wrap(err, "failed to list secrets")
+		}
+		secrets = list.Items
+	}
+
+	for _, secret := range secrets {
+		key, ok := secret.Data[resource.CaKey]
+		if !ok {
+			continue
+		}
+		if _, err := caCertForKey(caCert, key); err == nil {
+			return secret.Name, key, nil
+		}
+	}
+
+	if caSecretName != "" {
+		return "", nil, errors.Errorf("CA secret %s doesn't contain the key of the CA certificate of the cluster", caSecretName)
+	}
+	return "", nil, nil
+}
+
+// caCertForKey returns the certificate of the PEM encoded CA bundle which belongs to the PEM encoded key. A CA
+// bundle holds several certificates after the CA was rotated.
+func caCertForKey(pemBundle, pemKey []byte) ([]byte, error) {
+	for rest := pemBundle; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("no certificate of the bundle matches the CA key")
+		}
+		cert := pem.EncodeToMemory(block)
+		if matches, err := keyMatchesCert(pemKey, cert); err == nil && matches {
+			return cert, nil
+		}
+	}
+}
+
+// keyMatchesCert returns true if the PEM encoded private key belongs to the PEM encoded certificate.
+func keyMatchesCert(pemKey, pemCert []byte) (bool, error) {
+	certBlock, _ := pem.Decode(pemCert)
+	if certBlock == nil {
+		return false, errors.New("failed to decode certificate")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return false, err
+	}
+
+	keyBlock, _ := pem.Decode(pemKey)
+	if keyBlock == nil {
+		return false, errors.New("failed to decode key")
+	}
+	var key crypto.Signer
+	if k, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes); err == nil {
+		key = k
+	} else if k, err := x509.ParseECPrivateKey(keyBlock.Bytes); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes); err == nil {
+		signer, ok := k.(crypto.Signer)
+		if !ok {
+			return false, errors.New("unsupported private key")
+		}
+		key = signer
+	} else {
+		return false, errors.New("unsupported private key")
+	}
+
+	public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && public.Equal(cert.PublicKey), nil
+}
+
+// reuseProvidedCerts copies the existing certificates to the secrets referenced by build-manifest, for clusters
+// whose CA key isn't stored in the cluster. The node certificate must already include the join service.
+func reuseProvidedCerts(cl client.Client, rc *generator.GenerateCert, namespace string, layout certificateLayout,
+	nodeSecret corev1.Secret, caConfigMapPrefix, nodeSecretName, clientSecretName string) error {
+	joinHosts := []string{
+		fmt.Sprintf("%s-join", rc.DiscoveryServiceName),
+		fmt.Sprintf("%s-join.%s", rc.DiscoveryServiceName, namespace),
+		fmt.Sprintf("%s-join.%s.svc.%s", rc.DiscoveryServiceName, namespace, rc.ClusterDomain),
+	}
+
+	nodeCert, nodeKey := certAndKey(nodeSecret, "node")
+	missing, err := missingDNSNames(nodeCert, joinHosts)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read the node certificate of secret %s", nodeSecret.Name)
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("the CA key of the node certificate in secret %s isn't stored in namespace %s: "+
+			"pass the secret holding the CA key with --ca-secret, or re-issue the node certificate with the DNS names %s",
+			nodeSecret.Name, namespace, strings.Join(missing, ", "))
+	}
+	if layout.clientSecret == "" {
+		return errors.Errorf("statefulset %s doesn't mount a client certificate secret", rc.DiscoveryServiceName)
+	}
+	var clientSecret corev1.Secret
+	if err := cl.Get(ctx, types.NamespacedName{Name: layout.clientSecret, Namespace: namespace}, &clientSecret); err != nil {
+		return errors.Wrapf(err, "failed to get client secret %s", layout.clientSecret)
+	}
+	clientCert, clientKey := certAndKey(clientSecret, "client.root")
+
+	caCert := nodeSecret.Data[resource.CaCert]
+	if err := saveCAConfigMap(cl, namespace, caConfigMapPrefix, caCert); err != nil {
+		return err
+	}
+	for _, s := range []struct {
+		name      string
+		cert, key []byte
+	}{
+		{name: nodeSecretName, cert: nodeCert, key: nodeKey},
+		{name: clientSecretName, cert: clientCert, key: clientKey},
+	} {
+		secret := resource.CreateTLSSecret(s.name, corev1.SecretTypeTLS, resource.NewKubeResource(ctx, cl, namespace, kube.DefaultPersister))
+		if err := secret.UpdateTLSSecret(s.cert, s.key, caCert, map[string]string{}); err != nil {
+			return errors.Wrapf(err, "failed to copy certificates to secret %s", s.name)
+		}
+	}
+	logrus.Infof("Copied the existing certificates of secrets [%s] and [%s] to [%s] and [%s]",
+		layout.nodeSecret, layout.clientSecret, nodeSecretName, clientSecretName)
+
+	return nil
+}
+
+// certAndKey returns the certificate and key of a secret, stored either as a TLS secret or with the file names
+// of the cockroach certs dir.
+func certAndKey(secret corev1.Secret, name string) ([]byte, []byte) {
+	if cert, ok := secret.Data[corev1.TLSCertKey]; ok {
+		return cert, secret.Data[corev1.TLSPrivateKeyKey]
+	}
+	return secret.Data[name+".crt"], secret.Data[name+".key"]
+}
+
+// missingDNSNames returns the hosts which aren't DNS names of the PEM encoded certificate.
+func missingDNSNames(pemCert []byte, hosts []string) ([]string, error) {
+	block, _ := pem.Decode(pemCert)
+	if block == nil {
+		return nil, errors.New("failed to decode certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			missing = append(missing, host)
+		}
+	}
+	return missing, nil
+}
+
+// saveCAConfigMap stores the CA certificate in the ConfigMap expected by the CockroachDB Enterprise Operator.
+func saveCAConfigMap(cl client.Client, namespace, prefix string, caCert []byte) error {
+	cm := resource.CreateConfigMap(namespace, prefix, caCert, resource.NewKubeResource(ctx, cl, namespace, kube.DefaultPersister))
+	if err := cm.Update(); err != nil {
+		return errors.Wrap(err, "failed to update CA cert in ConfigMap")
+	}
+	logrus.Infof("Generated and saved CA certificate in ConfigMap [%s-crt]", prefix)
+	return nil
+}
+
+// updateCertsForCertManager updates the Certificate which issues the node secret, so that it includes the
+// DNS names of the join service, and copies the CA certificate of its issuer to a ConfigMap, or prints how to.
+func updateCertsForCertManager(cl client.Client, rc *generator.GenerateCert, namespace string, nodeSecret corev1.Secret,
+	certManager CertManagerOptions) error {
 	// Get the node certificate CR
 	nodeCertificate := certv1.Certificate{}
-	nodeCertificateName := fmt.Sprintf("%s-node", rc.DiscoveryServiceName)
+	nodeCertificateName := nodeSecret.Annotations[certv1.CertificateNameKey]
 	if err := cl.Get(context.Background(), types.NamespacedName{Name: nodeCertificateName, Namespace: namespace}, &nodeCertificate); err != nil {
-		return false, nil
+		return errors.Wrapf(err, "failed to get certificate %s", nodeCertificateName)
 	}
 
-	// Update the node certificate with some DNSNames
-	dnsNames := []string{
+	// Add the DNSNames of the join service which are missing, so that running the command again doesn't
+	// duplicate them.
+	joinHosts := []string{
 		fmt.Sprintf("%s-join", rc.DiscoveryServiceName),
 		fmt.Sprintf("%s-join.%s", rc.DiscoveryServiceName, namespace),
 		fmt.Sprintf("%s-join.%s.svc.%s", rc.DiscoveryServiceName, namespace, rc.ClusterDomain),
 	}
-	nodeCertificate.Spec.DNSNames = append(nodeCertificate.Spec.DNSNames, dnsNames...)
+	var dnsNames []string
+	for _, name := range nodeCertificate.Spec.DNSNames {
+		if !slices.Contains(dnsNames, name) {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	for _, host := range joinHosts {
+		if !slices.Contains(dnsNames, host) {
+			dnsNames = append(dnsNames, host)
+		}
+	}
 
-	// update the node certificate with the new DNSNames
-	if err := cl.Update(context.Background(), &nodeCertificate); err != nil {
-		return false, errors.Wrap(err, "failed to update node certificate with new DNSNames")
+	var revision *int
+	if !slices.Equal(dnsNames, nodeCertificate.Spec.DNSNames) {
+		// cert-manager re-issues the certificate with the next revision once the spec changes.
+		revision = new(int)
+		if nodeCertificate.Status.Revision != nil {
+			*revision = *nodeCertificate.Status.Revision
+		}
+
+		patch := client.MergeFrom(nodeCertificate.DeepCopy())
+		nodeCertificate.Spec.DNSNames = dnsNames
+		if err := cl.Patch(context.Background(), &nodeCertificate, patch); err != nil {
+			return errors.Wrap(err, "failed to update node certificate with new DNSNames")
+		}
+		logrus.Infof("Added the join service to the DNS names of certificate [%s]", nodeCertificateName)
 	}
 
-	return true, nil
-}
+	if err := waitForCertificate(cl, nodeCertificate, revision, joinHosts, certManager.IssueTimeout); err != nil {
+		return err
+	}
 
-// loadCASecret loads the CA secret from the CA secret or the node secret
-// If ca.crt is present in the CA secret, then we use the CA secret
-// If ca.crt is not present in the CA secret, then we use the node secret
-// If ca.crt is not present in the node secret, then we return an error
-func loadCASecret(cl client.Client, rc *generator.GenerateCert, existingNodeSecretName, namespace string) error {
-	var caCert, caKey []byte
-	secret, err := resource.LoadTLSSecret(rc.CaSecret, resource.NewKubeResource(ctx, cl, namespace, kube.DefaultPersister))
-	if err != nil {
-		return errors.Wrap(err, "failed to get CA key secret")
+	caSecret := types.NamespacedName{Name: rc.CaSecret, Namespace: namespace}
+	if caSecret.Name == "" {
+		var err error
+		if caSecret, err = issuerCASecret(cl, namespace, nodeCertificate.Spec.IssuerRef, certManager.ClusterResourceNamespace); err != nil {
+			return err
+		}
 	}
 
-	if !secret.ReadyCA() {
-		if !secret.IsCAKeyPresent() {
-			return errors.Wrap(err, "CA secret doesn't contain the required CA key")
+	// If the cert-manager is used, we don't need to generate the certs.
+	fmt.Printf("✅ Successfully updated the %s certificate to include the new DNS names.\n", nodeCertificateName)
+
+	if certManager.CreateTrustBundle {
+		return createTrustBundle(cl, namespace, rc.DiscoveryServiceName, caSecret, certManager.TrustBundleTimeout)
+	}
+
+	fmt.Println()
+	fmt.Println("ℹ️  Note: By default, cert-manager stores the CA certificate in a Secret, which is used by the Issuer.")
+	fmt.Println()
+	fmt.Println("🔁 To provide the CA certificate in a ConfigMap (required by some applications like CockroachDB), you can use the trust-manager project:")
+	fmt.Println("   [trust-manager] https://cert-manager.io/docs/trust/trust-manager/")
+	fmt.Println()
+	fmt.Println("⚙️  The trust-manager can be configured to automatically copy the CA certificate from a Secret to a ConfigMap.")
+	fmt.Println()
+	fmt.Printf("📦 Your CA Secret is in the '%s' namespace, make sure your trust-manager is configured to reference it.\n", caSecret.Namespace)
+	fmt.Println("   You can do this by setting the trust namespace via Helm:")
+	fmt.Printf("helm upgrade trust-manager jetstack/trust-manager --install --namespace cert-manager --set app.trust.namespace=%s\n", caSecret.Namespace)
+	fmt.Println()
+	fmt.Println("ℹ️  You can use the following command to generate the required ConfigMap, or run migrate-certs with --create-trust-bundle:")
+	fmt.Printf(`cat <<EOF | kubectl apply -f -
+apiVersion: trust.cert-manager.io/v1alpha1
+kind: Bundle
+metadata:
+  name: %s-ca-crt
+spec:
+  sources:
+    - secret:
+        name: %s
+        key: ca.crt
+  target:
+    configMap:
+      key: ca.crt
+    namespaceSelector:
+      matchLabels:
+       kubernetes.io/metadata.name: %s
+EOF`, rc.DiscoveryServiceName, caSecret.Name, namespace)
+	fmt.Println()
+	fmt.Printf("Configmap name will be %s-ca-crt in %s namespace \n", rc.DiscoveryServiceName, namespace)
+
+	return nil
+}
+
+// waitForCertificate waits for cert-manager to issue the Certificate with the given DNS names. If the Certificate
+// was updated, revision is its revision before the update, and a later revision must be issued.
+func waitForCertificate(cl client.Client, certificate certv1.Certificate, revision *int, dnsNames []string, timeout time.Duration) error {
+	f := func() error {
+		var current certv1.Certificate
+		if err := cl.Get(ctx, client.ObjectKeyFromObject(&certificate), &current); err != nil {
+			return err
+		}
+		if !certificateReady(current) {
+			return errors.Errorf("certificate %s is not ready", current.Name)
+		}
+		if revision != nil && (current.Status.Revision == nil || *current.Status.Revision <= *revision) {
+			return errors.Errorf("certificate %s was not re-issued yet", current.Name)
 		}
 
-		nodeSecret, err := resource.LoadTLSSecret(existingNodeSecretName, resource.NewKubeResource(ctx, cl, namespace, kube.DefaultPersister))
+		var secret corev1.Secret
+		if err := cl.Get(ctx, types.NamespacedName{Name: current.Spec.SecretName, Namespace: current.Namespace}, &secret); err != nil {
+			return err
+		}
+		missing, err := missingDNSNames(secret.Data[corev1.TLSCertKey], dnsNames)
 		if err != nil {
-			return errors.Wrap(err, "failed to get node secret")
+			return errors.Wrapf(err, "failed to read the certificate of secret %s", secret.Name)
 		}
-
-		if !nodeSecret.IsCACertPresent() {
-			return errors.Wrap(err, "node secret doesn't contain the required CA cert")
+		if len(missing) > 0 {
+			return errors.Errorf("certificate of secret %s doesn't include the DNS names %s", secret.Name, strings.Join(missing, ", "))
 		}
+		return nil
+	}
 
-		caCert = nodeSecret.CA()
-	} else {
-		caCert = secret.CA()
+	logrus.Infof("Waiting for cert-manager to issue certificate [%s]", certificate.Name)
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = timeout
+	b.MaxInterval = 5 * time.Second
+	if err := backoff.Retry(f, b); err != nil {
+		return errors.Wrapf(err, "cert-manager didn't issue certificate %s", certificate.Name)
 	}
+	return nil
+}
 
-	caKey = secret.CAKey()
-	cm := resource.CreateConfigMap(namespace, rc.CaSecret, caCert,
-		resource.NewKubeResource(ctx, cl, namespace, kube.DefaultPersister))
-	if err = cm.Update(); err != nil {
-		return errors.Wrap(err, "failed to update CA cert in ConfigMap")
+// certificateReady returns true if the Ready condition of the Certificate is true.
+func certificateReady(certificate certv1.Certificate) bool {
+	for _, condition := range certificate.Status.Conditions {
+		if condition.Type == certv1.CertificateConditionReady {
+			return condition.Status == cmmeta.ConditionTrue
+		}
 	}
-	logrus.Infof("Generated and saved CA certificate in ConfigMap [%s]", rc.CaSecret)
+	return false
+}
 
-	if err := os.WriteFile(filepath.Join(rc.CertsDir, resource.CaCert), caCert, security.CertFileMode); err != nil {
-		return errors.Wrap(err, "failed to write CA cert")
+// createTrustBundle creates the trust-manager Bundle which copies the CA certificate of the issuer to the
+// <sts>-ca-crt ConfigMap, and waits for the ConfigMap to hold the CA certificate. If trust-manager isn't
+// installed, the CA certificate is copied to a plain ConfigMap, which is updated each time migrate-certs runs.
+func createTrustBundle(cl client.Client, namespace, stsName string, caSecret types.NamespacedName, timeout time.Duration) error {
+	var secret corev1.Secret
+	if err := cl.Get(ctx, caSecret, &secret); err != nil {
+		return errors.Wrapf(err, "failed to get CA secret %s/%s", caSecret.Namespace, caSecret.Name)
+	}
+	// The secret of a CA issuer always holds the CA in tls.crt, while ca.crt is only set for intermediate CAs
+	// or self-signed CAs issued by cert-manager.
+	caKey := resource.CaCert
+	if len(secret.Data[caKey]) == 0 {
+		caKey = corev1.TLSCertKey
+	}
+	caCert := secret.Data[caKey]
+	if len(caCert) == 0 {
+		return errors.Errorf("CA secret %s/%s doesn't contain a CA certificate", caSecret.Namespace, caSecret.Name)
 	}
 
-	if err := os.WriteFile(rc.CAKey, caKey, security.KeyFileMode); err != nil {
-		return errors.Wrap(err, "failed to write CA key")
+	configMapName := fmt.Sprintf("%s-ca-crt", stsName)
+	bundle := &unstructured.Unstructured{}
+	bundle.SetGroupVersionKind(bundleGVK)
+	bundle.SetName(configMapName)
+	_, err := controllerutil.CreateOrUpdate(ctx, cl, bundle, func() error {
+		bundle.Object["spec"] = map[string]interface{}{
+			"sources": []interface{}{
+				map[string]interface{}{"secret": map[string]interface{}{"name": caSecret.Name, "key": caKey}},
+			},
+			"target": map[string]interface{}{
+				"configMap": map[string]interface{}{"key": resource.CaCert},
+				"namespaceSelector": map[string]interface{}{
+					"matchLabels": map[string]interface{}{corev1.LabelMetadataName: namespace},
+				},
+			},
+		}
+		return nil
+	})
+	if meta.IsNoMatchError(err) || runtime.IsNotRegisteredError(err) {
+		logrus.Warnf("trust-manager isn't installed, copying the CA certificate of secret [%s/%s] to a ConfigMap. "+
+			"Run migrate-certs again when the CA is renewed", caSecret.Namespace, caSecret.Name)
+		return saveCAConfigMap(cl, namespace, fmt.Sprintf("%s-ca", stsName), caCert)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to create trust-manager bundle %s", configMapName)
+	}
+	logrus.Infof("Created trust-manager Bundle [%s], waiting for ConfigMap [%s]", configMapName, configMapName)
+
+	f := func() error {
+		var cm corev1.ConfigMap
+		if err := cl.Get(ctx, types.NamespacedName{Name: configMapName, Namespace: namespace}, &cm); err != nil {
+			return err
+		}
+		if !bundleContains([]byte(cm.Data[resource.CaCert]), caCert) {
+			return errors.Errorf("ConfigMap %s doesn't contain the CA certificate of secret %s/%s", configMapName, caSecret.Namespace, caSecret.Name)
+		}
+		return nil
+	}
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = timeout
+	b.MaxInterval = 5 * time.Second
+	if err := backoff.Retry(f, b); err != nil {
+		return errors.Wrapf(err, "trust-manager didn't sync bundle %s, make sure its trust namespace is %s", configMapName, caSecret.Namespace)
 	}
+	logrus.Infof("ConfigMap [%s] holds the CA certificate of secret [%s/%s]", configMapName, caSecret.Namespace, caSecret.Name)
 
 	return nil
 }
+
+// bundleContains returns true if the PEM encoded bundle contains the first certificate of the PEM encoded CA.
+// The certificates are compared decoded, since trust-manager rewrites the bundle.
+func bundleContains(bundle, pemCA []byte) bool {
+	caBlock, _ := pem.Decode(pemCA)
+	if caBlock == nil {
+		return false
+	}
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return false
+		}
+		if bytes.Equal(block.Bytes, caBlock.Bytes) {
+			return true
+		}
+	}
+}
+
+// issuerCASecret returns the secret holding the CA of a cert-manager CA Issuer or ClusterIssuer. The secrets of
+// ClusterIssuers are stored in the cluster resource namespace of cert-manager.
+func issuerCASecret(cl client.Client, namespace string, ref cmmeta.ObjectReference, clusterResourceNamespace string) (types.NamespacedName, error) {
+	var spec certv1.IssuerSpec
+	secretNamespace := namespace
+	switch ref.Kind {
+	case "", certv1.IssuerKind:
+		var issuer certv1.Issuer
+		if err := cl.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: namespace}, &issuer); err != nil {
+			return types.NamespacedName{}, errors.Wrapf(err, "failed to get issuer %s", ref.Name)
+		}
+		spec = issuer.Spec
+	case certv1.ClusterIssuerKind:
+		var issuer certv1.ClusterIssuer
+		if err := cl.Get(ctx, types.NamespacedName{Name: ref.Name}, &issuer); err != nil {
+			return types.NamespacedName{}, errors.Wrapf(err, "failed to get cluster issuer %s", ref.Name)
+		}
+		spec = issuer.Spec
+		secretNamespace = clusterResourceNamespace
+	default:
+		return types.NamespacedName{}, errors.Errorf("unsupported issuer kind %s, pass the CA secret with --ca-secret", ref.Kind)
+	}
+
+	if spec.CA == nil {
+		return types.NamespacedName{}, errors.Errorf("%s %s isn't a CA issuer, pass the CA secret with --ca-secret", ref.Kind, ref.Name)
+	}
+	return types.NamespacedName{Name: spec.CA.SecretName, Namespace: secretNamespace}, nil
+}
@@ -0,0 +1,453 @@
+package migrate
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/generator"
+	certv1 "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+const certsTestNamespace = "cockroachdb"
+
+// testCA is a CA generated in memory, since the cockroach binary isn't available to the tests.
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Cockroach CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return testCA{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// issue signs a certificate for the given DNS names and returns the PEM encoded certificate and key.
+func (ca testCA) issue(t *testing.T, dnsNames ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func newCertsTestClient(t *testing.T, objects ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, certv1.AddToScheme(scheme))
+	return fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+}
+
+// operatorStatefulSet is a StatefulSet of the public operator, which projects the node and client secrets
+// into the same volume.
+func operatorStatefulSet(name, nodeSecret, clientSecret string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       certsTestNamespace,
+			OwnerReferences: []metav1.OwnerReference{{Kind: "CrdbCluster", Name: name, APIVersion: "crdb.cockroachlabs.com/v1alpha1"}},
+		},
+		Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{{
+				Name: "certs",
+				VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{
+					{Secret: &corev1.SecretProjection{
+						LocalObjectReference: corev1.LocalObjectReference{Name: nodeSecret},
+						Items: []corev1.KeyToPath{
+							{Key: "ca.crt", Path: "ca.crt"},
+							{Key: "tls.crt", Path: "node.crt"},
+							{Key: "tls.key", Path: "node.key"},
+						},
+					}},
+					{Secret: &corev1.SecretProjection{
+						LocalObjectReference: corev1.LocalObjectReference{Name: clientSecret},
+						Items: []corev1.KeyToPath{
+							{Key: "tls.crt", Path: "client.root.crt"},
+							{Key: "tls.key", Path: "client.root.key"},
+						},
+					}},
+				}}},
+			}},
+		}}},
+	}
+}
+
+// helmStatefulSet is a StatefulSet of the Helm chart, which mounts the whole node and client secrets.
+func helmStatefulSet(name, nodeSecret, clientSecret string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   certsTestNamespace,
+			Annotations: map[string]string{helmReleaseNameKey: "crdb"},
+		},
+		Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{
+				{Name: "datadir"},
+				{Name: "certs-secret", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: nodeSecret}}},
+				{Name: "client-secret", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: clientSecret}}},
+			},
+		}}},
+	}
+}
+
+func crdbCluster(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	cluster := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	cluster.SetAPIVersion("crdb.cockroachlabs.com/v1alpha1")
+	cluster.SetKind("CrdbCluster")
+	cluster.SetName(name)
+	cluster.SetNamespace(certsTestNamespace)
+	return cluster
+}
+
+func TestDetectCertificateLayout(t *testing.T) {
+	tests := []struct {
+		name     string
+		objects  []client.Object
+		expected certificateLayout
+		err      string
+	}{
+		{
+			name: "helm chart self-signer",
+			objects: []client.Object{
+				helmStatefulSet("crdb", "crdb-node-secret", "crdb-client-secret"),
+			},
+			expected: certificateLayout{source: helmCertSource, nodeSecret: "crdb-node-secret", clientSecret: "crdb-client-secret"},
+		},
+		{
+			name: "public operator with generated certificates",
+			objects: []client.Object{
+				operatorStatefulSet("crdb", "crdb-node", "crdb-root"),
+				crdbCluster("crdb", map[string]interface{}{"tlsEnabled": true}),
+			},
+			expected: certificateLayout{source: operatorCertSource, nodeSecret: "crdb-node", clientSecret: "crdb-root"},
+		},
+		{
+			name: "public operator with user provided certificates",
+			objects: []client.Object{
+				operatorStatefulSet("crdb", "crdb-node", "crdb-root"),
+				crdbCluster("crdb", map[string]interface{}{"nodeTLSSecret": "my-node", "clientTLSSecret": "my-client"}),
+			},
+			expected: certificateLayout{source: operatorCertSource, nodeSecret: "my-node", clientSecret: "my-client"},
+		},
+		{
+			name: "unknown source",
+			objects: []client.Object{
+				&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "crdb", Namespace: certsTestNamespace}},
+			},
+			err: "neither owned by a CrdbCluster nor managed by helm",
+		},
+		{
+			name: "insecure cluster",
+			objects: []client.Object{
+				helmStatefulSet("crdb", "", ""),
+			},
+			err: "doesn't mount a node certificate secret",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := detectCertificateLayout(newCertsTestClient(t, tt.objects...), "crdb", certsTestNamespace)
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, layout)
+		})
+	}
+}
+
+func TestFindCAKey(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	secret := func(name string, key []byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: certsTestNamespace},
+			Data:       map[string][]byte{"ca.crt": ca.certPEM, "ca.key": key},
+		}
+	}
+	cl := newCertsTestClient(t, secret("other-ca", other.keyPEM), secret("my-ca", ca.keyPEM))
+
+	// The CA key is found by matching the CA certificate, whatever the name of its secret.
+	name, key, err := findCAKey(cl, certsTestNamespace, "", ca.certPEM)
+	require.NoError(t, err)
+	assert.Equal(t, "my-ca", name)
+	assert.Equal(t, ca.keyPEM, key)
+
+	_, key, err = findCAKey(cl, certsTestNamespace, "", newTestCA(t).certPEM)
+	require.NoError(t, err)
+	assert.Nil(t, key)
+
+	_, _, err = findCAKey(cl, certsTestNamespace, "other-ca", ca.certPEM)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "doesn't contain the key of the CA certificate")
+}
+
+func TestGenerateCertsForOperatorReusesProvidedCerts(t *testing.T) {
+	ctx := context.Background()
+	ca := newTestCA(t)
+	rc := &generator.GenerateCert{DiscoveryServiceName: "crdb", ClusterDomain: "cluster.local"}
+
+	// The CA key isn't stored in the cluster, so the node certificate must already include the join service.
+	nodeCert, nodeKey := ca.issue(t, "crdb-public", "crdb-join", "crdb-join.cockroachdb", "crdb-join.cockroachdb.svc.cluster.local")
+	clientCert, clientKey := ca.issue(t)
+	objects := func(nodeCert []byte) []client.Object {
+		return []client.Object{
+			operatorStatefulSet("crdb", "my-node", "my-client"),
+			crdbCluster("crdb", map[string]interface{}{"nodeTLSSecret": "my-node", "clientTLSSecret": "my-client"}),
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-node", Namespace: certsTestNamespace},
+				Data:       map[string][]byte{"ca.crt": ca.certPEM, "tls.crt": nodeCert, "tls.key": nodeKey},
+			},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-client", Namespace: certsTestNamespace},
+				Data:       map[string][]byte{"ca.crt": ca.certPEM, "client.root.crt": clientCert, "client.root.key": clientKey},
+			},
+		}
+	}
+
+	cl := newCertsTestClient(t, objects(nodeCert)...)
+	require.NoError(t, GenerateCertsForOperator(cl, certsTestNamespace, rc, CertManagerOptions{}))
+
+	var cm corev1.ConfigMap
+	require.NoError(t, cl.Get(ctx, types.NamespacedName{Name: "crdb-ca-crt", Namespace: certsTestNamespace}, &cm))
+	assert.Equal(t, string(ca.certPEM), cm.Data["ca.crt"])
+
+	var secret corev1.Secret
+	require.NoError(t, cl.Get(ctx, types.NamespacedName{Name: "crdb-node-secret", Namespace: certsTestNamespace}, &secret))
+	assert.Equal(t, nodeCert, secret.Data["tls.crt"])
+	assert.Equal(t, nodeKey, secret.Data["tls.key"])
+	require.NoError(t, cl.Get(ctx, types.NamespacedName{Name: "crdb-client-secret", Namespace: certsTestNamespace}, &secret))
+	assert.Equal(t, clientCert, secret.Data["tls.crt"])
+	assert.Equal(t, clientKey, secret.Data["tls.key"])
+
+	// A node certificate without the join service can't be reused.
+	nodeCert, _ = ca.issue(t, "crdb-public")
+	err := GenerateCertsForOperator(newCertsTestClient(t, objects(nodeCert)...), certsTestNamespace, rc, CertManagerOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "--ca-secret")
+	assert.Contains(t, err.Error(), "crdb-join.cockroachdb.svc.cluster.local")
+}
+
+func TestGenerateCertsForOperatorCertManager(t *testing.T) {
+	ctx := context.Background()
+	ca := newTestCA(t)
+	rc := &generator.GenerateCert{DiscoveryServiceName: "crdb", ClusterDomain: "cluster.local"}
+	certManager := CertManagerOptions{IssueTimeout: time.Second}
+	joinNames := []string{"crdb-join", "crdb-join.cockroachdb", "crdb-join.cockroachdb.svc.cluster.local"}
+
+	// newClient returns a client on which cert-manager re-issues the node certificate when it is patched, unless
+	// reissue is false.
+	newClient := func(t *testing.T, dnsNames []string, reissue bool) (client.Client, *int) {
+		patches := new(int)
+		nodeCert, nodeKey := ca.issue(t, dnsNames...)
+		objects := []client.Object{
+			helmStatefulSet("crdb", "crdb-node-tls", "crdb-root-tls"),
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "crdb-node-tls",
+					Namespace:   certsTestNamespace,
+					Annotations: map[string]string{certv1.CertificateNameKey: "crdb-node"},
+				},
+				Data: map[string][]byte{"ca.crt": ca.certPEM, "tls.crt": nodeCert, "tls.key": nodeKey},
+			},
+			&certv1.Certificate{
+				ObjectMeta: metav1.ObjectMeta{Name: "crdb-node", Namespace: certsTestNamespace},
+				Spec: certv1.CertificateSpec{
+					SecretName: "crdb-node-tls",
+					DNSNames:   dnsNames,
+					IssuerRef:  cmmeta.ObjectReference{Name: "crdb-issuer", Kind: certv1.IssuerKind},
+				},
+				Status: certv1.CertificateStatus{
+					Revision:   To(1),
+					Conditions: []certv1.CertificateCondition{{Type: certv1.CertificateConditionReady, Status: cmmeta.ConditionTrue}},
+				},
+			},
+			&certv1.Issuer{
+				ObjectMeta: metav1.ObjectMeta{Name: "crdb-issuer", Namespace: certsTestNamespace},
+				Spec: certv1.IssuerSpec{IssuerConfig: certv1.IssuerConfig{
+					CA: &certv1.CAIssuer{SecretName: "my-ca"},
+				}},
+			},
+		}
+
+		scheme := runtime.NewScheme()
+		require.NoError(t, clientgoscheme.AddToScheme(scheme))
+		require.NoError(t, certv1.AddToScheme(scheme))
+		return fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(ctx context.Context, cl client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				if err := cl.Patch(ctx, obj, patch, opts...); err != nil {
+					return err
+				}
+				*patches++
+				certificate, ok := obj.(*certv1.Certificate)
+				if !ok || !reissue {
+					return nil
+				}
+
+				nodeCert, nodeKey := ca.issue(t, certificate.Spec.DNSNames...)
+				secret := &corev1.Secret{}
+				require.NoError(t, cl.Get(ctx, types.NamespacedName{Name: "crdb-node-tls", Namespace: certsTestNamespace}, secret))
+				secret.Data["tls.crt"], secret.Data["tls.key"] = nodeCert, nodeKey
+				require.NoError(t, cl.Update(ctx, secret))
+				certificate.Status.Revision = To(*certificate.Status.Revision + 1)
+				return cl.Update(ctx, certificate)
+			},
+		}).Build(), patches
+	}
+
+	t.Run("join service added", func(t *testing.T) {
+		cl, patches := newClient(t, []string{"crdb-public", "crdb-public"}, true)
+		require.NoError(t, GenerateCertsForOperator(cl, certsTestNamespace, rc, certManager))
+		assert.Equal(t, 1, *patches)
+
+		var certificate certv1.Certificate
+		require.NoError(t, cl.Get(ctx, types.NamespacedName{Name: "crdb-node", Namespace: certsTestNamespace}, &certificate))
+		assert.Equal(t, append([]string{"crdb-public"}, joinNames...), certificate.Spec.DNSNames)
+		assert.Equal(t, 2, *certificate.Status.Revision)
+
+		caSecret, err := issuerCASecret(cl, certsTestNamespace, certificate.Spec.IssuerRef, "cert-manager")
+		require.NoError(t, err)
+		assert.Equal(t, types.NamespacedName{Name: "my-ca", Namespace: certsTestNamespace}, caSecret)
+	})
+
+	t.Run("join service already present", func(t *testing.T) {
+		cl, patches := newClient(t, append([]string{"crdb-public"}, joinNames...), true)
+		require.NoError(t, GenerateCertsForOperator(cl, certsTestNamespace, rc, certManager))
+		assert.Equal(t, 0, *patches)
+	})
+
+	t.Run("certificate not re-issued", func(t *testing.T) {
+		cl, _ := newClient(t, []string{"crdb-public"}, false)
+		err := GenerateCertsForOperator(cl, certsTestNamespace, rc, certManager)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "cert-manager didn't issue certificate crdb-node")
+	})
+}
+
+func TestCreateTrustBundle(t *testing.T) {
+	ctx := context.Background()
+	ca := newTestCA(t)
+	caSecret := types.NamespacedName{Name: "my-ca", Namespace: certsTestNamespace}
+	// The secret of a CA issuer holds the CA in tls.crt.
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: caSecret.Name, Namespace: caSecret.Namespace},
+		Data:       map[string][]byte{"tls.crt": ca.certPEM, "tls.key": ca.keyPEM},
+	}
+	withTrustManager := func(t *testing.T, objects ...client.Object) client.Client {
+		scheme := runtime.NewScheme()
+		require.NoError(t, clientgoscheme.AddToScheme(scheme))
+		scheme.AddKnownTypeWithName(bundleGVK, &unstructured.Unstructured{})
+		scheme.AddKnownTypeWithName(bundleGVK.GroupVersion().WithKind("BundleList"), &unstructured.UnstructuredList{})
+		return fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+	}
+	configMap := func(data []byte) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "crdb-ca-crt", Namespace: certsTestNamespace},
+			Data:       map[string]string{"ca.crt": string(data)},
+		}
+	}
+
+	t.Run("bundle synced by trust-manager", func(t *testing.T) {
+		// trust-manager appends the other sources of the bundle.
+		cl := withTrustManager(t, secret, configMap(append(newTestCA(t).certPEM, ca.certPEM...)))
+		require.NoError(t, createTrustBundle(cl, certsTestNamespace, "crdb", caSecret, time.Second))
+
+		bundle := &unstructured.Unstructured{}
+		bundle.SetGroupVersionKind(bundleGVK)
+		require.NoError(t, cl.Get(ctx, types.NamespacedName{Name: "crdb-ca-crt"}, bundle))
+		sources, _, _ := unstructured.NestedSlice(bundle.Object, "spec", "sources")
+		assert.Equal(t, []interface{}{map[string]interface{}{"secret": map[string]interface{}{"name": "my-ca", "key": "tls.crt"}}}, sources)
+	})
+
+	t.Run("bundle with another CA", func(t *testing.T) {
+		cl := withTrustManager(t, secret, configMap(newTestCA(t).certPEM))
+		err := createTrustBundle(cl, certsTestNamespace, "crdb", caSecret, time.Second)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "make sure its trust namespace is cockroachdb")
+	})
+
+	t.Run("trust-manager not installed", func(t *testing.T) {
+		// The API server doesn't serve the Bundle kind without the trust-manager CRDs.
+		scheme := runtime.NewScheme()
+		require.NoError(t, clientgoscheme.AddToScheme(scheme))
+		cl := fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(secret).WithInterceptorFuncs(interceptor.Funcs{
+			Get: func(ctx context.Context, cl client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+				if obj.GetObjectKind().GroupVersionKind() == bundleGVK {
+					return &meta.NoKindMatchError{GroupKind: bundleGVK.GroupKind(), SearchedVersions: []string{bundleGVK.Version}}
+				}
+				return cl.Get(ctx, key, obj, opts...)
+			},
+		}).Build()
+		require.NoError(t, createTrustBundle(cl, certsTestNamespace, "crdb", caSecret, time.Second))
+
+		var cm corev1.ConfigMap
+		require.NoError(t, cl.Get(ctx, types.NamespacedName{Name: "crdb-ca-crt", Namespace: certsTestNamespace}, &cm))
+		assert.Equal(t, string(ca.certPEM), cm.Data["ca.crt"])
+	})
+}
+
+func TestBundleContains(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	assert.True(t, bundleContains(append(other.certPEM, ca.certPEM...), ca.certPEM))
+	assert.False(t, bundleContains(other.certPEM, ca.certPEM))
+	assert.False(t, bundleContains(nil, ca.certPEM))
+}
@@ -0,0 +1,205 @@
+package migrate
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	publicv1 "github.com/cockroachdb/cockroach-operator/apis/v1alpha1"
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// notMigratedYaml lists the fields of the public operator CrdbCluster which aren't carried over.
+const notMigratedYaml = "not-migrated.yaml"
+
+// notMigratedField is a field of the public operator CrdbCluster spec which has no equivalent in the values of
+// the CockroachDB Enterprise Operator chart.
+type notMigratedField struct {
+	Field  string `json:"field"`
+	Value  any    `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// mapPublicOperatorSpec maps the fields of the public operator CrdbCluster spec to the helm values. Most fields
+// are also rendered by the public operator into the StatefulSet the values are built from, they are set
+// explicitly so that the CrdbCluster spec takes precedence. The fields which can't be mapped are returned.
+//
+//   - nodes, grpcPort, httpPort, sqlPort, tlsEnabled, logConfigMap and terminationGracePeriodSecs are set by
+//     buildHelmValuesFromOperator.
+//   - image and cockroachDBVersion map to the image, with the pull policy and secret set on the pod template.
+//   - cache, maxSQLMemory and additionalArgs map to the start flags.
+//   - resources, affinity, tolerations, nodeSelector and topologySpreadConstraints map to the chart values of
+//     the same name, and podEnvVariables, priorityClassName and automountServiceAccountToken to the pod template.
+//   - additionalLabels map to the labels of all resources, additionalAnnotations to the pod and public Service
+//     annotations.
+//   - dataStore maps to the data store if it is backed by a PVC, ingress maps to the ingress values.
+//   - nodeTLSSecret, clientTLSSecret, maxUnavailable and minAvailable have no equivalent.
+func mapPublicOperatorSpec(cluster publicv1.CrdbCluster, values *helmValues, input *parsedMigrationInput) []notMigratedField {
+	spec := cluster.Spec
+	crdbCluster := &values.CockroachDB.CrdbCluster
+	var notMigrated []notMigratedField
+
+	crdbCluster.Image.Name = publicOperatorImage(cluster, input.podSpec.container)
+
+	if spec.Cache != "" {
+		ensureStartFlag(input.startFlags, "cache", "--cache="+spec.Cache, false)
+	}
+	if spec.MaxSQLMemory != "" {
+		ensureStartFlag(input.startFlags, "max-sql-memory", "--max-sql-memory="+spec.MaxSQLMemory, false)
+	}
+	for _, arg := range spec.AdditionalArgs {
+		name, _, _ := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		// Flags mapped to other CrdbNode fields are picked up from the StatefulSet command.
+		if flag, ok := cockroachStartFlags[name]; !ok || flag.kind == upsertFlag {
+			ensureStartFlag(input.startFlags, name, arg, flag.repeatable)
+		}
+	}
+	crdbCluster.StartFlags = startFlagsValue(input.startFlags)
+
+	if len(spec.Resources.Limits) > 0 || len(spec.Resources.Requests) > 0 {
+		crdbCluster.Resources = spec.Resources.DeepCopy()
+	}
+	crdbCluster.Affinity = spec.Affinity
+	crdbCluster.Tolerations = spec.Tolerations
+	crdbCluster.NodeSelector = spec.NodeSelector
+	crdbCluster.TopologySpreadConstraints = spec.TopologySpreadConstraints
+
+	if len(spec.AdditionalLabels) > 0 {
+		if values.K8s == nil {
+			values.K8s = &k8sValues{}
+		}
+		values.K8s.Labels = spec.AdditionalLabels
+	}
+	if len(spec.AdditionalAnnotations) > 0 {
+		crdbCluster.PodAnnotations = spec.AdditionalAnnotations
+		if crdbCluster.Service.Public == nil {
+			crdbCluster.Service.Public = &publicServiceValues{Name: cluster.Name + "-public"}
+		}
+		crdbCluster.Service.Public.Annotations = spec.AdditionalAnnotations
+	}
+
+	if crdbCluster.PodTemplate != nil {
+		applyPublicOperatorPodSettings(cluster, crdbCluster.PodTemplate)
+	}
+	if spec.PriorityClassName != "" {
+		input.podSpec.unmapped = slices.DeleteFunc(input.podSpec.unmapped, func(u string) bool {
+			return u == priorityClassSetting(spec.PriorityClassName)
+		})
+	}
+	if spec.DataStore.VolumeClaim == nil {
+		notMigrated = append(notMigrated, notMigratedField{
+			Field:  "dataStore",
+			Value:  spec.DataStore,
+			Reason: "the CockroachDB Enterprise Operator only supports data stores backed by a PVC",
+		})
+	}
+
+	if spec.Ingress != nil {
+		for _, i := range []struct {
+			name    string
+			ingress *publicv1.Ingress
+		}{
+			{name: "ui", ingress: spec.Ingress.UI},
+			{name: "sql", ingress: spec.Ingress.SQL},
+		} {
+			if i.ingress != nil && len(i.ingress.TLS) > 0 {
+				notMigrated = append(notMigrated, notMigratedField{
+					Field:  fmt.Sprintf("ingress.%s.tls", i.name),
+					Value:  i.ingress.TLS,
+					Reason: "the cockroachdb chart doesn't configure TLS for the ingress, add it through the ingress annotations of your ingress controller",
+				})
+			}
+		}
+	}
+
+	for _, f := range []struct {
+		field string
+		value string
+	}{
+		{field: "nodeTLSSecret", value: spec.NodeTLSSecret},
+		{field: "clientTLSSecret", value: spec.ClientTLSSecret},
+	} {
+		if f.value != "" {
+			notMigrated = append(notMigrated, notMigratedField{
+				Field:  f.field,
+				Value:  f.value,
+				Reason: "migrate-certs issues new certificates signed by the public operator CA, re-issue the user provided certificates with the DNS names of the CockroachDB Enterprise Operator and set tls.externalCertificates",
+			})
+		}
+	}
+
+	for _, f := range []struct {
+		field string
+		value *int32
+	}{
+		{field: "maxUnavailable", value: spec.MaxUnavailable},
+		{field: "minAvailable", value: spec.MinAvailable},
+	} {
+		if f.value != nil {
+			notMigrated = append(notMigrated, notMigratedField{
+				Field:  f.field,
+				Value:  *f.value,
+				Reason: "the PodDisruptionBudget is managed by the CockroachDB Enterprise Operator",
+			})
+		}
+	}
+
+	return notMigrated
+}
+
+// applyPublicOperatorPodSettings sets the pod settings of the public operator CrdbCluster spec which are only
+// configurable through the pod template.
+func applyPublicOperatorPodSettings(cluster publicv1.CrdbCluster, podTemplate *v1alpha1.PodTemplateSpec) {
+	spec := cluster.Spec
+	podSpec := &podTemplate.Spec
+
+	if spec.PriorityClassName != "" {
+		podSpec.PriorityClassName = spec.PriorityClassName
+	}
+	// The public operator sets the field on the StatefulSet pods even if it is unset in the CrdbCluster, so its
+	// default of false is carried over as well.
+	podSpec.AutomountServiceAccountToken = To(spec.AutomountServiceAccountToken)
+	if spec.Image != nil && spec.Image.PullSecret != nil && !slices.Contains(podSpec.ImagePullSecrets, corev1.LocalObjectReference{Name: *spec.Image.PullSecret}) {
+		podSpec.ImagePullSecrets = append(slices.Clone(podSpec.ImagePullSecrets), corev1.LocalObjectReference{Name: *spec.Image.PullSecret})
+	}
+
+	if len(podSpec.Containers) == 0 {
+		return
+	}
+	container := &podSpec.Containers[0]
+	if spec.Image != nil && spec.Image.PullPolicyName != nil {
+		container.ImagePullPolicy = *spec.Image.PullPolicyName
+	}
+	for _, env := range spec.PodEnvVariables {
+		if !slices.ContainsFunc(container.Env, func(e corev1.EnvVar) bool { return e.Name == env.Name }) {
+			container.Env = append(container.Env, env)
+		}
+	}
+}
+
+// publicOperatorImage returns the image of the CrdbCluster. If the cluster only sets the CockroachDB version, the
+// public operator resolves the image, so the image of the StatefulSet is used.
+func publicOperatorImage(cluster publicv1.CrdbCluster, container corev1.Container) string {
+	if cluster.Spec.Image != nil && cluster.Spec.Image.Name != "" {
+		return cluster.Spec.Image.Name
+	}
+	return container.Image
+}
+
+// ensureStartFlag adds the flag to the start flags, unless it is already set to the same value.
+func ensureStartFlag(flags *v1alpha1.Flags, name, flag string, repeatable bool) {
+	if slices.Contains(flags.Upsert, flag) {
+		return
+	}
+	upsertStartFlag(flags, name, flag, repeatable)
+}
+
+// notMigratedWarnings lists the fields of the public operator CrdbCluster which aren't carried over.
+func notMigratedWarnings(fields []notMigratedField) []string {
+	var warnings []string
+	for _, f := range fields {
+		warnings = append(warnings, fmt.Sprintf("crdbcluster field %s not migrated: %s", f.Field, f.Reason))
+	}
+	return warnings
+}
@@ -0,0 +1,69 @@
+package migrate
+
+import (
+	"testing"
+
+	publicv1 "github.com/cockroachdb/cockroach-operator/apis/v1alpha1"
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMapPublicOperatorSpec(t *testing.T) {
+	cluster := publicv1.CrdbCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb"},
+		Spec: publicv1.CrdbClusterSpec{
+			CockroachDBVersion:           "v25.1.5",
+			Cache:                        "25%",
+			AdditionalArgs:               []string{"--max-offset=250ms", "--locality=region=us-east1", "--temp-dir=/tmp"},
+			PriorityClassName:            "crdb-critical",
+			AutomountServiceAccountToken: true,
+			PodEnvVariables:              []corev1.EnvVar{{Name: "COCKROACH_CHANNEL", Value: "ignored"}, {Name: "EXTRA", Value: "1"}},
+			AdditionalLabels:             map[string]string{"team": "db"},
+			MinAvailable:                 To(int32(2)),
+			NodeTLSSecret:                "my-node-certs",
+			DataStore:                    publicv1.Volume{HostPath: &corev1.HostPathVolumeSource{Path: "/mnt/data"}},
+			Ingress: &publicv1.IngressConfig{
+				SQL: &publicv1.Ingress{Host: "sql.example.com", TLS: []networkingv1.IngressTLS{{SecretName: "sql-tls"}}},
+			},
+		},
+	}
+	input := parsedMigrationInput{
+		startFlags: &v1alpha1.Flags{Upsert: []string{"--cache=25%", "--max-offset=250ms", "--temp-dir=/tmp"}},
+		podSpec: podSpecInput{
+			container: corev1.Container{Image: "cockroachdb/cockroach:v25.1.5"},
+			unmapped:  []string{priorityClassSetting("crdb-critical"), "host network"},
+		},
+	}
+	values := helmValues{}
+	values.CockroachDB.CrdbCluster.PodTemplate = &v1alpha1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{{Name: enterpriseOperatorContainerName, Env: []corev1.EnvVar{{Name: "COCKROACH_CHANNEL", Value: "kubernetes-operator"}}}},
+	}}
+
+	notMigrated := mapPublicOperatorSpec(cluster, &values, &input)
+
+	crdbCluster := values.CockroachDB.CrdbCluster
+	assert.Equal(t, "cockroachdb/cockroach:v25.1.5", crdbCluster.Image.Name)
+	// Flags already rendered into the StatefulSet command keep their position.
+	assert.Equal(t, []string{"--cache=25%", "--max-offset=250ms", "--temp-dir=/tmp"}, crdbCluster.StartFlags.Upsert)
+	assert.Equal(t, map[string]string{"team": "db"}, values.K8s.Labels)
+	assert.Equal(t, "crdb-critical", crdbCluster.PodTemplate.Spec.PriorityClassName)
+	assert.Equal(t, To(true), crdbCluster.PodTemplate.Spec.AutomountServiceAccountToken)
+	assert.Equal(t, []corev1.EnvVar{{Name: "COCKROACH_CHANNEL", Value: "kubernetes-operator"}, {Name: "EXTRA", Value: "1"}},
+		crdbCluster.PodTemplate.Spec.Containers[0].Env)
+	assert.Equal(t, []string{"host network"}, input.podSpec.unmapped)
+
+	var fields []string
+	for _, f := range notMigrated {
+		fields = append(fields, f.Field)
+	}
+	assert.Equal(t, []string{"dataStore", "ingress.sql.tls", "nodeTLSSecret", "minAvailable"}, fields)
+
+	// The public operator defaults to not mounting the service account token, which the pod template keeps.
+	cluster.Spec.AutomountServiceAccountToken = false
+	notMigrated = mapPublicOperatorSpec(cluster, &values, &input)
+	assert.Equal(t, To(false), values.CockroachDB.CrdbCluster.PodTemplate.Spec.AutomountServiceAccountToken)
+	assert.Len(t, notMigrated, len(fields))
+}
@@ -0,0 +1,199 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/database"
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// pcrMaxReplicationLag is the replication lag above which the replication stream of a standby is
+// considered unhealthy.
+const pcrMaxReplicationLag = 5 * time.Minute
+
+// pcrInspector reads the physical cluster replication (PCR) state of a running cluster.
+type pcrInspector interface {
+	virtualClusters(ctx context.Context) ([]database.VirtualCluster, error)
+	replicationStatus(ctx context.Context, virtualCluster string) (database.ReplicationStatus, error)
+	Close() error
+}
+
+// sqlPCRInspector reads the PCR state from the system virtual cluster of the cluster.
+type sqlPCRInspector struct {
+	db *sql.DB
+}
+
+// newSQLPCRInspector connects to the system virtual cluster through the first pod of the StatefulSet, with
+// the client certificate of the root user. Clusters without a client secret are connected to insecurely.
+func newSQLPCRInspector(ctx context.Context, config *rest.Config, namespace, stsName string, sqlPort int32, clientSecret string) (pcrInspector, error) {
+	db, err := connectToCluster(ctx, config, namespace, stsName, sqlPort, clientSecret, database.SystemVirtualCluster)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to the system virtual cluster")
+	}
+	return &sqlPCRInspector{db: db}, nil
+}
+
+// connectToCluster connects to the virtual cluster through the first pod of the StatefulSet, or to the default
+// virtual cluster if virtualCluster is empty.
+func connectToCluster(ctx context.Context, config *rest.Config, namespace, stsName string, sqlPort int32, clientSecret, virtualCluster string) (*sql.DB, error) {
+	c, err := client.New(config, client.Options{})
+	if err != nil {
+		return nil, errors.Wrap(err, "building k8s client")
+	}
+
+	return database.NewDbConnection(&database.DBConnection{
+		Ctx:                         ctx,
+		Client:                      c,
+		RestConfig:                  config,
+		ServiceName:                 fmt.Sprintf("%s-0.%s", stsName, stsName),
+		Namespace:                   namespace,
+		Port:                        &sqlPort,
+		UseSSL:                      clientSecret != "",
+		ClientCertificateSecretName: clientSecret,
+		RootCertificateSecretName:   clientSecret,
+		VirtualCluster:              virtualCluster,
+		ApplicationName:             "migration-helper",
+	})
+}
+
+func (s *sqlPCRInspector) virtualClusters(ctx context.Context) ([]database.VirtualCluster, error) {
+	return database.ShowVirtualClusters(ctx, s.db)
+}
+
+func (s *sqlPCRInspector) replicationStatus(ctx context.Context, virtualCluster string) (database.ReplicationStatus, error) {
+	return database.ShowReplicationStatus(ctx, s.db, virtualCluster)
+}
+
+func (s *sqlPCRInspector) Close() error {
+	return s.db.Close()
+}
+
+// pcrState is the PCR setup of the cluster being migrated.
+type pcrState struct {
+	// spec is the virtual cluster of the CrdbNodes, nil if the cluster isn't virtualized.
+	spec *v1alpha1.CrdbVirtualClusterSpec
+	// detection records where the mode was read from.
+	detection string
+	// virtualCluster is the application virtual cluster served by the primary, or replicated by the standby.
+	virtualCluster string
+	// replication is the state of the replication stream of a standby.
+	replication *database.ReplicationStatus
+	// warning explains why the mode couldn't be read from the running cluster.
+	warning string
+}
+
+func (s pcrState) mode() v1alpha1.CrdbVirtualClusterMode {
+	if s.spec == nil {
+		return v1alpha1.VirtualClusterDisabled
+	}
+	return s.spec.Mode
+}
+
+// inspectPCR reads the PCR mode from the virtual clusters of the running cluster, along with the replication
+// status of a standby.
+func inspectPCR(ctx context.Context, inspector pcrInspector) (pcrState, error) {
+	clusters, err := inspector.virtualClusters(ctx)
+	if err != nil {
+		return pcrState{}, err
+	}
+
+	virtualization := database.DetectVirtualization(clusters)
+	state := pcrState{detection: "virtual clusters of the running cluster", virtualCluster: virtualization.VirtualCluster}
+	switch virtualization.Mode {
+	case database.VirtualizationPrimary:
+		state.spec = &v1alpha1.CrdbVirtualClusterSpec{Mode: v1alpha1.VirtualClusterPrimary}
+	case database.VirtualizationStandby:
+		state.spec = &v1alpha1.CrdbVirtualClusterSpec{Mode: v1alpha1.VirtualClusterStandby}
+		status, err := inspector.replicationStatus(ctx, virtualization.VirtualCluster)
+		if err != nil {
+			return pcrState{}, err
+		}
+		state.replication = &status
+	}
+	return state, nil
+}
+
+// detectPCR detects the PCR mode from the running cluster. The init job of the Helm chart is only used if the
+// cluster can't be reached, since it's usually garbage collected by the time the cluster is migrated, and to
+// detect a standby initialized with --virtualized-empty which doesn't replicate yet.
+func (m *Manifest) detectPCR(ctx context.Context, sts *appsv1.StatefulSet, input parsedMigrationInput) pcrState {
+	fromJob := pcrState{spec: detectPCRFromInitJob(m.clientset, sts.Name, m.namespace)}
+	if fromJob.spec != nil {
+		fromJob.detection = fmt.Sprintf("init job %s-init", sts.Name)
+	}
+	if m.newPCRInspector == nil {
+		return fromJob
+	}
+
+	inspector, err := m.newPCRInspector(ctx, sts, input)
+	if err == nil {
+		defer inspector.Close()
+	}
+	var state pcrState
+	if err == nil {
+		state, err = inspectPCR(ctx, inspector)
+	}
+	if err != nil {
+		fromJob.warning = fmt.Sprintf("couldn't read the virtual clusters of the running cluster, the PCR mode is detected from the init job: %v", err)
+		return fromJob
+	}
+
+	if state.spec == nil && fromJob.mode() == v1alpha1.VirtualClusterStandby {
+		fromJob.detection += ", the standby doesn't replicate yet"
+		return fromJob
+	}
+	return state
+}
+
+// helmChartPCR detects the PCR setup of the StatefulSet of the Manifest once, so that it can be validated
+// before the manifests are generated.
+func (m *Manifest) helmChartPCR(ctx context.Context, sts *appsv1.StatefulSet, input parsedMigrationInput) pcrState {
+	if m.pcr == nil {
+		state := m.detectPCR(ctx, sts, input)
+		m.pcr = &state
+	}
+	return *m.pcr
+}
+
+// validatePCRPair checks that the clusters are the primary and the standby of the same replication stream,
+// and that the stream is healthy.
+func validatePCRPair(a, b pcrState) error {
+	primary, standby := a, b
+	if a.mode() == v1alpha1.VirtualClusterStandby {
+		primary, standby = b, a
+	}
+	if primary.mode() != v1alpha1.VirtualClusterPrimary || standby.mode() != v1alpha1.VirtualClusterStandby {
+		return errors.Newf("expected a primary and a standby cluster, found %s and %s", a.mode(), b.mode())
+	}
+
+	if standby.replication == nil {
+		return errors.New("the standby cluster doesn't replicate, start the replication stream before migrating the pair")
+	}
+	if source := standby.replication.SourceVirtualCluster; source != "" && primary.virtualCluster != "" && source != primary.virtualCluster {
+		return errors.Newf("the standby cluster replicates virtual cluster %s, but the primary cluster serves %s", source, primary.virtualCluster)
+	}
+	return standby.replication.Healthy(time.Now(), pcrMaxReplicationLag)
+}
+
+// checkPCRHealth checks that a cluster still has the PCR mode it was migrated with. A standby must replicate
+// with a lag below pcrMaxReplicationLag, and a primary must serve its application virtual cluster.
+func checkPCRHealth(ctx context.Context, inspector pcrInspector, mode v1alpha1.CrdbVirtualClusterMode) error {
+	state, err := inspectPCR(ctx, inspector)
+	if err != nil {
+		return err
+	}
+	if state.mode() != mode {
+		return errors.Newf("cluster is in PCR mode %s, expected %s", state.mode(), mode)
+	}
+	if state.replication != nil {
+		return state.replication.Healthy(time.Now(), pcrMaxReplicationLag)
+	}
+	return nil
+}
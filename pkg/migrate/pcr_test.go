@@ -0,0 +1,206 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/database"
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakePCRInspector returns fixed virtual clusters and replication status.
+type fakePCRInspector struct {
+	clusters    []database.VirtualCluster
+	replication database.ReplicationStatus
+	err         error
+	calls       int
+}
+
+func (f *fakePCRInspector) virtualClusters(ctx context.Context) ([]database.VirtualCluster, error) {
+	f.calls++
+	return f.clusters, f.err
+}
+
+func (f *fakePCRInspector) replicationStatus(ctx context.Context, virtualCluster string) (database.ReplicationStatus, error) {
+	return f.replication, nil
+}
+
+func (f *fakePCRInspector) Close() error {
+	return nil
+}
+
+func systemVirtualCluster() database.VirtualCluster {
+	return database.VirtualCluster{ID: 1, Name: database.SystemVirtualCluster, DataState: "ready", ServiceMode: "shared"}
+}
+
+func primaryInspector() *fakePCRInspector {
+	return &fakePCRInspector{clusters: []database.VirtualCluster{
+		systemVirtualCluster(),
+		{ID: 3, Name: "main", DataState: "ready", ServiceMode: "shared"},
+	}}
+}
+
+func standbyInspector(replicatedTime time.Time) *fakePCRInspector {
+	return &fakePCRInspector{
+		clusters: []database.VirtualCluster{
+			systemVirtualCluster(),
+			{ID: 3, Name: "main", DataState: "replicating", ServiceMode: "none"},
+		},
+		replication: database.ReplicationStatus{
+			VirtualCluster:       "main",
+			SourceVirtualCluster: "main",
+			Status:               "replicating",
+			ReplicatedTime:       replicatedTime,
+		},
+	}
+}
+
+func initJob(stsName, flag string) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: stsName + "-init", Namespace: "default"},
+		Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Command: []string{"/bin/bash", "-c", "cockroach init " + flag}}},
+		}}},
+	}
+}
+
+func TestDetectPCR(t *testing.T) {
+	ctx := context.Background()
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb", Namespace: "default"}}
+
+	tests := []struct {
+		name              string
+		job               *batchv1.Job
+		inspector         *fakePCRInspector
+		expectedMode      v1alpha1.CrdbVirtualClusterMode
+		expectedDetection string
+		expectWarning     bool
+	}{
+		{
+			name:              "standby from the running cluster without init job",
+			inspector:         standbyInspector(time.Now()),
+			expectedMode:      v1alpha1.VirtualClusterStandby,
+			expectedDetection: "virtual clusters of the running cluster",
+		},
+		{
+			name:              "running cluster takes precedence over the init job",
+			job:               initJob("cockroachdb", "--virtualized-empty"),
+			inspector:         primaryInspector(),
+			expectedMode:      v1alpha1.VirtualClusterPrimary,
+			expectedDetection: "virtual clusters of the running cluster",
+		},
+		{
+			name:              "standby which doesn't replicate yet",
+			job:               initJob("cockroachdb", "--virtualized-empty"),
+			inspector:         &fakePCRInspector{clusters: []database.VirtualCluster{systemVirtualCluster()}},
+			expectedMode:      v1alpha1.VirtualClusterStandby,
+			expectedDetection: "init job cockroachdb-init, the standby doesn't replicate yet",
+		},
+		{
+			name:              "unreachable cluster falls back to the init job",
+			job:               initJob("cockroachdb", "--virtualized"),
+			inspector:         &fakePCRInspector{err: errors.New("connection refused")},
+			expectedMode:      v1alpha1.VirtualClusterPrimary,
+			expectedDetection: "init job cockroachdb-init",
+			expectWarning:     true,
+		},
+		{
+			name:              "not virtualized",
+			inspector:         &fakePCRInspector{clusters: []database.VirtualCluster{systemVirtualCluster()}},
+			expectedMode:      v1alpha1.VirtualClusterDisabled,
+			expectedDetection: "virtual clusters of the running cluster",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			if tt.job != nil {
+				clientset = fake.NewSimpleClientset(tt.job)
+			}
+			m := &Manifest{
+				namespace: "default",
+				clientset: clientset,
+				newPCRInspector: func(ctx context.Context, sts *appsv1.StatefulSet, input parsedMigrationInput) (pcrInspector, error) {
+					return tt.inspector, nil
+				},
+			}
+
+			state := m.detectPCR(ctx, sts, parsedMigrationInput{})
+			assert.Equal(t, tt.expectedMode, state.mode())
+			assert.Equal(t, tt.expectedDetection, state.detection)
+			assert.Equal(t, tt.expectWarning, state.warning != "")
+		})
+	}
+}
+
+func TestValidatePCRPair(t *testing.T) {
+	ctx := context.Background()
+	inspect := func(inspector *fakePCRInspector) pcrState {
+		state, err := inspectPCR(ctx, inspector)
+		require.NoError(t, err)
+		return state
+	}
+
+	primary := inspect(primaryInspector())
+	standby := inspect(standbyInspector(time.Now()))
+	require.NoError(t, validatePCRPair(primary, standby))
+	require.NoError(t, validatePCRPair(standby, primary))
+
+	err := validatePCRPair(primary, primary)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expected a primary and a standby cluster")
+
+	lagging := inspect(standbyInspector(time.Now().Add(-time.Hour)))
+	require.Error(t, validatePCRPair(primary, lagging))
+
+	other := standbyInspector(time.Now())
+	other.replication.SourceVirtualCluster = "app"
+	err = validatePCRPair(primary, inspect(other))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "replicates virtual cluster app")
+
+	empty := pcrState{spec: &v1alpha1.CrdbVirtualClusterSpec{Mode: v1alpha1.VirtualClusterStandby}}
+	require.Error(t, validatePCRPair(primary, empty))
+}
+
+func TestExecutorChecksPCR(t *testing.T) {
+	ctx := context.Background()
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb", Namespace: executeTestNamespace},
+		Spec:       appsv1.StatefulSetSpec{Replicas: To(int32(1))},
+	}
+
+	// An unhealthy replication stream stops the migration before any node is migrated.
+	dir := t.TempDir()
+	writeExecuteManifests(t, dir, "cockroachdb", 1)
+	clientset, dynamicClient := newExecuteTestEnv(t, sts)
+	var helmCalls [][]string
+	e := newTestExecutor(PublicOperatorSource, "cockroachdb", dir, "", clientset, dynamicClient, &helmCalls)
+	e.pcrMode = v1alpha1.VirtualClusterStandby
+	lagging := standbyInspector(time.Now().Add(-time.Hour))
+	e.newPCRInspector = func(ctx context.Context) (pcrInspector, error) { return lagging, nil }
+
+	err := e.Run(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "checking PCR before the migration")
+	current, err := clientset.AppsV1().StatefulSets(executeTestNamespace).Get(ctx, "cockroachdb", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), *current.Spec.Replicas)
+
+	// A healthy stream is checked before and after the migration.
+	healthy := standbyInspector(time.Now())
+	e.newPCRInspector = func(ctx context.Context) (pcrInspector, error) { return healthy, nil }
+	require.NoError(t, e.Run(ctx))
+	assert.Equal(t, 2, healthy.calls)
+	assert.Len(t, helmCalls, 1)
+}
@@ -0,0 +1,256 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const enterpriseOperatorContainerName = "cockroachdb"
+
+// operatorManagedVolumes are the volumes which the Helm chart and the public operator add to the CockroachDB pods
+// for the data stores, certificates and logging configuration. The CockroachDB Enterprise Operator configures
+// its own equivalent volumes, so they aren't carried over.
+var operatorManagedVolumes = map[string]bool{
+	"datadir":      true,
+	"failoverdir":  true,
+	"certs":        true,
+	"certs-secret": true,
+	"emptydir":     true,
+	"log-config":   true,
+}
+
+// operatorManagedInitContainers are the init containers which copy the certificates in place for the Helm chart
+// and the public operator.
+var operatorManagedInitContainers = map[string]bool{
+	"copy-certs": true,
+	"db-init":    true,
+}
+
+// crdbContainerPorts are the ports of the CockroachDB container which are configured by the operator.
+var crdbContainerPorts = map[string]bool{
+	grpcName: true,
+	sqlName:  true,
+	"http":   true,
+}
+
+// podSpecInput holds the settings of the CockroachDB pods which are carried over to the CrdbNode pod template.
+type podSpecInput struct {
+	// container is the CockroachDB container of the StatefulSet.
+	container corev1.Container
+	// volumeMounts are the mounts of the CockroachDB container which aren't managed by the operator.
+	volumeMounts     []corev1.VolumeMount
+	sideCars         v1alpha1.CrdbNodeSideCars
+	securityContext  *corev1.PodSecurityContext
+	imagePullSecrets []corev1.LocalObjectReference
+	// unmapped describes the settings which couldn't be carried over.
+	unmapped []string
+}
+
+func isOperatorManagedVolume(name string) bool {
+	return operatorManagedVolumes[name] || strings.HasPrefix(name, "datadir-")
+}
+
+// findCrdbContainer returns the CockroachDB container of the pod. The container is looked up by the names used
+// by the Helm chart and the public operator first, and then by the command it runs, so that renamed containers
+// are still found.
+func findCrdbContainer(podSpec corev1.PodSpec) (corev1.Container, error) {
+	for _, c := range podSpec.Containers {
+		if c.Name == crdbContainerName || c.Name == enterpriseOperatorContainerName {
+			return c, nil
+		}
+	}
+
+	var found []corev1.Container
+	for _, c := range podSpec.Containers {
+		if _, err := cockroachStartArgs(c); err == nil {
+			found = append(found, c)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return corev1.Container{}, errors.New("couldn't find a container running cockroach start")
+	case 1:
+		return found[0], nil
+	default:
+		return corev1.Container{}, errors.Newf("found %d containers running cockroach start", len(found))
+	}
+}
+
+// generatePodSpecInput collects the containers, volumes and security settings of the StatefulSet pods which
+// are not managed by the CockroachDB Enterprise Operator, so that they can be set on the CrdbNode pods.
+func generatePodSpecInput(sts *appsv1.StatefulSet) (podSpecInput, error) {
+	podSpec := sts.Spec.Template.Spec
+
+	crdb, err := findCrdbContainer(podSpec)
+	if err != nil {
+		return podSpecInput{}, errors.Wrapf(err, "statefulset %s", sts.Name)
+	}
+
+	input := podSpecInput{
+		container:        crdb,
+		securityContext:  podSpec.SecurityContext,
+		imagePullSecrets: podSpec.ImagePullSecrets,
+	}
+
+	// Volumes backed by a volume claim template other than the data stores can't be attached to the CrdbNodes.
+	claimTemplates := make(map[string]bool)
+	for _, vct := range sts.Spec.VolumeClaimTemplates {
+		claimTemplates[vct.Name] = true
+	}
+	skipped := make(map[string]bool)
+	for _, v := range podSpec.Volumes {
+		switch {
+		case isOperatorManagedVolume(v.Name):
+			skipped[v.Name] = true
+		case v.PersistentVolumeClaim != nil && claimTemplates[v.PersistentVolumeClaim.ClaimName]:
+			skipped[v.Name] = true
+			input.unmapped = append(input.unmapped, fmt.Sprintf("volume %s backed by volume claim template %s", v.Name, v.PersistentVolumeClaim.ClaimName))
+		}
+	}
+	// The volume claim templates mounted by the cockroach container are mapped by mapVolumeClaimTemplates.
+	crdbMounts := make(map[string]bool)
+	for _, m := range crdb.VolumeMounts {
+		crdbMounts[m.Name] = true
+	}
+	for _, vct := range sts.Spec.VolumeClaimTemplates {
+		if !isOperatorManagedVolume(vct.Name) && !volumeUsed(podSpec.Volumes, vct.Name) && !crdbMounts[vct.Name] {
+			input.unmapped = append(input.unmapped, fmt.Sprintf("volume claim template %s", vct.Name))
+		}
+	}
+
+	for _, m := range crdb.VolumeMounts {
+		if !skipped[m.Name] {
+			input.volumeMounts = append(input.volumeMounts, m)
+		} else if !isOperatorManagedVolume(m.Name) {
+			input.unmapped = append(input.unmapped, fmt.Sprintf("mount of volume %s in container %s", m.Name, crdb.Name))
+		}
+	}
+
+	for _, p := range crdb.Ports {
+		if !crdbContainerPorts[p.Name] {
+			input.unmapped = append(input.unmapped, fmt.Sprintf("port %s (%d) of container %s", p.Name, p.ContainerPort, crdb.Name))
+		}
+	}
+	if crdb.StartupProbe != nil {
+		input.unmapped = append(input.unmapped, fmt.Sprintf("startup probe of container %s", crdb.Name))
+	}
+
+	for _, c := range podSpec.InitContainers {
+		if operatorManagedInitContainers[c.Name] {
+			continue
+		}
+		input.sideCars.InitContainers = append(input.sideCars.InitContainers, input.sideCar(c, skipped))
+	}
+	for _, c := range podSpec.Containers {
+		if c.Name == crdb.Name {
+			continue
+		}
+		input.sideCars.Containers = append(input.sideCars.Containers, input.sideCar(c, skipped))
+	}
+
+	// Only the volumes mounted by the containers carried over are needed.
+	mounted := make(map[string]bool)
+	for _, m := range input.volumeMounts {
+		mounted[m.Name] = true
+	}
+	for _, c := range append(input.sideCars.InitContainers, input.sideCars.Containers...) {
+		for _, m := range c.VolumeMounts {
+			mounted[m.Name] = true
+		}
+	}
+	for _, v := range podSpec.Volumes {
+		if !skipped[v.Name] && mounted[v.Name] {
+			input.sideCars.Volumes = append(input.sideCars.Volumes, v)
+		}
+	}
+
+	if podSpec.PriorityClassName != "" {
+		input.unmapped = append(input.unmapped, priorityClassSetting(podSpec.PriorityClassName))
+	}
+	if podSpec.HostNetwork {
+		input.unmapped = append(input.unmapped, "host network")
+	}
+	if len(podSpec.HostAliases) > 0 {
+		input.unmapped = append(input.unmapped, "host aliases")
+	}
+	if podSpec.DNSConfig != nil {
+		input.unmapped = append(input.unmapped, "dns config")
+	}
+	if podSpec.RuntimeClassName != nil {
+		input.unmapped = append(input.unmapped, fmt.Sprintf("runtime class %s", *podSpec.RuntimeClassName))
+	}
+
+	return input, nil
+}
+
+// sideCar returns a copy of the container without the mounts of the skipped volumes, which are reported as
+// unmapped instead.
+func (p *podSpecInput) sideCar(c corev1.Container, skipped map[string]bool) corev1.Container {
+	sideCar := *c.DeepCopy()
+	sideCar.VolumeMounts = nil
+	for _, m := range c.VolumeMounts {
+		if skipped[m.Name] {
+			p.unmapped = append(p.unmapped, fmt.Sprintf("mount of volume %s in container %s", m.Name, c.Name))
+			continue
+		}
+		sideCar.VolumeMounts = append(sideCar.VolumeMounts, m)
+	}
+	return sideCar
+}
+
+func priorityClassSetting(name string) string {
+	return fmt.Sprintf("priority class %s", name)
+}
+
+func volumeUsed(volumes []corev1.Volume, claimName string) bool {
+	for _, v := range volumes {
+		if v.PersistentVolumeClaim != nil && v.PersistentVolumeClaim.ClaimName == claimName {
+			return true
+		}
+	}
+	return false
+}
+
+// crdbContainer builds the cockroachdb container of the CrdbNode pod template.
+func (p podSpecInput) crdbContainer() corev1.Container {
+	return corev1.Container{
+		Image:     p.container.Image,
+		Name:      enterpriseOperatorContainerName,
+		Resources: p.container.Resources,
+		Env: append(append([]corev1.EnvVar{}, p.container.Env...), []corev1.EnvVar{
+			{
+				Name: "HOST_IP",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{
+						APIVersion: "v1",
+						FieldPath:  "status.hostIP",
+					},
+				},
+			},
+			{
+				Name:  "GODEBUG",
+				Value: "disablethp=1",
+			},
+		}...),
+		EnvFrom:         p.container.EnvFrom,
+		VolumeMounts:    p.volumeMounts,
+		SecurityContext: p.container.SecurityContext,
+	}
+}
+
+// addPodSpecValues sets the sidecars and the pod level settings in the helm values built for the CockroachDB
+// Enterprise Operator chart. Settings which aren't configured are left out.
+func addPodSpecValues(values *helmValues, podSpec podSpecInput) {
+	crdbCluster := &values.CockroachDB.CrdbCluster
+
+	if len(podSpec.sideCars.Containers) > 0 || len(podSpec.sideCars.InitContainers) > 0 || len(podSpec.sideCars.Volumes) > 0 {
+		crdbCluster.SideCars = &podSpec.sideCars
+	}
+	crdbCluster.PodTemplate.Spec.SecurityContext = podSpec.securityContext
+	crdbCluster.PodTemplate.Spec.ImagePullSecrets = podSpec.imagePullSecrets
+}
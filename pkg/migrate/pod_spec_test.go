@@ -0,0 +1,105 @@
+package migrate
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestFindCrdbContainer(t *testing.T) {
+	start := corev1.Container{Name: "crdb", Command: []string{"/cockroach/cockroach", "start"}}
+	shipper := corev1.Container{Name: "fluent-bit", Command: []string{"/fluent-bit/bin/fluent-bit"}}
+
+	c, err := findCrdbContainer(corev1.PodSpec{Containers: []corev1.Container{shipper, {Name: "db"}}})
+	require.NoError(t, err)
+	assert.Equal(t, "db", c.Name)
+
+	c, err = findCrdbContainer(corev1.PodSpec{Containers: []corev1.Container{shipper, start}})
+	require.NoError(t, err)
+	assert.Equal(t, "crdb", c.Name)
+
+	_, err = findCrdbContainer(corev1.PodSpec{Containers: []corev1.Container{shipper}})
+	require.Error(t, err)
+
+	_, err = findCrdbContainer(corev1.PodSpec{Containers: []corev1.Container{start, start}})
+	require.Error(t, err)
+}
+
+func TestGeneratePodSpecInput(t *testing.T) {
+	sts := appsv1.StatefulSet{}
+	manifestBytes, err := os.ReadFile("testdata/helm/allInput/cockroachdb-statefulset.yaml")
+	require.NoError(t, err)
+	require.NoError(t, yaml.Unmarshal(manifestBytes, &sts))
+
+	podSpec := &sts.Spec.Template.Spec
+	podSpec.Containers[0].Name = "cockroach"
+	podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts,
+		corev1.VolumeMount{Name: "secret-backup", MountPath: "/etc/cockroach/secrets/backup"},
+		corev1.VolumeMount{Name: "logsdir", MountPath: "/cockroach/cockroach-logs"},
+	)
+	podSpec.Containers = append(podSpec.Containers, corev1.Container{
+		Name:         "fluent-bit",
+		Image:        "fluent/fluent-bit",
+		VolumeMounts: []corev1.VolumeMount{{Name: "fluent-bit-config", MountPath: "/fluent-bit/etc"}},
+	})
+	podSpec.InitContainers = append(podSpec.InitContainers, corev1.Container{
+		Name:  "visus",
+		Image: "cockroachdb/visus",
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "certs-secret", MountPath: "/cockroach/node/"},
+			{Name: "client-secret", MountPath: "/cockroach/client"},
+		},
+	})
+	podSpec.Volumes = append(podSpec.Volumes,
+		corev1.Volume{Name: "secret-backup", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "backup"}}},
+		corev1.Volume{Name: "fluent-bit-config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "fluent-bit"},
+		}}},
+		corev1.Volume{Name: "client-secret", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "client"}}},
+		corev1.Volume{Name: "logsdir", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "logsdir"}}},
+	)
+	sts.Spec.VolumeClaimTemplates = append(sts.Spec.VolumeClaimTemplates, corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "logsdir"},
+	})
+	podSpec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "cockroachdb.db.registry"}}
+	podSpec.PriorityClassName = "crdb-critical"
+
+	input, err := generatePodSpecInput(&sts)
+	require.NoError(t, err)
+
+	assert.Equal(t, "cockroach", input.container.Name)
+	assert.Equal(t, []corev1.VolumeMount{{Name: "secret-backup", MountPath: "/etc/cockroach/secrets/backup"}}, input.volumeMounts)
+	assert.Equal(t, podSpec.SecurityContext, input.securityContext)
+	assert.Equal(t, podSpec.ImagePullSecrets, input.imagePullSecrets)
+
+	// The certificate copying init container is replaced by the operator, visus is carried over.
+	require.Len(t, input.sideCars.InitContainers, 1)
+	assert.Equal(t, "visus", input.sideCars.InitContainers[0].Name)
+	assert.Equal(t, []corev1.VolumeMount{{Name: "client-secret", MountPath: "/cockroach/client"}}, input.sideCars.InitContainers[0].VolumeMounts)
+	require.Len(t, input.sideCars.Containers, 1)
+	assert.Equal(t, "fluent-bit", input.sideCars.Containers[0].Name)
+
+	var volumes []string
+	for _, v := range input.sideCars.Volumes {
+		volumes = append(volumes, v.Name)
+	}
+	assert.Equal(t, []string{"secret-backup", "fluent-bit-config", "client-secret"}, volumes)
+
+	assert.Equal(t, []string{
+		"volume logsdir backed by volume claim template logsdir",
+		"mount of volume logsdir in container cockroach",
+		"mount of volume certs-secret in container visus",
+		"priority class crdb-critical",
+	}, input.unmapped)
+
+	container := input.crdbContainer()
+	assert.Equal(t, enterpriseOperatorContainerName, container.Name)
+	assert.Equal(t, podSpec.Containers[0].SecurityContext, container.SecurityContext)
+	assert.Equal(t, input.volumeMounts, container.VolumeMounts)
+}
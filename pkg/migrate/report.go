@@ -0,0 +1,304 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	publicv1 "github.com/cockroachdb/cockroach-operator/apis/v1alpha1"
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// migrationReportJSON is the machine-readable summary of build-manifest, written next to the generated manifests.
+const migrationReportJSON = "migration-report.json"
+
+// Certificate modes of the migrated cluster.
+const (
+	selfSignerCertificates  = "self-signer"
+	certManagerCertificates = "cert-manager"
+	externalCertificates    = "external"
+	insecureCertificates    = "insecure"
+)
+
+// migrationReport records what build-manifest detected and generated, so that the migration can be reviewed
+// or checked by automation before the manifests are applied.
+type migrationReport struct {
+	Source          MigrationSource    `json:"source"`
+	SourceDetection string             `json:"sourceDetection"`
+	Namespace       string             `json:"namespace"`
+	Name            string             `json:"name"`
+	StartFlags      []flagRoute        `json:"startFlags"`
+	LocalityLabels  []string           `json:"localityLabels"`
+	Certificates    certificatesReport `json:"certificates"`
+	Secrets         []string           `json:"secrets"`
+	ConfigMaps      []string           `json:"configMaps"`
+	SQLPort         int32              `json:"sqlPort"`
+	PCR             *pcrReport         `json:"pcr,omitempty"`
+	Warnings        []string           `json:"warnings"`
+	Files           []reportFile       `json:"files"`
+}
+
+// flagRoute is a parsed start flag and the field of the generated manifests it was carried over to.
+type flagRoute struct {
+	Flag        string `json:"flag"`
+	Destination string `json:"destination"`
+}
+
+// certificatesReport is the certificate setup of the migrated cluster.
+type certificatesReport struct {
+	Mode         string `json:"mode"`
+	CAConfigMap  string `json:"caConfigMap,omitempty"`
+	NodeSecret   string `json:"nodeSecret,omitempty"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	IssuerName   string `json:"issuerName,omitempty"`
+	IssuerKind   string `json:"issuerKind,omitempty"`
+}
+
+// pcrReport is the physical cluster replication setup of the migrated cluster.
+type pcrReport struct {
+	Mode      v1alpha1.CrdbVirtualClusterMode `json:"mode"`
+	Detection string                          `json:"detection"`
+	// VirtualCluster is the application virtual cluster served by the primary, or replicated by the standby.
+	VirtualCluster       string `json:"virtualCluster,omitempty"`
+	SourceVirtualCluster string `json:"sourceVirtualCluster,omitempty"`
+	ReplicationStatus    string `json:"replicationStatus,omitempty"`
+	// Peer is the other cluster of the PCR pair, if both were migrated together.
+	Peer string `json:"peer,omitempty"`
+}
+
+// reportFile is a file written by build-manifest.
+type reportFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// outputFiles records the files build-manifest writes to the output dir, so that the report lists exactly the
+// files of the run.
+type outputFiles struct {
+	dir   string
+	paths []string
+}
+
+// write writes the objects to the given path relative to the output dir and records the file.
+func (o *outputFiles) write(path string, data []any) error {
+	return o.writeWithMode(path, 0644, data)
+}
+
+// writeWithMode writes the objects with the given permissions to the given path relative to the output dir and
+// records the file.
+func (o *outputFiles) writeWithMode(path string, mode os.FileMode, data []any) error {
+	if err := yamlToDiskWithMode(filepath.Join(o.dir, path), mode, data); err != nil {
+		return err
+	}
+	if !slices.Contains(o.paths, path) {
+		o.paths = append(o.paths, path)
+	}
+	return nil
+}
+
+// routeFlag records where a parsed start flag was carried over to.
+func (p *parsedMigrationInput) routeFlag(flag, destination string) {
+	p.flagRoutes = append(p.flagRoutes, flagRoute{Flag: flag, Destination: destination})
+}
+
+// newHelmChartReport builds the report of a StatefulSet deployed via the Helm chart.
+func newHelmChartReport(sts *appsv1.StatefulSet, input parsedMigrationInput, pcr pcrState, pcrPeer string, warnings []string) migrationReport {
+	report := newMigrationReport(HelmChartSource, sts, input, warnings)
+	report.SourceDetection = fmt.Sprintf("statefulset %s selected with build-manifest helm", sts.Name)
+	if sts.Labels[helmManagedByLabel] == "Helm" {
+		report.SourceDetection = fmt.Sprintf("statefulset %s is labelled %s=Helm", sts.Name, helmManagedByLabel)
+	}
+
+	switch {
+	case !input.tlsEnabled:
+		report.Certificates.Mode = insecureCertificates
+	case input.certManagerInput != nil:
+		report.Certificates = certificatesReport{
+			Mode:         certManagerCertificates,
+			CAConfigMap:  input.caConfigMap,
+			NodeSecret:   input.nodeSecretName,
+			ClientSecret: input.clientSecretName,
+			IssuerName:   input.certManagerInput.issuerName,
+			IssuerKind:   input.certManagerInput.issuerKind,
+		}
+	default:
+		report.Certificates = certificatesReport{
+			Mode:         selfSignerCertificates,
+			CAConfigMap:  input.caConfigMap,
+			NodeSecret:   input.nodeSecretName,
+			ClientSecret: input.clientSecretName,
+		}
+		if input.providedCerts {
+			report.Certificates.Mode = externalCertificates
+		}
+	}
+	if pcr.spec != nil {
+		report.PCR = &pcrReport{
+			Mode:           pcr.spec.Mode,
+			Detection:      pcr.detection,
+			VirtualCluster: pcr.virtualCluster,
+			Peer:           pcrPeer,
+		}
+		if pcr.replication != nil {
+			report.PCR.SourceVirtualCluster = pcr.replication.SourceVirtualCluster
+			report.PCR.ReplicationStatus = pcr.replication.Status
+		}
+	}
+	report.addReferences()
+
+	return report
+}
+
+// newPublicOperatorReport builds the report of a cluster managed by the public operator.
+func newPublicOperatorReport(cluster publicv1.CrdbCluster, sts *appsv1.StatefulSet, input parsedMigrationInput, warnings []string) migrationReport {
+	report := newMigrationReport(PublicOperatorSource, sts, input, warnings)
+	report.Name = cluster.Name
+	if cluster.Spec.SQLPort != nil {
+		report.SQLPort = *cluster.Spec.SQLPort
+	}
+	report.SourceDetection = fmt.Sprintf("crdbcluster %s selected with build-manifest operator", cluster.Name)
+	for _, owner := range sts.OwnerReferences {
+		if owner.Kind == "CrdbCluster" && owner.Name == cluster.Name {
+			report.SourceDetection = fmt.Sprintf("statefulset %s is owned by crdbcluster %s", sts.Name, cluster.Name)
+		}
+	}
+
+	report.Certificates.Mode = insecureCertificates
+	if input.tlsEnabled {
+		// The public operator generates its certificates unless the user provides them.
+		report.Certificates = certificatesReport{
+			Mode:         selfSignerCertificates,
+			CAConfigMap:  cluster.Name + "-ca-crt",
+			NodeSecret:   cluster.Name + "-node-secret",
+			ClientSecret: cluster.Name + "-client-secret",
+		}
+		if cluster.Spec.NodeTLSSecret != "" {
+			report.Certificates.Mode = externalCertificates
+		}
+	}
+	if cluster.Spec.LogConfigMap != "" && !slices.Contains(report.ConfigMaps, cluster.Spec.LogConfigMap) {
+		report.ConfigMaps = append(report.ConfigMaps, cluster.Spec.LogConfigMap)
+	}
+	report.addReferences()
+
+	return report
+}
+
+// newMigrationReport builds the parts of the report which are common to all sources.
+func newMigrationReport(source MigrationSource, sts *appsv1.StatefulSet, input parsedMigrationInput, warnings []string) migrationReport {
+	report := migrationReport{
+		Source:         source,
+		Namespace:      sts.Namespace,
+		Name:           sts.Name,
+		SQLPort:        input.sqlPort,
+		StartFlags:     append([]flagRoute{}, input.flagRoutes...),
+		LocalityLabels: append([]string{}, input.localityLabels...),
+		Secrets:        []string{},
+		ConfigMaps:     []string{},
+		Warnings:       append([]string{}, warnings...),
+		Files:          []reportFile{},
+	}
+	if input.loggingConfigMap != "" {
+		report.ConfigMaps = append(report.ConfigMaps, input.loggingConfigMap)
+	}
+	if ear := input.encryptionAtRest; ear != nil {
+		for _, name := range []*string{ear.KeySecretName, ear.OldKeySecretName} {
+			if name != nil && *name != "" {
+				report.Secrets = append(report.Secrets, *name)
+			}
+		}
+	}
+
+	return report
+}
+
+// migrationWarnings lists the parts of the migration input which need a review before the generated manifests
+// are applied.
+func migrationWarnings(input parsedMigrationInput) []string {
+	var warnings []string
+	if len(input.localityLabels) > 0 {
+		warnings = append(warnings, fmt.Sprintf("locality label keys %v must be present on the kubernetes nodes", input.localityLabels))
+	}
+	for _, flag := range input.unrecognizedFlags {
+		warnings = append(warnings, fmt.Sprintf("unrecognized cockroach start argument %s kept as a start flag", flag))
+	}
+	for _, flag := range input.unmappedFlags {
+		warnings = append(warnings, fmt.Sprintf("start flag kept unmapped: %s", flag))
+	}
+	for _, flag := range input.droppedFlags {
+		warnings = append(warnings, fmt.Sprintf("start flag dropped: %s", flag))
+	}
+	for _, setting := range input.podSpec.unmapped {
+		warnings = append(warnings, fmt.Sprintf("pod setting not migrated: %s", setting))
+	}
+	return warnings
+}
+
+// printWarnings prints the warnings which are recorded in the migration report.
+func printWarnings(warnings []string) {
+	if len(warnings) == 0 {
+		return
+	}
+	fmt.Printf("⚠️  Review the following before applying the generated manifests, they are also recorded in %s:\n", migrationReportJSON)
+	for _, w := range warnings {
+		fmt.Printf("  - %s\n", w)
+	}
+}
+
+// addReferences adds the certificate Secrets and ConfigMaps to the referenced resources.
+func (r *migrationReport) addReferences() {
+	for _, name := range []string{r.Certificates.NodeSecret, r.Certificates.ClientSecret} {
+		if name != "" && !slices.Contains(r.Secrets, name) {
+			r.Secrets = append(r.Secrets, name)
+		}
+	}
+	if name := r.Certificates.CAConfigMap; name != "" && !slices.Contains(r.ConfigMaps, name) {
+		r.ConfigMaps = append(r.ConfigMaps, name)
+	}
+}
+
+// writeMigrationReport records the files written by the run and writes the report to the output dir.
+func writeMigrationReport(out *outputFiles, report migrationReport) error {
+	for _, path := range out.paths {
+		data, err := os.ReadFile(filepath.Join(out.dir, path))
+		if err != nil {
+			return errors.Wrap(err, "reading generated file")
+		}
+		sum := sha256.Sum256(data)
+		report.Files = append(report.Files, reportFile{Path: filepath.ToSlash(path), SHA256: hex.EncodeToString(sum[:])})
+	}
+	slices.SortFunc(report.Files, func(a, b reportFile) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshalling migration report")
+	}
+	return os.WriteFile(filepath.Join(out.dir, migrationReportJSON), append(data, '\n'), 0644)
+}
+
+// readMigrationReport reads the report written by build-manifest. It returns nil if the manifests were
+// generated without a report.
+func readMigrationReport(dir string) (*migrationReport, error) {
+	data, err := os.ReadFile(filepath.Join(dir, migrationReportJSON))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading migration report")
+	}
+
+	report := &migrationReport{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, errors.Wrap(err, "decoding migration report")
+	}
+	return report, nil
+}
@@ -0,0 +1,653 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	publicv1 "github.com/cockroachdb/cockroach-operator/apis/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+)
+
+const (
+	rollbackDir            = "rollback"
+	rollbackStsYaml        = "statefulset.yaml"
+	rollbackServicesYaml   = "services.yaml"
+	rollbackPDBYaml        = "pdb.yaml"
+	rollbackRBACYaml       = "rbac.yaml"
+	rollbackSecretsYaml    = "secrets.yaml"
+	rollbackHelmValuesYaml = "helm-values.yaml"
+	helmReleaseNameKey     = "meta.helm.sh/release-name"
+	helmInstanceLabel      = "app.kubernetes.io/instance"
+	helmReleaseSecretType  = "helm.sh/release.v1"
+	crdbGroup              = "crdb.cockroachlabs.com"
+	crdbVersion            = "v1alpha1"
+	crdbNodesResource      = "crdbnodes"
+	crdbClusterLabel       = "crdb.cockroachlabs.com/cluster"
+	rollbackDirMode        = 0700
+	rollbackFileMode       = 0600
+)
+
+// rollbackCrdbClusterYaml is the snapshot of the CrdbCluster of the public operator. It is applied manually once
+// the public operator is re-installed.
+const rollbackCrdbClusterYaml = "crdbcluster.yaml"
+
+var crdbNodeGVR = schema.GroupVersionResource{
+	Group:    crdbGroup,
+	Version:  crdbVersion,
+	Resource: crdbNodesResource,
+}
+
+// helmRelease holds the fields of a Helm v3 release record that are needed for rollback.
+type helmRelease struct {
+	Name    string                 `json:"name"`
+	Version int                    `json:"version"`
+	Config  map[string]interface{} `json:"config"`
+}
+
+// backupForRollback snapshots every resource that is required to return to the StatefulSet based deployment
+// into the rollback directory under the output dir. Resources that are not present in the cluster are skipped.
+func backupForRollback(ctx context.Context, clientset kubernetes.Interface, sts *appsv1.StatefulSet, input parsedMigrationInput, out *outputFiles) error {
+	releaseName := sts.Annotations[helmReleaseNameKey]
+	if releaseName == "" {
+		// An empty instance label would select the resources of every release in the namespace.
+		return errors.Newf("statefulset %s has no %s annotation, can't find the resources of its helm release", sts.Name, helmReleaseNameKey)
+	}
+
+	secretNames := []string{input.loggingConfigMap, input.nodeSecretName, input.clientSecretName, fmt.Sprintf("%s-ca-secret", sts.Name)}
+	if err := snapshotForRollback(ctx, clientset, sts, releaseName, secretNames, out); err != nil {
+		return err
+	}
+
+	release, err := latestHelmRelease(ctx, clientset, sts.Namespace, releaseName)
+	if err != nil {
+		return errors.Wrap(err, "fetching helm release values")
+	}
+	if release == nil {
+		fmt.Printf("Helm release %s not found, skipping backup of helm values.\n", releaseName)
+	} else {
+		if err := out.writeWithMode(filepath.Join(rollbackDir, rollbackHelmValuesYaml), rollbackFileMode, []any{release.Config}); err != nil {
+			return errors.Wrap(err, "writing helm release values")
+		}
+	}
+
+	fmt.Printf("📁 Backed up resources required for rollback to %s\n", filepath.Join(out.dir, rollbackDir))
+	return nil
+}
+
+// backupPublicOperatorForRollback snapshots the CrdbCluster of the public operator and every resource that is
+// required to return to its StatefulSet into the rollback directory under the output dir.
+func backupPublicOperatorForRollback(ctx context.Context, clientset kubernetes.Interface, cluster publicv1.CrdbCluster, sts *appsv1.StatefulSet, out *outputFiles) error {
+	// The names of the certificate secrets generated by the public operator, unless the user provides them.
+	secretNames := []string{cluster.Name + "-node", cluster.Name + "-root", cluster.Name + "-ca"}
+	if cluster.Spec.NodeTLSSecret != "" {
+		secretNames[0] = cluster.Spec.NodeTLSSecret
+	}
+	if cluster.Spec.ClientTLSSecret != "" {
+		secretNames[1] = cluster.Spec.ClientTLSSecret
+	}
+	// The public operator labels the resources of the cluster with its name as the instance.
+	if err := snapshotForRollback(ctx, clientset, sts, cluster.Name, secretNames, out); err != nil {
+		return err
+	}
+
+	snapshot := cluster.DeepCopy()
+	snapshot.TypeMeta = metav1.TypeMeta{APIVersion: "crdb.cockroachlabs.com/v1alpha1", Kind: "CrdbCluster"}
+	snapshot.Status = publicv1.CrdbClusterStatus{}
+	cleanObjectMeta(&snapshot.ObjectMeta)
+	if err := out.writeWithMode(filepath.Join(rollbackDir, rollbackCrdbClusterYaml), rollbackFileMode, []any{snapshot}); err != nil {
+		return errors.Wrap(err, "writing crdbcluster snapshot")
+	}
+
+	fmt.Printf("📁 Backed up resources required for rollback to %s\n", filepath.Join(out.dir, rollbackDir))
+	return nil
+}
+
+// snapshotForRollback writes the StatefulSet, the Services, PodDisruptionBudgets and RBAC resources labelled with
+// the given instance, and the given Secrets to the rollback directory.
+func snapshotForRollback(ctx context.Context, clientset kubernetes.Interface, sts *appsv1.StatefulSet, instance string, secretNames []string, out *outputFiles) error {
+	// The snapshot holds the private keys of the certificate secrets, so it is only readable by the user.
+	dir := filepath.Join(out.dir, rollbackDir)
+	if err := os.MkdirAll(dir, rollbackDirMode); err != nil {
+		return errors.Wrap(err, "creating rollback directory")
+	}
+	if err := os.Chmod(dir, rollbackDirMode); err != nil {
+		return errors.Wrap(err, "setting rollback directory permissions")
+	}
+
+	selector := metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", helmInstanceLabel, instance)}
+
+	snapshot := sts.DeepCopy()
+	snapshot.TypeMeta = metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"}
+	snapshot.Status = appsv1.StatefulSetStatus{}
+	cleanObjectMeta(&snapshot.ObjectMeta)
+	if err := out.writeWithMode(filepath.Join(rollbackDir, rollbackStsYaml), rollbackFileMode, []any{snapshot}); err != nil {
+		return errors.Wrap(err, "writing statefulset snapshot")
+	}
+
+	svcList, err := clientset.CoreV1().Services(sts.Namespace).List(ctx, selector)
+	if err != nil {
+		return errors.Wrap(err, "listing services")
+	}
+	var services []any
+	for i := range svcList.Items {
+		svc := svcList.Items[i]
+		svc.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Service"}
+		svc.Status = corev1.ServiceStatus{}
+		// ClusterIPs are allocated by the API server and can't be requested again once released.
+		svc.Spec.ClusterIP = ""
+		svc.Spec.ClusterIPs = nil
+		cleanObjectMeta(&svc.ObjectMeta)
+		services = append(services, &svc)
+	}
+
+	pdbList, err := clientset.PolicyV1().PodDisruptionBudgets(sts.Namespace).List(ctx, selector)
+	if err != nil {
+		return errors.Wrap(err, "listing pod disruption budgets")
+	}
+	var pdbs []any
+	for i := range pdbList.Items {
+		pdb := pdbList.Items[i]
+		pdb.TypeMeta = metav1.TypeMeta{APIVersion: "policy/v1", Kind: "PodDisruptionBudget"}
+		pdb.Status = policyv1.PodDisruptionBudgetStatus{}
+		cleanObjectMeta(&pdb.ObjectMeta)
+		pdbs = append(pdbs, &pdb)
+	}
+
+	rbac, err := rbacForRollback(ctx, clientset, sts.Namespace, selector)
+	if err != nil {
+		return err
+	}
+
+	var secrets []any
+	for _, name := range secretNames {
+		if name == "" {
+			continue
+		}
+
+		secret, err := clientset.CoreV1().Secrets(sts.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				fmt.Printf("Secret %s not found, skipping backup.\n", name)
+				continue
+			}
+			return fmt.Errorf("failed to get secret %s: %w", name, err)
+		}
+		secret.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"}
+		cleanObjectMeta(&secret.ObjectMeta)
+		secrets = append(secrets, secret)
+	}
+
+	for file, objs := range map[string][]any{
+		rollbackServicesYaml: services,
+		rollbackPDBYaml:      pdbs,
+		rollbackRBACYaml:     rbac,
+		rollbackSecretsYaml:  secrets,
+	} {
+		if len(objs) == 0 {
+			continue
+		}
+		if err := out.writeWithMode(filepath.Join(rollbackDir, file), rollbackFileMode, objs); err != nil {
+			return errors.Wrapf(err, "writing %s", file)
+		}
+	}
+
+	return nil
+}
+
+// rbacForRollback returns the ServiceAccounts, Roles, RoleBindings, ClusterRoles and ClusterRoleBindings
+// created by the helm release.
+func rbacForRollback(ctx context.Context, clientset kubernetes.Interface, namespace string, selector metav1.ListOptions) ([]any, error) {
+	var objs []any
+
+	saList, err := clientset.CoreV1().ServiceAccounts(namespace).List(ctx, selector)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing service accounts")
+	}
+	for i := range saList.Items {
+		sa := saList.Items[i]
+		sa.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"}
+		cleanObjectMeta(&sa.ObjectMeta)
+		objs = append(objs, &sa)
+	}
+
+	roleList, err := clientset.RbacV1().Roles(namespace).List(ctx, selector)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing roles")
+	}
+	for i := range roleList.Items {
+		role := roleList.Items[i]
+		role.TypeMeta = metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role"}
+		cleanObjectMeta(&role.ObjectMeta)
+		objs = append(objs, &role)
+	}
+
+	roleBindingList, err := clientset.RbacV1().RoleBindings(namespace).List(ctx, selector)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing role bindings")
+	}
+	for i := range roleBindingList.Items {
+		roleBinding := roleBindingList.Items[i]
+		roleBinding.TypeMeta = metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"}
+		cleanObjectMeta(&roleBinding.ObjectMeta)
+		objs = append(objs, &roleBinding)
+	}
+
+	clusterRoleList, err := clientset.RbacV1().ClusterRoles().List(ctx, selector)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing cluster roles")
+	}
+	for i := range clusterRoleList.Items {
+		clusterRole := clusterRoleList.Items[i]
+		clusterRole.TypeMeta = metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"}
+		cleanObjectMeta(&clusterRole.ObjectMeta)
+		objs = append(objs, &clusterRole)
+	}
+
+	clusterRoleBindingList, err := clientset.RbacV1().ClusterRoleBindings().List(ctx, selector)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing cluster role bindings")
+	}
+	for i := range clusterRoleBindingList.Items {
+		clusterRoleBinding := clusterRoleBindingList.Items[i]
+		clusterRoleBinding.TypeMeta = metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"}
+		cleanObjectMeta(&clusterRoleBinding.ObjectMeta)
+		objs = append(objs, &clusterRoleBinding)
+	}
+
+	return objs, nil
+}
+
+// cleanObjectMeta drops the server populated fields so that the object can be re-created from the snapshot.
+func cleanObjectMeta(meta *metav1.ObjectMeta) {
+	meta.ResourceVersion = ""
+	meta.UID = ""
+	meta.Generation = 0
+	meta.CreationTimestamp = metav1.Time{}
+	meta.ManagedFields = nil
+	meta.OwnerReferences = nil
+	delete(meta.Annotations, corev1.LastAppliedConfigAnnotation)
+}
+
+// latestHelmRelease returns the last deployed revision of the given helm release. Helm stores every revision
+// in a secret whose "release" key holds the base64 encoded, gzipped JSON release record.
+func latestHelmRelease(ctx context.Context, clientset kubernetes.Interface, namespace, releaseName string) (*helmRelease, error) {
+	secrets, err := clientset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("owner=helm,name=%s,status=deployed", releaseName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *helmRelease
+	for i := range secrets.Items {
+		if secrets.Items[i].Type != helmReleaseSecretType {
+			continue
+		}
+
+		release, err := decodeHelmRelease(secrets.Items[i].Data["release"])
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding helm release secret %s", secrets.Items[i].Name)
+		}
+		if latest == nil || release.Version > latest.Version {
+			latest = release
+		}
+	}
+
+	return latest, nil
+}
+
+// decodeHelmRelease decodes the release record stored by helm in the release secret.
+func decodeHelmRelease(data []byte) (*helmRelease, error) {
+	decoded, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// gzip magic header, helm compresses the release record before encoding it.
+	if len(decoded) > 2 && decoded[0] == 0x1f && decoded[1] == 0x8b {
+		reader, err := gzip.NewReader(bytes.NewReader(decoded))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		if decoded, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	release := &helmRelease{}
+	if err := json.Unmarshal(decoded, release); err != nil {
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// Rollback restores the StatefulSet based deployment from the snapshot written by build-manifest.
+type Rollback struct {
+	namespace        string
+	manifestDir      string
+	readinessWait    time.Duration
+	podUpdateTimeout time.Duration
+	clientset        kubernetes.Interface
+	dynamicClient    dynamic.Interface
+}
+
+// NewRollback constructs a Rollback for the manifests generated under manifestDir.
+func NewRollback(kubeconfig, namespace, manifestDir string, readinessWait, podUpdateTimeout time.Duration) (*Rollback, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "building k8s config")
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "building k8s clientset")
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "building k8s dynamic client")
+	}
+
+	return &Rollback{
+		namespace:        namespace,
+		manifestDir:      manifestDir,
+		readinessWait:    readinessWait,
+		podUpdateTimeout: podUpdateTimeout,
+		clientset:        clientset,
+		dynamicClient:    dynamicClient,
+	}, nil
+}
+
+// Run restores the backed up resources and hands the CrdbNodes back to the StatefulSet one at a time.
+// CrdbNodes are removed starting from the lowest ordinal, which is the reverse of the order in which
+// they were created during the migration, so that the StatefulSet can scale up into the freed ordinal.
+func (r *Rollback) Run(ctx context.Context) error {
+	dir := filepath.Join(r.manifestDir, rollbackDir)
+
+	objs, err := readManifests(filepath.Join(dir, rollbackStsYaml))
+	if err != nil {
+		return errors.Wrap(err, "reading statefulset snapshot")
+	}
+	if len(objs) != 1 {
+		return errors.Newf("expected a single statefulset in %s", rollbackStsYaml)
+	}
+	snapshot, ok := objs[0].(*appsv1.StatefulSet)
+	if !ok {
+		return errors.Newf("%s doesn't contain a statefulset", rollbackStsYaml)
+	}
+
+	for _, file := range []string{rollbackRBACYaml, rollbackSecretsYaml, rollbackServicesYaml, rollbackPDBYaml} {
+		objs, err := readManifests(filepath.Join(dir, file))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return errors.Wrapf(err, "reading %s", file)
+		}
+		for i := range objs {
+			if err := r.restore(ctx, objs[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	nodes, err := r.dynamicClient.Resource(crdbNodeGVR).Namespace(r.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", crdbClusterLabel, snapshot.Name),
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "listing crdbnodes")
+	}
+	var names []string
+	if nodes != nil {
+		for i := range nodes.Items {
+			names = append(names, nodes.Items[i].GetName())
+		}
+	}
+	ordinals, err := crdbNodeOrdinals(snapshot.Name, names)
+	if err != nil {
+		return err
+	}
+
+	sts, err := r.clientset.AppsV1().StatefulSets(r.namespace).Get(ctx, snapshot.Name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "fetching statefulset")
+		}
+
+		replicas := *snapshot.Spec.Replicas
+		if len(ordinals) > 0 {
+			replicas = ordinals[0]
+		}
+		sts = snapshot.DeepCopy()
+		sts.Namespace = r.namespace
+		sts.Spec.Replicas = &replicas
+		if sts, err = r.clientset.AppsV1().StatefulSets(r.namespace).Create(ctx, sts, metav1.CreateOptions{}); err != nil {
+			return errors.Wrap(err, "re-creating statefulset")
+		}
+		fmt.Printf("Re-created statefulset %s with %d replicas\n", sts.Name, replicas)
+	}
+
+	for _, ordinal := range ordinals {
+		if *sts.Spec.Replicas < ordinal {
+			return errors.Newf("statefulset %s has %d replicas, expected %d before restoring %s-%d",
+				sts.Name, *sts.Spec.Replicas, ordinal, sts.Name, ordinal)
+		}
+
+		nodeName := fmt.Sprintf("%s-%d", sts.Name, ordinal)
+		fmt.Printf("Deleting crdbnode %s\n", nodeName)
+		if err := r.dynamicClient.Resource(crdbNodeGVR).Namespace(r.namespace).Delete(ctx, nodeName, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "deleting crdbnode %s", nodeName)
+		}
+
+		// The operator removes the pod before dropping the crdbnode finalizer.
+		if err := r.waitForPodDeleted(ctx, nodeName); err != nil {
+			return errors.Wrapf(err, "waiting for pod %s to be deleted, make sure the operator is running", nodeName)
+		}
+
+		if *sts.Spec.Replicas == ordinal {
+			if sts, err = r.scale(ctx, sts.Name, ordinal+1); err != nil {
+				return err
+			}
+		}
+
+		if err := r.waitForPodReady(ctx, nodeName); err != nil {
+			return err
+		}
+
+		fmt.Printf("Waiting for %s for pod %s to become stable\n", r.readinessWait.String(), nodeName)
+		if err := kube.Sleep(ctx, r.readinessWait); err != nil {
+			return err
+		}
+	}
+
+	if *sts.Spec.Replicas != *snapshot.Spec.Replicas {
+		if _, err := r.scale(ctx, sts.Name, *snapshot.Spec.Replicas); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("✅ Rollback to the statefulset completed.")
+	if _, err := os.Stat(filepath.Join(dir, rollbackHelmValuesYaml)); err == nil {
+		fmt.Println("📌 If the helm release was already upgraded, restore it with the backed up values:")
+		fmt.Printf("   helm upgrade %s cockroachdb/cockroachdb -f %s\n",
+			snapshot.Annotations[helmReleaseNameKey], filepath.Join(dir, rollbackHelmValuesYaml))
+	}
+	if _, err := os.Stat(filepath.Join(dir, rollbackCrdbClusterYaml)); err == nil {
+		fmt.Println("📌 To manage the statefulset with the public operator again, re-install it and apply the backed up crdbcluster:")
+		fmt.Printf("   kubectl apply -f %s\n", filepath.Join(dir, rollbackCrdbClusterYaml))
+	}
+
+	return nil
+}
+
+// restore creates the backed up object if it is missing. Services are updated in place since the migration
+// rewrites the ports of the public service.
+func (r *Rollback) restore(ctx context.Context, obj runtime.Object) error {
+	var err error
+	switch o := obj.(type) {
+	case *corev1.Service:
+		existing, getErr := r.clientset.CoreV1().Services(r.namespace).Get(ctx, o.Name, metav1.GetOptions{})
+		if getErr == nil {
+			existing.Spec.Ports = o.Spec.Ports
+			_, err = r.clientset.CoreV1().Services(r.namespace).Update(ctx, existing, metav1.UpdateOptions{})
+			break
+		}
+		_, err = r.clientset.CoreV1().Services(r.namespace).Create(ctx, o, metav1.CreateOptions{})
+	case *policyv1.PodDisruptionBudget:
+		_, err = r.clientset.PolicyV1().PodDisruptionBudgets(r.namespace).Create(ctx, o, metav1.CreateOptions{})
+	case *corev1.Secret:
+		_, err = r.clientset.CoreV1().Secrets(r.namespace).Create(ctx, o, metav1.CreateOptions{})
+	case *corev1.ServiceAccount:
+		_, err = r.clientset.CoreV1().ServiceAccounts(r.namespace).Create(ctx, o, metav1.CreateOptions{})
+	case *rbacv1.Role:
+		_, err = r.clientset.RbacV1().Roles(r.namespace).Create(ctx, o, metav1.CreateOptions{})
+	case *rbacv1.RoleBinding:
+		_, err = r.clientset.RbacV1().RoleBindings(r.namespace).Create(ctx, o, metav1.CreateOptions{})
+	case *rbacv1.ClusterRole:
+		_, err = r.clientset.RbacV1().ClusterRoles().Create(ctx, o, metav1.CreateOptions{})
+	case *rbacv1.ClusterRoleBinding:
+		_, err = r.clientset.RbacV1().ClusterRoleBindings().Create(ctx, o, metav1.CreateOptions{})
+	default:
+		return errors.Newf("unsupported object %T in rollback snapshot", obj)
+	}
+
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "restoring %T", obj)
+	}
+
+	return nil
+}
+
+func (r *Rollback) scale(ctx context.Context, name string, replicas int32) (*appsv1.StatefulSet, error) {
+	sts, err := r.clientset.AppsV1().StatefulSets(r.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching statefulset")
+	}
+
+	sts.Spec.Replicas = &replicas
+	sts, err = r.clientset.AppsV1().StatefulSets(r.namespace).Update(ctx, sts, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "scaling statefulset %s to %d replicas", name, replicas)
+	}
+	fmt.Printf("Scaled statefulset %s to %d replicas\n", name, replicas)
+
+	return sts, nil
+}
+
+func (r *Rollback) waitForPodDeleted(ctx context.Context, name string) error {
+	f := func() error {
+		_, err := r.clientset.CoreV1().Pods(r.namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("pod %s still exists", name)
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = r.podUpdateTimeout
+	b.MaxInterval = 5 * time.Second
+	return backoff.Retry(f, b)
+}
+
+func (r *Rollback) waitForPodReady(ctx context.Context, name string) error {
+	f := func() error {
+		pod, err := r.clientset.CoreV1().Pods(r.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !kube.IsPodReady(pod) {
+			return fmt.Errorf("pod %s not in ready state", name)
+		}
+
+		fmt.Printf("Pod %s in ready state now\n", name)
+		return nil
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = r.podUpdateTimeout
+	b.MaxInterval = 5 * time.Second
+	return backoff.Retry(f, b)
+}
+
+// crdbNodeOrdinals returns the sorted ordinals of the CrdbNodes created for the given StatefulSet.
+func crdbNodeOrdinals(stsName string, names []string) ([]int32, error) {
+	var ordinals []int32
+	for _, name := range names {
+		suffix := strings.TrimPrefix(name, stsName+"-")
+		if suffix == name {
+			continue
+		}
+
+		ordinal, err := strconv.ParseInt(suffix, 10, 32)
+		if err != nil {
+			return nil, errors.Newf("crdbnode %s doesn't match the statefulset pod naming", name)
+		}
+		ordinals = append(ordinals, int32(ordinal))
+	}
+
+	sort.Slice(ordinals, func(i, j int) bool { return ordinals[i] < ordinals[j] })
+	return ordinals, nil
+}
+
+// readManifests decodes every YAML document in the given file into a typed object.
+func readManifests(path string) ([]runtime.Object, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading manifest")
+	}
+
+	var objs []runtime.Object
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(doc, nil, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding manifest")
+		}
+		objs = append(objs, obj)
+	}
+
+	return objs, nil
+}
@@ -0,0 +1,230 @@
+package migrate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	publicv1 "github.com/cockroachdb/cockroach-operator/apis/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
+)
+
+func encodeHelmRelease(t *testing.T, release helmRelease) []byte {
+	data, err := json.Marshal(release)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	return []byte(base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
+
+func TestDecodeHelmRelease(t *testing.T) {
+	release := helmRelease{
+		Name:    "cockroachdb",
+		Version: 2,
+		Config:  map[string]interface{}{"statefulset": map[string]interface{}{"replicas": float64(3)}},
+	}
+
+	decoded, err := decodeHelmRelease(encodeHelmRelease(t, release))
+	require.NoError(t, err)
+	assert.Equal(t, release, *decoded)
+
+	// Releases written without compression are plain base64 encoded JSON.
+	plain, err := json.Marshal(release)
+	require.NoError(t, err)
+	decoded, err = decodeHelmRelease([]byte(base64.StdEncoding.EncodeToString(plain)))
+	require.NoError(t, err)
+	assert.Equal(t, release, *decoded)
+}
+
+func TestBackupForRollback(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	ctx := context.TODO()
+	namespace := "default"
+	outputDir := t.TempDir()
+	labels := map[string]string{helmInstanceLabel: "cockroachdb"}
+
+	sts := appsv1.StatefulSet{}
+	manifestBytes, err := os.ReadFile("testdata/helm/allInput/cockroachdb-statefulset.yaml")
+	require.NoError(t, err)
+	require.NoError(t, yaml.Unmarshal(manifestBytes, &sts))
+
+	_, err = clientset.CoreV1().Services(namespace).Create(ctx, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb-public", Namespace: namespace, Labels: labels},
+		Spec:       corev1.ServiceSpec{ClusterIP: "10.0.0.1", Ports: []corev1.ServicePort{{Name: "grpc", Port: 26257}}},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	// Services of other releases must not be part of the snapshot.
+	_, err = clientset.CoreV1().Services(namespace).Create(ctx, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: namespace},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = clientset.PolicyV1().PodDisruptionBudgets(namespace).Create(ctx, &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb-budget", Namespace: namespace, Labels: labels},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = clientset.CoreV1().ServiceAccounts(namespace).Create(ctx, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb", Namespace: namespace, Labels: labels},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = clientset.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb-node-secret", Namespace: namespace, ResourceVersion: "10"},
+		Data:       map[string][]byte{"tls.crt": []byte("cert")},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	// Helm release secret holding the values the release was installed with.
+	_, err = clientset.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sh.helm.release.v1.cockroachdb.v1",
+			Namespace: namespace,
+			Labels:    map[string]string{"owner": "helm", "name": "cockroachdb", "status": "deployed"},
+		},
+		Type: helmReleaseSecretType,
+		Data: map[string][]byte{"release": encodeHelmRelease(t, helmRelease{
+			Name:    "cockroachdb",
+			Version: 1,
+			Config:  map[string]interface{}{"tls": map[string]interface{}{"enabled": true}},
+		})},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	input := parsedMigrationInput{nodeSecretName: "cockroachdb-node-secret", clientSecretName: "cockroachdb-client-secret"}
+	require.NoError(t, backupForRollback(ctx, clientset, &sts, input, &outputFiles{dir: outputDir}))
+
+	dir := filepath.Join(outputDir, rollbackDir)
+
+	stsObjs, err := readManifests(filepath.Join(dir, rollbackStsYaml))
+	require.NoError(t, err)
+	require.Len(t, stsObjs, 1)
+	snapshot := stsObjs[0].(*appsv1.StatefulSet)
+	assert.Equal(t, "cockroachdb", snapshot.Name)
+	assert.Equal(t, int32(3), *snapshot.Spec.Replicas)
+	assert.Empty(t, snapshot.ResourceVersion)
+	assert.Empty(t, snapshot.UID)
+	assert.Zero(t, snapshot.Status.Replicas)
+
+	svcObjs, err := readManifests(filepath.Join(dir, rollbackServicesYaml))
+	require.NoError(t, err)
+	require.Len(t, svcObjs, 1)
+	svc := svcObjs[0].(*corev1.Service)
+	assert.Equal(t, "cockroachdb-public", svc.Name)
+	assert.Empty(t, svc.Spec.ClusterIP)
+	assert.Equal(t, int32(26257), svc.Spec.Ports[0].Port)
+
+	pdbObjs, err := readManifests(filepath.Join(dir, rollbackPDBYaml))
+	require.NoError(t, err)
+	require.Len(t, pdbObjs, 1)
+
+	rbacObjs, err := readManifests(filepath.Join(dir, rollbackRBACYaml))
+	require.NoError(t, err)
+	require.Len(t, rbacObjs, 1)
+	assert.IsType(t, &corev1.ServiceAccount{}, rbacObjs[0])
+
+	secretObjs, err := readManifests(filepath.Join(dir, rollbackSecretsYaml))
+	require.NoError(t, err)
+	require.Len(t, secretObjs, 1)
+	secret := secretObjs[0].(*corev1.Secret)
+	assert.Equal(t, "cockroachdb-node-secret", secret.Name)
+	assert.Equal(t, []byte("cert"), secret.Data["tls.crt"])
+	assert.Empty(t, secret.ResourceVersion)
+
+	valuesBytes, err := os.ReadFile(filepath.Join(dir, rollbackHelmValuesYaml))
+	require.NoError(t, err)
+	assert.Equal(t, "tls:\n  enabled: true\n", string(valuesBytes))
+
+	// The snapshot holds private keys, so only the user can read it.
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(dir, rollbackSecretsYaml))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Without the release annotation, the snapshot would pick up the resources of every release.
+	delete(sts.Annotations, helmReleaseNameKey)
+	err = backupForRollback(ctx, clientset, &sts, input, &outputFiles{dir: t.TempDir()})
+	assert.ErrorContains(t, err, "has no meta.helm.sh/release-name annotation")
+}
+
+func TestBackupPublicOperatorForRollback(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	ctx := context.TODO()
+	namespace := "default"
+	outputDir := t.TempDir()
+
+	sts := appsv1.StatefulSet{}
+	manifestBytes, err := os.ReadFile("testdata/operator/allInput/cockroachdb-statefulset.yaml")
+	require.NoError(t, err)
+	require.NoError(t, yaml.Unmarshal(manifestBytes, &sts))
+
+	cluster := publicv1.CrdbCluster{}
+	manifestBytes, err = os.ReadFile("testdata/operator/allInput/crdbcluster.yaml")
+	require.NoError(t, err)
+	require.NoError(t, yaml.Unmarshal(manifestBytes, &cluster))
+	cluster.ResourceVersion = "10"
+	cluster.Status.ClusterStatus = "Finished"
+
+	// The public operator labels the resources of the cluster with the cluster name as the instance.
+	_, err = clientset.CoreV1().Services(namespace).Create(ctx, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb-public", Namespace: namespace, Labels: map[string]string{helmInstanceLabel: cluster.Name}},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = clientset.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: cluster.Name + "-node", Namespace: namespace},
+		Data:       map[string][]byte{"tls.crt": []byte("cert")},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, backupPublicOperatorForRollback(ctx, clientset, cluster, &sts, &outputFiles{dir: outputDir}))
+
+	dir := filepath.Join(outputDir, rollbackDir)
+
+	stsObjs, err := readManifests(filepath.Join(dir, rollbackStsYaml))
+	require.NoError(t, err)
+	require.Len(t, stsObjs, 1)
+	assert.Equal(t, sts.Name, stsObjs[0].(*appsv1.StatefulSet).Name)
+
+	svcObjs, err := readManifests(filepath.Join(dir, rollbackServicesYaml))
+	require.NoError(t, err)
+	require.Len(t, svcObjs, 1)
+
+	secretObjs, err := readManifests(filepath.Join(dir, rollbackSecretsYaml))
+	require.NoError(t, err)
+	require.Len(t, secretObjs, 1)
+	assert.Equal(t, cluster.Name+"-node", secretObjs[0].(*corev1.Secret).Name)
+
+	clusterBytes, err := os.ReadFile(filepath.Join(dir, rollbackCrdbClusterYaml))
+	require.NoError(t, err)
+	snapshot := publicv1.CrdbCluster{}
+	require.NoError(t, yaml.Unmarshal(clusterBytes, &snapshot))
+	assert.Equal(t, "CrdbCluster", snapshot.Kind)
+	assert.Equal(t, cluster.Name, snapshot.Name)
+	assert.Equal(t, cluster.Spec.Nodes, snapshot.Spec.Nodes)
+	assert.Empty(t, snapshot.ResourceVersion)
+	assert.Empty(t, snapshot.Status.ClusterStatus)
+}
+
+func TestCrdbNodeOrdinals(t *testing.T) {
+	ordinals, err := crdbNodeOrdinals("cockroachdb", []string{"cockroachdb-2", "cockroachdb-10", "cockroachdb-1", "other-0"})
+	require.NoError(t, err)
+	assert.Equal(t, []int32{1, 2, 10}, ordinals)
+
+	_, err = crdbNodeOrdinals("cockroachdb", []string{"cockroachdb-abc"})
+	require.Error(t, err)
+}
@@ -0,0 +1,444 @@
+package migrate
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// startFlagKind describes how a `cockroach start` flag is carried over to the CockroachDB Enterprise Operator.
+type startFlagKind int
+
+const (
+	// upsertFlag flags are copied as is into the CrdbNode start flags.
+	upsertFlag startFlagKind = iota
+	// operatorManagedFlag flags are configured by the CockroachDB Enterprise Operator and are dropped.
+	operatorManagedFlag
+	portFlag
+	httpPortFlag
+	sqlAddrFlag
+	httpAddrFlag
+	insecureFlag
+	localityFlag
+	walFailoverFlag
+	encryptionFlag
+	// initFlag flags initialize the cluster like `cockroach init` does. Only `cockroach start-single-node`, which
+	// initializes the cluster itself, accepts them. They are dropped, since the CrdbNodes join an initialized
+	// cluster, whose PCR mode is detected from its virtual clusters.
+	initFlag
+)
+
+type startFlag struct {
+	kind startFlagKind
+	// boolean flags never take the next argument as their value, only the --flag=value form.
+	boolean bool
+	// repeatable flags can be passed more than once, e.g. one --store per store. For any other flag
+	// the last occurrence wins, like it does for cockroach itself.
+	repeatable bool
+}
+
+// cockroachStartFlags lists the flags accepted by `cockroach start` and `cockroach start-single-node`.
+var cockroachStartFlags = map[string]startFlag{
+	"accept-sql-without-tls":            {kind: upsertFlag, boolean: true},
+	"advertise-addr":                    {kind: upsertFlag},
+	"advertise-host":                    {kind: upsertFlag},
+	"advertise-port":                    {kind: upsertFlag},
+	"attrs":                             {kind: upsertFlag},
+	"background":                        {kind: operatorManagedFlag, boolean: true},
+	"cache":                             {kind: upsertFlag},
+	"cert-principal-map":                {kind: upsertFlag},
+	"certs-dir":                         {kind: upsertFlag},
+	"clock-device":                      {kind: upsertFlag},
+	"cluster-name":                      {kind: upsertFlag},
+	"disable-cluster-name-verification": {kind: upsertFlag, boolean: true},
+	"enterprise-encryption":             {kind: encryptionFlag, repeatable: true},
+	"external-io-dir":                   {kind: upsertFlag},
+	"http-addr":                         {kind: httpAddrFlag},
+	"http-port":                         {kind: httpPortFlag},
+	"insecure":                          {kind: insecureFlag, boolean: true},
+	"join":                              {kind: upsertFlag},
+	"listen-addr":                       {kind: upsertFlag},
+	"listening-url-file":                {kind: upsertFlag},
+	"locality":                          {kind: localityFlag},
+	"locality-advertise-addr":           {kind: upsertFlag},
+	"log":                               {kind: operatorManagedFlag},
+	"log-config-file":                   {kind: operatorManagedFlag},
+	"log-dir":                           {kind: operatorManagedFlag},
+	"log-file-max-size":                 {kind: operatorManagedFlag},
+	"log-file-verbosity":                {kind: operatorManagedFlag},
+	"log-group-max-size":                {kind: operatorManagedFlag},
+	"logtostderr":                       {kind: operatorManagedFlag, boolean: true},
+	"max-disk-temp-storage":             {kind: upsertFlag},
+	"max-go-memory":                     {kind: upsertFlag},
+	"max-offset":                        {kind: upsertFlag},
+	"max-sql-memory":                    {kind: upsertFlag},
+	"max-tsdb-memory":                   {kind: upsertFlag},
+	"pid-file":                          {kind: upsertFlag},
+	"port":                              {kind: portFlag},
+	"secondary-cache":                   {kind: upsertFlag},
+	"socket-dir":                        {kind: upsertFlag},
+	"spatial-libs":                      {kind: upsertFlag},
+	"sql-addr":                          {kind: sqlAddrFlag},
+	"sql-advertise-addr":                {kind: upsertFlag},
+	"sql-audit-dir":                     {kind: upsertFlag},
+	"store":                             {kind: upsertFlag, repeatable: true},
+	"temp-dir":                          {kind: upsertFlag},
+	"unencrypted-localhost-http":        {kind: upsertFlag, boolean: true},
+	"virtualized":                       {kind: initFlag, boolean: true},
+	"virtualized-empty":                 {kind: initFlag, boolean: true},
+	"wal-failover":                      {kind: walFailoverFlag},
+}
+
+// envRefRegex matches the $(VAR) references expanded by Kubernetes and the ${VAR} and $VAR
+// references expanded by the shell.
+var envRefRegex = regexp.MustCompile(`\$\(([A-Za-z_][A-Za-z0-9_]*)\)|\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// containerEnv returns the env variables of the container which have a literal value.
+func containerEnv(c corev1.Container) map[string]string {
+	env := make(map[string]string)
+	for _, e := range c.Env {
+		if e.ValueFrom == nil {
+			env[e.Name] = e.Value
+		}
+	}
+	return env
+}
+
+// expandEnv replaces the env references in value which are defined in env. References to unknown variables,
+// e.g. the ones populated from a field reference, are left untouched.
+func expandEnv(value string, env map[string]string) string {
+	return envRefRegex.ReplaceAllStringFunc(value, func(ref string) string {
+		m := envRefRegex.FindStringSubmatch(ref)
+		if v, ok := env[m[1]+m[2]+m[3]]; ok {
+			return v
+		}
+		return ref
+	})
+}
+
+// cockroachStartArgs returns the arguments passed to `cockroach start` by the container, either directly
+// or through a shell script like the one rendered by the CockroachDB Helm chart.
+func cockroachStartArgs(c corev1.Container) ([]string, error) {
+	argv := append(append([]string{}, c.Command...), c.Args...)
+
+	commands := [][]string{argv}
+	if script, ok := shellScript(argv); ok {
+		var err error
+		if commands, err = shellCommands(script); err != nil {
+			return nil, errors.Wrapf(err, "parsing command of container %s", c.Name)
+		}
+	}
+
+	for _, cmd := range commands {
+		for i := 0; i+1 < len(cmd); i++ {
+			bin := path.Base(cmd[i])
+			if (bin == "cockroach" || bin == "cockroach.sh") && (cmd[i+1] == "start" || cmd[i+1] == "start-single-node") {
+				return cmd[i+2:], nil
+			}
+		}
+	}
+
+	return nil, errors.Newf("couldn't find cockroach start command in container %s", c.Name)
+}
+
+// shellScript returns the script passed to a shell with the -c option, e.g. `bash -ecx <script>`.
+func shellScript(argv []string) (string, bool) {
+	if len(argv) == 0 || strings.HasPrefix(path.Base(argv[0]), "cockroach") {
+		return "", false
+	}
+
+	for i := 1; i+1 < len(argv); i++ {
+		if strings.HasPrefix(argv[i], "-") && !strings.HasPrefix(argv[i], "--") && strings.Contains(argv[i], "c") {
+			return argv[i+1], true
+		}
+	}
+	return "", false
+}
+
+// shellCommands splits a shell script into simple commands separated by ;, &, &&, |, || or newlines,
+// and each command into words following the POSIX quoting rules. Command substitutions and parameter
+// expansions are kept verbatim in the words they belong to.
+func shellCommands(script string) ([][]string, error) {
+	var (
+		commands [][]string
+		words    []string
+		word     strings.Builder
+		inWord   bool
+	)
+
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func() {
+		endWord()
+		if len(words) > 0 {
+			commands = append(commands, words)
+			words = nil
+		}
+	}
+	// copyUntil copies the script verbatim up to and including the closing character which balances
+	// the opening one found at index i.
+	copyUntil := func(i int, open, close byte) (int, error) {
+		depth := 0
+		for j := i; j < len(script); j++ {
+			switch script[j] {
+			case open:
+				depth++
+			case close:
+				depth--
+			}
+			if depth == 0 {
+				word.WriteString(script[i : j+1])
+				return j, nil
+			}
+		}
+		return 0, errors.Newf("unterminated %c in %q", open, script)
+	}
+
+	for i := 0; i < len(script); i++ {
+		ch := script[i]
+		switch {
+		case ch == '\\':
+			if i+1 < len(script) {
+				i++
+				// A backslash followed by a newline continues the line.
+				if script[i] != '\n' {
+					word.WriteByte(script[i])
+					inWord = true
+				}
+			}
+
+		case ch == '\'':
+			end := strings.IndexByte(script[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.Newf("unterminated single quote in %q", script)
+			}
+			word.WriteString(script[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+
+		case ch == '"':
+			inWord = true
+			closed := false
+			for i++; i < len(script); i++ {
+				if script[i] == '"' {
+					closed = true
+					break
+				}
+				if script[i] == '\\' && i+1 < len(script) && strings.IndexByte("$`\"\\\n", script[i+1]) >= 0 {
+					i++
+					if script[i] != '\n' {
+						word.WriteByte(script[i])
+					}
+					continue
+				}
+				word.WriteByte(script[i])
+			}
+			if !closed {
+				return nil, errors.Newf("unterminated double quote in %q", script)
+			}
+
+		case ch == '$' && i+1 < len(script) && (script[i+1] == '(' || script[i+1] == '{'):
+			open, close := script[i+1], byte(')')
+			if open == '{' {
+				close = '}'
+			}
+			word.WriteByte('$')
+			end, err := copyUntil(i+1, open, close)
+			if err != nil {
+				return nil, err
+			}
+			inWord = true
+			i = end
+
+		case ch == '`':
+			end := strings.IndexByte(script[i+1:], '`')
+			if end < 0 {
+				return nil, errors.Newf("unterminated backquote in %q", script)
+			}
+			word.WriteString(script[i : i+end+2])
+			inWord = true
+			i += end + 1
+
+		case ch == '#' && !inWord:
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+			endCommand()
+
+		case ch == ';' || ch == '&' || ch == '|' || ch == '\n':
+			endCommand()
+
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			endWord()
+
+		default:
+			word.WriteByte(ch)
+			inWord = true
+		}
+	}
+	endCommand()
+
+	return commands, nil
+}
+
+// extractJoinStringAndFlags parses the arguments of `cockroach start`. Ports, locality and TLS settings are
+// stored in the parsed input, WAL failover and encryption at rest flags are stored to be mapped by mapStoreFlags,
+// flags which the CockroachDB Enterprise Operator configures itself are dropped and all the other flags are kept
+// as start flags. Env references are kept as is in the start flags, since the
+// CrdbNode pods get the same env, and are expanded using env for the settings stored in the parsed input.
+// Flags that are not known to be accepted by `cockroach start` are kept as start flags and also recorded as
+// unrecognized, so that they can be reviewed.
+func extractJoinStringAndFlags(
+	parsedInput *parsedMigrationInput,
+	args []string,
+	env map[string]string) error {
+
+	flags := &v1alpha1.Flags{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			parsedInput.unrecognizedFlags = append(parsedInput.unrecognizedFlags, arg)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		flag, ok := cockroachStartFlags[name]
+		if !ok {
+			// Without knowing the flag, a following argument which isn't a flag is assumed to be its value.
+			if !hasValue && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value, hasValue = args[i], true
+			}
+			parsedInput.unrecognizedFlags = append(parsedInput.unrecognizedFlags, formatFlag(name, value, hasValue))
+			parsedInput.routeFlag(formatFlag(name, value, hasValue), "startFlags (unrecognized)")
+			upsertStartFlag(flags, name, formatFlag(name, value, hasValue), false)
+			continue
+		}
+
+		if !flag.boolean && !hasValue {
+			if i+1 == len(args) {
+				return errors.Newf("flag --%s needs a value", name)
+			}
+			i++
+			value, hasValue = args[i], true
+		}
+		resolved := expandEnv(value, env)
+
+		switch flag.kind {
+		case upsertFlag:
+			parsedInput.routeFlag(formatFlag(name, value, hasValue), "startFlags")
+			upsertStartFlag(flags, name, formatFlag(name, value, hasValue), flag.repeatable)
+
+		case operatorManagedFlag:
+			// CockroachDB Enterprise Operator automatically adds "--logs" flag if it is not present.
+			parsedInput.routeFlag(formatFlag(name, value, hasValue), "dropped, configured by the operator")
+			continue
+
+		case portFlag, httpPortFlag:
+			num, err := parseInt32(resolved)
+			if err != nil {
+				return fmt.Errorf("invalid --%s value: %w", name, err)
+			}
+			if flag.kind == portFlag {
+				parsedInput.sqlPort = num
+				parsedInput.routeFlag(formatFlag(name, value, hasValue), "service.ports.sql")
+			} else {
+				parsedInput.httpPort = num
+				parsedInput.routeFlag(formatFlag(name, value, hasValue), "service.ports.http")
+			}
+
+		case sqlAddrFlag, httpAddrFlag:
+			_, port, err := net.SplitHostPort(resolved)
+			if err != nil {
+				return fmt.Errorf("invalid --%s value: %w", name, err)
+			}
+			if port != "" {
+				num, err := parseInt32(port)
+				if err != nil {
+					return fmt.Errorf("invalid --%s value: %w", name, err)
+				}
+				if flag.kind == sqlAddrFlag {
+					parsedInput.sqlPort = num
+				} else {
+					parsedInput.httpPort = num
+				}
+			}
+			if flag.kind == sqlAddrFlag {
+				parsedInput.routeFlag(formatFlag(name, value, hasValue), "startFlags, service.ports.sql")
+			} else {
+				parsedInput.routeFlag(formatFlag(name, value, hasValue), "startFlags, service.ports.http")
+			}
+			upsertStartFlag(flags, name, formatFlag(name, value, hasValue), false)
+
+		case insecureFlag:
+			insecure := true
+			if hasValue {
+				var err error
+				if insecure, err = strconv.ParseBool(resolved); err != nil {
+					return fmt.Errorf("invalid --%s value: %w", name, err)
+				}
+			}
+			parsedInput.tlsEnabled = !insecure
+			parsedInput.routeFlag(formatFlag(name, value, hasValue), "tls.enabled")
+
+		case initFlag:
+			parsedInput.routeFlag(formatFlag(name, value, hasValue), "dropped, not a start flag")
+			parsedInput.droppedFlags = append(parsedInput.droppedFlags, fmt.Sprintf(
+				"%s: only initializes the cluster, the PCR mode is detected from its virtual clusters", formatFlag(name, value, hasValue)))
+
+		case walFailoverFlag:
+			parsedInput.walFailover = &startFlagValue{flag: formatFlag(name, value, hasValue), value: resolved}
+
+		case encryptionFlag:
+			parsedInput.encryptionFlags = append(parsedInput.encryptionFlags, startFlagValue{flag: formatFlag(name, value, hasValue), value: resolved})
+
+		case localityFlag:
+			parsedInput.routeFlag(formatFlag(name, value, hasValue), "localityLabels")
+			parsedInput.localityLabels = nil
+			for _, tier := range strings.Split(resolved, ",") {
+				parsedInput.localityLabels = append(parsedInput.localityLabels, strings.Split(tier, "=")[0])
+			}
+		}
+	}
+	parsedInput.startFlags = flags
+
+	// The helm chart configures crdb to listen for grpc and sql on one port and for http on another.
+	// The cloud operator uses three distinct ports for grpc, sql, and http.
+	// Default port for grpc is 26258
+	parsedInput.grpcPort = grpcPort
+
+	return nil
+}
+
+func formatFlag(name, value string, hasValue bool) string {
+	if !hasValue {
+		return "--" + name
+	}
+	return fmt.Sprintf("--%s=%s", name, value)
+}
+
+// upsertStartFlag adds the flag to the start flags, replacing an earlier occurrence of a flag that isn't repeatable.
+func upsertStartFlag(flags *v1alpha1.Flags, name, flag string, repeatable bool) {
+	if !repeatable {
+		for i, f := range flags.Upsert {
+			if f == "--"+name || strings.HasPrefix(f, "--"+name+"=") {
+				flags.Upsert = append(flags.Upsert[:i], flags.Upsert[i+1:]...)
+				break
+			}
+		}
+	}
+	flags.Upsert = append(flags.Upsert, flag)
+}
@@ -0,0 +1,234 @@
+package migrate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestExtractStartFlagsFromContainer(t *testing.T) {
+	helmEnv := []corev1.EnvVar{
+		{Name: "STATEFULSET_NAME", Value: "cockroachdb"},
+		{Name: "STATEFULSET_FQDN", Value: "cockroachdb.default.svc.cluster.local"},
+	}
+	helmJoin := "--join=${STATEFULSET_NAME}-0.${STATEFULSET_FQDN}:26257,${STATEFULSET_NAME}-1.${STATEFULSET_FQDN}:26257,${STATEFULSET_NAME}-2.${STATEFULSET_FQDN}:26257"
+
+	tests := []struct {
+		name              string
+		container         corev1.Container
+		wantUpsert        []string
+		wantSQLPort       int32
+		wantHTTPPort      int32
+		wantTLSEnabled    bool
+		wantLocality      []string
+		wantUnrecognized  []string
+		wantDropped       []string
+		wantWALFailover   *startFlagValue
+		wantErrorContains string
+	}{
+		{
+			name: "helm chart with default values",
+			container: corev1.Container{
+				Name: "db",
+				Args: []string{"shell", "-ecx", "exec /cockroach/cockroach start " + helmJoin +
+					" --advertise-host=$(hostname).${STATEFULSET_FQDN} --certs-dir=/cockroach/cockroach-certs/" +
+					" --http-port=8080 --port=26257 --cache=25% --max-sql-memory=25% --logtostderr=INFO"},
+				Env: helmEnv,
+			},
+			wantUpsert: []string{
+				helmJoin,
+				"--advertise-host=$(hostname).${STATEFULSET_FQDN}",
+				"--certs-dir=/cockroach/cockroach-certs/",
+				"--cache=25%",
+				"--max-sql-memory=25%",
+			},
+			wantSQLPort:    26257,
+			wantHTTPPort:   8080,
+			wantTLSEnabled: true,
+		},
+		{
+			name: "helm chart with insecure multi-store cluster",
+			container: corev1.Container{
+				Name: "db",
+				Args: []string{"shell", "-ecx", "exec /cockroach/cockroach" +
+					" start --join=${STATEFULSET_NAME}-0.${STATEFULSET_FQDN}:26257" +
+					" --cluster-name=prod --disable-cluster-name-verification" +
+					" --advertise-host=$(hostname).${STATEFULSET_FQDN} --insecure --attrs=ssd:fast" +
+					" --http-port=8080 --port=26257 --cache=25% --max-sql-memory=25%" +
+					" --locality=region=us-east1,zone=us-east1-b" +
+					" --store=path=cockroach-data,size=100Gi --store=path=cockroach-data-2,size=100Gi" +
+					" --wal-failover=among-stores --log-config-file=/cockroach/log-config/log-config.yaml"},
+				Env: helmEnv,
+			},
+			wantUpsert: []string{
+				"--join=${STATEFULSET_NAME}-0.${STATEFULSET_FQDN}:26257",
+				"--cluster-name=prod",
+				"--disable-cluster-name-verification",
+				"--advertise-host=$(hostname).${STATEFULSET_FQDN}",
+				"--attrs=ssd:fast",
+				"--cache=25%",
+				"--max-sql-memory=25%",
+				"--store=path=cockroach-data,size=100Gi",
+				"--store=path=cockroach-data-2,size=100Gi",
+			},
+			wantSQLPort:     26257,
+			wantHTTPPort:    8080,
+			wantTLSEnabled:  false,
+			wantLocality:    []string{"region", "zone"},
+			wantWALFailover: &startFlagValue{flag: "--wal-failover=among-stores", value: "among-stores"},
+		},
+		{
+			name: "public operator with quoted multi-line log config",
+			container: corev1.Container{
+				Name: "db",
+				Command: []string{"/bin/bash", "-ecx", "exec /cockroach/cockroach.sh start --advertise-host=$(POD_NAME).cockroachdb.default" +
+					" --certs-dir=/cockroach/cockroach-certs/ --http-port=8080 --sql-addr=:26257 --listen-addr=:26258" +
+					" --log=\"sinks:\n  file-groups:\n    dev:\n      channels: DEV\n\" --cache=30% --max-sql-memory=30%" +
+					" --join=cockroachdb-0.cockroachdb.default:26258"},
+				Env: []corev1.EnvVar{{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+				}}},
+			},
+			wantUpsert: []string{
+				"--advertise-host=$(POD_NAME).cockroachdb.default",
+				"--certs-dir=/cockroach/cockroach-certs/",
+				"--sql-addr=:26257",
+				"--listen-addr=:26258",
+				"--cache=30%",
+				"--max-sql-memory=30%",
+				"--join=cockroachdb-0.cockroachdb.default:26258",
+			},
+			wantSQLPort:    26257,
+			wantHTTPPort:   8080,
+			wantTLSEnabled: true,
+		},
+		{
+			name: "exec form with space separated values and repeated flags",
+			container: corev1.Container{
+				Name:    "db",
+				Command: []string{"/cockroach/cockroach"},
+				Args: []string{"start", "--join", "cockroachdb-0:26257", "--cache", "25%", "--cache", "30%",
+					"--port", "$(SQL_PORT)", "--http-addr", ":8081", "--locality", "region=$(REGION)"},
+				Env: []corev1.EnvVar{{Name: "SQL_PORT", Value: "26000"}, {Name: "REGION", Value: "us-east1"}},
+			},
+			wantUpsert: []string{
+				"--join=cockroachdb-0:26257",
+				"--cache=30%",
+				"--http-addr=:8081",
+			},
+			wantSQLPort:    26000,
+			wantHTTPPort:   8081,
+			wantTLSEnabled: true,
+			wantLocality:   []string{"region"},
+		},
+		{
+			name: "shell wrapper with && and unrecognized arguments",
+			container: corev1.Container{
+				Name: "db",
+				Command: []string{"sh", "-c", "ulimit -n 65536 && cd /cockroach && exec ./cockroach start-single-node" +
+					" --locality-advertise-addr=region=us@10.0.0.1 --insecure=false --custom-flag 'some value' positional" +
+					" --port=${SQL_PORT} # trailing comment"},
+				Env: []corev1.EnvVar{{Name: "SQL_PORT", Value: "26257"}},
+			},
+			wantUpsert: []string{
+				"--locality-advertise-addr=region=us@10.0.0.1",
+				"--custom-flag=some value",
+			},
+			wantSQLPort:      26257,
+			wantTLSEnabled:   true,
+			wantUnrecognized: []string{"--custom-flag=some value", "positional"},
+		},
+		{
+			name: "single node initialized as a virtualized cluster",
+			container: corev1.Container{
+				Name:    "db",
+				Command: []string{"/cockroach/cockroach", "start-single-node", "--insecure", "--virtualized", "--cache=25%"},
+			},
+			wantUpsert:     []string{"--cache=25%"},
+			wantTLSEnabled: false,
+			wantDropped: []string{
+				"--virtualized: only initializes the cluster, the PCR mode is detected from its virtual clusters",
+			},
+		},
+		{
+			name: "unterminated quote",
+			container: corev1.Container{
+				Name: "db",
+				Args: []string{"shell", "-ecx", "exec /cockroach/cockroach start --cluster-name='prod"},
+			},
+			wantErrorContains: "unterminated single quote",
+		},
+		{
+			name: "flag without value",
+			container: corev1.Container{
+				Name:    "db",
+				Command: []string{"/cockroach/cockroach", "start", "--cache"},
+			},
+			wantErrorContains: "flag --cache needs a value",
+		},
+		{
+			name: "invalid port",
+			container: corev1.Container{
+				Name:    "db",
+				Command: []string{"/cockroach/cockroach", "start", "--port=$(SQL_PORT)"},
+			},
+			wantErrorContains: "invalid --port value",
+		},
+		{
+			name: "no start command",
+			container: corev1.Container{
+				Name:    "db",
+				Command: []string{"/bin/bash", "-c", "sleep infinity"},
+			},
+			wantErrorContains: "couldn't find cockroach start command",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := parsedMigrationInput{tlsEnabled: true}
+
+			args, err := cockroachStartArgs(tt.container)
+			if err == nil {
+				err = extractJoinStringAndFlags(&input, args, containerEnv(tt.container))
+			}
+			if tt.wantErrorContains != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErrorContains)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.wantUpsert, input.startFlags.Upsert)
+			assert.Equal(t, tt.wantSQLPort, input.sqlPort)
+			assert.Equal(t, int32(grpcPort), input.grpcPort)
+			assert.Equal(t, tt.wantHTTPPort, input.httpPort)
+			assert.Equal(t, tt.wantTLSEnabled, input.tlsEnabled)
+			assert.Equal(t, tt.wantLocality, input.localityLabels)
+			assert.Equal(t, tt.wantUnrecognized, input.unrecognizedFlags)
+			assert.Equal(t, tt.wantDropped, input.droppedFlags)
+			assert.Equal(t, tt.wantWALFailover, input.walFailover)
+		})
+	}
+}
+
+func TestShellCommands(t *testing.T) {
+	commands, err := shellCommands(`set -e; echo "a \"b\" \$HOME" 'c d'\
+ $(hostname -f) ${A:-x y} && exec cockroach || true | cat &`)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"set", "-e"},
+		{"echo", `a "b" $HOME`, "c d", "$(hostname -f)", "${A:-x y}"},
+		{"exec", "cockroach"},
+		{"true"},
+		{"cat"},
+	}, commands)
+}
+
+func TestExpandEnv(t *testing.T) {
+	env := map[string]string{"NAME": "cockroachdb", "FQDN": "cockroachdb.default"}
+	assert.Equal(t, "cockroachdb-0.cockroachdb.default", expandEnv("${NAME}-0.$(FQDN)", env))
+	assert.Equal(t, "cockroachdb.$(hostname).$POD_NAME", expandEnv("$NAME.$(hostname).$POD_NAME", env))
+}
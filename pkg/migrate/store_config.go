@@ -0,0 +1,439 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	failoverVolumeName = "failoverdir"
+	// storeKeyDataKey is the key of the store key in the secrets referenced by the EncryptionAtRest spec.
+	storeKeyDataKey = "StoreKeyData"
+	// unknownKeyPlatform is the EncryptionAtRest platform of store keys which aren't managed by a KMS.
+	unknownKeyPlatform = "UNKNOWN_KEY_TYPE"
+	plainStoreKey      = "plain"
+	// clusterSettingKeySuffix is the suffix of the cluster setting keys in the init secret of the Helm chart.
+	clusterSettingKeySuffix = "-cluster-setting"
+	// cockroachWorkingDir is the working directory of the cockroach container, relative store paths are resolved from it.
+	cockroachWorkingDir = "/cockroach"
+	defaultStorePath    = "cockroach-data"
+)
+
+// startFlagValue is a start flag as passed to cockroach start, along with its value with the env references expanded.
+type startFlagValue struct {
+	flag  string
+	value string
+}
+
+// mapStoreFlags maps the --wal-failover and --enterprise-encryption start flags to the WAL failover and
+// encryption at rest specs of the CockroachDB Enterprise Operator. The store keys are copied to new secrets
+// using the key expected by the operator. Flags that can't be mapped are kept as start flags.
+func mapStoreFlags(ctx context.Context, clientset kubernetes.Interface, sts *appsv1.StatefulSet, input *parsedMigrationInput) error {
+	if input.walFailover != nil {
+		if spec, reason := walFailoverSpec(sts, input.walFailover.value); spec != nil {
+			input.walFailoverSpec = spec
+			input.routeFlag(input.walFailover.flag, "walFailoverSpec")
+		} else {
+			input.keepStartFlag(*input.walFailover, reason)
+		}
+	}
+
+	switch len(input.encryptionFlags) {
+	case 0:
+	case 1:
+		ear, reason, err := encryptionAtRestSpec(ctx, clientset, sts, input.podSpec.container, firstStorePath(input.startFlags), input.encryptionFlags[0].value)
+		if err != nil {
+			return err
+		}
+		if ear != nil {
+			input.encryptionAtRest = ear
+			input.routeFlag(input.encryptionFlags[0].flag, "encryptionAtRest")
+		} else {
+			input.keepStartFlag(input.encryptionFlags[0], reason)
+		}
+	default:
+		for _, f := range input.encryptionFlags {
+			input.keepStartFlag(f, "encryption at rest is configured for more than one store")
+		}
+	}
+
+	return nil
+}
+
+// keepStartFlag keeps a flag which couldn't be mapped to a CrdbNode field as a start flag.
+func (p *parsedMigrationInput) keepStartFlag(f startFlagValue, reason string) {
+	p.startFlags.Upsert = append(p.startFlags.Upsert, f.flag)
+	p.routeFlag(f.flag, "startFlags (unmapped)")
+	p.unmappedFlags = append(p.unmappedFlags, fmt.Sprintf("%s: %s", f.flag, reason))
+}
+
+// walFailoverSpec returns the WAL failover spec for a --wal-failover value. Only WAL failover to a side disk
+// backed by the failover volume claim template of the Helm chart, and disabled WAL failover can be mapped.
+func walFailoverSpec(sts *appsv1.StatefulSet, value string) (*v1alpha1.CrdbWalFailoverSpec, string) {
+	if value == "disabled" {
+		return &v1alpha1.CrdbWalFailoverSpec{Status: v1alpha1.WalDisable}, ""
+	}
+	if !strings.HasPrefix(value, "path=") {
+		return nil, "only WAL failover to a side disk can be configured by the operator"
+	}
+
+	for _, vct := range sts.Spec.VolumeClaimTemplates {
+		if vct.Name != failoverVolumeName {
+			continue
+		}
+		spec := &v1alpha1.CrdbWalFailoverSpec{Status: v1alpha1.WalEnable}
+		if size, ok := vct.Spec.Resources.Requests[corev1.ResourceStorage]; ok {
+			spec.Size = size.String()
+		}
+		if vct.Spec.StorageClassName != nil {
+			spec.StorageClassName = *vct.Spec.StorageClassName
+		}
+		return spec, ""
+	}
+
+	return nil, fmt.Sprintf("the side disk isn't backed by the %s volume claim template", failoverVolumeName)
+}
+
+// encryptionAtRestSpec returns the encryption at rest spec for an --enterprise-encryption value of the first store,
+// which is at the given resolved path. The store keys are read from the secret volumes they are mounted from.
+func encryptionAtRestSpec(
+	ctx context.Context,
+	clientset kubernetes.Interface,
+	sts *appsv1.StatefulSet,
+	container corev1.Container,
+	firstStore string,
+	value string) (*v1alpha1.EncryptionAtRest, string, error) {
+
+	opts := make(map[string]string)
+	for _, opt := range strings.Split(value, ",") {
+		k, v, _ := strings.Cut(opt, "=")
+		opts[k] = v
+	}
+
+	if _, ok := opts["rotation-period"]; ok {
+		return nil, "rotation-period can't be configured by the operator", nil
+	}
+	if resolveStorePath(opts["path"]) != firstStore {
+		return nil, "encryption at rest is only configured by the operator for the first store", nil
+	}
+
+	ear := &v1alpha1.EncryptionAtRest{Platform: unknownKeyPlatform}
+	for _, k := range []struct {
+		opt    string
+		suffix string
+		name   **string
+	}{
+		{opt: "key", suffix: "store-key", name: &ear.KeySecretName},
+		{opt: "old-key", suffix: "old-store-key", name: &ear.OldKeySecretName},
+	} {
+		keyPath := opts[k.opt]
+		if keyPath == "" || keyPath == plainStoreKey {
+			continue
+		}
+
+		secretName, secretKey, ok := secretForPath(sts, container, keyPath)
+		if !ok {
+			return nil, fmt.Sprintf("%s %s isn't mounted from a secret", k.opt, keyPath), nil
+		}
+		name := fmt.Sprintf("%s-%s", sts.Name, k.suffix)
+		if err := copyStoreKey(ctx, clientset, sts.Namespace, secretName, secretKey, name); err != nil {
+			return nil, "", err
+		}
+		*k.name = To(name)
+	}
+
+	return ear, "", nil
+}
+
+// secretForPath returns the secret and the key within it which are mounted at the given path of the container.
+func secretForPath(sts *appsv1.StatefulSet, container corev1.Container, path string) (string, string, bool) {
+	for _, m := range container.VolumeMounts {
+		rel, err := filepath.Rel(m.MountPath, path)
+		if err != nil || strings.HasPrefix(rel, "..") || rel == "." {
+			continue
+		}
+		if m.SubPath != "" {
+			rel = filepath.Join(m.SubPath, rel)
+		}
+
+		for _, v := range sts.Spec.Template.Spec.Volumes {
+			if v.Name != m.Name || v.Secret == nil {
+				continue
+			}
+			for _, item := range v.Secret.Items {
+				if item.Path == rel {
+					return v.Secret.SecretName, item.Key, true
+				}
+			}
+			if len(v.Secret.Items) == 0 {
+				return v.Secret.SecretName, rel, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// copyStoreKey copies a store key to a secret using the key expected by the CockroachDB Enterprise Operator.
+func copyStoreKey(ctx context.Context, clientset kubernetes.Interface, namespace, sourceName, sourceKey, name string) error {
+	source, err := clientset.CoreV1().Secrets(namespace).Get(ctx, sourceName, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "fetching store key secret %s", sourceName)
+	}
+	data, ok := source.Data[sourceKey]
+	if !ok {
+		return errors.Newf("store key secret %s has no key %s", sourceName, sourceKey)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Data: map[string][]byte{storeKeyDataKey: data},
+	}
+	if _, err := clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "creating store key secret %s", name)
+		}
+		if _, err := clientset.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return errors.Wrapf(err, "updating store key secret %s", name)
+		}
+	}
+
+	fmt.Printf("Secret created successfully: %s\n", name)
+	return nil
+}
+
+// clusterSettingsFromInitSecret returns the cluster settings provisioned by the init job of the Helm chart.
+// The Helm chart stores them in the <statefulset>-init secret, under keys which replace the dots of the setting
+// names by dashes. Since that encoding can't be reversed, the setting names are read from the
+// init.provisioning.clusterSettings values of the Helm release, and matched to the keys with the same encoding.
+func clusterSettingsFromInitSecret(ctx context.Context, clientset kubernetes.Interface, sts *appsv1.StatefulSet) (map[string]string, error) {
+	secret, err := clientset.CoreV1().Secrets(sts.Namespace).Get(ctx, fmt.Sprintf("%s-init", sts.Name), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching init secret")
+	}
+
+	var keys []string
+	for key := range secret.Data {
+		if strings.HasSuffix(key, clusterSettingKeySuffix) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	sort.Strings(keys)
+
+	names, err := releaseClusterSettingNames(ctx, clientset, sts)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]string)
+	for _, key := range keys {
+		name, ok := names[key]
+		if !ok {
+			return nil, errors.Newf("cluster setting %s of secret %s is not in the init.provisioning.clusterSettings "+
+				"values of the helm release", key, secret.Name)
+		}
+		// The Helm chart documents quoting the values as SQL string literals.
+		settings[name] = strings.TrimSuffix(strings.TrimPrefix(string(secret.Data[key]), "'"), "'")
+	}
+
+	return settings, nil
+}
+
+// releaseClusterSettingNames returns the names of the init.provisioning.clusterSettings values of the Helm release
+// of the StatefulSet, by the key the Helm chart stores them under in the init secret.
+func releaseClusterSettingNames(ctx context.Context, clientset kubernetes.Interface, sts *appsv1.StatefulSet) (map[string]string, error) {
+	releaseName := sts.Annotations[helmReleaseNameKey]
+	if releaseName == "" {
+		return nil, errors.Newf("statefulset %s has no %s annotation, can't read the names of the cluster settings "+
+			"of the init secret", sts.Name, helmReleaseNameKey)
+	}
+
+	release, err := latestHelmRelease(ctx, clientset, sts.Namespace, releaseName)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching helm release values")
+	}
+	if release == nil {
+		return nil, errors.Newf("helm release %s not found, can't read the names of the cluster settings of the "+
+			"init secret", releaseName)
+	}
+
+	clusterSettings, _, err := unstructured.NestedMap(release.Config, "init", "provisioning", "clusterSettings")
+	if err != nil {
+		return nil, errors.Wrap(err, "reading init.provisioning.clusterSettings of the helm release")
+	}
+
+	names := make(map[string]string, len(clusterSettings))
+	for name := range clusterSettings {
+		names[strings.ReplaceAll(name, ".", "-")+clusterSettingKeySuffix] = name
+	}
+	return names, nil
+}
+
+// addStoreValues sets the WAL failover, encryption at rest and cluster settings in the helm values built for the
+// CockroachDB Enterprise Operator chart. Settings which aren't configured are left out.
+func addStoreValues(values *helmValues, input parsedMigrationInput) {
+	crdbCluster := &values.CockroachDB.CrdbCluster
+
+	crdbCluster.WALFailoverSpec = input.walFailoverSpec
+	crdbCluster.ClusterSettings = input.clusterSettings
+	for i := range crdbCluster.Regions {
+		crdbCluster.Regions[i].EncryptionAtRest = input.encryptionAtRest
+	}
+}
+
+// dataStoreInput holds the volume claim templates of the StatefulSet which are mounted by the cockroach container.
+type dataStoreInput struct {
+	// volumeClaimTemplate backs the first store and becomes the data store of the CrdbNodes. Its name is kept,
+	// so that the operator picks up the existing PVCs, which are named <template>-<statefulset>-<ordinal>.
+	volumeClaimTemplate corev1.PersistentVolumeClaim
+	// additionalMounts are the mounts of the other volume claim templates, e.g. of additional stores. They are
+	// mounted from the existing PVCs of each node, while their --store flags are kept as start flags.
+	additionalMounts []corev1.VolumeMount
+}
+
+// mapVolumeClaimTemplates picks the volume claim template of the first store as the data store of the CrdbNodes.
+// The mounts of the other volume claim templates are taken out of the pod spec, since the PVC they are backed by
+// differs for every node. The WAL failover volume claim template is configured through the WAL failover spec.
+func mapVolumeClaimTemplates(sts *appsv1.StatefulSet, input *parsedMigrationInput) error {
+	if len(sts.Spec.VolumeClaimTemplates) == 0 {
+		return errors.Newf("statefulset %s has no volume claim templates", sts.Name)
+	}
+
+	mounts := make(map[string]corev1.VolumeMount)
+	for _, m := range input.podSpec.container.VolumeMounts {
+		mounts[m.Name] = m
+	}
+
+	primary := firstStoreClaimTemplate(sts, mounts, firstStorePath(input.startFlags))
+	input.dataStore = dataStoreInput{volumeClaimTemplate: primary}
+
+	var volumeMounts []corev1.VolumeMount
+	for _, m := range input.podSpec.volumeMounts {
+		if m.Name == primary.Name || m.Name == failoverVolumeName {
+			continue
+		}
+		if claimTemplate(sts, m.Name) != nil {
+			input.dataStore.additionalMounts = append(input.dataStore.additionalMounts, m)
+			// The CrdbCluster has a single data store and a pod template shared by all nodes, so the chart can't
+			// reference the PVC of each node.
+			input.podSpec.unmapped = append(input.podSpec.unmapped, fmt.Sprintf("volume claim template %s is only "+
+				"mounted by the crdbnode manifests, from the existing %s-%s-<ordinal> PVCs", m.Name, m.Name, sts.Name))
+			continue
+		}
+		volumeMounts = append(volumeMounts, m)
+	}
+	input.podSpec.volumeMounts = volumeMounts
+
+	return nil
+}
+
+// addNodeVolumes mounts the additional volume claim templates into the pod template of a CrdbNode, from the PVCs
+// created by the StatefulSet for the pod with the same name.
+func (d dataStoreInput) addNodeVolumes(podTemplate *v1alpha1.PodTemplateSpec, podName string) {
+	if len(d.additionalMounts) == 0 {
+		return
+	}
+	for _, m := range d.additionalMounts {
+		podTemplate.Spec.Volumes = append(podTemplate.Spec.Volumes, corev1.Volume{
+			Name: m.Name,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: fmt.Sprintf("%s-%s", m.Name, podName),
+				},
+			},
+		})
+	}
+	container := &podTemplate.Spec.Containers[0]
+	container.VolumeMounts = append(append([]corev1.VolumeMount{}, container.VolumeMounts...), d.additionalMounts...)
+}
+
+// firstStorePath returns the path of the first --store flag, resolved against the working directory of cockroach.
+func firstStorePath(flags *v1alpha1.Flags) string {
+	storePath := defaultStorePath
+	if flags != nil {
+		for _, f := range flags.Upsert {
+			if value, ok := strings.CutPrefix(f, "--store="); ok {
+				storePath = value
+				for _, opt := range strings.Split(value, ",") {
+					if p, ok := strings.CutPrefix(opt, "path="); ok {
+						storePath = p
+					}
+				}
+				break
+			}
+		}
+	}
+	return resolveStorePath(storePath)
+}
+
+// resolveStorePath resolves a store path against the working directory of cockroach.
+func resolveStorePath(storePath string) string {
+	if !filepath.IsAbs(storePath) {
+		return filepath.Join(cockroachWorkingDir, storePath)
+	}
+	return filepath.Clean(storePath)
+}
+
+// firstStoreClaimTemplate returns the volume claim template mounted at the path of the first store. If none is,
+// the datadir template of the Helm chart and the public operator, or else the first template is used.
+func firstStoreClaimTemplate(sts *appsv1.StatefulSet, mounts map[string]corev1.VolumeMount, storePath string) corev1.PersistentVolumeClaim {
+	for _, vct := range sts.Spec.VolumeClaimTemplates {
+		m, ok := mounts[vct.Name]
+		if !ok {
+			continue
+		}
+		if rel, err := filepath.Rel(m.MountPath, storePath); err == nil && !strings.HasPrefix(rel, "..") {
+			return vct
+		}
+	}
+	if vct := claimTemplate(sts, "datadir"); vct != nil {
+		return *vct
+	}
+	for _, vct := range sts.Spec.VolumeClaimTemplates {
+		if vct.Name != failoverVolumeName {
+			return vct
+		}
+	}
+	return sts.Spec.VolumeClaimTemplates[0]
+}
+
+func claimTemplate(sts *appsv1.StatefulSet, name string) *corev1.PersistentVolumeClaim {
+	for i := range sts.Spec.VolumeClaimTemplates {
+		if sts.Spec.VolumeClaimTemplates[i].Name == name {
+			return &sts.Spec.VolumeClaimTemplates[i]
+		}
+	}
+	return nil
+}
+
+// crdbNodeDataStore returns the data store of the CrdbNodes.
+func (d dataStoreInput) crdbNodeDataStore() v1alpha1.DataStore {
+	return v1alpha1.DataStore{
+		VolumeClaimTemplate: &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: d.volumeClaimTemplate.Name,
+			},
+			Spec: d.volumeClaimTemplate.Spec,
+		},
+	}
+}
@@ -0,0 +1,275 @@
+package migrate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWALFailoverSpec(t *testing.T) {
+	sts := &appsv1.StatefulSet{}
+
+	spec, _ := walFailoverSpec(sts, "disabled")
+	assert.Equal(t, &v1alpha1.CrdbWalFailoverSpec{Status: v1alpha1.WalDisable}, spec)
+
+	spec, reason := walFailoverSpec(sts, "among-stores")
+	assert.Nil(t, spec)
+	assert.Contains(t, reason, "side disk")
+
+	spec, reason = walFailoverSpec(sts, "path=/cockroach/cockroach-failover")
+	assert.Nil(t, spec)
+	assert.Contains(t, reason, failoverVolumeName)
+
+	sts.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{{
+		ObjectMeta: metav1.ObjectMeta{Name: failoverVolumeName},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: To("standard"),
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("25Gi")},
+			},
+		},
+	}}
+	spec, _ = walFailoverSpec(sts, "path=/cockroach/cockroach-failover")
+	assert.Equal(t, &v1alpha1.CrdbWalFailoverSpec{Status: v1alpha1.WalEnable, Size: "25Gi", StorageClassName: "standard"}, spec)
+}
+
+func TestMapStoreFlags(t *testing.T) {
+	ctx := context.Background()
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb", Namespace: "default"}}
+	sts.Spec.Template.Spec.Volumes = []corev1.Volume{{
+		Name: "secret-store-keys",
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+			SecretName: "store-keys",
+			Items: []corev1.KeyToPath{
+				{Key: "current", Path: "aes-128.key"},
+				{Key: "previous", Path: "old/aes-128.key"},
+			},
+		}},
+	}}
+	container := corev1.Container{
+		Name:         "db",
+		VolumeMounts: []corev1.VolumeMount{{Name: "secret-store-keys", MountPath: "/etc/cockroach/secrets/store-keys"}},
+	}
+
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "store-keys", Namespace: "default"},
+		Data:       map[string][]byte{"current": []byte("new-key"), "previous": []byte("old-key")},
+	})
+
+	flag := "--enterprise-encryption=path=cockroach-data,key=/etc/cockroach/secrets/store-keys/aes-128.key," +
+		"old-key=/etc/cockroach/secrets/store-keys/old/aes-128.key"
+	input := parsedMigrationInput{
+		startFlags:      &v1alpha1.Flags{},
+		podSpec:         podSpecInput{container: container},
+		walFailover:     &startFlagValue{flag: "--wal-failover=among-stores", value: "among-stores"},
+		encryptionFlags: []startFlagValue{{flag: flag, value: flag[len("--enterprise-encryption="):]}},
+	}
+	require.NoError(t, mapStoreFlags(ctx, clientset, sts, &input))
+
+	assert.Nil(t, input.walFailoverSpec)
+	assert.Equal(t, []string{"--wal-failover=among-stores"}, input.startFlags.Upsert)
+	require.Len(t, input.unmappedFlags, 1)
+	assert.Equal(t, &v1alpha1.EncryptionAtRest{
+		Platform:         unknownKeyPlatform,
+		KeySecretName:    To("cockroachdb-store-key"),
+		OldKeySecretName: To("cockroachdb-old-store-key"),
+	}, input.encryptionAtRest)
+
+	for name, key := range map[string]string{"cockroachdb-store-key": "new-key", "cockroachdb-old-store-key": "old-key"} {
+		secret, err := clientset.CoreV1().Secrets("default").Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []byte(key), secret.Data[storeKeyDataKey])
+	}
+
+	// Running the migration again updates the copied store keys.
+	input.encryptionAtRest = nil
+	require.NoError(t, mapStoreFlags(ctx, clientset, sts, &input))
+	assert.NotNil(t, input.encryptionAtRest)
+
+	// Keys which aren't mounted from a secret, and keys of other stores, are kept as start flags.
+	for _, value := range []string{
+		"path=cockroach-data,key=/keys/aes-128.key,old-key=plain",
+		"path=cockroach-data-2,key=plain,old-key=plain",
+		"path=cockroach-data,key=plain,old-key=plain,rotation-period=24h",
+	} {
+		input := parsedMigrationInput{
+			startFlags:      &v1alpha1.Flags{},
+			podSpec:         podSpecInput{container: container},
+			encryptionFlags: []startFlagValue{{flag: "--enterprise-encryption=" + value, value: value}},
+		}
+		require.NoError(t, mapStoreFlags(ctx, clientset, sts, &input))
+		assert.Nil(t, input.encryptionAtRest, value)
+		assert.Equal(t, []string{"--enterprise-encryption=" + value}, input.startFlags.Upsert)
+	}
+
+	// Encryption at rest of a renamed first store is mapped, while the default store path is now another store.
+	for value, mapped := range map[string]bool{
+		"path=/cockroach/data/,key=plain,old-key=plain": true,
+		"path=cockroach-data,key=plain,old-key=plain":   false,
+	} {
+		input := parsedMigrationInput{
+			startFlags:      &v1alpha1.Flags{Upsert: []string{"--store=path=data,attrs=ssd"}},
+			podSpec:         podSpecInput{container: container},
+			encryptionFlags: []startFlagValue{{flag: "--enterprise-encryption=" + value, value: value}},
+		}
+		require.NoError(t, mapStoreFlags(ctx, clientset, sts, &input))
+		assert.Equal(t, mapped, input.encryptionAtRest != nil, value)
+	}
+}
+
+func TestClusterSettingsFromInitSecret(t *testing.T) {
+	ctx := context.Background()
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Name:        "cockroachdb",
+		Namespace:   "default",
+		Annotations: map[string]string{helmReleaseNameKey: "cockroachdb"},
+	}}
+
+	settings, err := clusterSettingsFromInitSecret(ctx, fake.NewSimpleClientset(), sts)
+	require.NoError(t, err)
+	assert.Nil(t, settings)
+
+	initSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb-init", Namespace: "default"},
+		Data: map[string][]byte{
+			"cluster-organization-cluster-setting":         []byte("'Cockroach Labs'"),
+			"server-time_until_store_dead-cluster-setting": []byte("'5m'"),
+			"enterprise-license-cluster-setting":           []byte("license"),
+			"user-root-password":                           []byte("secret"),
+		},
+	}
+	release := func(clusterSettings map[string]interface{}) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "sh.helm.release.v1.cockroachdb.v1",
+				Namespace: "default",
+				Labels:    map[string]string{"owner": "helm", "name": "cockroachdb", "status": "deployed"},
+			},
+			Type: helmReleaseSecretType,
+			Data: map[string][]byte{"release": encodeHelmRelease(t, helmRelease{
+				Name:    "cockroachdb",
+				Version: 1,
+				Config: map[string]interface{}{"init": map[string]interface{}{"provisioning": map[string]interface{}{
+					"clusterSettings": clusterSettings,
+				}}},
+			})},
+		}
+	}
+
+	// The names of the settings can't be told from the keys of the secret without the helm release.
+	_, err = clusterSettingsFromInitSecret(ctx, fake.NewSimpleClientset(initSecret), sts)
+	assert.ErrorContains(t, err, "helm release cockroachdb not found")
+
+	clientset := fake.NewSimpleClientset(initSecret, release(map[string]interface{}{
+		"cluster.organization":         "'Cockroach Labs'",
+		"server.time_until_store_dead": "'5m'",
+		"enterprise.license":           "license",
+	}))
+	settings, err = clusterSettingsFromInitSecret(ctx, clientset, sts)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"cluster.organization":         "Cockroach Labs",
+		"server.time_until_store_dead": "5m",
+		"enterprise.license":           "license",
+	}, settings)
+
+	clientset = fake.NewSimpleClientset(initSecret, release(map[string]interface{}{"cluster.organization": "'Cockroach Labs'"}))
+	_, err = clusterSettingsFromInitSecret(ctx, clientset, sts)
+	assert.ErrorContains(t, err, "cluster setting enterprise-license-cluster-setting of secret cockroachdb-init is not in")
+}
+
+func TestMapVolumeClaimTemplates(t *testing.T) {
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb", Namespace: "default"}}
+	input := parsedMigrationInput{startFlags: &v1alpha1.Flags{}}
+	require.Error(t, mapVolumeClaimTemplates(sts, &input))
+
+	storageClass := To("fast")
+	sts.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{
+		{ObjectMeta: metav1.ObjectMeta{Name: failoverVolumeName}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "store-2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "data"}, Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: storageClass}},
+	}
+	mounts := []corev1.VolumeMount{
+		{Name: "data", MountPath: "/cockroach/data"},
+		{Name: failoverVolumeName, MountPath: "/cockroach/failover"},
+		{Name: "certs", MountPath: "/cockroach/cockroach-certs"},
+	}
+	input = parsedMigrationInput{
+		startFlags: &v1alpha1.Flags{Upsert: []string{"--store=path=data/cockroach,attrs=ssd"}},
+		podSpec:    podSpecInput{container: corev1.Container{VolumeMounts: mounts}, volumeMounts: mounts},
+	}
+	require.NoError(t, mapVolumeClaimTemplates(sts, &input))
+
+	assert.Equal(t, "data", input.dataStore.volumeClaimTemplate.Name)
+	assert.Equal(t, []corev1.VolumeMount{mounts[2]}, input.podSpec.volumeMounts)
+	assert.Equal(t, v1alpha1.DataStore{VolumeClaimTemplate: &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data"},
+		Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: storageClass},
+	}}, input.dataStore.crdbNodeDataStore())
+
+	// Additional stores are mounted from the PVCs of the StatefulSet pod with the same name, and their --store
+	// flags are kept.
+	mounts = append(mounts, corev1.VolumeMount{Name: "store-2", MountPath: "/cockroach/store-2"})
+	input = parsedMigrationInput{
+		startFlags: &v1alpha1.Flags{Upsert: []string{"--store=path=data/cockroach,attrs=ssd", "--store=/cockroach/store-2"}},
+		podSpec:    podSpecInput{container: corev1.Container{VolumeMounts: mounts}, volumeMounts: mounts},
+	}
+	require.NoError(t, mapVolumeClaimTemplates(sts, &input))
+	assert.Equal(t, []corev1.VolumeMount{mounts[3]}, input.dataStore.additionalMounts)
+	assert.Equal(t, []corev1.VolumeMount{mounts[2]}, input.podSpec.volumeMounts)
+	assert.Equal(t, []string{"volume claim template store-2 is only mounted by the crdbnode manifests, from the existing store-2-cockroachdb-<ordinal> PVCs"},
+		input.podSpec.unmapped)
+
+	podTemplate := &v1alpha1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{input.podSpec.crdbContainer()}}}
+	input.dataStore.addNodeVolumes(podTemplate, "cockroachdb-1")
+	assert.Equal(t, []corev1.Volume{{
+		Name: "store-2",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "store-2-cockroachdb-1"},
+		},
+	}}, podTemplate.Spec.Volumes)
+	assert.Equal(t, []corev1.VolumeMount{mounts[2], mounts[3]}, podTemplate.Spec.Containers[0].VolumeMounts)
+	assert.Equal(t, []string{"--store=path=data/cockroach,attrs=ssd", "--store=/cockroach/store-2"}, input.startFlags.Upsert)
+
+	// Without a mount matching the first store, the datadir template of the Helm chart is used.
+	sts.Spec.VolumeClaimTemplates[2].Name = "datadir"
+	input = parsedMigrationInput{startFlags: &v1alpha1.Flags{}}
+	require.NoError(t, mapVolumeClaimTemplates(sts, &input))
+	assert.Equal(t, "datadir", input.dataStore.volumeClaimTemplate.Name)
+	assert.Empty(t, input.dataStore.additionalMounts)
+}
+
+func TestBuildManifestsForInsecureCluster(t *testing.T) {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "cockroachdb", Namespace: "default"},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:             To(int32(3)),
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{ObjectMeta: metav1.ObjectMeta{Name: "datadir"}}},
+		},
+	}
+	input := parsedMigrationInput{startFlags: &v1alpha1.Flags{}}
+	require.NoError(t, extractJoinStringAndFlags(&input, []string{"--insecure", "--join=cockroachdb-0"}, nil))
+	require.NoError(t, mapVolumeClaimTemplates(sts, &input))
+	require.False(t, input.tlsEnabled)
+
+	nodeSpec := buildNodeSpecFromHelm(sts, "node-1", "cockroachdb-0", input)
+	assert.Nil(t, nodeSpec.Certificates.ExternalCertificates)
+	assert.Equal(t, "datadir", nodeSpec.DataStore.VolumeClaimTemplate.Name)
+
+	values := buildHelmValuesFromHelm(sts, "gcp", "us-east1", "default", input)
+	assert.Equal(t, tlsValues{}, values.CockroachDB.TLS)
+	require.NoError(t, validateHelmValues(values))
+
+	// Cert-manager settings aren't carried over either.
+	input.certManagerInput = &certManagerInput{issuerName: "issuer", issuerKind: "Issuer"}
+	values = buildHelmValuesFromHelm(sts, "gcp", "us-east1", "default", input)
+	assert.Equal(t, tlsValues{}, values.CockroachDB.TLS)
+}
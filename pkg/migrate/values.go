@@ -0,0 +1,212 @@
+package migrate
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// The default values and the values schema of the cockroachdb chart of the CockroachDB Enterprise Operator
+// are embedded, so that the generated values can be validated without a checkout of the charts. The copies under
+// chart/ are refreshed by `go run build/build.go generate`.
+var (
+	//go:embed chart/values.yaml
+	chartDefaultValues []byte
+	//go:embed chart/values.schema.json
+	chartValuesSchema []byte
+)
+
+// helmValues mirrors the values of cockroachdb-parent/charts/cockroachdb/values.yaml which are set by the
+// migration. Values which aren't set are left out, so that the chart defaults apply.
+type helmValues struct {
+	CockroachDB cockroachDBValues `json:"cockroachdb"`
+	K8s         *k8sValues        `json:"k8s,omitempty"`
+}
+
+type cockroachDBValues struct {
+	TLS         tlsValues         `json:"tls"`
+	CrdbCluster crdbClusterValues `json:"crdbCluster"`
+}
+
+type tlsValues struct {
+	Enabled              bool                        `json:"enabled"`
+	SelfSigner           selfSignerValues            `json:"selfSigner"`
+	CertManager          *certManagerValues          `json:"certManager,omitempty"`
+	ExternalCertificates *externalCertificatesValues `json:"externalCertificates,omitempty"`
+}
+
+type selfSignerValues struct {
+	Enabled bool `json:"enabled"`
+}
+
+type certManagerValues struct {
+	Enabled          bool         `json:"enabled"`
+	CAConfigMap      string       `json:"caConfigMap"`
+	NodeSecret       string       `json:"nodeSecret"`
+	ClientRootSecret string       `json:"clientRootSecret"`
+	Issuer           issuerValues `json:"issuer"`
+}
+
+type issuerValues struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type externalCertificatesValues struct {
+	Enabled      bool                          `json:"enabled"`
+	Certificates v1alpha1.ExternalCertificates `json:"certificates"`
+}
+
+type crdbClusterValues struct {
+	Image           imageValues                   `json:"image"`
+	ClusterSettings map[string]string             `json:"clusterSettings,omitempty"`
+	DataStore       dataStoreValues               `json:"dataStore"`
+	Regions         []v1alpha1.CrdbClusterRegion  `json:"regions"`
+	WALFailoverSpec *v1alpha1.CrdbWalFailoverSpec `json:"walFailoverSpec,omitempty"`
+	PodLabels       map[string]string             `json:"podLabels,omitempty"`
+	PodAnnotations  map[string]string             `json:"podAnnotations,omitempty"`
+	Resources       *corev1.ResourceRequirements  `json:"resources,omitempty"`
+	Affinity        *corev1.Affinity              `json:"affinity,omitempty"`
+	Tolerations     []corev1.Toleration           `json:"tolerations,omitempty"`
+	NodeSelector    map[string]string             `json:"nodeSelector,omitempty"`
+	// TopologySpreadConstraints replace the default constraints of the chart when they are set.
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	StartFlags                *startFlagsValues                 `json:"startFlags,omitempty"`
+	Service                   serviceValues                     `json:"service"`
+	SideCars                  *v1alpha1.CrdbNodeSideCars        `json:"sideCars,omitempty"`
+	LocalityLabels            []string                          `json:"localityLabels,omitempty"`
+	LoggingConfigMapName      string                            `json:"loggingConfigMapName,omitempty"`
+	PodTemplate               *v1alpha1.PodTemplateSpec         `json:"podTemplate,omitempty"`
+	VirtualCluster            *v1alpha1.CrdbVirtualClusterSpec  `json:"virtualCluster,omitempty"`
+}
+
+type imageValues struct {
+	Name string `json:"name"`
+}
+
+type dataStoreValues struct {
+	VolumeClaimTemplate volumeClaimTemplateValues `json:"volumeClaimTemplate"`
+}
+
+type volumeClaimTemplateValues struct {
+	Metadata objectNameValues                 `json:"metadata"`
+	Spec     corev1.PersistentVolumeClaimSpec `json:"spec"`
+}
+
+type objectNameValues struct {
+	Name string `json:"name"`
+}
+
+// startFlagsValues are the start flags of the chart. Unlike v1alpha1.Flags, empty lists are left out.
+type startFlagsValues struct {
+	Upsert []string `json:"upsert,omitempty"`
+	Omit   []string `json:"omit,omitempty"`
+}
+
+type serviceValues struct {
+	Ports   servicePortsValues   `json:"ports"`
+	Public  *publicServiceValues `json:"public,omitempty"`
+	Ingress *ingressValues       `json:"ingress,omitempty"`
+}
+
+type servicePortsValues struct {
+	GRPC portValues `json:"grpc"`
+	HTTP portValues `json:"http"`
+	SQL  portValues `json:"sql"`
+}
+
+type portValues struct {
+	Port *int32 `json:"port,omitempty"`
+}
+
+type publicServiceValues struct {
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ingressValues struct {
+	Enabled bool               `json:"enabled"`
+	UI      *ingressHostValues `json:"ui,omitempty"`
+	SQL     *ingressHostValues `json:"sql,omitempty"`
+}
+
+type ingressHostValues struct {
+	IngressClassName string            `json:"ingressClassName"`
+	Annotations      map[string]string `json:"annotations,omitempty"`
+	Host             string            `json:"host"`
+}
+
+type k8sValues struct {
+	FullnameOverride string `json:"fullnameOverride,omitempty"`
+	// Labels are added to all the resources of the chart.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// startFlagsValue returns the start flags values for the flags of the CrdbNodes, or nil if there are none.
+func startFlagsValue(flags *v1alpha1.Flags) *startFlagsValues {
+	if flags == nil || (len(flags.Upsert) == 0 && len(flags.Omit) == 0) {
+		return nil
+	}
+	return &startFlagsValues{Upsert: flags.Upsert, Omit: flags.Omit}
+}
+
+// validateHelmValues validates the values against the values schema of the chart. Like helm, the values are
+// merged with the chart defaults before they are validated.
+func validateHelmValues(values helmValues) error {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("values.schema.json", bytes.NewReader(chartValuesSchema)); err != nil {
+		return errors.Wrap(err, "loading values schema")
+	}
+	schema, err := compiler.Compile("values.schema.json")
+	if err != nil {
+		return errors.Wrap(err, "compiling values schema")
+	}
+
+	defaultsJSON, err := yaml.YAMLToJSON(chartDefaultValues)
+	if err != nil {
+		return errors.Wrap(err, "converting default values")
+	}
+	var defaults map[string]interface{}
+	if err := json.Unmarshal(defaultsJSON, &defaults); err != nil {
+		return errors.Wrap(err, "unmarshalling default values")
+	}
+
+	valuesJSON, err := json.Marshal(values)
+	if err != nil {
+		return errors.Wrap(err, "marshalling values")
+	}
+	var overrides map[string]interface{}
+	if err := json.Unmarshal(valuesJSON, &overrides); err != nil {
+		return errors.Wrap(err, "unmarshalling values")
+	}
+
+	if err := schema.Validate(coalesceValues(overrides, defaults)); err != nil {
+		return errors.Wrap(err, "values don't match the chart schema")
+	}
+	return nil
+}
+
+// coalesceValues merges the values into the defaults the way helm does: maps are merged recursively and any
+// other value replaces the default.
+func coalesceValues(values, defaults map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(defaults))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range values {
+		valueMap, isMap := v.(map[string]interface{})
+		defaultMap, defaultIsMap := merged[k].(map[string]interface{})
+		if isMap && defaultIsMap {
+			merged[k] = coalesceValues(valueMap, defaultMap)
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
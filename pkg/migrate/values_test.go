@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+func TestEmbeddedChartValuesUpToDate(t *testing.T) {
+	for file, embedded := range map[string][]byte{
+		"values.yaml":        chartDefaultValues,
+		"values.schema.json": chartValuesSchema,
+	} {
+		chartFile, err := os.ReadFile("../../cockroachdb-parent/charts/cockroachdb/" + file)
+		require.NoError(t, err)
+		assert.Equal(t, string(chartFile), string(embedded), "%s is out of date, run go run build/build.go generate", file)
+	}
+}
+
+func TestHelmValuesOmitUnsetValues(t *testing.T) {
+	values := helmValues{}
+	values.CockroachDB.CrdbCluster.StartFlags = startFlagsValue(&v1alpha1.Flags{})
+	values.CockroachDB.CrdbCluster.Regions = []v1alpha1.CrdbClusterRegion{{Code: "us-east1", Nodes: 3}}
+
+	out, err := yaml.Marshal(values)
+	require.NoError(t, err)
+	assert.NotContains(t, string(out), "null")
+	assert.NotContains(t, string(out), "startFlags")
+	assert.NotContains(t, string(out), "domain")
+
+	values.CockroachDB.CrdbCluster.StartFlags = startFlagsValue(&v1alpha1.Flags{Upsert: []string{"--cache=25%"}})
+	out, err = yaml.Marshal(values)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "startFlags:\n      upsert:\n      - --cache=25%\n")
+}
+
+func TestValidateHelmValues(t *testing.T) {
+	values := helmValues{}
+	values.CockroachDB.CrdbCluster.Image.Name = "cockroachdb/cockroach:v25.1.5"
+	require.NoError(t, validateHelmValues(values))
+
+	defer func(schema []byte) { chartValuesSchema = schema }(chartValuesSchema)
+	chartValuesSchema = []byte(`{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "properties": {
+    "cockroachdb": {
+      "properties": {
+        "crdbCluster": {
+          "properties": {
+            "image": {"properties": {"name": {"pattern": "^cockroachdb/"}}},
+            "rollingRestartDelay": {"type": "string"}
+          }
+        }
+      }
+    }
+  }
+}`)
+
+	// The chart defaults are validated along with the values.
+	require.NoError(t, validateHelmValues(values))
+
+	values.CockroachDB.CrdbCluster.Image.Name = "registry.example.com/cockroach:v25.1.5"
+	err := validateHelmValues(values)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "/cockroachdb/crdbCluster/image/name")
+}
+
+func TestCoalesceValues(t *testing.T) {
+	defaults := map[string]interface{}{
+		"image":   map[string]interface{}{"name": "default", "pullPolicy": "IfNotPresent"},
+		"regions": []interface{}{"us-east-1"},
+		"labels":  map[string]interface{}{"a": "b"},
+	}
+	values := map[string]interface{}{
+		"image":   map[string]interface{}{"name": "custom"},
+		"regions": []interface{}{"us-central1"},
+		"labels":  "none",
+	}
+	assert.Equal(t, map[string]interface{}{
+		"image":   map[string]interface{}{"name": "custom", "pullPolicy": "IfNotPresent"},
+		"regions": []interface{}{"us-central1"},
+		"labels":  "none",
+	}, coalesceValues(values, defaults))
+	assert.Equal(t, "default", defaults["image"].(map[string]interface{})["name"])
+}
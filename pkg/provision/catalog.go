@@ -0,0 +1,255 @@
+package provision
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgx/v4"
+)
+
+// Catalog is the live state of the cluster which provisioning manages.
+type Catalog struct {
+	// ClusterSettings holds the current value of the cluster settings of the spec.
+	ClusterSettings map[string]string
+	Roles           map[string]CatalogRole
+	Databases       map[string]CatalogDatabase
+	// Schedules are the backup schedules created by provisioning, by label.
+	Schedules map[string][]CatalogSchedule
+}
+
+// CatalogRole is a user or a role, as stored in system.users.
+type CatalogRole struct {
+	IsRole         bool
+	HashedPassword string
+	// Options maps the role options to their value, which is empty for options without value.
+	Options  map[string]string
+	MemberOf []string
+}
+
+// CatalogDatabase is a database and the privileges granted on it.
+type CatalogDatabase struct {
+	// Grants maps the grantees to their privileges.
+	Grants map[string][]Grant
+}
+
+// Grant is a privilege granted on a database.
+type Grant struct {
+	Privilege   string
+	GrantOption bool
+}
+
+// CatalogSchedule is a backup schedule.
+type CatalogSchedule struct {
+	ID         int64
+	Recurrence string
+	// Incremental is set on the incremental schedule of a pair of full and incremental schedules.
+	Incremental bool
+	Statement   string
+}
+
+// ReadCatalog reads the live state of the cluster. The cluster settings are only read for the settings of the
+// spec, while the roles, databases and backup schedules are all read, so that they can be pruned.
+func ReadCatalog(ctx context.Context, db *sql.DB, spec Spec) (Catalog, error) {
+	catalog := Catalog{
+		ClusterSettings: map[string]string{},
+		Roles:           map[string]CatalogRole{},
+		Databases:       map[string]CatalogDatabase{},
+		Schedules:       map[string][]CatalogSchedule{},
+	}
+
+	for name := range spec.ClusterSettings {
+		var value sql.NullString
+		// Each part of the dotted name of the setting is quoted as an identifier.
+		setting := pgx.Identifier(strings.Split(name, ".")).Sanitize()
+		if err := db.QueryRowContext(ctx, "SHOW CLUSTER SETTING "+setting).Scan(&value); err != nil {
+			return catalog, errors.Wrapf(err, "reading cluster setting %s", name)
+		}
+		catalog.ClusterSettings[name] = value.String
+	}
+
+	if err := readRoles(ctx, db, catalog.Roles); err != nil {
+		return catalog, err
+	}
+	if err := readDatabases(ctx, db, catalog.Databases); err != nil {
+		return catalog, err
+	}
+	if err := readSchedules(ctx, db, catalog.Schedules); err != nil {
+		return catalog, err
+	}
+	return catalog, nil
+}
+
+func readRoles(ctx context.Context, db *sql.DB, roles map[string]CatalogRole) error {
+	rows, err := db.QueryContext(ctx, `SELECT username, COALESCE("hashedPassword", ''::BYTES), "isRole" FROM system.users`)
+	if err != nil {
+		return errors.Wrap(err, "listing users")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var hashedPassword []byte
+		role := CatalogRole{Options: map[string]string{}}
+		if err := rows.Scan(&name, &hashedPassword, &role.IsRole); err != nil {
+			return errors.Wrap(err, "scanning user")
+		}
+		role.HashedPassword = string(hashedPassword)
+		roles[name] = role
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "listing users")
+	}
+
+	rows, err = db.QueryContext(ctx, `SELECT username, option, COALESCE(value, '') FROM system.role_options`)
+	if err != nil {
+		return errors.Wrap(err, "listing role options")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, option, value string
+		if err := rows.Scan(&name, &option, &value); err != nil {
+			return errors.Wrap(err, "scanning role option")
+		}
+		if role, ok := roles[name]; ok {
+			role.Options[strings.ToUpper(option)] = value
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "listing role options")
+	}
+
+	rows, err = db.QueryContext(ctx, `SELECT role, member FROM system.role_members`)
+	if err != nil {
+		return errors.Wrap(err, "listing role members")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, member string
+		if err := rows.Scan(&name, &member); err != nil {
+			return errors.Wrap(err, "scanning role member")
+		}
+		if role, ok := roles[member]; ok {
+			role.MemberOf = append(role.MemberOf, name)
+			roles[member] = role
+		}
+	}
+	return errors.Wrap(rows.Err(), "listing role members")
+}
+
+func readDatabases(ctx context.Context, db *sql.DB, databases map[string]CatalogDatabase) error {
+	rows, err := db.QueryContext(ctx, "SELECT database_name FROM [SHOW DATABASES]")
+	if err != nil {
+		return errors.Wrap(err, "listing databases")
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "scanning database")
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "listing databases")
+	}
+
+	for _, name := range names {
+		grants, err := showGrants(ctx, db, name)
+		if err != nil {
+			return err
+		}
+		databases[name] = CatalogDatabase{Grants: grants}
+	}
+	return nil
+}
+
+// showGrants lists the privileges granted on a database. The is_grantable column was added in CockroachDB
+// 22.1, so the columns are looked up by name rather than by position.
+func showGrants(ctx context.Context, db *sql.DB, database string) (map[string][]Grant, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SHOW GRANTS ON DATABASE %s", pgx.Identifier{database}.Sanitize()))
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing grants on database %s", database)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	grants := map[string][]Grant{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrapf(err, "scanning grant on database %s", database)
+		}
+
+		var grantee string
+		var grant Grant
+		for i, column := range columns {
+			switch column {
+			case "grantee":
+				grantee = values[i].String
+			case "privilege_type":
+				grant.Privilege = values[i].String
+			case "is_grantable":
+				grant.GrantOption = values[i].String == "true" || values[i].String == "t"
+			}
+		}
+		grants[grantee] = append(grants[grantee], grant)
+	}
+	return grants, errors.Wrapf(rows.Err(), "listing grants on database %s", database)
+}
+
+// backupScheduleArgs are the execution arguments of a backup schedule, as shown in the command column of
+// SHOW SCHEDULES.
+type backupScheduleArgs struct {
+	BackupStatement string `json:"backup_statement"`
+	// BackupType is either the name or the number of the enum, depending on the version.
+	BackupType interface{} `json:"backup_type"`
+}
+
+// ReadSchedules reads the backup schedules created by provisioning, by label.
+func ReadSchedules(ctx context.Context, db *sql.DB) (map[string][]CatalogSchedule, error) {
+	schedules := map[string][]CatalogSchedule{}
+	return schedules, readSchedules(ctx, db, schedules)
+}
+
+func readSchedules(ctx context.Context, db *sql.DB, schedules map[string][]CatalogSchedule) error {
+	rows, err := db.QueryContext(ctx, "SELECT id, label, COALESCE(recurrence, ''), command::STRING FROM [SHOW SCHEDULES] WHERE label LIKE '%"+scheduleLabelSuffix+"'")
+	if err != nil {
+		return errors.Wrap(err, "listing backup schedules")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var label, command string
+		var s CatalogSchedule
+		if err := rows.Scan(&s.ID, &label, &s.Recurrence, &command); err != nil {
+			return errors.Wrap(err, "scanning backup schedule")
+		}
+		if !strings.HasSuffix(label, scheduleLabelSuffix) {
+			continue
+		}
+		var args backupScheduleArgs
+		if err := json.Unmarshal([]byte(command), &args); err != nil {
+			return errors.Wrapf(err, "decoding command of backup schedule %d", s.ID)
+		}
+		s.Statement = args.BackupStatement
+		switch t := args.BackupType.(type) {
+		case string:
+			s.Incremental = t == "INCREMENTAL"
+		case float64:
+			s.Incremental = t == 1
+		}
+		schedules[label] = append(schedules[label], s)
+	}
+	return errors.Wrap(rows.Err(), "listing backup schedules")
+}
@@ -0,0 +1,63 @@
+package provision
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const scramPrefix = "SCRAM-SHA-256$"
+
+// passwordMatches reports whether the password hashes to the hash stored in system.users. CockroachDB hashes
+// passwords either with bcrypt or, since 22.2, with SCRAM-SHA-256. Hashes of other formats never match, so that
+// the password is set again.
+func passwordMatches(hash, password string) bool {
+	if strings.HasPrefix(hash, scramPrefix) {
+		return scramPasswordMatches(strings.TrimPrefix(hash, scramPrefix), password)
+	}
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	return false
+}
+
+// scramPasswordMatches checks a password against a SCRAM-SHA-256 hash, as defined by RFC 5803:
+// <iterations>:<salt>$<stored key>:<server key>.
+func scramPasswordMatches(hash, password string) bool {
+	parameters, keys, ok := strings.Cut(hash, "$")
+	if !ok {
+		return false
+	}
+	iterations, encodedSalt, ok := strings.Cut(parameters, ":")
+	if !ok {
+		return false
+	}
+	encodedStoredKey, _, ok := strings.Cut(keys, ":")
+	if !ok {
+		return false
+	}
+
+	n, err := strconv.Atoi(iterations)
+	if err != nil {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return false
+	}
+	storedKey, err := base64.StdEncoding.DecodeString(encodedStoredKey)
+	if err != nil {
+		return false
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(password), salt, n, sha256.Size, sha256.New)
+	mac := hmac.New(sha256.New, saltedPassword)
+	mac.Write([]byte("Client Key"))
+	clientKey := sha256.Sum256(mac.Sum(nil))
+	return hmac.Equal(clientKey[:], storedKey)
+}
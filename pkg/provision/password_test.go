@@ -0,0 +1,43 @@
+package provision
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// scramHash hashes a password the way CockroachDB stores SCRAM-SHA-256 hashes.
+func scramHash(password string, salt []byte, iterations int) string {
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	keyOf := func(name string) []byte {
+		mac := hmac.New(sha256.New, saltedPassword)
+		mac.Write([]byte(name))
+		return mac.Sum(nil)
+	}
+	storedKey := sha256.Sum256(keyOf("Client Key"))
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", iterations,
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(storedKey[:]),
+		base64.StdEncoding.EncodeToString(keyOf("Server Key")))
+}
+
+func TestPasswordMatches(t *testing.T) {
+	scram := scramHash("secret", []byte("0123456789abcdef"), 4096)
+	assert.True(t, passwordMatches(scram, "secret"))
+	assert.False(t, passwordMatches(scram, "other"))
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	assert.True(t, passwordMatches(string(bcryptHash), "secret"))
+	assert.False(t, passwordMatches(string(bcryptHash), "other"))
+
+	assert.False(t, passwordMatches("", "secret"))
+	assert.False(t, passwordMatches("SCRAM-SHA-256$invalid", "secret"))
+}
@@ -0,0 +1,370 @@
+package provision
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/cockroachdb/helm-charts/pkg/database"
+)
+
+// PlanOptions controls which objects missing from the spec are removed from the cluster.
+type PlanOptions struct {
+	// Prune revokes the role memberships and database grants which are not in the spec, drops the backup
+	// schedules of databases without backup and drops the users and roles which are not in the spec.
+	Prune bool
+	// DropDatabases drops the databases which are not in the spec, along with their content.
+	DropDatabases bool
+}
+
+// Change is a statement which brings the cluster closer to the spec.
+type Change struct {
+	SQL string
+	// Display is the statement with its secrets redacted.
+	Display string
+	// Database is the database the statement is run in, for statements which only apply to the current
+	// database.
+	Database string
+}
+
+func (c Change) String() string {
+	statement := c.SQL
+	if c.Display != "" {
+		statement = c.Display
+	}
+	if c.Database != "" {
+		return fmt.Sprintf("USE %s; %s", ident(c.Database), statement)
+	}
+	return statement
+}
+
+// Roles and databases which are never changed nor pruned.
+var (
+	reservedRoles     = []string{"root", "admin", "node", "public"}
+	reservedDatabases = []string{"system", "defaultdb", "postgres"}
+)
+
+// Plan returns the statements which bring the cluster from the catalog to the spec. It returns no statement
+// once the cluster matches the spec.
+func Plan(spec Spec, catalog Catalog, opts PlanOptions) []Change {
+	var changes []Change
+
+	for _, name := range sortedKeys(spec.ClusterSettings) {
+		value := spec.ClusterSettings[name]
+		if current, ok := catalog.ClusterSettings[name]; ok && settingEqual(current, value) {
+			continue
+		}
+		changes = append(changes, change("SET CLUSTER SETTING %s = %s", name, database.QuoteLiteral(value)))
+	}
+
+	desiredRoles := map[string]bool{}
+	for _, r := range spec.Roles {
+		desiredRoles[r.Name] = true
+		changes = append(changes, planRole(r.Name, "", withDefault(r.Options, "NOLOGIN", "LOGIN"), true, catalog)...)
+	}
+	for _, u := range spec.Users {
+		desiredRoles[u.Name] = true
+		changes = append(changes, planRole(u.Name, u.Password, withDefault(u.Options, "LOGIN", "NOLOGIN"), false, catalog)...)
+	}
+	for _, r := range spec.Roles {
+		for _, member := range r.Members {
+			if !slices.Contains(catalog.Roles[member].MemberOf, r.Name) {
+				changes = append(changes, change("GRANT %s TO %s", ident(r.Name), ident(member)))
+			}
+		}
+	}
+
+	desiredDatabases := map[string]bool{}
+	desiredSchedules := map[string]bool{}
+	for _, d := range spec.Databases {
+		desiredDatabases[d.Name] = true
+		live, exists := catalog.Databases[d.Name]
+		if !exists {
+			changes = append(changes, change("CREATE DATABASE IF NOT EXISTS %s", strings.Join(append([]string{ident(d.Name)}, d.Options...), " ")))
+		}
+		changes = append(changes, planGrants(d, live, opts.Prune)...)
+
+		if d.Backup != nil {
+			label := scheduleLabel(d.Name)
+			desiredSchedules[label] = true
+			changes = append(changes, planBackupSchedule(d.Name, *d.Backup, catalog.Schedules[label])...)
+		}
+	}
+
+	if opts.Prune {
+		for _, r := range spec.Roles {
+			for _, member := range sortedKeys(catalog.Roles) {
+				if member != "root" && slices.Contains(catalog.Roles[member].MemberOf, r.Name) && !slices.Contains(r.Members, member) {
+					changes = append(changes, change("REVOKE %s FROM %s", ident(r.Name), ident(member)))
+				}
+			}
+		}
+		for _, label := range sortedKeys(catalog.Schedules) {
+			if !desiredSchedules[label] {
+				changes = append(changes, dropSchedules(catalog.Schedules[label])...)
+			}
+		}
+	}
+	var keptDatabases []string
+	for _, name := range sortedKeys(catalog.Databases) {
+		if opts.DropDatabases && !desiredDatabases[name] && !slices.Contains(reservedDatabases, name) {
+			changes = append(changes, change("DROP DATABASE %s CASCADE", ident(name)))
+			continue
+		}
+		keptDatabases = append(keptDatabases, name)
+	}
+	if opts.Prune {
+		for _, name := range sortedKeys(catalog.Roles) {
+			if !desiredRoles[name] && !slices.Contains(reservedRoles, name) {
+				changes = append(changes, planDropRole(name, catalog, desiredDatabases, keptDatabases)...)
+			}
+		}
+	}
+	return changes
+}
+
+// planDropRole drops a user or a role which is not in the spec. A role can't be dropped while it is granted
+// privileges or owns objects: its grants on the databases outside the spec are revoked, as planGrants only
+// revokes the grants on the databases of the spec. Its objects are then reassigned to root, and its remaining
+// privileges and default privileges dropped, in every database which is kept.
+func planDropRole(name string, catalog Catalog, desiredDatabases map[string]bool, keptDatabases []string) []Change {
+	var changes []Change
+	for _, db := range keptDatabases {
+		if _, granted := catalog.Databases[db].Grants[name]; granted && !desiredDatabases[db] {
+			changes = append(changes, change("REVOKE ALL ON DATABASE %s FROM %s", ident(db), ident(name)))
+		}
+	}
+	for _, db := range keptDatabases {
+		// Users can't own objects, nor be granted privileges, in the system database.
+		if db == "system" {
+			continue
+		}
+		changes = append(changes,
+			Change{SQL: fmt.Sprintf("REASSIGN OWNED BY %s TO root", ident(name)), Database: db},
+			Change{SQL: fmt.Sprintf("DROP OWNED BY %s", ident(name)), Database: db},
+		)
+	}
+	return append(changes, change("DROP ROLE %s", ident(name)))
+}
+
+// planRole creates a user or a role, or aligns the options and the password of an existing one.
+func planRole(name, password string, options []string, isRole bool, catalog Catalog) []Change {
+	kind := "USER"
+	if isRole {
+		kind = "ROLE"
+	}
+
+	live, exists := catalog.Roles[name]
+	if !exists {
+		statement := fmt.Sprintf("CREATE %s IF NOT EXISTS %s", kind, ident(name))
+		if isRole {
+			return []Change{{SQL: strings.Join(append([]string{statement, "WITH"}, options...), " ")}}
+		}
+		// Users are created with a null password, as the init job did.
+		secret, redacted := "NULL", "NULL"
+		if password != "" {
+			secret, redacted = database.QuoteLiteral(password), "'*****'"
+		}
+		return []Change{{
+			SQL:     strings.Join(append([]string{statement, "WITH PASSWORD", secret}, options...), " "),
+			Display: strings.Join(append([]string{statement, "WITH PASSWORD", redacted}, options...), " "),
+		}}
+	}
+
+	var changes []Change
+	var missing []string
+	for _, option := range options {
+		if !optionSatisfied(live.Options, option) {
+			missing = append(missing, option)
+		}
+	}
+	if len(missing) > 0 {
+		changes = append(changes, change("ALTER %s %s WITH %s", kind, ident(name), strings.Join(missing, " ")))
+	}
+	if password != "" && !passwordMatches(live.HashedPassword, password) {
+		changes = append(changes, Change{
+			SQL:     fmt.Sprintf("ALTER USER %s WITH PASSWORD %s", ident(name), database.QuoteLiteral(password)),
+			Display: fmt.Sprintf("ALTER USER %s WITH PASSWORD '*****'", ident(name)),
+		})
+	}
+	return changes
+}
+
+// optionSatisfied reports whether a role option of the spec is already set. Options with a value, such as
+// VALID UNTIL '2030-01-01', are satisfied by a stored value starting with the value of the spec, as timestamps
+// are stored with their time and time zone.
+func optionSatisfied(live map[string]string, option string) bool {
+	option = strings.ToUpper(strings.TrimSpace(option))
+	if key, value, ok := strings.Cut(option, "'"); ok {
+		key = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(key), "="))
+		current, set := live[key]
+		return set && strings.HasPrefix(strings.ToUpper(current), strings.TrimSuffix(value, "'"))
+	}
+
+	_, noLogin := live["NOLOGIN"]
+	switch {
+	case option == "LOGIN":
+		return !noLogin
+	case option == "NOLOGIN":
+		return noLogin
+	case strings.HasPrefix(option, "NO"):
+		_, set := live[strings.TrimPrefix(option, "NO")]
+		return !set
+	default:
+		_, set := live[option]
+		return set
+	}
+}
+
+// planGrants grants ALL on the database to its owners. Grants to other roles are revoked when pruning. The grant
+// option of the reserved roles, such as root, is never revoked.
+func planGrants(d Database, live CatalogDatabase, prune bool) []Change {
+	desired := map[string]bool{}
+	for _, owner := range d.Owners {
+		desired[owner] = false
+	}
+	for _, owner := range d.OwnersWithGrantOption {
+		desired[owner] = true
+	}
+
+	var changes []Change
+	for _, grantee := range sortedKeys(desired) {
+		withGrantOption := desired[grantee]
+		all := slices.IndexFunc(live.Grants[grantee], func(g Grant) bool { return g.Privilege == "ALL" })
+		switch {
+		case all < 0 && withGrantOption:
+			changes = append(changes, change("GRANT ALL ON DATABASE %s TO %s WITH GRANT OPTION", ident(d.Name), ident(grantee)))
+		case all < 0:
+			changes = append(changes, change("GRANT ALL ON DATABASE %s TO %s", ident(d.Name), ident(grantee)))
+		case withGrantOption && !live.Grants[grantee][all].GrantOption:
+			changes = append(changes, change("GRANT ALL ON DATABASE %s TO %s WITH GRANT OPTION", ident(d.Name), ident(grantee)))
+		case !withGrantOption && live.Grants[grantee][all].GrantOption && !slices.Contains(reservedRoles, grantee):
+			changes = append(changes, change("REVOKE GRANT OPTION FOR ALL ON DATABASE %s FROM %s", ident(d.Name), ident(grantee)))
+		}
+	}
+
+	if prune {
+		for _, grantee := range sortedKeys(live.Grants) {
+			if _, ok := desired[grantee]; !ok && !slices.Contains(reservedRoles, grantee) {
+				changes = append(changes, change("REVOKE ALL ON DATABASE %s FROM %s", ident(d.Name), ident(grantee)))
+			}
+		}
+	}
+	return changes
+}
+
+// PlanSchedules returns the statements which bring the backup schedules of the databases to the spec, leaving
+// their users, grants and the databases themselves unchanged. Prune drops the schedules of the databases
+// without backup.
+func PlanSchedules(spec Spec, schedules map[string][]CatalogSchedule, prune bool) []Change {
+	var changes []Change
+	desired := map[string]bool{}
+	for _, d := range spec.Databases {
+		if d.Backup != nil {
+			label := scheduleLabel(d.Name)
+			desired[label] = true
+			changes = append(changes, planBackupSchedule(d.Name, *d.Backup, schedules[label])...)
+		}
+	}
+	if prune {
+		for _, label := range sortedKeys(schedules) {
+			if !desired[label] {
+				changes = append(changes, dropSchedules(schedules[label])...)
+			}
+		}
+	}
+	return changes
+}
+
+// planBackupSchedule creates the backup schedule of a database, or re-creates it if it doesn't match the spec.
+// The schedule options only apply to the first run, so they are not compared.
+func planBackupSchedule(dbName string, backup Backup, live []CatalogSchedule) []Change {
+	if len(live) > 0 && scheduleMatches(backup, live) {
+		return nil
+	}
+
+	statement := fmt.Sprintf("CREATE SCHEDULE IF NOT EXISTS %s FOR BACKUP DATABASE %s INTO %s",
+		database.QuoteLiteral(scheduleLabel(dbName)), ident(dbName), database.QuoteLiteral(backup.Into))
+	if len(backup.Options) > 0 {
+		statement += " WITH " + strings.Join(backup.Options, ", ")
+	}
+	statement += " RECURRING " + database.QuoteLiteral(backup.Recurring)
+	if backup.FullBackup != "" {
+		statement += " FULL BACKUP " + database.QuoteLiteral(backup.FullBackup)
+	} else {
+		statement += " FULL BACKUP ALWAYS"
+	}
+	if backup.Schedule != nil && len(backup.Schedule.Options) > 0 {
+		statement += " WITH SCHEDULE OPTIONS " + strings.Join(backup.Schedule.Options, ", ")
+	}
+
+	return append(dropSchedules(live), Change{SQL: statement})
+}
+
+// scheduleMatches reports whether the schedules back up into the destination of the spec, with its options
+// and recurrences. A backup with a separate full backup recurrence is made of a full and an incremental
+// schedule.
+func scheduleMatches(backup Backup, live []CatalogSchedule) bool {
+	recurrences := map[bool]string{false: backup.Recurring}
+	if backup.FullBackup != "" {
+		recurrences = map[bool]string{false: backup.FullBackup, true: backup.Recurring}
+	}
+	if len(live) != len(recurrences) {
+		return false
+	}
+
+	// The credentials in the query of the destination are redacted in the statement.
+	destination, _, _ := strings.Cut(backup.Into, "?")
+	for _, s := range live {
+		recurrence, ok := recurrences[s.Incremental]
+		if !ok || recurrence != s.Recurrence || !strings.Contains(s.Statement, destination) {
+			return false
+		}
+		for _, option := range backup.Options {
+			key, _, _ := strings.Cut(option, "=")
+			if !strings.Contains(strings.ToLower(s.Statement), strings.ToLower(strings.TrimSpace(key))) {
+				return false
+			}
+		}
+		delete(recurrences, s.Incremental)
+	}
+	return true
+}
+
+func dropSchedules(schedules []CatalogSchedule) []Change {
+	var changes []Change
+	for _, s := range schedules {
+		changes = append(changes, change("DROP SCHEDULE %d", s.ID))
+	}
+	return changes
+}
+
+// withDefault adds the given option, unless its opposite is set.
+func withDefault(options []string, option, opposite string) []string {
+	for _, o := range options {
+		if o := strings.ToUpper(strings.TrimSpace(o)); o == option || o == opposite {
+			return options
+		}
+	}
+	return append([]string{option}, options...)
+}
+
+func change(format string, args ...interface{}) Change {
+	return Change{SQL: fmt.Sprintf(format, args...)}
+}
+
+func ident(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
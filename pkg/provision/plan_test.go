@@ -0,0 +1,288 @@
+package provision
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testSpec() Spec {
+	return Spec{
+		ClusterSettings: map[string]string{"cluster.organization": "FooCorp"},
+		Users: []User{
+			{Name: "app", Password: "secret", Options: []string{"CREATEROLE"}},
+			{Name: "reader"},
+		},
+		Roles: []Role{{Name: "readers", Members: []string{"reader"}}},
+		Databases: []Database{{
+			Name:                  "appdb",
+			Options:               []string{"encoding='utf-8'"},
+			Owners:                []string{"app", "root"},
+			OwnersWithGrantOption: []string{"readers"},
+			Backup: &Backup{
+				Into:       "s3://backups/appdb?AUTH=implicit",
+				Options:    []string{"revision_history"},
+				Recurring:  "@hourly",
+				FullBackup: "@daily",
+				Schedule:   &BackupSchedule{Options: []string{"first_run = 'now'"}},
+			},
+		}},
+	}
+}
+
+// provisionedCatalog returns the catalog of a cluster which matches testSpec.
+func provisionedCatalog(t *testing.T) Catalog {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	return Catalog{
+		ClusterSettings: map[string]string{"cluster.organization": "FooCorp"},
+		Roles: map[string]CatalogRole{
+			"root":    {HashedPassword: "", Options: map[string]string{}, MemberOf: []string{"admin"}},
+			"admin":   {IsRole: true, Options: map[string]string{}},
+			"app":     {HashedPassword: string(hash), Options: map[string]string{"CREATEROLE": ""}},
+			"reader":  {Options: map[string]string{}, MemberOf: []string{"readers"}},
+			"readers": {IsRole: true, Options: map[string]string{"NOLOGIN": ""}},
+		},
+		Databases: map[string]CatalogDatabase{
+			"system":    {},
+			"defaultdb": {},
+			"appdb": {Grants: map[string][]Grant{
+				"admin":   {{Privilege: "ALL", GrantOption: true}},
+				"root":    {{Privilege: "ALL", GrantOption: true}},
+				"public":  {{Privilege: "CONNECT"}},
+				"app":     {{Privilege: "ALL"}},
+				"readers": {{Privilege: "ALL", GrantOption: true}},
+			}},
+		},
+		Schedules: map[string][]CatalogSchedule{
+			"appdb_scheduled_backup": {
+				{ID: 1, Recurrence: "@daily", Statement: "BACKUP DATABASE appdb INTO 's3://backups/appdb?AUTH=implicit' WITH revision_history = true, detached"},
+				{ID: 2, Recurrence: "@hourly", Incremental: true, Statement: "BACKUP DATABASE appdb INTO LATEST IN 's3://backups/appdb?AUTH=implicit' WITH revision_history = true, detached"},
+			},
+		},
+	}
+}
+
+func statements(changes []Change) []string {
+	var sql []string
+	for _, c := range changes {
+		sql = append(sql, c.String())
+	}
+	return sql
+}
+
+func TestPlanEmptyCluster(t *testing.T) {
+	catalog := Catalog{
+		ClusterSettings: map[string]string{"cluster.organization": ""},
+		Roles:           map[string]CatalogRole{"root": {Options: map[string]string{}}},
+		Databases:       map[string]CatalogDatabase{"system": {}},
+	}
+
+	changes := Plan(testSpec(), catalog, PlanOptions{})
+	assert.Equal(t, []string{
+		`SET CLUSTER SETTING cluster.organization = 'FooCorp'`,
+		`CREATE ROLE IF NOT EXISTS "readers" WITH NOLOGIN`,
+		`CREATE USER IF NOT EXISTS "app" WITH PASSWORD '*****' LOGIN CREATEROLE`,
+		`CREATE USER IF NOT EXISTS "reader" WITH PASSWORD NULL LOGIN`,
+		`GRANT "readers" TO "reader"`,
+		`CREATE DATABASE IF NOT EXISTS "appdb" encoding='utf-8'`,
+		`GRANT ALL ON DATABASE "appdb" TO "app"`,
+		`GRANT ALL ON DATABASE "appdb" TO "readers" WITH GRANT OPTION`,
+		`GRANT ALL ON DATABASE "appdb" TO "root"`,
+		`CREATE SCHEDULE IF NOT EXISTS 'appdb_scheduled_backup' FOR BACKUP DATABASE "appdb" INTO 's3://backups/appdb?AUTH=implicit' ` +
+			`WITH revision_history RECURRING '@hourly' FULL BACKUP '@daily' WITH SCHEDULE OPTIONS first_run = 'now'`,
+	}, statements(changes))
+	assert.Contains(t, changes[2].SQL, "PASSWORD 'secret'")
+}
+
+func TestPlanProvisionedCluster(t *testing.T) {
+	// A provisioned cluster converges, even with pruning.
+	assert.Empty(t, Plan(testSpec(), provisionedCatalog(t), PlanOptions{Prune: true, DropDatabases: true}))
+}
+
+func TestPlanChanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		update   func(spec *Spec, catalog *Catalog)
+		opts     PlanOptions
+		expected []string
+	}{
+		{
+			name: "cluster setting changed",
+			update: func(spec *Spec, catalog *Catalog) {
+				spec.ClusterSettings["cluster.organization"] = "Foo's Corp"
+			},
+			expected: []string{`SET CLUSTER SETTING cluster.organization = 'Foo''s Corp'`},
+		},
+		{
+			name: "cluster setting shown as an interval",
+			update: func(spec *Spec, catalog *Catalog) {
+				spec.ClusterSettings["server.time_until_store_dead"] = "5m"
+				catalog.ClusterSettings["server.time_until_store_dead"] = "00:05:00"
+			},
+			expected: nil,
+		},
+		{
+			name: "password and options changed",
+			update: func(spec *Spec, catalog *Catalog) {
+				spec.Users[0].Password = "rotated"
+				spec.Users[0].Options = []string{"NOCREATEROLE", "VALID UNTIL '2030-01-01'"}
+			},
+			expected: []string{
+				`ALTER USER "app" WITH NOCREATEROLE VALID UNTIL '2030-01-01'`,
+				`ALTER USER "app" WITH PASSWORD '*****'`,
+			},
+		},
+		{
+			name: "role which should log in",
+			update: func(spec *Spec, catalog *Catalog) {
+				catalog.Roles["app"].Options["NOLOGIN"] = ""
+			},
+			expected: []string{`ALTER USER "app" WITH LOGIN`},
+		},
+		{
+			name: "grant option",
+			update: func(spec *Spec, catalog *Catalog) {
+				spec.Databases[0].OwnersWithGrantOption = nil
+				spec.Databases[0].Owners = []string{"app", "readers", "root"}
+			},
+			expected: []string{`REVOKE GRANT OPTION FOR ALL ON DATABASE "appdb" FROM "readers"`},
+		},
+		{
+			name: "backup schedule changed",
+			update: func(spec *Spec, catalog *Catalog) {
+				spec.Databases[0].Backup.FullBackup = ""
+				spec.Databases[0].Backup.Options = nil
+			},
+			expected: []string{
+				`DROP SCHEDULE 1`,
+				`DROP SCHEDULE 2`,
+				`CREATE SCHEDULE IF NOT EXISTS 'appdb_scheduled_backup' FOR BACKUP DATABASE "appdb" INTO 's3://backups/appdb?AUTH=implicit' ` +
+					`RECURRING '@hourly' FULL BACKUP ALWAYS WITH SCHEDULE OPTIONS first_run = 'now'`,
+			},
+		},
+		{
+			name: "objects missing from the spec are kept without pruning",
+			update: func(spec *Spec, catalog *Catalog) {
+				spec.Users = spec.Users[:1]
+				spec.Roles[0].Members = nil
+				spec.Databases[0].OwnersWithGrantOption = nil
+				spec.Databases[0].Backup = nil
+				catalog.Databases["olddb"] = CatalogDatabase{}
+			},
+			expected: nil,
+		},
+		{
+			name: "prune",
+			update: func(spec *Spec, catalog *Catalog) {
+				spec.Users = spec.Users[:1]
+				spec.Roles[0].Members = nil
+				spec.Databases[0].OwnersWithGrantOption = nil
+				spec.Databases[0].Backup = nil
+				catalog.Databases["olddb"] = CatalogDatabase{}
+			},
+			opts: PlanOptions{Prune: true},
+			expected: []string{
+				`REVOKE ALL ON DATABASE "appdb" FROM "readers"`,
+				`REVOKE "readers" FROM "reader"`,
+				`DROP SCHEDULE 1`,
+				`DROP SCHEDULE 2`,
+				`USE "appdb"; REASSIGN OWNED BY "reader" TO root`,
+				`USE "appdb"; DROP OWNED BY "reader"`,
+				`USE "defaultdb"; REASSIGN OWNED BY "reader" TO root`,
+				`USE "defaultdb"; DROP OWNED BY "reader"`,
+				`USE "olddb"; REASSIGN OWNED BY "reader" TO root`,
+				`USE "olddb"; DROP OWNED BY "reader"`,
+				`DROP ROLE "reader"`,
+			},
+		},
+		{
+			name: "prune role granted on a database outside the spec",
+			update: func(spec *Spec, catalog *Catalog) {
+				spec.Users = spec.Users[:1]
+				spec.Roles[0].Members = nil
+				catalog.Databases["olddb"] = CatalogDatabase{Grants: map[string][]Grant{"reader": {{Privilege: "ALL"}}}}
+			},
+			opts: PlanOptions{Prune: true},
+			expected: []string{
+				`REVOKE "readers" FROM "reader"`,
+				`REVOKE ALL ON DATABASE "olddb" FROM "reader"`,
+				`USE "appdb"; REASSIGN OWNED BY "reader" TO root`,
+				`USE "appdb"; DROP OWNED BY "reader"`,
+				`USE "defaultdb"; REASSIGN OWNED BY "reader" TO root`,
+				`USE "defaultdb"; DROP OWNED BY "reader"`,
+				`USE "olddb"; REASSIGN OWNED BY "reader" TO root`,
+				`USE "olddb"; DROP OWNED BY "reader"`,
+				`DROP ROLE "reader"`,
+			},
+		},
+		{
+			name: "prune role granted on a dropped database",
+			update: func(spec *Spec, catalog *Catalog) {
+				spec.Users = spec.Users[:1]
+				spec.Roles[0].Members = nil
+				catalog.Databases["olddb"] = CatalogDatabase{Grants: map[string][]Grant{"reader": {{Privilege: "ALL"}}}}
+			},
+			opts: PlanOptions{Prune: true, DropDatabases: true},
+			expected: []string{
+				`REVOKE "readers" FROM "reader"`,
+				`DROP DATABASE "olddb" CASCADE`,
+				`USE "appdb"; REASSIGN OWNED BY "reader" TO root`,
+				`USE "appdb"; DROP OWNED BY "reader"`,
+				`USE "defaultdb"; REASSIGN OWNED BY "reader" TO root`,
+				`USE "defaultdb"; DROP OWNED BY "reader"`,
+				`DROP ROLE "reader"`,
+			},
+		},
+		{
+			name: "drop databases",
+			update: func(spec *Spec, catalog *Catalog) {
+				catalog.Databases["olddb"] = CatalogDatabase{}
+			},
+			opts:     PlanOptions{DropDatabases: true},
+			expected: []string{`DROP DATABASE "olddb" CASCADE`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, catalog := testSpec(), provisionedCatalog(t)
+			tt.update(&spec, &catalog)
+			assert.Equal(t, tt.expected, statements(Plan(spec, catalog, tt.opts)))
+		})
+	}
+}
+
+func TestOptionSatisfied(t *testing.T) {
+	live := map[string]string{"CREATEROLE": "", "VALID UNTIL": "2030-01-01 00:00:00+00:00"}
+
+	assert.True(t, optionSatisfied(live, "createrole"))
+	assert.True(t, optionSatisfied(live, "LOGIN"))
+	assert.True(t, optionSatisfied(live, "NOCREATELOGIN"))
+	assert.True(t, optionSatisfied(live, "VALID UNTIL '2030-01-01'"))
+	assert.False(t, optionSatisfied(live, "VALID UNTIL '2031-01-01'"))
+	assert.False(t, optionSatisfied(live, "NOCREATEROLE"))
+	assert.False(t, optionSatisfied(live, "NOLOGIN"))
+	assert.False(t, optionSatisfied(live, "CREATEDB"))
+}
+
+func TestPlanSchedules(t *testing.T) {
+	catalog := provisionedCatalog(t)
+	assert.Empty(t, PlanSchedules(testSpec(), catalog.Schedules, true))
+
+	spec := testSpec()
+	spec.Databases[0].Backup.Recurring = "@weekly"
+	spec.Databases = append(spec.Databases, Database{Name: "other"})
+	catalog.Schedules["old_scheduled_backup"] = []CatalogSchedule{{ID: 3, Recurrence: "@daily"}}
+
+	assert.Equal(t, []string{
+		`DROP SCHEDULE 1`,
+		`DROP SCHEDULE 2`,
+		`CREATE SCHEDULE IF NOT EXISTS 'appdb_scheduled_backup' FOR BACKUP DATABASE "appdb" INTO 's3://backups/appdb?AUTH=implicit' ` +
+			`WITH revision_history RECURRING '@weekly' FULL BACKUP '@daily' WITH SCHEDULE OPTIONS first_run = 'now'`,
+	}, statements(PlanSchedules(spec, catalog.Schedules, false)))
+	assert.Equal(t, []string{`DROP SCHEDULE 3`}, statements(PlanSchedules(testSpec(), catalog.Schedules, true)))
+}
@@ -0,0 +1,94 @@
+package provision
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/database"
+)
+
+// Options are the connection and pruning options of the provisioning.
+type Options struct {
+	database.StatefulSetConnection
+	// DryRun prints the changes without applying them.
+	DryRun bool
+	PlanOptions
+}
+
+// Provisioner converges the users, roles, grants, databases, cluster settings and backup schedules of a
+// cluster to a spec.
+type Provisioner struct {
+	db   *sql.DB
+	opts Options
+	out  io.Writer
+}
+
+// NewProvisioner connects to the ready pods of the StatefulSet as the root user.
+func NewProvisioner(ctx context.Context, kubeconfig string, opts Options) (*Provisioner, error) {
+	_, _, db, err := opts.Connect(ctx, kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Provisioner{db: db, opts: opts, out: os.Stdout}, nil
+}
+
+// Run reads the live catalog of the cluster, and applies the changes which bring it to the spec. Running it
+// again once the cluster matches the spec applies no change.
+func (p *Provisioner) Run(ctx context.Context, spec Spec) error {
+	catalog, err := ReadCatalog(ctx, p.db, spec)
+	if err != nil {
+		return errors.Wrap(err, "reading the catalog")
+	}
+
+	changes := Plan(spec, catalog, p.opts.PlanOptions)
+	if len(changes) == 0 {
+		fmt.Fprintln(p.out, "✅ The cluster already matches the provisioning spec.")
+		return nil
+	}
+	if p.opts.DryRun {
+		fmt.Fprintf(p.out, "%d changes would be applied:\n", len(changes))
+		for _, c := range changes {
+			fmt.Fprintf(p.out, "  %s;\n", c)
+		}
+		return nil
+	}
+
+	for _, c := range changes {
+		fmt.Fprintf(p.out, "Applying %s;\n", c)
+		if err := p.apply(ctx, c); err != nil {
+			return errors.Wrapf(err, "applying %s", c)
+		}
+	}
+	fmt.Fprintf(p.out, "✅ Applied %d changes.\n", len(changes))
+	return nil
+}
+
+// apply runs the statement of the change, on a connection using its database if it has one.
+func (p *Provisioner) apply(ctx context.Context, c Change) error {
+	if c.Database == "" {
+		_, err := p.db.ExecContext(ctx, c.SQL)
+		return err
+	}
+
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// The connection returns to the pool, where the other statements expect the default database.
+	defer func() { _, _ = conn.ExecContext(ctx, "RESET database") }()
+	if _, err := conn.ExecContext(ctx, "USE "+ident(c.Database)); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, c.SQL)
+	return err
+}
+
+// Close closes the connection to the cluster.
+func (p *Provisioner) Close() error {
+	return p.db.Close()
+}
@@ -0,0 +1,75 @@
+package provision
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// settingEqual reports whether the current value of a cluster setting, as shown by SHOW CLUSTER SETTING, is the
+// value of the spec. Durations are shown as intervals, such as 01:00:00 for 1h, and byte sizes in IEC units, such
+// as 64 MiB for 67108864, so they are compared by value.
+func settingEqual(current, value string) bool {
+	if strings.EqualFold(strings.TrimSpace(current), strings.TrimSpace(value)) {
+		return true
+	}
+	if c, ok := parseSettingDuration(current); ok {
+		if v, ok := parseSettingDuration(value); ok {
+			return c == v
+		}
+	}
+	if c, ok := parseByteSize(current); ok {
+		if v, ok := parseByteSize(value); ok {
+			return c == v
+		}
+	}
+	return false
+}
+
+// interval matches the intervals shown for duration settings, such as 01:00:00, 00:00:00.5 or 2 days 03:00:00.
+var interval = regexp.MustCompile(`^(?:(\d+) days? ?)?(?:(\d+):(\d{2}):(\d{2}(?:\.\d+)?))?$`)
+
+// parseSettingDuration parses a Go duration, such as 1h30m, or an interval.
+func parseSettingDuration(s string) (time.Duration, bool) {
+	s = strings.TrimSpace(s)
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, true
+	}
+	m := interval.FindStringSubmatch(s)
+	if s == "" || m == nil {
+		return 0, false
+	}
+	days, _ := strconv.Atoi(m[1])
+	hours, _ := strconv.Atoi(m[2])
+	minutes, _ := strconv.Atoi(m[3])
+	seconds, _ := strconv.ParseFloat(m[4], 64)
+	return time.Duration(days)*24*time.Hour + time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+		time.Duration(seconds*float64(time.Second)), true
+}
+
+// byteSize matches the byte sizes of settings, such as 64 MiB, 64MiB, 1.5 GB or 1024.
+var byteSize = regexp.MustCompile(`^(\d+(?:\.\d+)?) ?([a-zA-Z]*)$`)
+
+var byteUnits = map[string]float64{
+	"": 1, "b": 1,
+	"kb": 1e3, "mb": 1e6, "gb": 1e9, "tb": 1e12, "pb": 1e15, "eb": 1e18,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40, "pib": 1 << 50, "eib": 1 << 60,
+}
+
+// parseByteSize parses a byte size in SI or IEC units.
+func parseByteSize(s string) (float64, bool) {
+	m := byteSize.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, false
+	}
+	unit, ok := byteUnits[strings.ToLower(m[2])]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return n * unit, true
+}
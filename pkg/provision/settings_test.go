@@ -0,0 +1,31 @@
+package provision
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettingEqual(t *testing.T) {
+	for _, tt := range []struct {
+		current, value string
+		expected       bool
+	}{
+		{"FooCorp", "FooCorp", true},
+		{"FooCorp", "BarCorp", false},
+		{"true", "TRUE", true},
+		{"01:00:00", "1h", true},
+		{"00:05:00", "5m0s", true},
+		{"00:00:00.5", "500ms", true},
+		{"2 days 03:00:00", "51h", true},
+		{"01:00:00", "2h", false},
+		{"64 MiB", "64MiB", true},
+		{"64 MiB", "67108864", true},
+		{"1.0 GiB", "1024 MiB", true},
+		{"64 MiB", "64MB", false},
+		{"0.5", "0.50", true},
+		{"5", "6", false},
+	} {
+		assert.Equal(t, tt.expected, settingEqual(tt.current, tt.value), "%q = %q", tt.current, tt.value)
+	}
+}
@@ -0,0 +1,210 @@
+package provision
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// Spec is the desired provisioning state of a cluster. It has the shape of the init.provisioning values of the
+// Helm chart, with roles added.
+type Spec struct {
+	// ClusterSettings are the cluster settings to set. Values may be quoted with single quotes, as in the
+	// values of the Helm chart.
+	ClusterSettings map[string]string `json:"clusterSettings,omitempty"`
+	Users           []User            `json:"users,omitempty"`
+	Roles           []Role            `json:"roles,omitempty"`
+	Databases       []Database        `json:"databases,omitempty"`
+}
+
+// User is a SQL user which can log in.
+type User struct {
+	Name string `json:"name"`
+	// Password is the password of the user. The user is created without password if it is empty.
+	Password string `json:"password,omitempty"`
+	// Options are the role options of the user, such as CREATEROLE or VALID UNTIL '2030-01-01'.
+	Options []string `json:"options,omitempty"`
+}
+
+// Role is a SQL role, which can't log in, and its members.
+type Role struct {
+	Name    string   `json:"name"`
+	Options []string `json:"options,omitempty"`
+	Members []string `json:"members,omitempty"`
+}
+
+// Database is a database, the users granted ALL on it and its backup schedule.
+type Database struct {
+	Name string `json:"name"`
+	// Options are the options the database is created with. They are not applied to existing databases.
+	Options               []string `json:"options,omitempty"`
+	Owners                []string `json:"owners,omitempty"`
+	OwnersWithGrantOption []string `json:"owners_with_grant_option,omitempty"`
+	Backup                *Backup  `json:"backup,omitempty"`
+}
+
+// Backup is the backup schedule of a database.
+type Backup struct {
+	Into    string   `json:"into"`
+	Options []string `json:"options,omitempty"`
+	// Recurring is the recurrence of the incremental backups, or of the full backups if FullBackup is empty.
+	Recurring  string          `json:"recurring"`
+	FullBackup string          `json:"fullBackup,omitempty"`
+	Schedule   *BackupSchedule `json:"schedule,omitempty"`
+}
+
+// BackupSchedule holds the options of a backup schedule.
+type BackupSchedule struct {
+	// Options are only applied when the schedule is created.
+	Options []string `json:"options,omitempty"`
+}
+
+// values is a values file of the Helm chart, of which only init.provisioning is read.
+type values struct {
+	Init *struct {
+		Provisioning *Spec `json:"provisioning"`
+	} `json:"init"`
+}
+
+// LoadSpec reads the provisioning spec from a YAML file. The file either holds the spec itself, or is a values
+// file of the Helm chart, in which case init.provisioning is read.
+//
+// Passwords and cluster settings left empty are read from the environment variables the init job of the Helm
+// chart sets from the <release>-init secret: <user>_PASSWORD and <setting with underscores>_CLUSTER_SETTING.
+func LoadSpec(path string) (Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Spec{}, errors.Wrapf(err, "reading provisioning spec %s", path)
+	}
+
+	var spec Spec
+	var v values
+	if err := yaml.Unmarshal(data, &v); err == nil && v.Init != nil && v.Init.Provisioning != nil {
+		spec = *v.Init.Provisioning
+	} else if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		return Spec{}, errors.Wrapf(err, "decoding provisioning spec %s", path)
+	}
+
+	spec.readEnv(os.LookupEnv)
+	spec.Normalize()
+	return spec, spec.Validate()
+}
+
+// readEnv fills the empty passwords and cluster settings from the environment.
+func (s *Spec) readEnv(lookupEnv func(string) (string, bool)) {
+	for i, u := range s.Users {
+		if u.Password != "" {
+			continue
+		}
+		if password, ok := lookupEnv(u.Name + "_PASSWORD"); ok {
+			s.Users[i].Password = password
+		}
+	}
+	for name, value := range s.ClusterSettings {
+		if value != "" {
+			continue
+		}
+		if value, ok := lookupEnv(strings.ReplaceAll(name, ".", "_") + "_CLUSTER_SETTING"); ok {
+			s.ClusterSettings[name] = value
+		}
+	}
+}
+
+// Normalize folds the names to lower case, as the unquoted identifiers of the init job were, and unquotes the
+// cluster setting values.
+func (s *Spec) Normalize() {
+	for i := range s.Users {
+		s.Users[i].Name = strings.ToLower(s.Users[i].Name)
+	}
+	for i := range s.Roles {
+		s.Roles[i].Name = strings.ToLower(s.Roles[i].Name)
+		s.Roles[i].Members = lowerAll(s.Roles[i].Members)
+	}
+	for i := range s.Databases {
+		d := &s.Databases[i]
+		d.Name = strings.ToLower(d.Name)
+		d.Owners = lowerAll(d.Owners)
+		d.OwnersWithGrantOption = lowerAll(d.OwnersWithGrantOption)
+	}
+	for name, value := range s.ClusterSettings {
+		s.ClusterSettings[name] = unquote(strings.TrimSpace(value))
+	}
+}
+
+// Validate returns an error if a name is missing or defined twice, if a backup lacks its destination or
+// recurrence, or if a cluster setting is invalid.
+func (s Spec) Validate() error {
+	seen := map[string]string{}
+	add := func(kind, name string) error {
+		if name == "" {
+			return errors.Newf("%s without name", kind)
+		}
+		if other, ok := seen[name]; ok {
+			return errors.Newf("%s %s is also defined as %s", kind, name, other)
+		}
+		seen[name] = kind
+		return nil
+	}
+	for _, u := range s.Users {
+		if err := add("user", u.Name); err != nil {
+			return err
+		}
+	}
+	for _, r := range s.Roles {
+		if err := add("role", r.Name); err != nil {
+			return err
+		}
+	}
+
+	databases := map[string]bool{}
+	for _, d := range s.Databases {
+		if d.Name == "" {
+			return errors.New("database without name")
+		}
+		if databases[d.Name] {
+			return errors.Newf("database %s is defined twice", d.Name)
+		}
+		databases[d.Name] = true
+		if b := d.Backup; b != nil && (b.Into == "" || b.Recurring == "") {
+			return errors.Newf("backup of database %s requires into and recurring", d.Name)
+		}
+	}
+	for name, value := range s.ClusterSettings {
+		if !clusterSettingName.MatchString(name) {
+			return errors.Newf("invalid cluster setting name %q", name)
+		}
+		if value == "" {
+			return errors.Newf("cluster setting %s has no value", name)
+		}
+	}
+	return nil
+}
+
+// scheduleLabel is the label of the backup schedule of a database, as created by the init job.
+func scheduleLabel(database string) string {
+	return fmt.Sprintf("%s%s", database, scheduleLabelSuffix)
+}
+
+const scheduleLabelSuffix = "_scheduled_backup"
+
+// clusterSettingName matches the names of cluster settings, which are written into the statements as is.
+var clusterSettingName = regexp.MustCompile(`^[a-z0-9_]+(\.[a-z0-9_]+)*$`)
+
+func lowerAll(names []string) []string {
+	lowered := make([]string, 0, len(names))
+	for _, name := range names {
+		lowered = append(lowered, strings.ToLower(name))
+	}
+	return lowered
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return value
+}
@@ -0,0 +1,97 @@
+package provision
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSpec(t *testing.T) {
+	t.Setenv("testUser_PASSWORD", "from-secret")
+	t.Setenv("enterprise_license_CLUSTER_SETTING", "'crl-0-xxx'")
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "helm values",
+			data: `
+init:
+  provisioning:
+    enabled: true
+    clusterSettings:
+      cluster.organization: "'FooCorp - Local Testing'"
+      enterprise.license:
+    users:
+    - name: testUser
+      options: [LOGIN]
+    databases:
+    - name: testDatabase
+      owners: [testUser]
+      backup:
+        into: s3://backups
+        recurring: '@daily'
+tls:
+  enabled: true
+`,
+		},
+		{
+			name: "provisioning spec",
+			data: `
+clusterSettings:
+  cluster.organization: "'FooCorp - Local Testing'"
+  enterprise.license: ""
+users:
+- name: testUser
+  options: [LOGIN]
+databases:
+- name: testDatabase
+  owners: [testUser]
+  backup:
+    into: s3://backups
+    recurring: '@daily'
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "spec.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.data), 0644))
+
+			spec, err := LoadSpec(path)
+			require.NoError(t, err)
+			assert.Equal(t, Spec{
+				ClusterSettings: map[string]string{
+					"cluster.organization": "FooCorp - Local Testing",
+					"enterprise.license":   "crl-0-xxx",
+				},
+				Users: []User{{Name: "testuser", Password: "from-secret", Options: []string{"LOGIN"}}},
+				Databases: []Database{{
+					Name:                  "testdatabase",
+					Owners:                []string{"testuser"},
+					OwnersWithGrantOption: []string{},
+					Backup:                &Backup{Into: "s3://backups", Recurring: "@daily"},
+				}},
+			}, spec)
+		})
+	}
+}
+
+func TestSpecValidate(t *testing.T) {
+	for name, spec := range map[string]Spec{
+		"duplicate name":         {Users: []User{{Name: "app"}}, Roles: []Role{{Name: "app"}}},
+		"backup without into":    {Databases: []Database{{Name: "db", Backup: &Backup{Recurring: "@daily"}}}},
+		"invalid setting name":   {ClusterSettings: map[string]string{"x; DROP DATABASE db": "1"}},
+		"setting without value":  {ClusterSettings: map[string]string{"cluster.organization": ""}},
+		"database defined twice": {Databases: []Database{{Name: "db"}, {Name: "db"}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.Error(t, spec.Validate())
+		})
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2021 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resource
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mitchellh/hashstructure/v2"
+	"github.com/robfig/cron"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// StoreKeyData is the key of the store key in the secret, which is also the name of the key file when the
+	// secret is mounted into the cockroachdb pods.
+	StoreKeyData = "StoreKeyData"
+	// StoreKeyID is the annotation holding the hex encoded ID of the store key.
+	StoreKeyID = "store-key-id"
+)
+
+// CreateStoreKeySecret returns a StoreKeySecret struct that is used to store an encryption at rest store key via
+// a secret.
+func CreateStoreKeySecret(name string, r Resource) *StoreKeySecret {
+	return &StoreKeySecret{
+		Resource: r,
+		secret: &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+			},
+			Type: corev1.SecretTypeOpaque,
+		},
+	}
+}
+
+// LoadStoreKeySecret fetches secret from the API server
+func LoadStoreKeySecret(name string, r Resource) (*StoreKeySecret, error) {
+	s := CreateStoreKeySecret(name, r)
+
+	err := s.Fetch(s.secret)
+
+	s.secret = s.secret.DeepCopy()
+
+	if s.secret.Data == nil {
+		s.secret.Data = map[string][]byte{}
+	}
+
+	return s, err
+}
+
+type StoreKeySecret struct {
+	Resource
+
+	secret *corev1.Secret
+}
+
+// Ready checks if the secret contains a store key
+func (s *StoreKeySecret) Ready() bool {
+	return len(s.secret.Data[StoreKeyData]) > 0
+}
+
+// ValidateAnnotations validates if all the required annotations are present
+func (s *StoreKeySecret) ValidateAnnotations() bool {
+	annotations := s.secret.Annotations
+
+	for _, a := range []string{CertValidFrom, CertValidUpto, CertDuration, SecretDataHash} {
+		if _, ok := annotations[a]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsRotationRequired checks if the store key needs to be rotated, in the same way as the certificates: when the
+// key was altered, its duration changed or it expires before the next run of the cron.
+func (s *StoreKeySecret) IsRotationRequired(duration time.Duration, cronStr string) (bool, string) {
+	annotations := s.secret.Annotations
+
+	// validate secret data hash
+	hash, err := hashstructure.Hash(s.secret.Data, hashstructure.FormatV2, nil)
+	if err != nil {
+		return true, "Failed to verify secret data hash, rotating store key"
+	}
+
+	if fmt.Sprintf("%d", hash) != annotations[SecretDataHash] {
+		return true, "Secret data altered, rotating store key"
+	}
+
+	// validate duration
+	if duration.String() != annotations[CertDuration] {
+		return true, "Store key duration mismatch, rotating store key"
+	}
+
+	// validate expiry. If expiry is before the next cron, then rotate the store key
+	expiryTime, err := time.Parse(time.RFC3339, annotations[CertValidUpto])
+	if err != nil {
+		return true, "Failed to verify expiry date, rotating store key"
+	}
+
+	cronSchedule, err := cron.ParseStandard(cronStr)
+	if err != nil {
+		return true, "Failed to verify expiry date due to invalid cron, rotating store key"
+	}
+
+	if expiryTime.Before(cronSchedule.Next(time.Now())) {
+		return true, "Store key about to expire, rotating store key"
+	}
+
+	return false, ""
+}
+
+// UpdateStoreKey saves the store key in the secret, along with its annotations
+func (s *StoreKeySecret) UpdateStoreKey(key []byte, annotations map[string]string) error {
+	data := map[string][]byte{StoreKeyData: append([]byte{}, key...)}
+
+	// create hash of the new data
+	hash, err := hashstructure.Hash(data, hashstructure.FormatV2, nil)
+	if err != nil {
+		return err
+	}
+
+	newAnnotations := map[string]string{SecretDataHash: fmt.Sprintf("%d", hash)}
+	for k, v := range annotations {
+		if k != SecretDataHash {
+			newAnnotations[k] = v
+		}
+	}
+
+	_, err = s.Persist(s.secret, func() error {
+		s.secret.Data = data
+		s.secret.Annotations = newAnnotations
+
+		return nil
+	})
+
+	return err
+}
+
+func (s *StoreKeySecret) Secret() *corev1.Secret {
+	return s.secret
+}
+
+func (s *StoreKeySecret) StoreKey() []byte {
+	return s.secret.Data[StoreKeyData]
+}
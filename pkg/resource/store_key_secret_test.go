@@ -0,0 +1,74 @@
+/*
+Copyright 2021 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resource_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+	"github.com/cockroachdb/helm-charts/pkg/resource"
+	"github.com/cockroachdb/helm-charts/pkg/testutils"
+)
+
+func TestUpdateStoreKey(t *testing.T) {
+	ctx := context.TODO()
+	scheme := testutils.InitScheme(t)
+	name := "test-store-key"
+	namespace := "test-namespace"
+
+	fakeClient := testutils.NewFakeClient(scheme)
+	r := resource.NewKubeResource(ctx, fakeClient, namespace, kube.DefaultPersister)
+
+	secret, err := resource.LoadStoreKeySecret(name, r)
+	require.Error(t, err)
+	assert.False(t, secret.Ready())
+	assert.False(t, secret.ValidateAnnotations())
+
+	now := time.Now()
+	annotations := resource.GetSecretAnnotations(now.Format(time.RFC3339), now.Add(24*time.Hour).Format(time.RFC3339), (24 * time.Hour).String())
+	annotations[resource.StoreKeyID] = "abcd"
+	key := []byte("sample key")
+	require.NoError(t, secret.UpdateStoreKey(key, annotations))
+
+	secret, err = resource.LoadStoreKeySecret(name, r)
+	require.NoError(t, err)
+	assert.True(t, secret.Ready())
+	assert.True(t, secret.ValidateAnnotations())
+	assert.Equal(t, key, secret.StoreKey())
+	assert.Equal(t, "abcd", secret.Secret().Annotations[resource.StoreKeyID])
+
+	rotate, _ := secret.IsRotationRequired(24*time.Hour, "@every 1h")
+	assert.False(t, rotate, "a key valid for a day is rotated by an hourly cron")
+
+	rotate, reason := secret.IsRotationRequired(24*time.Hour, "@every 48h")
+	assert.True(t, rotate)
+	assert.Equal(t, "Store key about to expire, rotating store key", reason)
+
+	rotate, reason = secret.IsRotationRequired(48*time.Hour, "@every 1h")
+	assert.True(t, rotate)
+	assert.Equal(t, "Store key duration mismatch, rotating store key", reason)
+
+	secret.Secret().Data[resource.StoreKeyData] = []byte("altered key")
+	rotate, reason = secret.IsRotationRequired(24*time.Hour, "@every 48h")
+	assert.True(t, rotate)
+	assert.Equal(t, "Secret data altered, rotating store key", reason)
+}
@@ -0,0 +1,407 @@
+// Package scale scales the StatefulSet of a CockroachDB cluster down safely: the nodes of the removed pods are
+// decommissioned, and their replicas moved to the other nodes, before the pods are deleted.
+package scale
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/database"
+	"github.com/cockroachdb/helm-charts/pkg/database/health"
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Options are the target and the safety options of a scale-down.
+type Options struct {
+	database.StatefulSetConnection
+	// Replicas is the number of replicas the StatefulSet is scaled down to.
+	Replicas int32
+	// DeletePVCs deletes the PVCs of the removed pods once they are deleted. They hold the stores of
+	// decommissioned nodes, which can't rejoin the cluster.
+	DeletePVCs bool
+	// DryRun prints the decommission state of the nodes of the removed pods, without changing them.
+	DryRun bool
+	// DecommissionTimeout bounds the wait for the replicas of the nodes to be moved to the other nodes.
+	DecommissionTimeout time.Duration
+	// HealthTimeout bounds the wait for the nodes to be decommissioned, and for the ranges to be fully
+	// replicated.
+	HealthTimeout time.Duration
+	// PodUpdateTimeout bounds the wait for the removed pods to be deleted.
+	PodUpdateTimeout time.Duration
+}
+
+// cluster reports the health of the cluster, the replicas of its nodes and the replication factor of its zone
+// configurations.
+type cluster interface {
+	Status(ctx context.Context) (health.Status, error)
+	Replicas(ctx context.Context) (map[int32]int64, error)
+	ReplicationFactor(ctx context.Context) (int32, string, error)
+}
+
+// nodeCommands run the decommission commands of the cockroach CLI.
+type nodeCommands interface {
+	StartDecommission(ctx context.Context, podName string, nodeIDs ...int32) error
+	Decommission(ctx context.Context, podName string, nodeIDs ...int32) error
+}
+
+// NodeState is the decommission state of the node of a removed pod.
+type NodeState struct {
+	Pod string
+	// NodeID is zero if no node of the cluster runs in the pod.
+	NodeID   int32
+	Replicas int64
+	// State is empty while the node isn't decommissioned.
+	State v1alpha1.NodeDecommissionState
+}
+
+func (s NodeState) String() string {
+	if s.NodeID == 0 {
+		return fmt.Sprintf("pod %s runs no node", s.Pod)
+	}
+	state := s.State
+	if state == "" {
+		state = "active"
+	}
+	return fmt.Sprintf("node %d of pod %s is %s with %d replicas", s.NodeID, s.Pod, state, s.Replicas)
+}
+
+// decommissionState returns the NodeDecommissionState of a node, as the CrdbNode controller reports it.
+func decommissionState(node health.Node, replicas int64) v1alpha1.NodeDecommissionState {
+	switch {
+	case node.Decommissioned():
+		return v1alpha1.Decommissioned
+	case node.Membership == health.MembershipDecommissioning && replicas > 0:
+		return v1alpha1.TransferringReplicas
+	case node.Membership == health.MembershipDecommissioning:
+		return v1alpha1.ZeroReplicas
+	case node.Draining:
+		return v1alpha1.Draining
+	}
+	return ""
+}
+
+// ScaleDowner scales the StatefulSet of a cluster down, after decommissioning the nodes of the removed pods.
+type ScaleDowner struct {
+	client  client.Client
+	cluster cluster
+	nodes   nodeCommands
+	opts    Options
+	closer  func() error
+	// pollInterval is the maximum interval between the checks of the nodes and of the pods.
+	pollInterval time.Duration
+}
+
+// NewScaleDowner connects to the Kubernetes cluster, and to the ready pods of the StatefulSet as the root user.
+func NewScaleDowner(kubeconfig string, opts Options) (*ScaleDowner, error) {
+	if opts.Replicas < 1 {
+		return nil, errors.Newf("the statefulset can't be scaled down to %d replicas", opts.Replicas)
+	}
+
+	config, cl, err := opts.KubeClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	executor, err := kube.NewPodExecutor(config, opts.Namespace, opts.PortForward)
+	if err != nil {
+		return nil, errors.Wrap(err, "building pod executor")
+	}
+
+	checker, err := health.Connect(opts.DBConnection(context.Background(), cl, config))
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to statefulset %s", opts.StatefulSetName)
+	}
+
+	return &ScaleDowner{
+		client:  cl,
+		cluster: checker,
+		nodes: &database.NodeCLI{
+			Exec: func(ctx context.Context, podName string, command []string, stdout, stderr io.Writer) error {
+				return executor.Exec(ctx, podName, database.DBContainerName, command, stdout, stderr)
+			},
+			Port:     opts.SQLPort,
+			Insecure: opts.ClientSecret == "",
+			Out:      os.Stdout,
+		},
+		opts:         opts,
+		closer:       checker.Close,
+		pollInterval: 5 * time.Second,
+	}, nil
+}
+
+// Close closes the connection to the cluster.
+func (s *ScaleDowner) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer()
+}
+
+// Run scales the StatefulSet down:
+//
+//  1. The nodes of the pods above the target replicas are decommissioned, through the CLI of the first pod.
+//  2. Their replicas are moved to the other nodes, and their decommission is finalized once they hold none.
+//  3. The ranges of the cluster must be fully replicated.
+//  4. The replicas of the StatefulSet are patched, and the removed pods are deleted with their PVCs if DeletePVCs
+//     is set.
+//
+// The state of each node is read from the cluster, so a scale-down which was interrupted is resumed by running
+// it again.
+func (s *ScaleDowner) Run(ctx context.Context) error {
+	var sts appsv1.StatefulSet
+	if err := s.client.Get(ctx, types.NamespacedName{Namespace: s.opts.Namespace, Name: s.opts.StatefulSetName}, &sts); err != nil {
+		return errors.Wrapf(err, "getting statefulset %s", s.opts.StatefulSetName)
+	}
+	current := int32(1)
+	if sts.Spec.Replicas != nil {
+		current = *sts.Spec.Replicas
+	}
+	target := s.opts.Replicas
+	if target > current {
+		return errors.Newf("statefulset %s has %d replicas, scale it up to %d with helm", sts.Name, current, target)
+	}
+	if target == current {
+		logrus.Infof("Statefulset %s already has %d replicas", sts.Name, current)
+		return s.deleteLeftoverPVCs(ctx, &sts)
+	}
+
+	factor, zone, err := s.cluster.ReplicationFactor(ctx)
+	if err != nil {
+		return err
+	}
+	if target < factor {
+		return errors.Newf("the ranges of %s are replicated %d times, and can't be fully replicated on %d nodes: lower its num_replicas before scaling down", zone, factor, target)
+	}
+
+	var pods []string
+	for ordinal := current - 1; ordinal >= target; ordinal-- {
+		pods = append(pods, fmt.Sprintf("%s-%d", sts.Name, ordinal))
+	}
+	states, err := s.nodeStates(ctx, pods)
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		if s.opts.DryRun {
+			logrus.Infof("[dry-run] Decommission %s", state)
+		} else {
+			logrus.Info(state)
+		}
+	}
+	if s.opts.DryRun {
+		logrus.Infof("[dry-run] Scale statefulset %s from %d to %d replicas", sts.Name, current, target)
+		return nil
+	}
+
+	if err := s.decommission(ctx, sts.Name+"-0", states); err != nil {
+		return err
+	}
+	if err := s.waitForReplicatedRanges(ctx); err != nil {
+		return err
+	}
+
+	patch := client.MergeFrom(sts.DeepCopy())
+	sts.Spec.Replicas = &target
+	if err := s.client.Patch(ctx, &sts, patch); err != nil {
+		return errors.Wrapf(err, "scaling statefulset %s to %d replicas", sts.Name, target)
+	}
+	logrus.Infof("Scaled statefulset %s to %d replicas", sts.Name, target)
+	for _, pod := range pods {
+		if err := kube.WaitForPodDeleted(ctx, kube.ClientPods(s.client, s.opts.Namespace), pod, s.opts.PodUpdateTimeout, s.pollInterval); err != nil {
+			return err
+		}
+	}
+
+	if err := s.deleteLeftoverPVCs(ctx, &sts); err != nil {
+		return err
+	}
+	logrus.Infof("Set statefulset.replicas to %d in the values of the helm release, or the next helm upgrade scales the statefulset back up", target)
+	return nil
+}
+
+// decommission decommissions the nodes, and waits for their replicas to be moved before it finalizes their
+// decommission.
+func (s *ScaleDowner) decommission(ctx context.Context, cliPod string, states []NodeState) error {
+	var pending []int32
+	started := false
+	for _, state := range states {
+		switch state.State {
+		case "", v1alpha1.Draining, v1alpha1.Drained:
+			if state.NodeID != 0 {
+				pending = append(pending, state.NodeID)
+			}
+		default:
+			started = true
+		}
+	}
+	// The nodes being decommissioned by an interrupted scale-down leave the cluster under-replicated.
+	if !started {
+		status, err := s.cluster.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if err := status.Healthy(); err != nil {
+			return errors.Wrap(err, "refusing to decommission nodes")
+		}
+	}
+	if len(pending) > 0 {
+		logrus.Infof("Decommissioning nodes %v", pending)
+		if err := s.nodes.StartDecommission(ctx, cliPod, pending...); err != nil {
+			return err
+		}
+	}
+
+	pods := make([]string, len(states))
+	for i, state := range states {
+		pods[i] = state.Pod
+	}
+	err := s.retry(ctx, s.opts.DecommissionTimeout, func() error {
+		return s.waitForStates(ctx, pods, v1alpha1.ZeroReplicas, v1alpha1.Decommissioned)
+	})
+	if err != nil {
+		return errors.Wrap(err, "waiting for the replicas of the nodes to be moved, re-run the command to resume")
+	}
+
+	states, err = s.nodeStates(ctx, pods)
+	if err != nil {
+		return err
+	}
+	var finalize []int32
+	for _, state := range states {
+		if state.State == v1alpha1.ZeroReplicas {
+			finalize = append(finalize, state.NodeID)
+		}
+	}
+	if len(finalize) > 0 {
+		logrus.Infof("Finalizing the decommission of nodes %v", finalize)
+		if err := s.nodes.Decommission(ctx, cliPod, finalize...); err != nil {
+			return err
+		}
+	}
+	return s.retry(ctx, s.opts.HealthTimeout, func() error {
+		return s.waitForStates(ctx, pods, v1alpha1.Decommissioned)
+	})
+}
+
+// waitForStates returns an error unless the node of every pod is in one of the states.
+func (s *ScaleDowner) waitForStates(ctx context.Context, pods []string, want ...v1alpha1.NodeDecommissionState) error {
+	states, err := s.nodeStates(ctx, pods)
+	if err != nil {
+		return err
+	}
+	var waiting []string
+	for _, state := range states {
+		if state.NodeID == 0 {
+			continue
+		}
+		done := false
+		for _, w := range want {
+			done = done || state.State == w
+		}
+		if !done {
+			waiting = append(waiting, state.String())
+		}
+	}
+	if len(waiting) > 0 {
+		logrus.Info(strings.Join(waiting, ", "))
+		return errors.Newf("waiting for %s", strings.Join(waiting, ", "))
+	}
+	return nil
+}
+
+// nodeStates returns the decommission state of the latest node of each pod.
+func (s *ScaleDowner) nodeStates(ctx context.Context, pods []string) ([]NodeState, error) {
+	status, err := s.cluster.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := s.cluster.Replicas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]NodeState, len(pods))
+	for i, pod := range pods {
+		states[i] = NodeState{Pod: pod}
+		nodes := status.NodesOnHost(pod)
+		if len(nodes) == 0 {
+			continue
+		}
+		// A pod recreated with an empty store joins the cluster as a new node, with a higher ID.
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+		node := nodes[len(nodes)-1]
+		states[i].NodeID = node.ID
+		states[i].Replicas = replicas[node.ID]
+		states[i].State = decommissionState(node, replicas[node.ID])
+	}
+	return states, nil
+}
+
+// waitForReplicatedRanges waits for every remaining node to be live, and for every range to be fully replicated.
+func (s *ScaleDowner) waitForReplicatedRanges(ctx context.Context) error {
+	return s.retry(ctx, s.opts.HealthTimeout, func() error {
+		status, err := s.cluster.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return status.Healthy()
+	})
+}
+
+// deleteLeftoverPVCs deletes the PVCs of the volume claim templates of the StatefulSet whose pods were removed,
+// if DeletePVCs is set.
+func (s *ScaleDowner) deleteLeftoverPVCs(ctx context.Context, sts *appsv1.StatefulSet) error {
+	var pvcs corev1.PersistentVolumeClaimList
+	if err := s.client.List(ctx, &pvcs, client.InNamespace(s.opts.Namespace)); err != nil {
+		return errors.Wrap(err, "listing pvcs")
+	}
+
+	var leftover []string
+	for _, pvc := range pvcs.Items {
+		for _, template := range sts.Spec.VolumeClaimTemplates {
+			prefix := fmt.Sprintf("%s-%s-", template.Name, sts.Name)
+			if !strings.HasPrefix(pvc.Name, prefix) {
+				continue
+			}
+			ordinal, err := strconv.Atoi(strings.TrimPrefix(pvc.Name, prefix))
+			if err == nil && int32(ordinal) >= s.opts.Replicas {
+				leftover = append(leftover, pvc.Name)
+			}
+		}
+	}
+	sort.Strings(leftover)
+	if len(leftover) == 0 {
+		return nil
+	}
+	if !s.opts.DeletePVCs {
+		logrus.Warnf("PVCs %s hold the stores of decommissioned nodes, delete them before the statefulset is scaled up again", strings.Join(leftover, ", "))
+		return nil
+	}
+
+	for _, name := range leftover {
+		pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: s.opts.Namespace, Name: name}}
+		if err := s.client.Delete(ctx, pvc); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "deleting pvc %s", name)
+		}
+		logrus.Infof("Deleted pvc %s", name)
+	}
+	return nil
+}
+
+func (s *ScaleDowner) retry(ctx context.Context, timeout time.Duration, f func() error) error {
+	return kube.Retry(ctx, timeout, s.pollInterval, f)
+}
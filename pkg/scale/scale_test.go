@@ -0,0 +1,310 @@
+package scale
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/database/health"
+	"github.com/cockroachdb/helm-charts/pkg/upstream/cockroach-operator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+const scaleTestNamespace = "crdb-ns"
+
+// fakeCluster is a cluster with a node per pod, whose decommissioning nodes lose a replica at each check.
+type fakeCluster struct {
+	nodes    []health.Node
+	replicas map[int32]int64
+	ranges   health.RangeCounts
+	calls    []string
+	// factor is the replication factor of the zone configurations.
+	factor int32
+}
+
+func newFakeCluster(pods int) *fakeCluster {
+	c := &fakeCluster{replicas: map[int32]int64{}, factor: 3}
+	for i := 0; i < pods; i++ {
+		id := int32(i + 1)
+		c.nodes = append(c.nodes, health.Node{
+			ID:         id,
+			Address:    fmt.Sprintf("crdb-%d.crdb.%s.svc.cluster.local:26257", i, scaleTestNamespace),
+			IsLive:     true,
+			Membership: health.MembershipActive,
+		})
+		c.replicas[id] = 2
+	}
+	return c
+}
+
+func (c *fakeCluster) Status(context.Context) (health.Status, error) {
+	return health.Status{Nodes: append([]health.Node(nil), c.nodes...), Ranges: c.ranges}, nil
+}
+
+func (c *fakeCluster) Replicas(context.Context) (map[int32]int64, error) {
+	replicas := map[int32]int64{}
+	for _, n := range c.nodes {
+		if n.Membership == health.MembershipDecommissioning && c.replicas[n.ID] > 0 {
+			c.replicas[n.ID]--
+		}
+		replicas[n.ID] = c.replicas[n.ID]
+	}
+	return replicas, nil
+}
+
+func (c *fakeCluster) ReplicationFactor(context.Context) (int32, string, error) {
+	return c.factor, "RANGE default", nil
+}
+
+func (c *fakeCluster) setMembership(membership string, ids []int32) {
+	for _, id := range ids {
+		for i := range c.nodes {
+			if c.nodes[i].ID == id {
+				c.nodes[i].Membership = membership
+			}
+		}
+	}
+}
+
+func (c *fakeCluster) StartDecommission(_ context.Context, pod string, ids ...int32) error {
+	c.calls = append(c.calls, fmt.Sprintf("start %s %v", pod, ids))
+	c.setMembership(health.MembershipDecommissioning, ids)
+	return nil
+}
+
+func (c *fakeCluster) Decommission(_ context.Context, pod string, ids ...int32) error {
+	c.calls = append(c.calls, fmt.Sprintf("decommission %s %v", pod, ids))
+	for _, id := range ids {
+		if c.replicas[id] > 0 {
+			return fmt.Errorf("node %d has replicas", id)
+		}
+	}
+	c.setMembership(health.MembershipDecommissioned, ids)
+	return nil
+}
+
+func scaleTestObjects(replicas int32, pvcs int) []client.Object {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "crdb", Namespace: scaleTestNamespace},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+				{ObjectMeta: metav1.ObjectMeta{Name: "datadir"}},
+			},
+		},
+	}
+	objects := []client.Object{sts}
+	for i := int32(0); i < replicas; i++ {
+		objects = append(objects, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("crdb-%d", i), Namespace: scaleTestNamespace}})
+	}
+	for i := 0; i < pvcs; i++ {
+		objects = append(objects, &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("datadir-crdb-%d", i), Namespace: scaleTestNamespace}})
+	}
+	// A PVC of another StatefulSet whose name starts with the name of the StatefulSet.
+	objects = append(objects, &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "datadir-crdb-other-4", Namespace: scaleTestNamespace}})
+	return objects
+}
+
+// newScaleTestClient returns a client which deletes the pods above the replicas of a patched StatefulSet, as the
+// StatefulSet controller does.
+func newScaleTestClient(objects ...client.Object) client.Client {
+	return fakeclient.NewClientBuilder().
+		WithObjects(objects...).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(ctx context.Context, cl client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				if err := cl.Patch(ctx, obj, patch, opts...); err != nil {
+					return err
+				}
+				sts, ok := obj.(*appsv1.StatefulSet)
+				if !ok {
+					return nil
+				}
+				var pods corev1.PodList
+				if err := cl.List(ctx, &pods, client.InNamespace(sts.Namespace)); err != nil {
+					return err
+				}
+				for i := range pods.Items {
+					var ordinal int32
+					if _, err := fmt.Sscanf(pods.Items[i].Name, "crdb-%d", &ordinal); err == nil && ordinal >= *sts.Spec.Replicas {
+						if err := cl.Delete(ctx, &pods.Items[i]); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			},
+		}).
+		Build()
+}
+
+func newTestScaleDowner(cl client.Client, cluster *fakeCluster, opts Options) *ScaleDowner {
+	opts.StatefulSetName = "crdb"
+	opts.Namespace = scaleTestNamespace
+	opts.DecommissionTimeout = time.Second
+	opts.HealthTimeout = time.Second
+	opts.PodUpdateTimeout = time.Second
+	return &ScaleDowner{client: cl, cluster: cluster, nodes: cluster, opts: opts, pollInterval: time.Millisecond}
+}
+
+func pvcNames(t *testing.T, cl client.Client) []string {
+	var pvcs corev1.PersistentVolumeClaimList
+	require.NoError(t, cl.List(context.Background(), &pvcs, client.InNamespace(scaleTestNamespace)))
+	var names []string
+	for _, pvc := range pvcs.Items {
+		names = append(names, pvc.Name)
+	}
+	return names
+}
+
+func podNames(t *testing.T, cl client.Client) []string {
+	var pods corev1.PodList
+	require.NoError(t, cl.List(context.Background(), &pods, client.InNamespace(scaleTestNamespace)))
+	var names []string
+	for _, pod := range pods.Items {
+		names = append(names, pod.Name)
+	}
+	return names
+}
+
+func TestScaleDown(t *testing.T) {
+	ctx := context.Background()
+	cl := newScaleTestClient(scaleTestObjects(5, 5)...)
+	cluster := newFakeCluster(5)
+	s := newTestScaleDowner(cl, cluster, Options{Replicas: 3, DeletePVCs: true})
+
+	require.NoError(t, s.Run(ctx))
+
+	assert.Equal(t, []string{"start crdb-0 [5 4]", "decommission crdb-0 [5 4]"}, cluster.calls)
+	assert.Equal(t, health.MembershipDecommissioned, cluster.nodes[3].Membership)
+	assert.Equal(t, health.MembershipDecommissioned, cluster.nodes[4].Membership)
+	assert.Equal(t, health.MembershipActive, cluster.nodes[2].Membership)
+
+	var sts appsv1.StatefulSet
+	require.NoError(t, cl.Get(ctx, client.ObjectKey{Namespace: scaleTestNamespace, Name: "crdb"}, &sts))
+	assert.Equal(t, int32(3), *sts.Spec.Replicas)
+	assert.ElementsMatch(t, []string{"crdb-0", "crdb-1", "crdb-2"}, podNames(t, cl))
+	assert.ElementsMatch(t, []string{"datadir-crdb-0", "datadir-crdb-1", "datadir-crdb-2", "datadir-crdb-other-4"}, pvcNames(t, cl))
+}
+
+func TestScaleDownKeepsPVCs(t *testing.T) {
+	cl := newScaleTestClient(scaleTestObjects(4, 4)...)
+	cluster := newFakeCluster(4)
+	s := newTestScaleDowner(cl, cluster, Options{Replicas: 3})
+
+	require.NoError(t, s.Run(context.Background()))
+
+	assert.ElementsMatch(t, []string{"crdb-0", "crdb-1", "crdb-2"}, podNames(t, cl))
+	assert.Len(t, pvcNames(t, cl), 5)
+}
+
+func TestScaleDownDryRun(t *testing.T) {
+	cl := newScaleTestClient(scaleTestObjects(5, 5)...)
+	cluster := newFakeCluster(5)
+	s := newTestScaleDowner(cl, cluster, Options{Replicas: 3, DryRun: true, DeletePVCs: true})
+
+	require.NoError(t, s.Run(context.Background()))
+
+	assert.Empty(t, cluster.calls)
+	assert.Len(t, podNames(t, cl), 5)
+	assert.Len(t, pvcNames(t, cl), 6)
+}
+
+func TestScaleDownResume(t *testing.T) {
+	cl := newScaleTestClient(scaleTestObjects(5, 5)...)
+	cluster := newFakeCluster(5)
+	// The node of crdb-4 was decommissioned by an interrupted scale-down, which left a range under-replicated.
+	cluster.setMembership(health.MembershipDecommissioning, []int32{5})
+	cluster.ranges.UnderReplicated = 1
+	s := newTestScaleDowner(cl, cluster, Options{Replicas: 3})
+
+	// The cluster is unhealthy until the decommission is finalized.
+	s.cluster = &healingCluster{fakeCluster: cluster}
+	require.NoError(t, s.Run(context.Background()))
+
+	assert.Equal(t, []string{"start crdb-0 [4]", "decommission crdb-0 [5 4]"}, cluster.calls)
+	assert.ElementsMatch(t, []string{"crdb-0", "crdb-1", "crdb-2"}, podNames(t, cl))
+}
+
+// healingCluster replicates its ranges fully once its nodes hold no replicas to move.
+type healingCluster struct {
+	*fakeCluster
+}
+
+func (c *healingCluster) Status(ctx context.Context) (health.Status, error) {
+	for _, n := range c.nodes {
+		if n.Membership == health.MembershipDecommissioned {
+			c.ranges.UnderReplicated = 0
+		}
+	}
+	return c.fakeCluster.Status(ctx)
+}
+
+func TestScaleDownUnhealthy(t *testing.T) {
+	cl := newScaleTestClient(scaleTestObjects(4, 4)...)
+	cluster := newFakeCluster(4)
+	cluster.nodes[1].IsLive = false
+	s := newTestScaleDowner(cl, cluster, Options{Replicas: 3})
+
+	err := s.Run(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "refusing to decommission nodes: cluster is unhealthy: node 2 is not live")
+	assert.Empty(t, cluster.calls)
+	assert.Len(t, podNames(t, cl), 4)
+}
+
+func TestScaleDownInterruptedAfterPatch(t *testing.T) {
+	cl := newScaleTestClient(scaleTestObjects(3, 5)...)
+	cluster := newFakeCluster(5)
+	cluster.setMembership(health.MembershipDecommissioned, []int32{4, 5})
+	s := newTestScaleDowner(cl, cluster, Options{Replicas: 3, DeletePVCs: true})
+
+	require.NoError(t, s.Run(context.Background()))
+
+	assert.Empty(t, cluster.calls)
+	assert.ElementsMatch(t, []string{"datadir-crdb-0", "datadir-crdb-1", "datadir-crdb-2", "datadir-crdb-other-4"}, pvcNames(t, cl))
+}
+
+func TestScaleDownAboveReplicas(t *testing.T) {
+	cl := newScaleTestClient(scaleTestObjects(3, 3)...)
+	s := newTestScaleDowner(cl, newFakeCluster(3), Options{Replicas: 4})
+
+	err := s.Run(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "scale it up to 4 with helm")
+}
+
+func TestScaleDownBelowReplicationFactor(t *testing.T) {
+	cl := newScaleTestClient(scaleTestObjects(5, 5)...)
+	cluster := newFakeCluster(5)
+	cluster.factor = 5
+	s := newTestScaleDowner(cl, cluster, Options{Replicas: 4, DryRun: true})
+
+	err := s.Run(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the ranges of RANGE default are replicated 5 times, and can't be fully replicated on 4 nodes")
+	assert.Empty(t, cluster.calls)
+}
+
+func TestDecommissionState(t *testing.T) {
+	for _, tc := range []struct {
+		node     health.Node
+		replicas int64
+		want     v1alpha1.NodeDecommissionState
+	}{
+		{node: health.Node{Membership: health.MembershipActive}, replicas: 3, want: ""},
+		{node: health.Node{Membership: health.MembershipActive, Draining: true}, replicas: 3, want: v1alpha1.Draining},
+		{node: health.Node{Membership: health.MembershipDecommissioning}, replicas: 3, want: v1alpha1.TransferringReplicas},
+		{node: health.Node{Membership: health.MembershipDecommissioning, Draining: true}, want: v1alpha1.ZeroReplicas},
+		{node: health.Node{Membership: health.MembershipDecommissioned}, want: v1alpha1.Decommissioned},
+	} {
+		assert.Equal(t, tc.want, decommissionState(tc.node, tc.replicas), "%+v with %d replicas", tc.node, tc.replicas)
+	}
+}
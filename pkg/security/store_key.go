@@ -0,0 +1,63 @@
+/*
+Copyright 2021 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package security
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// StoreKeyIDLength is the length in bytes of the random ID which prefixes the AES key in a store key file.
+const StoreKeyIDLength = 32
+
+// StoreKeySizes are the supported AES key sizes of the store keys, in bits.
+var StoreKeySizes = []int{128, 192, 256}
+
+// GenerateStoreKey generates an encryption at rest store key of the given AES size in bits. The key is in the
+// format of the files written by `cockroach gen encryption-key`: a random key ID of StoreKeyIDLength bytes
+// followed by the AES key.
+func GenerateStoreKey(size int) ([]byte, error) {
+	if !isStoreKeySize(size) {
+		return nil, fmt.Errorf("invalid store key size %d, must be one of %v", size, StoreKeySizes)
+	}
+
+	key := make([]byte, StoreKeyIDLength+size/8)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate store key: %w", err)
+	}
+	return key, nil
+}
+
+// StoreKeyID returns the hex encoded ID of a store key, which CockroachDB logs as the active store key ID. It
+// fails if the key is not in the format of GenerateStoreKey.
+func StoreKeyID(key []byte) (string, error) {
+	if !isStoreKeySize((len(key) - StoreKeyIDLength) * 8) {
+		return "", fmt.Errorf("invalid store key length %d, must be %d bytes of key ID followed by a key of %v bits",
+			len(key), StoreKeyIDLength, StoreKeySizes)
+	}
+	return hex.EncodeToString(key[:StoreKeyIDLength]), nil
+}
+
+func isStoreKeySize(size int) bool {
+	for _, s := range StoreKeySizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2021 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package security_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cockroachdb/helm-charts/pkg/security"
+)
+
+func TestGenerateStoreKey(t *testing.T) {
+	for size, length := range map[int]int{128: 48, 192: 56, 256: 64} {
+		key, err := security.GenerateStoreKey(size)
+		require.NoError(t, err)
+		assert.Len(t, key, length)
+
+		id, err := security.StoreKeyID(key)
+		require.NoError(t, err)
+		assert.Len(t, id, 2*security.StoreKeyIDLength)
+
+		other, err := security.GenerateStoreKey(size)
+		require.NoError(t, err)
+		assert.False(t, bytes.Equal(key, other), "keys of size %d are not random", size)
+	}
+
+	_, err := security.GenerateStoreKey(512)
+	assert.EqualError(t, err, "invalid store key size 512, must be one of [128 192 256]")
+}
+
+func TestStoreKeyID(t *testing.T) {
+	key := append(bytes.Repeat([]byte{0xab}, security.StoreKeyIDLength), make([]byte, 16)...)
+	id, err := security.StoreKeyID(key)
+	require.NoError(t, err)
+	assert.Equal(t, "abababababababababababababababababababababababababababababababab", id)
+
+	_, err = security.StoreKeyID(key[:40])
+	assert.ErrorContains(t, err, "invalid store key length 40")
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2026 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutils
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// SQLStep is a statement expected by a SQLScript, and its result.
+type SQLStep struct {
+	// Query is matched against the statement, once their whitespace is collapsed. The statement must contain it.
+	Query string
+	// Args are the expected arguments of the statement. They aren't checked if nil.
+	Args []driver.Value
+	// Columns and Rows are the result of a query.
+	Columns []string
+	Rows    [][]driver.Value
+	// RowsAffected is the result of an exec.
+	RowsAffected int64
+	// Err fails the statement.
+	Err error
+}
+
+// SQLScript is a fake SQL database which answers a script of statements in order, for the unit tests of
+// the code querying CockroachDB. A statement which doesn't match the next step of the script fails.
+type SQLScript struct {
+	mu       sync.Mutex
+	steps    []SQLStep
+	executed []string
+	errs     []error
+}
+
+// NewSQLScript returns a SQLScript answering the steps in order.
+func NewSQLScript(steps ...SQLStep) *SQLScript {
+	return &SQLScript{steps: steps}
+}
+
+// Add appends steps to the script.
+func (s *SQLScript) Add(steps ...SQLStep) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = append(s.steps, steps...)
+}
+
+// DB returns a sql.DB connected to the script.
+func (s *SQLScript) DB() *sql.DB {
+	return sql.OpenDB(sqlScriptConnector{s})
+}
+
+// Executed returns the statements executed so far.
+func (s *SQLScript) Executed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.executed...)
+}
+
+// Verify returns an error if a statement didn't match the script, or if steps of the script were not executed.
+func (s *SQLScript) Verify() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.errs) > 0 {
+		return s.errs[0]
+	}
+	if len(s.steps) > 0 {
+		return fmt.Errorf("%d statements of the script were not executed, starting with %q", len(s.steps), s.steps[0].Query)
+	}
+	return nil
+}
+
+// next pops the step matching the statement.
+func (s *SQLScript) next(query string, args []driver.NamedValue) (SQLStep, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query = strings.Join(strings.Fields(query), " ")
+	s.executed = append(s.executed, query)
+	if len(s.steps) == 0 {
+		err := fmt.Errorf("unexpected statement %q, the script is over", query)
+		s.errs = append(s.errs, err)
+		return SQLStep{}, err
+	}
+
+	step := s.steps[0]
+	if !strings.Contains(query, strings.Join(strings.Fields(step.Query), " ")) {
+		err := fmt.Errorf("unexpected statement %q, expected %q", query, step.Query)
+		s.errs = append(s.errs, err)
+		return SQLStep{}, err
+	}
+	if step.Args != nil {
+		values := make([]driver.Value, len(args))
+		for i, arg := range args {
+			values[i] = arg.Value
+		}
+		if !reflect.DeepEqual(values, step.Args) {
+			err := fmt.Errorf("unexpected arguments %v of statement %q, expected %v", values, query, step.Args)
+			s.errs = append(s.errs, err)
+			return SQLStep{}, err
+		}
+	}
+	s.steps = s.steps[1:]
+	return step, step.Err
+}
+
+type sqlScriptConnector struct {
+	script *SQLScript
+}
+
+func (c sqlScriptConnector) Connect(context.Context) (driver.Conn, error) {
+	return sqlScriptConn(c), nil
+}
+
+func (c sqlScriptConnector) Driver() driver.Driver {
+	return sqlScriptDriver{}
+}
+
+type sqlScriptDriver struct{}
+
+func (sqlScriptDriver) Open(string) (driver.Conn, error) {
+	return nil, fmt.Errorf("the sql script driver must be opened with SQLScript.DB")
+}
+
+type sqlScriptConn struct {
+	script *SQLScript
+}
+
+var (
+	_ driver.QueryerContext = sqlScriptConn{}
+	_ driver.ExecerContext  = sqlScriptConn{}
+)
+
+func (c sqlScriptConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	step, err := c.script.next(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlScriptRows{columns: step.Columns, rows: step.Rows}, nil
+}
+
+func (c sqlScriptConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	step, err := c.script.next(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(step.RowsAffected), nil
+}
+
+func (c sqlScriptConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("the sql script driver doesn't prepare statements")
+}
+
+func (c sqlScriptConn) Close() error {
+	return nil
+}
+
+func (c sqlScriptConn) Begin() (driver.Tx, error) {
+	return sqlScriptTx{}, nil
+}
+
+type sqlScriptTx struct{}
+
+func (sqlScriptTx) Commit() error   { return nil }
+func (sqlScriptTx) Rollback() error { return nil }
+
+type sqlScriptRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *sqlScriptRows) Columns() []string {
+	return r.columns
+}
+
+func (r *sqlScriptRows) Close() error {
+	return nil
+}
+
+func (r *sqlScriptRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
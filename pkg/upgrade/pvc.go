@@ -0,0 +1,666 @@
+package upgrade
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/database"
+	"github.com/cockroachdb/helm-charts/pkg/database/health"
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+	util "github.com/cockroachdb/helm-charts/pkg/utils"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	pvcCheckpointJSON = "upgrade-pvc-checkpoint.json"
+	// statefulSetTemplate is the template of the StatefulSet in the cockroachdb chart.
+	statefulSetTemplate = "templates/statefulset.yaml"
+	// helmReleaseNameAnnotation is the annotation of the resources of a helm release with its name.
+	helmReleaseNameAnnotation = "meta.helm.sh/release-name"
+	// finalHelmStep upgrades the helm release once every pod is replaced, with its own update strategy.
+	finalHelmStep = "helm"
+)
+
+// onDeleteOverrides are set on the helm release while its pods are replaced, so that the StatefulSet only
+// recreates the pod which was deleted, rather than rolling the other pods to the new pod template.
+var onDeleteOverrides = []string{
+	"--set", "statefulset.updateStrategy.type=OnDelete",
+	"--set", "statefulset.updateStrategy.rollingUpdate=null",
+}
+
+// PVCOptions are the helm release and the safety options of an upgrade which changes the volume claim templates
+// of the StatefulSet.
+type PVCOptions struct {
+	database.StatefulSetConnection
+	// ReleaseName is the helm release of the StatefulSet. It defaults to the release the StatefulSet is annotated
+	// with.
+	ReleaseName  string
+	Chart        string
+	ChartVersion string
+	// ValuesFiles are the values of the upgraded release. At least one is required, since the volume claim
+	// templates are rendered from them.
+	ValuesFiles []string
+	// CheckpointDir holds the progress of the upgrade, so that an interrupted upgrade is resumed by running it
+	// again.
+	CheckpointDir string
+	// DryRun prints the changes of the volumes of each pod, without applying them.
+	DryRun bool
+	// PauseBetweenPods asks for an approval before the next pod is replaced.
+	PauseBetweenPods bool
+	// ReadinessWait is waited for after each pod becomes ready, before the health of the cluster is checked.
+	ReadinessWait time.Duration
+	// PodUpdateTimeout bounds the wait for each pod to be deleted, and to be recreated and become ready.
+	PodUpdateTimeout time.Duration
+	// HealthTimeout bounds the wait for the cluster to be healthy after each pod is replaced.
+	HealthTimeout time.Duration
+	// DecommissionTimeout bounds the decommission of a node whose data volume is recreated.
+	DecommissionTimeout time.Duration
+}
+
+// pvcCluster reports the health of the cluster, and the replication factor of its zone configurations.
+type pvcCluster interface {
+	clusterStatus
+	ReplicationFactor(ctx context.Context) (int32, string, error)
+}
+
+// nodeCommands run the node commands of the cockroach CLI.
+type nodeCommands interface {
+	Decommission(ctx context.Context, podName string, nodeIDs ...int32) error
+	Drain(ctx context.Context, podName string, nodeID int32) error
+}
+
+// pvcCheckpoint records the progress of a PVCUpgrader.
+type pvcCheckpoint struct {
+	StatefulSet string `json:"statefulSet"`
+	// Release is recorded since the StatefulSet it is read from is deleted while a pod is replaced.
+	Release string `json:"release"`
+	// CurrentPod is the ordinal of the pod being replaced. Its node was already drained or decommissioned.
+	CurrentPod *int32 `json:"currentPod,omitempty"`
+	// UpgradedPods are the ordinals of the pods which were replaced.
+	UpgradedPods   []int32  `json:"upgradedPods,omitempty"`
+	CompletedSteps []string `json:"completedSteps,omitempty"`
+}
+
+func (c *pvcCheckpoint) podUpgraded(ordinal int32) bool {
+	for _, o := range c.UpgradedPods {
+		if o == ordinal {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *pvcCheckpoint) stepCompleted(step string) bool {
+	for _, s := range c.CompletedSteps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// claimChange is a change of a PVC of a pod, required by the volume claim templates of the upgraded release.
+type claimChange struct {
+	claim string
+	// recreate is set if the PVC exists with a different spec. It is created by the StatefulSet otherwise.
+	recreate bool
+	reasons  []string
+}
+
+func (c claimChange) String() string {
+	if !c.recreate {
+		return fmt.Sprintf("create %s", c.claim)
+	}
+	return fmt.Sprintf("recreate %s (%s)", c.claim, strings.Join(c.reasons, ", "))
+}
+
+// podPlan are the changes of the volumes of a pod.
+type podPlan struct {
+	ordinal int32
+	name    string
+	changes []claimChange
+}
+
+// recreated returns the PVCs of the pod which are deleted and recreated.
+func (p podPlan) recreated() []string {
+	var claims []string
+	for _, c := range p.changes {
+		if c.recreate {
+			claims = append(claims, c.claim)
+		}
+	}
+	return claims
+}
+
+// PVCUpgrader upgrades a helm release which changes the volume claim templates of its StatefulSet, such as a
+// new storage class, a new size, or a new volume for the logs or the WAL failover. The templates of a
+// StatefulSet are immutable, so its pods are replaced one at a time: the node of the pod is drained, or
+// decommissioned if its volumes are recreated, the StatefulSet is deleted without its pods, the pod and its
+// changed PVCs are deleted, and the release is upgraded to recreate the StatefulSet, which recreates the pod
+// with the new volumes.
+type PVCUpgrader struct {
+	client client.Client
+	nodes  nodeCommands
+	opts   PVCOptions
+	// connect connects to the pods matching the selector, which are found without the StatefulSet while it
+	// is deleted.
+	connect func(ctx context.Context, selector labels.Selector) (pvcCluster, error)
+	cluster pvcCluster
+	closer  func() error
+	// runHelm runs the helm CLI, and renderHelm returns its output.
+	runHelm    func(ctx context.Context, args ...string) error
+	renderHelm func(ctx context.Context, args ...string) ([]byte, error)
+	in         *bufio.Reader
+	// pollInterval is the maximum interval between the checks of the pods and of the cluster.
+	pollInterval time.Duration
+}
+
+// NewPVCUpgrader connects to the Kubernetes cluster. The CockroachDB cluster is connected to when the upgrade is
+// run, as the root user.
+func NewPVCUpgrader(kubeconfig string, opts PVCOptions) (*PVCUpgrader, error) {
+	if opts.Chart == "" {
+		return nil, errors.New("the chart is required")
+	}
+	if len(opts.ValuesFiles) == 0 {
+		return nil, errors.New("a values file is required, the volume claim templates are rendered from it")
+	}
+
+	config, cl, err := opts.KubeClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	executor, err := kube.NewPodExecutor(config, opts.Namespace, opts.PortForward)
+	if err != nil {
+		return nil, errors.Wrap(err, "building pod executor")
+	}
+
+	u := &PVCUpgrader{
+		client: cl,
+		nodes: &database.NodeCLI{
+			Exec: func(ctx context.Context, podName string, command []string, stdout, stderr io.Writer) error {
+				return executor.Exec(ctx, podName, database.DBContainerName, command, stdout, stderr)
+			},
+			Port:     opts.SQLPort,
+			Insecure: opts.ClientSecret == "",
+			Out:      os.Stdout,
+		},
+		opts:         opts,
+		runHelm:      runHelmCLI,
+		renderHelm:   renderHelmCLI,
+		in:           bufio.NewReader(os.Stdin),
+		pollInterval: 5 * time.Second,
+	}
+	u.connect = func(ctx context.Context, selector labels.Selector) (pvcCluster, error) {
+		dbConn := opts.DBConnection(ctx, cl, config)
+		dbConn.StatefulSetName = ""
+		dbConn.PodSelector = selector
+		dbConn.ServiceName = opts.StatefulSetName + "-public"
+		checker, err := health.Connect(dbConn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "connecting to statefulset %s", opts.StatefulSetName)
+		}
+		u.closer = checker.Close
+		return checker, nil
+	}
+	return u, nil
+}
+
+// Close closes the connection to the cluster.
+func (u *PVCUpgrader) Close() error {
+	if u.closer == nil {
+		return nil
+	}
+	return u.closer()
+}
+
+// Run replaces the pods whose volumes change, from the highest ordinal, and checkpoints the progress after each
+// pod. The cluster must be healthy before each pod is replaced, and once it is recreated. Once every pod is
+// replaced, the release is upgraded with its own update strategy. Run can be called again to resume an
+// interrupted upgrade.
+func (u *PVCUpgrader) Run(ctx context.Context) error {
+	checkpoint, err := u.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	var live *appsv1.StatefulSet
+	var sts appsv1.StatefulSet
+	err = u.client.Get(ctx, types.NamespacedName{Namespace: u.opts.Namespace, Name: u.opts.StatefulSetName}, &sts)
+	switch {
+	case err == nil:
+		live = &sts
+	case !apierrors.IsNotFound(err):
+		return errors.Wrapf(err, "getting statefulset %s", u.opts.StatefulSetName)
+	case checkpoint.CurrentPod == nil:
+		return errors.Wrapf(err, "getting statefulset %s", u.opts.StatefulSetName)
+	}
+
+	release := u.opts.ReleaseName
+	if release == "" {
+		release = checkpoint.Release
+	}
+	if release == "" && live != nil {
+		release = live.Annotations[helmReleaseNameAnnotation]
+	}
+	if release == "" {
+		return errors.Newf("statefulset %s has no %s annotation, set the helm release name", u.opts.StatefulSetName, helmReleaseNameAnnotation)
+	}
+	checkpoint.Release = release
+
+	rendered, err := u.render(ctx, release)
+	if err != nil {
+		return err
+	}
+	// The StatefulSet is only missing while a pod is replaced, its replicas and selector are the rendered ones.
+	if live == nil {
+		live = rendered
+	}
+	selector, err := metav1.LabelSelectorAsSelector(live.Spec.Selector)
+	if err != nil {
+		return errors.Wrapf(err, "parsing the selector of statefulset %s", u.opts.StatefulSetName)
+	}
+
+	var plans []podPlan
+	for ordinal := replicas(live) - 1; ordinal >= 0; ordinal-- {
+		if checkpoint.podUpgraded(ordinal) {
+			continue
+		}
+		plan, err := u.planPod(ctx, ordinal, rendered.Spec.VolumeClaimTemplates)
+		if err != nil {
+			return err
+		}
+		plans = append(plans, plan)
+	}
+	fresh := checkpoint.CurrentPod == nil && len(checkpoint.UpgradedPods) == 0
+	if fresh && !volumesChange(plans) {
+		logrus.Infof("The volumes of the pods of statefulset %s don't change, upgrade the helm release instead", u.opts.StatefulSetName)
+		return nil
+	}
+	printPlans(plans, checkpoint.CurrentPod, u.opts.DryRun)
+	if u.opts.DryRun {
+		if len(plans) > 0 {
+			logrus.Infof("[dry-run] Each pod is replaced with: helm %s", strings.Join(u.helmArgs("upgrade", release, onDeleteOverrides...), " "))
+		}
+		return nil
+	}
+
+	if u.cluster == nil {
+		if u.cluster, err = u.connect(ctx, selector); err != nil {
+			return err
+		}
+	}
+	// The pod being replaced when the upgrade was interrupted may be down, the cluster is checked once it is
+	// recreated.
+	if checkpoint.CurrentPod == nil && !checkpoint.stepCompleted(finalHelmStep) {
+		if err := checkHealthy(ctx, u.cluster); err != nil {
+			return errors.Wrap(err, "refusing to upgrade")
+		}
+		if recreatesVolumes(plans) {
+			status, err := u.cluster.Status(ctx)
+			if err != nil {
+				return err
+			}
+			if err := u.checkReplicationFactor(ctx, status); err != nil {
+				return errors.Wrap(err, "refusing to upgrade")
+			}
+		}
+	}
+
+	for i, plan := range plans {
+		resuming := checkpoint.CurrentPod != nil && *checkpoint.CurrentPod == plan.ordinal
+		if !resuming {
+			checkpoint.CurrentPod = &plan.ordinal
+			if err := u.saveCheckpoint(checkpoint); err != nil {
+				return err
+			}
+		}
+		if err := u.replacePod(ctx, release, plan, resuming); err != nil {
+			return errors.Wrapf(err, "replacing pod %s, re-run the command to resume", plan.name)
+		}
+
+		checkpoint.CurrentPod = nil
+		checkpoint.UpgradedPods = append(checkpoint.UpgradedPods, plan.ordinal)
+		if err := u.saveCheckpoint(checkpoint); err != nil {
+			return err
+		}
+
+		if i < len(plans)-1 && u.opts.PauseBetweenPods {
+			next := plans[i+1].name
+			if !util.Approve(u.in, fmt.Sprintf("Validate the changes of pod %s. Continue with %s?", plan.name, next)) {
+				logrus.Infof("Upgrade paused before %s. Re-run the command to resume.", next)
+				return nil
+			}
+		}
+	}
+
+	if !checkpoint.stepCompleted(finalHelmStep) {
+		if err := u.runHelm(ctx, u.helmArgs("upgrade", release)...); err != nil {
+			return errors.Wrap(err, "upgrading the helm release, re-run the command to resume")
+		}
+		checkpoint.CompletedSteps = append(checkpoint.CompletedSteps, finalHelmStep)
+		if err := u.saveCheckpoint(checkpoint); err != nil {
+			return err
+		}
+	}
+	if err := waitForHealthyCluster(ctx, u.cluster, u.opts.HealthTimeout, u.pollInterval); err != nil {
+		return err
+	}
+
+	if err := os.Remove(u.checkpointPath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing checkpoint")
+	}
+	logrus.Infof("Every pod of statefulset %s runs with the volume claim templates of release %s", u.opts.StatefulSetName, release)
+	return nil
+}
+
+// replacePod drains the node of the pod, or decommissions it if its volumes are recreated, and recreates the pod
+// and the volumes through the helm release. The node was already drained or decommissioned if the replacement is
+// resumed.
+func (u *PVCUpgrader) replacePod(ctx context.Context, release string, plan podPlan, resuming bool) error {
+	recreated := plan.recreated()
+	if !resuming {
+		if err := u.releaseNode(ctx, plan.name, len(recreated) > 0); err != nil {
+			return err
+		}
+	}
+
+	if err := u.deleteStatefulSet(ctx); err != nil {
+		return err
+	}
+	for _, claim := range recreated {
+		pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: u.opts.Namespace, Name: claim}}
+		if err := u.client.Delete(ctx, pvc); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "deleting pvc %s", claim)
+		}
+		logrus.Infof("Deleted pvc %s", claim)
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: u.opts.Namespace, Name: plan.name}}
+	if err := u.client.Delete(ctx, pod); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "deleting pod %s", plan.name)
+	}
+	logrus.Infof("Deleted pod %s", plan.name)
+
+	// The PVCs are only removed once the pod is gone, and would be reused by the recreated pod otherwise.
+	if err := kube.WaitForDeleted(ctx, u.client, pod, u.opts.PodUpdateTimeout, u.pollInterval); err != nil {
+		return err
+	}
+	for _, claim := range recreated {
+		if err := kube.WaitForDeleted(ctx, u.client, &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: u.opts.Namespace, Name: claim}}, u.opts.PodUpdateTimeout, u.pollInterval); err != nil {
+			return err
+		}
+	}
+
+	if err := u.runHelm(ctx, u.helmArgs("upgrade", release, onDeleteOverrides...)...); err != nil {
+		return errors.Wrap(err, "upgrading the helm release")
+	}
+	if err := kube.WaitForPodReady(ctx, u.client, plan.name, u.opts.Namespace, u.opts.PodUpdateTimeout, u.pollInterval); err != nil {
+		return err
+	}
+
+	logrus.Infof("Waiting for %s for pod %s to become stable", u.opts.ReadinessWait, plan.name)
+	if err := kube.Sleep(ctx, u.opts.ReadinessWait); err != nil {
+		return err
+	}
+	return waitForHealthyCluster(ctx, u.cluster, u.opts.HealthTimeout, u.pollInterval)
+}
+
+// releaseNode drains the node of the pod, or decommissions it if its store is lost with its volumes.
+func (u *PVCUpgrader) releaseNode(ctx context.Context, podName string, decommission bool) error {
+	status, err := u.cluster.Status(ctx)
+	if err != nil {
+		return err
+	}
+	node, ok := status.NodeOnHost(podName)
+	if !ok {
+		logrus.Warnf("No node of the cluster runs in pod %s, it is replaced without draining it", podName)
+		return nil
+	}
+
+	if !decommission {
+		logrus.Infof("Draining node %d of pod %s", node.ID, podName)
+		return u.nodes.Drain(ctx, podName, node.ID)
+	}
+
+	if err := u.checkReplicationFactor(ctx, status); err != nil {
+		return err
+	}
+	logrus.Infof("Decommissioning node %d of pod %s, whose volumes are recreated", node.ID, podName)
+	decommissionCtx, cancel := context.WithTimeout(ctx, u.opts.DecommissionTimeout)
+	defer cancel()
+	return u.nodes.Decommission(decommissionCtx, podName, node.ID)
+}
+
+// planPod compares the PVCs of the pod with the volume claim templates.
+func (u *PVCUpgrader) planPod(ctx context.Context, ordinal int32, templates []corev1.PersistentVolumeClaim) (podPlan, error) {
+	plan := podPlan{ordinal: ordinal, name: fmt.Sprintf("%s-%d", u.opts.StatefulSetName, ordinal)}
+	for _, template := range templates {
+		claim := fmt.Sprintf("%s-%s", template.Name, plan.name)
+		var pvc corev1.PersistentVolumeClaim
+		err := u.client.Get(ctx, types.NamespacedName{Namespace: u.opts.Namespace, Name: claim}, &pvc)
+		switch {
+		case apierrors.IsNotFound(err):
+			plan.changes = append(plan.changes, claimChange{claim: claim})
+		case err != nil:
+			return plan, errors.Wrapf(err, "getting pvc %s", claim)
+		default:
+			if reasons := claimDiff(pvc.Spec, template.Spec); len(reasons) > 0 {
+				plan.changes = append(plan.changes, claimChange{claim: claim, recreate: true, reasons: reasons})
+			}
+		}
+	}
+	return plan, nil
+}
+
+// claimDiff returns the differences of the spec of a PVC with its template, which can only be applied by
+// recreating it. The fields which are not set by the template are defaulted, and aren't compared.
+func claimDiff(pvc, template corev1.PersistentVolumeClaimSpec) []string {
+	var reasons []string
+	if template.StorageClassName != nil && (pvc.StorageClassName == nil || *pvc.StorageClassName != *template.StorageClassName) {
+		from := "<default>"
+		if pvc.StorageClassName != nil {
+			from = *pvc.StorageClassName
+		}
+		reasons = append(reasons, fmt.Sprintf("storage class %s to %s", from, *template.StorageClassName))
+	}
+	if size, ok := template.Resources.Requests[corev1.ResourceStorage]; ok {
+		current := pvc.Resources.Requests[corev1.ResourceStorage]
+		if current.Cmp(size) != 0 {
+			reasons = append(reasons, fmt.Sprintf("size %s to %s", current.String(), size.String()))
+		}
+	}
+	if len(template.AccessModes) > 0 && !sameAccessModes(pvc.AccessModes, template.AccessModes) {
+		reasons = append(reasons, fmt.Sprintf("access modes %v to %v", pvc.AccessModes, template.AccessModes))
+	}
+	if template.VolumeMode != nil && pvc.VolumeMode != nil && *pvc.VolumeMode != *template.VolumeMode {
+		reasons = append(reasons, fmt.Sprintf("volume mode %s to %s", *pvc.VolumeMode, *template.VolumeMode))
+	}
+	return reasons
+}
+
+func sameAccessModes(a, b []corev1.PersistentVolumeAccessMode) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]corev1.PersistentVolumeAccessMode(nil), a...)
+	b = append([]corev1.PersistentVolumeAccessMode(nil), b...)
+	sort.Slice(a, func(i, j int) bool { return a[i] < a[j] })
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func volumesChange(plans []podPlan) bool {
+	for _, plan := range plans {
+		if len(plan.changes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// recreatesVolumes returns whether the volumes of a pod are recreated, which decommissions its node.
+func recreatesVolumes(plans []podPlan) bool {
+	for _, plan := range plans {
+		if len(plan.recreated()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func printPlans(plans []podPlan, current *int32, dryRun bool) {
+	prefix := ""
+	if dryRun {
+		prefix = "[dry-run] "
+	}
+	if len(plans) == 0 {
+		logrus.Infof("%sNo pod left to replace", prefix)
+		return
+	}
+	for _, plan := range plans {
+		action := "drain the node and recreate the pod"
+		switch {
+		case current != nil && *current == plan.ordinal:
+			action = "resume the replacement of the pod"
+		case len(plan.recreated()) > 0:
+			action = "decommission the node and recreate the pod"
+		}
+		var changes []string
+		for _, c := range plan.changes {
+			changes = append(changes, c.String())
+		}
+		if len(changes) == 0 {
+			changes = append(changes, "no volume changes")
+		}
+		logrus.Infof("%sPod %s: %s, %s", prefix, plan.name, action, strings.Join(changes, ", "))
+	}
+}
+
+// render renders the StatefulSet of the upgraded release.
+func (u *PVCUpgrader) render(ctx context.Context, release string) (*appsv1.StatefulSet, error) {
+	out, err := u.renderHelm(ctx, u.helmArgs("template", release, "--show-only", statefulSetTemplate)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "rendering the statefulset of the helm release")
+	}
+	var sts appsv1.StatefulSet
+	if err := yaml.Unmarshal(out, &sts); err != nil {
+		return nil, errors.Wrap(err, "decoding the rendered statefulset")
+	}
+	if sts.Name != u.opts.StatefulSetName {
+		return nil, errors.Newf("the helm release renders statefulset %q, not %s", sts.Name, u.opts.StatefulSetName)
+	}
+	return &sts, nil
+}
+
+func (u *PVCUpgrader) helmArgs(action, release string, extra ...string) []string {
+	args := []string{action, release, u.opts.Chart, "--namespace", u.opts.Namespace}
+	if u.opts.ChartVersion != "" {
+		args = append(args, "--version", u.opts.ChartVersion)
+	}
+	for _, values := range u.opts.ValuesFiles {
+		args = append(args, "--values", values)
+	}
+	return append(args, extra...)
+}
+
+// deleteStatefulSet deletes the StatefulSet, and leaves its pods running.
+func (u *PVCUpgrader) deleteStatefulSet(ctx context.Context) error {
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: u.opts.Namespace, Name: u.opts.StatefulSetName}}
+	err := u.client.Delete(ctx, sts, client.PropagationPolicy(metav1.DeletePropagationOrphan))
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "deleting statefulset %s", u.opts.StatefulSetName)
+	}
+	logrus.Infof("Deleted statefulset %s, leaving its pods running", u.opts.StatefulSetName)
+	return kube.WaitForDeleted(ctx, u.client, sts, u.opts.PodUpdateTimeout, u.pollInterval)
+}
+
+// checkReplicationFactor returns an error if the ranges of the cluster can't be fully replicated on the other
+// nodes once a node is decommissioned, in which case its decommission never completes.
+func (u *PVCUpgrader) checkReplicationFactor(ctx context.Context, status health.Status) error {
+	factor, zone, err := u.cluster.ReplicationFactor(ctx)
+	if err != nil {
+		return err
+	}
+	if remaining := int32(len(status.BuildVersions())) - 1; remaining < factor {
+		return errors.Newf("the ranges of %s are replicated %d times, and can't be fully replicated on the %d nodes left once a node is decommissioned: lower its num_replicas or scale the cluster up before recreating volumes", zone, factor, remaining)
+	}
+	return nil
+}
+
+func (u *PVCUpgrader) checkpointPath() string {
+	return filepath.Join(u.opts.CheckpointDir, pvcCheckpointJSON)
+}
+
+func (u *PVCUpgrader) loadCheckpoint() (*pvcCheckpoint, error) {
+	checkpoint := &pvcCheckpoint{StatefulSet: u.opts.StatefulSetName}
+
+	found, err := util.LoadCheckpoint(u.checkpointPath(), checkpoint)
+	if err != nil || !found {
+		return checkpoint, err
+	}
+	if checkpoint.StatefulSet != u.opts.StatefulSetName {
+		return nil, errors.Newf("checkpoint %s belongs to statefulset %s", u.checkpointPath(), checkpoint.StatefulSet)
+	}
+	if len(checkpoint.UpgradedPods) > 0 || checkpoint.CurrentPod != nil {
+		logrus.Infof("Resuming upgrade, replaced pods: %v", checkpoint.UpgradedPods)
+	}
+	return checkpoint, nil
+}
+
+func (u *PVCUpgrader) saveCheckpoint(checkpoint *pvcCheckpoint) error {
+	if u.opts.DryRun {
+		return nil
+	}
+	return util.SaveCheckpoint(u.checkpointPath(), checkpoint)
+}
+
+func replicas(sts *appsv1.StatefulSet) int32 {
+	if sts.Spec.Replicas == nil {
+		return 1
+	}
+	return *sts.Spec.Replicas
+}
+
+func runHelmCLI(ctx context.Context, args ...string) error {
+	logrus.Infof("Running helm %s", strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, "helm", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func renderHelmCLI(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "helm", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "helm %s: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
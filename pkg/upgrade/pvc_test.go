@@ -0,0 +1,424 @@
+package upgrade
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/database/health"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+var pvcTestLabels = map[string]string{"app.kubernetes.io/instance": "crdb"}
+
+func claimTemplate(name, storageClass, size string) corev1.PersistentVolumeClaim {
+	return corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: &storageClass,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+			},
+		},
+	}
+}
+
+func pvcTestStatefulSet(templates ...corev1.PersistentVolumeClaim) *appsv1.StatefulSet {
+	replicas := int32(3)
+	return &appsv1.StatefulSet{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "crdb",
+			Namespace:   upgradeTestNamespace,
+			Annotations: map[string]string{helmReleaseNameAnnotation: "crdb"},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:             &replicas,
+			Selector:             &metav1.LabelSelector{MatchLabels: pvcTestLabels},
+			UpdateStrategy:       appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType},
+			VolumeClaimTemplates: templates,
+		},
+	}
+}
+
+// fakeHelm renders the StatefulSet, and recreates it with its missing pods and PVCs on upgrade, as the
+// StatefulSet controller does.
+type fakeHelm struct {
+	t        *testing.T
+	client   client.Client
+	rendered *appsv1.StatefulSet
+	calls    []string
+	// failUpgrade fails the given upgrade, counting from 1.
+	failUpgrade int
+	upgrades    int
+	podUIDs     int
+}
+
+func (h *fakeHelm) render(_ context.Context, args ...string) ([]byte, error) {
+	h.calls = append(h.calls, strings.Join(args, " "))
+	return yaml.Marshal(h.rendered)
+}
+
+func (h *fakeHelm) run(ctx context.Context, args ...string) error {
+	h.calls = append(h.calls, strings.Join(args, " "))
+	h.upgrades++
+	if h.upgrades == h.failUpgrade {
+		return assert.AnError
+	}
+
+	sts := h.rendered.DeepCopy()
+	if strings.Contains(strings.Join(args, " "), "updateStrategy.type=OnDelete") {
+		sts.Spec.UpdateStrategy = appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType}
+	}
+	var existing appsv1.StatefulSet
+	err := h.client.Get(ctx, client.ObjectKeyFromObject(sts), &existing)
+	switch {
+	case apierrors.IsNotFound(err):
+		require.NoError(h.t, h.client.Create(ctx, sts))
+	case err != nil:
+		return err
+	default:
+		existing.Spec = sts.Spec
+		require.NoError(h.t, h.client.Update(ctx, &existing))
+	}
+
+	for i := int32(0); i < *sts.Spec.Replicas; i++ {
+		podName := fmt.Sprintf("crdb-%d", i)
+		for _, template := range sts.Spec.VolumeClaimTemplates {
+			pvc := template.DeepCopy()
+			pvc.Name = fmt.Sprintf("%s-%s", template.Name, podName)
+			pvc.Namespace = upgradeTestNamespace
+			if err := h.client.Create(ctx, pvc); err != nil && !apierrors.IsAlreadyExists(err) {
+				return err
+			}
+		}
+		h.podUIDs++
+		if err := h.client.Create(ctx, pvcTestPod(podName, h.podUIDs)); err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func pvcTestPod(name string, uid int) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: upgradeTestNamespace,
+			Labels:    pvcTestLabels,
+			UID:       types.UID(fmt.Sprintf("uid-%d", uid)),
+		},
+		Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}},
+	}
+}
+
+// fakeNodes is a cluster with a node per pod. A node is decommissioned with the store of its pod, and the
+// recreated pod joins the cluster as a new node.
+type fakeNodes struct {
+	client   client.Client
+	nodes    map[types.UID]int32
+	nextID   int32
+	removed  []int32
+	drained  map[types.UID]bool
+	commands []string
+	// factor is the replication factor of the zone configurations.
+	factor int32
+}
+
+func (c *fakeNodes) Status(ctx context.Context) (health.Status, error) {
+	var pods corev1.PodList
+	if err := c.client.List(ctx, &pods, client.InNamespace(upgradeTestNamespace)); err != nil {
+		return health.Status{}, err
+	}
+
+	status := health.Status{}
+	for _, id := range c.removed {
+		status.Nodes = append(status.Nodes, health.Node{ID: id, Membership: health.MembershipDecommissioned})
+	}
+	for _, pod := range pods.Items {
+		id, ok := c.nodes[pod.UID]
+		if !ok {
+			c.nextID++
+			id = c.nextID
+			c.nodes[pod.UID] = id
+		}
+		status.Nodes = append(status.Nodes, health.Node{
+			ID:         id,
+			Address:    fmt.Sprintf("%s.crdb.default.svc.cluster.local:26257", pod.Name),
+			IsLive:     true,
+			Draining:   c.drained[pod.UID],
+			Membership: health.MembershipActive,
+		})
+	}
+	// A node is down while its pod is replaced.
+	if len(pods.Items) < 3 {
+		status.Ranges.UnderReplicated = 10
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool { return status.Nodes[i].ID < status.Nodes[j].ID })
+	return status, nil
+}
+
+func (c *fakeNodes) ReplicationFactor(context.Context) (int32, string, error) {
+	return c.factor, "RANGE default", nil
+}
+
+func (c *fakeNodes) Decommission(_ context.Context, podName string, nodeIDs ...int32) error {
+	c.commands = append(c.commands, fmt.Sprintf("decommission %v in %s", nodeIDs, podName))
+	for uid, id := range c.nodes {
+		for _, removed := range nodeIDs {
+			if id == removed {
+				delete(c.nodes, uid)
+				c.removed = append(c.removed, id)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *fakeNodes) Drain(ctx context.Context, podName string, nodeID int32) error {
+	c.commands = append(c.commands, fmt.Sprintf("drain %d in %s", nodeID, podName))
+	var pod corev1.Pod
+	if err := c.client.Get(ctx, types.NamespacedName{Namespace: upgradeTestNamespace, Name: podName}, &pod); err != nil {
+		return err
+	}
+	c.drained[pod.UID] = true
+	return nil
+}
+
+func newPVCTestCluster(t *testing.T, current, rendered *appsv1.StatefulSet) (client.Client, *fakeHelm, *fakeNodes) {
+	objects := []client.Object{current}
+	// A node of the three nodes can be decommissioned, the ranges are fully replicated on the two other nodes.
+	nodes := &fakeNodes{nodes: map[types.UID]int32{}, drained: map[types.UID]bool{}, factor: 2}
+	for i := 0; i < 3; i++ {
+		pod := pvcTestPod(fmt.Sprintf("crdb-%d", i), 100+i)
+		nodes.nextID++
+		nodes.nodes[pod.UID] = nodes.nextID
+		objects = append(objects, pod)
+		for _, template := range current.Spec.VolumeClaimTemplates {
+			pvc := template.DeepCopy()
+			pvc.Name = fmt.Sprintf("%s-%s", template.Name, pod.Name)
+			pvc.Namespace = upgradeTestNamespace
+			objects = append(objects, pvc)
+		}
+	}
+
+	cl := fakeclient.NewClientBuilder().WithObjects(objects...).Build()
+	nodes.client = cl
+	return cl, &fakeHelm{t: t, client: cl, rendered: rendered}, nodes
+}
+
+func newTestPVCUpgrader(t *testing.T, cl client.Client, helm *fakeHelm, nodes *fakeNodes, opts PVCOptions) *PVCUpgrader {
+	opts.StatefulSetName = "crdb"
+	opts.Namespace = upgradeTestNamespace
+	opts.Chart = "cockroachdb/cockroachdb"
+	opts.ValuesFiles = []string{"values.yaml"}
+	opts.CheckpointDir = t.TempDir()
+	opts.PodUpdateTimeout = time.Second
+	opts.HealthTimeout = 200 * time.Millisecond
+	opts.DecommissionTimeout = time.Second
+	return &PVCUpgrader{
+		client: cl,
+		nodes:  nodes,
+		opts:   opts,
+		connect: func(_ context.Context, selector labels.Selector) (pvcCluster, error) {
+			assert.Equal(t, labels.SelectorFromSet(pvcTestLabels).String(), selector.String())
+			return nodes, nil
+		},
+		runHelm:      helm.run,
+		renderHelm:   helm.render,
+		in:           bufio.NewReader(strings.NewReader("")),
+		pollInterval: 10 * time.Millisecond,
+	}
+}
+
+func claimSpec(t *testing.T, cl client.Client, name string) (string, string) {
+	var pvc corev1.PersistentVolumeClaim
+	require.NoError(t, cl.Get(context.Background(), types.NamespacedName{Namespace: upgradeTestNamespace, Name: name}, &pvc))
+	size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	return *pvc.Spec.StorageClassName, size.String()
+}
+
+const (
+	helmTemplateCall = "template crdb cockroachdb/cockroachdb --namespace default --values values.yaml --show-only templates/statefulset.yaml"
+	helmOnDeleteCall = "upgrade crdb cockroachdb/cockroachdb --namespace default --values values.yaml --set statefulset.updateStrategy.type=OnDelete --set statefulset.updateStrategy.rollingUpdate=null"
+	helmUpgradeCall  = "upgrade crdb cockroachdb/cockroachdb --namespace default --values values.yaml"
+)
+
+func TestPVCUpgradeRecreatesVolumes(t *testing.T) {
+	cl, helm, nodes := newPVCTestCluster(t,
+		pvcTestStatefulSet(claimTemplate("datadir", "standard", "10Gi")),
+		pvcTestStatefulSet(claimTemplate("datadir", "ssd", "100Gi"), claimTemplate("logsdir", "standard", "1Gi")))
+	u := newTestPVCUpgrader(t, cl, helm, nodes, PVCOptions{})
+
+	require.NoError(t, u.Run(context.Background()))
+
+	assert.Equal(t, []string{
+		"decommission [3] in crdb-2",
+		"decommission [2] in crdb-1",
+		"decommission [1] in crdb-0",
+	}, nodes.commands)
+	assert.Equal(t, []string{helmTemplateCall, helmOnDeleteCall, helmOnDeleteCall, helmOnDeleteCall, helmUpgradeCall}, helm.calls)
+	for i := 0; i < 3; i++ {
+		class, size := claimSpec(t, cl, fmt.Sprintf("datadir-crdb-%d", i))
+		assert.Equal(t, []string{"ssd", "100Gi"}, []string{class, size})
+		class, size = claimSpec(t, cl, fmt.Sprintf("logsdir-crdb-%d", i))
+		assert.Equal(t, []string{"standard", "1Gi"}, []string{class, size})
+	}
+
+	var sts appsv1.StatefulSet
+	require.NoError(t, cl.Get(context.Background(), types.NamespacedName{Namespace: upgradeTestNamespace, Name: "crdb"}, &sts))
+	assert.Equal(t, appsv1.RollingUpdateStatefulSetStrategyType, sts.Spec.UpdateStrategy.Type)
+	assert.NoFileExists(t, filepath.Join(u.opts.CheckpointDir, pvcCheckpointJSON))
+}
+
+func TestPVCUpgradeBelowReplicationFactor(t *testing.T) {
+	cl, helm, nodes := newPVCTestCluster(t,
+		pvcTestStatefulSet(claimTemplate("datadir", "standard", "10Gi")),
+		pvcTestStatefulSet(claimTemplate("datadir", "ssd", "10Gi")))
+	nodes.factor = 3
+	u := newTestPVCUpgrader(t, cl, helm, nodes, PVCOptions{})
+
+	err := u.Run(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the ranges of RANGE default are replicated 3 times, and can't be fully replicated on the 2 nodes left")
+	// No node is decommissioned, and no volume is deleted.
+	assert.Empty(t, nodes.commands)
+	assert.Equal(t, []string{helmTemplateCall}, helm.calls)
+	class, _ := claimSpec(t, cl, "datadir-crdb-2")
+	assert.Equal(t, "standard", class)
+}
+
+func TestPVCUpgradeAddsVolume(t *testing.T) {
+	cl, helm, nodes := newPVCTestCluster(t,
+		pvcTestStatefulSet(claimTemplate("datadir", "standard", "10Gi")),
+		pvcTestStatefulSet(claimTemplate("datadir", "standard", "10Gi"), claimTemplate("logsdir", "standard", "1Gi")))
+	var datadir corev1.PersistentVolumeClaim
+	require.NoError(t, cl.Get(context.Background(), types.NamespacedName{Namespace: upgradeTestNamespace, Name: "datadir-crdb-0"}, &datadir))
+	u := newTestPVCUpgrader(t, cl, helm, nodes, PVCOptions{})
+
+	require.NoError(t, u.Run(context.Background()))
+
+	// The nodes keep their stores, they are drained rather than decommissioned.
+	assert.Equal(t, []string{"drain 3 in crdb-2", "drain 2 in crdb-1", "drain 1 in crdb-0"}, nodes.commands)
+	var after corev1.PersistentVolumeClaim
+	require.NoError(t, cl.Get(context.Background(), types.NamespacedName{Namespace: upgradeTestNamespace, Name: "datadir-crdb-0"}, &after))
+	assert.Equal(t, datadir.ResourceVersion, after.ResourceVersion)
+	class, size := claimSpec(t, cl, "logsdir-crdb-0")
+	assert.Equal(t, []string{"standard", "1Gi"}, []string{class, size})
+}
+
+func TestPVCUpgradeDryRun(t *testing.T) {
+	cl, helm, nodes := newPVCTestCluster(t,
+		pvcTestStatefulSet(claimTemplate("datadir", "standard", "10Gi")),
+		pvcTestStatefulSet(claimTemplate("datadir", "ssd", "10Gi")))
+	u := newTestPVCUpgrader(t, cl, helm, nodes, PVCOptions{DryRun: true})
+
+	require.NoError(t, u.Run(context.Background()))
+
+	assert.Equal(t, []string{helmTemplateCall}, helm.calls)
+	assert.Empty(t, nodes.commands)
+	class, _ := claimSpec(t, cl, "datadir-crdb-2")
+	assert.Equal(t, "standard", class)
+	assert.NoFileExists(t, filepath.Join(u.opts.CheckpointDir, pvcCheckpointJSON))
+}
+
+func TestPVCUpgradeUnchangedVolumes(t *testing.T) {
+	cl, helm, nodes := newPVCTestCluster(t,
+		pvcTestStatefulSet(claimTemplate("datadir", "standard", "10Gi")),
+		pvcTestStatefulSet(claimTemplate("datadir", "standard", "10Gi")))
+	u := newTestPVCUpgrader(t, cl, helm, nodes, PVCOptions{})
+
+	require.NoError(t, u.Run(context.Background()))
+	assert.Equal(t, []string{helmTemplateCall}, helm.calls)
+	assert.Empty(t, nodes.commands)
+}
+
+func TestPVCUpgradeResume(t *testing.T) {
+	cl, helm, nodes := newPVCTestCluster(t,
+		pvcTestStatefulSet(claimTemplate("datadir", "standard", "10Gi")),
+		pvcTestStatefulSet(claimTemplate("datadir", "ssd", "10Gi")))
+	helm.failUpgrade = 2
+	u := newTestPVCUpgrader(t, cl, helm, nodes, PVCOptions{})
+
+	err := u.Run(context.Background())
+	require.ErrorIs(t, err, assert.AnError)
+	assert.Contains(t, err.Error(), "replacing pod crdb-1, re-run the command to resume")
+
+	data, err := os.ReadFile(filepath.Join(u.opts.CheckpointDir, pvcCheckpointJSON))
+	require.NoError(t, err)
+	var checkpoint pvcCheckpoint
+	require.NoError(t, json.Unmarshal(data, &checkpoint))
+	current := int32(1)
+	assert.Equal(t, pvcCheckpoint{StatefulSet: "crdb", Release: "crdb", CurrentPod: &current, UpgradedPods: []int32{2}}, checkpoint)
+	// The StatefulSet and the pod are left deleted, the cluster is unhealthy.
+	require.True(t, apierrors.IsNotFound(cl.Get(context.Background(), types.NamespacedName{Namespace: upgradeTestNamespace, Name: "crdb"}, &appsv1.StatefulSet{})))
+
+	resumed := newTestPVCUpgrader(t, cl, helm, nodes, PVCOptions{})
+	resumed.opts.CheckpointDir = u.opts.CheckpointDir
+	require.NoError(t, resumed.Run(context.Background()))
+
+	// The node of crdb-1 isn't decommissioned twice.
+	assert.Equal(t, []string{
+		"decommission [3] in crdb-2",
+		"decommission [2] in crdb-1",
+		"decommission [1] in crdb-0",
+	}, nodes.commands)
+	for i := 0; i < 3; i++ {
+		class, _ := claimSpec(t, cl, fmt.Sprintf("datadir-crdb-%d", i))
+		assert.Equal(t, "ssd", class)
+	}
+	assert.NoFileExists(t, filepath.Join(u.opts.CheckpointDir, pvcCheckpointJSON))
+}
+
+func TestClaimDiff(t *testing.T) {
+	current := claimTemplate("datadir", "standard", "10Gi").Spec
+	block := corev1.PersistentVolumeBlock
+	filesystem := corev1.PersistentVolumeFilesystem
+
+	tests := []struct {
+		name     string
+		template corev1.PersistentVolumeClaimSpec
+		want     []string
+	}{
+		{name: "unchanged", template: current},
+		{name: "defaults", template: corev1.PersistentVolumeClaimSpec{}},
+		{
+			name:     "storage class and size",
+			template: claimTemplate("datadir", "ssd", "100Gi").Spec,
+			want:     []string{"storage class standard to ssd", "size 10Gi to 100Gi"},
+		},
+		{
+			name: "access modes and volume mode",
+			template: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOncePod},
+				VolumeMode:  &block,
+			},
+			want: []string{"access modes [ReadWriteOnce] to [ReadWriteOncePod]", "volume mode Filesystem to Block"},
+		},
+	}
+	current.VolumeMode = &filesystem
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, claimDiff(current, tt.template))
+		})
+	}
+}
@@ -0,0 +1,437 @@
+package upgrade
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/database"
+	"github.com/cockroachdb/helm-charts/pkg/database/health"
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// preserveDowngradeOption holds the cluster version during a major upgrade, so that it can be rolled back.
+const preserveDowngradeOption = "cluster.preserve_downgrade_option"
+
+// Options are the target and the safety options of an upgrade.
+type Options struct {
+	database.StatefulSetConnection
+	// Version is the CockroachDB release to upgrade to, such as v24.1.3.
+	Version string
+	// Image is the image of the release. It defaults to the repository of the current image, tagged with Version.
+	Image string
+	// PreserveDowngrade sets cluster.preserve_downgrade_option during a major upgrade, so that the upgrade can be
+	// rolled back until it is finalized.
+	PreserveDowngrade bool
+	// Finalize finalizes a major upgrade once every node runs the new release. The cluster is left at the
+	// previous version otherwise, until cluster.preserve_downgrade_option is reset.
+	Finalize bool
+	// Rollback rolls the pods back to the previous image if the upgrade fails before it is finalized.
+	Rollback bool
+	// SkipVersionCheck skips the check that the cluster can be upgraded to the release in a single upgrade.
+	SkipVersionCheck bool
+	// ReadinessWait is waited for after each pod becomes ready, before the health of the cluster is checked.
+	ReadinessWait time.Duration
+	// PodUpdateTimeout bounds the wait for each pod to be recreated and become ready.
+	PodUpdateTimeout time.Duration
+	// HealthTimeout bounds the wait for the cluster to be healthy after each pod is restarted.
+	HealthTimeout time.Duration
+	// FinalizeTimeout bounds the wait for the cluster version to be finalized.
+	FinalizeTimeout time.Duration
+	// ConfirmReleaseImage confirms that the image of a StatefulSet managed by a Helm release is patched out of
+	// band, and that the image value of the release is set to the release afterwards. The next helm upgrade
+	// rolls the pods back to the image of the release otherwise.
+	ConfirmReleaseImage bool
+}
+
+// clusterStatus reports the health of the cluster.
+type clusterStatus interface {
+	Status(ctx context.Context) (health.Status, error)
+}
+
+// execer executes the statements which set the cluster settings.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Upgrader upgrades the CockroachDB release of the pods of a StatefulSet, one pod at a time, and finalizes the
+// upgrade of the cluster version.
+type Upgrader struct {
+	client  client.Client
+	cluster clusterStatus
+	db      execer
+	opts    Options
+	closer  func() error
+	// pollInterval is the maximum interval between the checks of the pods and of the cluster.
+	pollInterval time.Duration
+}
+
+// NewUpgrader connects to the Kubernetes cluster, and to the ready pods of the StatefulSet as the root user.
+func NewUpgrader(kubeconfig string, opts Options) (*Upgrader, error) {
+	if err := ValidateVersion(opts.Version); err != nil {
+		return nil, err
+	}
+
+	_, cl, db, err := opts.Connect(context.Background(), kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Upgrader{
+		client:       cl,
+		cluster:      health.NewChecker(db),
+		db:           db,
+		opts:         opts,
+		closer:       db.Close,
+		pollInterval: 5 * time.Second,
+	}, nil
+}
+
+// Close closes the connection to the cluster.
+func (u *Upgrader) Close() error {
+	if u.closer == nil {
+		return nil
+	}
+	return u.closer()
+}
+
+// Run upgrades the cluster:
+//
+//  1. The cluster must be healthy and finalized, and its version must be upgradable to the release. The upgrade of
+//     a cluster left with mixed versions by a failed upgrade is resumed, or rolled back to the previous version.
+//  2. cluster.preserve_downgrade_option is set during a major upgrade, if PreserveDowngrade is set.
+//  3. The pods are rolled to the new image from the highest ordinal, the cluster must be healthy after each pod.
+//  4. Every node must report the build of the release.
+//  5. The upgrade is finalized. The pods are rolled back to the previous image if a step failed, if Rollback is
+//     set and the cluster version wasn't finalized yet.
+func (u *Upgrader) Run(ctx context.Context) error {
+	var sts appsv1.StatefulSet
+	if err := u.client.Get(ctx, types.NamespacedName{Namespace: u.opts.Namespace, Name: u.opts.StatefulSetName}, &sts); err != nil {
+		return errors.Wrapf(err, "getting statefulset %s", u.opts.StatefulSetName)
+	}
+	container := dbContainer(&sts)
+	if container == nil {
+		return errors.Newf("statefulset %s has no container", u.opts.StatefulSetName)
+	}
+	previousImage := container.Image
+	targetImage := u.opts.Image
+	if targetImage == "" {
+		targetImage = imageWithVersion(previousImage, u.opts.Version)
+	}
+	release := sts.Annotations[helmReleaseNameAnnotation]
+	if release != "" && !u.opts.ConfirmReleaseImage {
+		return errors.Newf("statefulset %s is managed by helm release %s, whose image isn't updated by the upgrade: "+
+			"the next helm upgrade rolls the pods back unless the image value of the release is set to %s. Confirm "+
+			"that it will be set once the upgrade completes to proceed", u.opts.StatefulSetName, release, targetImage)
+	}
+
+	status, err := u.cluster.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if err := status.Healthy(); err != nil {
+		return errors.Wrap(err, "refusing to upgrade")
+	}
+	clusterVersion := status.Version.Version
+	if err := checkUpgradeState(status, u.opts.Version); err != nil {
+		return err
+	}
+	if !u.opts.SkipVersionCheck {
+		if err := CheckVersionSkip(clusterVersion, u.opts.Version); err != nil {
+			return err
+		}
+	}
+	if previousImage == targetImage && buildsMatch(status, u.opts.Version) == nil {
+		logrus.Infof("Every node of statefulset %s already runs %s", u.opts.StatefulSetName, u.opts.Version)
+		return nil
+	}
+
+	major := isMajorUpgrade(clusterVersion, u.opts.Version)
+	logrus.Infof("Upgrading statefulset %s from %s to %s, cluster version %s", u.opts.StatefulSetName, previousImage, targetImage, clusterVersion)
+
+	preserved := false
+	if major && u.opts.PreserveDowngrade {
+		logrus.Infof("Setting %s to %s", preserveDowngradeOption, clusterVersion)
+		if err := u.setPreserveDowngradeOption(ctx, clusterVersion); err != nil {
+			return err
+		}
+		preserved = true
+	}
+
+	if err := u.rollAndVerify(ctx, targetImage); err != nil {
+		if !u.opts.Rollback {
+			return errors.Wrapf(err, "upgrading to %s, the pods were not rolled back", u.opts.Version)
+		}
+		logrus.Errorf("Upgrade to %s failed: %v", u.opts.Version, err)
+		if rollbackErr := u.rollback(ctx, previousImage, preserved); rollbackErr != nil {
+			return errors.CombineErrors(errors.Wrapf(err, "upgrading to %s", u.opts.Version), errors.Wrap(rollbackErr, "rolling back"))
+		}
+		return errors.Wrapf(err, "upgrading to %s, rolled back to %s", u.opts.Version, previousImage)
+	}
+
+	if major {
+		if err := u.finalize(ctx, preserved); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Every node of statefulset %s runs %s", u.opts.StatefulSetName, u.opts.Version)
+	if release != "" {
+		logrus.Warnf("Set the image of helm release %s to %s, or the next helm upgrade rolls the pods back to %s",
+			release, targetImage, previousImage)
+	}
+	return nil
+}
+
+// checkUpgradeState returns an error unless the cluster is finalized, or its nodes run either the release series
+// of the cluster version or the one of the target version, as left by a failed upgrade. Such an upgrade is resumed
+// with the version it was started with, or rolled back with the previous version.
+func checkUpgradeState(status health.Status, version string) error {
+	state := status.Upgrade()
+	switch state {
+	case health.UpgradeFinalized:
+		return nil
+	case health.UpgradeMixedVersions:
+		if health.ReleaseSeries(version) == health.ReleaseSeries(status.Version.Version) {
+			// Rolling back.
+			return nil
+		}
+		for _, build := range status.BuildVersions() {
+			if series := health.ReleaseSeries(build); series != health.ReleaseSeries(status.Version.Version) && series != health.ReleaseSeries(version) {
+				return errors.Newf("refusing to upgrade a cluster whose nodes run %s, neither the release series of the cluster version %s nor of %s", build, status.Version.Version, version)
+			}
+		}
+		return nil
+	default:
+		return errors.Newf("refusing to upgrade a cluster whose previous upgrade is %s, finalize it first", state)
+	}
+}
+
+// rollAndVerify rolls the pods to the image, and checks that every node runs the release.
+func (u *Upgrader) rollAndVerify(ctx context.Context, image string) error {
+	if err := u.roll(ctx, image); err != nil {
+		return err
+	}
+	logrus.Infof("Verifying that every node runs %s", u.opts.Version)
+	return u.retry(ctx, u.opts.HealthTimeout, func() error {
+		status, err := u.cluster.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return buildsMatch(status, u.opts.Version)
+	})
+}
+
+// finalize finalizes a major upgrade, or leaves it to be finalized manually.
+func (u *Upgrader) finalize(ctx context.Context, preserved bool) error {
+	if !u.opts.Finalize {
+		if preserved {
+			logrus.Infof("The upgrade is not finalized, and can still be rolled back. Finalize it with "+
+				"RESET CLUSTER SETTING %s once the cluster is validated", preserveDowngradeOption)
+		}
+		return nil
+	}
+	if preserved {
+		logrus.Infof("Finalizing the upgrade, resetting %s", preserveDowngradeOption)
+		if _, err := u.db.ExecContext(ctx, "RESET CLUSTER SETTING "+preserveDowngradeOption); err != nil {
+			return errors.Wrapf(err, "resetting %s", preserveDowngradeOption)
+		}
+	}
+
+	logrus.Info("Waiting for the cluster version to be finalized")
+	return u.retry(ctx, u.opts.FinalizeTimeout, func() error {
+		status, err := u.cluster.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if state := status.Upgrade(); state != health.UpgradeFinalized {
+			return errors.Newf("cluster version %s is %s", status.Version.Version, state)
+		}
+		logrus.Infof("The cluster version is finalized to %s", status.Version.Version)
+		return nil
+	})
+}
+
+// rollback rolls the pods back to the previous image, unless the cluster version is already being finalized.
+func (u *Upgrader) rollback(ctx context.Context, previousImage string, preserved bool) error {
+	status, err := u.cluster.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if state := status.Upgrade(); state == health.UpgradeFinalizing {
+		return errors.Newf("the cluster version is being finalized, the upgrade can't be rolled back")
+	}
+
+	logrus.Infof("Rolling the pods back to %s", previousImage)
+	if err := u.roll(ctx, previousImage); err != nil {
+		return err
+	}
+	if preserved {
+		if _, err := u.db.ExecContext(ctx, "RESET CLUSTER SETTING "+preserveDowngradeOption); err != nil {
+			return errors.Wrapf(err, "resetting %s", preserveDowngradeOption)
+		}
+	}
+	return nil
+}
+
+func (u *Upgrader) setPreserveDowngradeOption(ctx context.Context, version string) error {
+	statement := fmt.Sprintf("SET CLUSTER SETTING %s = %s", preserveDowngradeOption, database.QuoteLiteral(version))
+	if _, err := u.db.ExecContext(ctx, statement); err != nil {
+		return errors.Wrapf(err, "setting %s", preserveDowngradeOption)
+	}
+	return nil
+}
+
+// roll sets the image of the StatefulSet, and lowers the partition of its rolling update one pod at a time from
+// the highest ordinal, so that each pod is only recreated once the previous one runs the image and the cluster is
+// healthy. The update strategy of the StatefulSet is restored once every pod runs the image. The partition is
+// left in place if a pod fails, so that the remaining pods keep running their image.
+func (u *Upgrader) roll(ctx context.Context, image string) error {
+	key := types.NamespacedName{Namespace: u.opts.Namespace, Name: u.opts.StatefulSetName}
+	var sts appsv1.StatefulSet
+	if err := u.client.Get(ctx, key, &sts); err != nil {
+		return errors.Wrapf(err, "getting statefulset %s", u.opts.StatefulSetName)
+	}
+	replicas := int32(1)
+	if sts.Spec.Replicas != nil {
+		replicas = *sts.Spec.Replicas
+	}
+	originalStrategy := *sts.Spec.UpdateStrategy.DeepCopy()
+	if rollingUpdate := originalStrategy.RollingUpdate; rollingUpdate != nil && rollingUpdate.Partition != nil && *rollingUpdate.Partition > 0 {
+		// The partition was left by a failed roll.
+		originalStrategy = appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType}
+	}
+
+	partition := replicas
+	if err := u.patchStatefulSet(ctx, &sts, func(sts *appsv1.StatefulSet) {
+		sts.Spec.UpdateStrategy = appsv1.StatefulSetUpdateStrategy{
+			Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+			RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+		}
+		dbContainer(sts).Image = image
+	}); err != nil {
+		return err
+	}
+
+	for ordinal := replicas - 1; ordinal >= 0; ordinal-- {
+		podName := u.opts.StatefulSetName + "-" + strconv.Itoa(int(ordinal))
+		logrus.Infof("Rolling pod %s to %s", podName, image)
+		partition := ordinal
+		if err := u.patchStatefulSet(ctx, &sts, func(sts *appsv1.StatefulSet) {
+			sts.Spec.UpdateStrategy.RollingUpdate.Partition = &partition
+		}); err != nil {
+			return err
+		}
+		err := u.waitForPodUpdated(ctx, podName)
+		if err == nil {
+			// Let the node settle before checking the health of the cluster.
+			if err = kube.Sleep(ctx, u.opts.ReadinessWait); err == nil {
+				err = waitForHealthyCluster(ctx, u.cluster, u.opts.HealthTimeout, u.pollInterval)
+			}
+		}
+		if err != nil {
+			logrus.Errorf("The rolling update of statefulset %s is left at partition %d, so that the pods below %s "+
+				"are not recreated", u.opts.StatefulSetName, ordinal, podName)
+			return errors.Wrapf(err, "after restarting pod %s", podName)
+		}
+	}
+
+	return u.patchStatefulSet(ctx, &sts, func(sts *appsv1.StatefulSet) {
+		sts.Spec.UpdateStrategy = originalStrategy
+	})
+}
+
+func (u *Upgrader) patchStatefulSet(ctx context.Context, sts *appsv1.StatefulSet, mutate func(*appsv1.StatefulSet)) error {
+	if err := u.client.Get(ctx, client.ObjectKeyFromObject(sts), sts); err != nil {
+		return errors.Wrapf(err, "getting statefulset %s", sts.Name)
+	}
+	patch := client.MergeFrom(sts.DeepCopy())
+	mutate(sts)
+	if err := u.client.Patch(ctx, sts, patch); err != nil {
+		return errors.Wrapf(err, "patching statefulset %s", sts.Name)
+	}
+	return nil
+}
+
+// waitForPodUpdated waits for the pod to be recreated at the update revision of the StatefulSet, and to be ready.
+func (u *Upgrader) waitForPodUpdated(ctx context.Context, podName string) error {
+	err := u.retry(ctx, u.opts.PodUpdateTimeout, func() error {
+		var sts appsv1.StatefulSet
+		if err := u.client.Get(ctx, types.NamespacedName{Namespace: u.opts.Namespace, Name: u.opts.StatefulSetName}, &sts); err != nil {
+			return err
+		}
+		if sts.Status.ObservedGeneration < sts.Generation || sts.Status.UpdateRevision == "" {
+			return errors.Newf("statefulset %s update is not observed yet", sts.Name)
+		}
+
+		var pod corev1.Pod
+		if err := u.client.Get(ctx, types.NamespacedName{Namespace: u.opts.Namespace, Name: podName}, &pod); err != nil {
+			return err
+		}
+		if pod.Labels[appsv1.ControllerRevisionHashLabelKey] != sts.Status.UpdateRevision {
+			return errors.Newf("pod %s is not updated to revision %s yet", podName, sts.Status.UpdateRevision)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return kube.WaitForPodReady(ctx, u.client, podName, u.opts.Namespace, u.opts.PodUpdateTimeout, u.pollInterval)
+}
+
+// checkHealthy returns an error if a node of the cluster is down or draining, or if ranges are not fully
+// replicated.
+func checkHealthy(ctx context.Context, cluster clusterStatus) error {
+	status, err := cluster.Status(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Healthy()
+}
+
+// waitForHealthyCluster waits for every node to be live, and for every range to be fully replicated.
+func waitForHealthyCluster(ctx context.Context, cluster clusterStatus, timeout, pollInterval time.Duration) error {
+	return kube.Retry(ctx, timeout, pollInterval, func() error {
+		return checkHealthy(ctx, cluster)
+	})
+}
+
+func (u *Upgrader) retry(ctx context.Context, timeout time.Duration, f func() error) error {
+	return kube.Retry(ctx, timeout, u.pollInterval, f)
+}
+
+// buildsMatch returns an error listing the nodes which don't run the version.
+func buildsMatch(status health.Status, version string) error {
+	var stale []string
+	for _, n := range status.Nodes {
+		if !n.Decommissioned() && n.BuildTag != version {
+			stale = append(stale, fmt.Sprintf("node %d runs %s", n.ID, n.BuildTag))
+		}
+	}
+	if len(stale) > 0 {
+		return errors.Newf("not every node runs %s: %s", version, strings.Join(stale, ", "))
+	}
+	return nil
+}
+
+// dbContainer returns the CockroachDB container of the StatefulSet, or its first container.
+func dbContainer(sts *appsv1.StatefulSet) *corev1.Container {
+	containers := sts.Spec.Template.Spec.Containers
+	for i := range containers {
+		if containers[i].Name == database.DBContainerName {
+			return &containers[i]
+		}
+	}
+	if len(containers) == 0 {
+		return nil
+	}
+	return &containers[0]
+}
@@ -0,0 +1,343 @@
+package upgrade
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/helm-charts/pkg/database/health"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+const (
+	upgradeTestNamespace = "default"
+	previousImage        = "cockroachdb/cockroach:v23.2.9"
+)
+
+// fakeCluster is a cluster whose nodes run the images of the pods. It finalizes its version as CockroachDB does,
+// once every node runs the same release series and cluster.preserve_downgrade_option is not set.
+type fakeCluster struct {
+	client client.Client
+
+	mu         sync.Mutex
+	version    string
+	preserve   string
+	statements []string
+	// broken are the versions whose nodes never become live.
+	broken map[string]bool
+	// unhealthy makes the cluster report under-replicated ranges.
+	unhealthy bool
+}
+
+func (c *fakeCluster) Status(ctx context.Context) (health.Status, error) {
+	var pods corev1.PodList
+	if err := c.client.List(ctx, &pods, client.InNamespace(upgradeTestNamespace)); err != nil {
+		return health.Status{}, err
+	}
+	sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Name < pods.Items[j].Name })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := health.Status{}
+	series := map[string]bool{}
+	for i, pod := range pods.Items {
+		image := pod.Spec.Containers[0].Image
+		build := image[strings.LastIndex(image, ":")+1:]
+		series[health.ReleaseSeries(build)] = true
+		status.Nodes = append(status.Nodes, health.Node{
+			ID:         int32(i + 1),
+			BuildTag:   build,
+			IsLive:     !c.broken[build],
+			Membership: health.MembershipActive,
+		})
+	}
+	if len(series) == 1 && c.preserve == "" {
+		for s := range series {
+			c.version = s
+		}
+	}
+	if c.unhealthy {
+		status.Ranges.UnderReplicated = 3
+	}
+	status.Version = health.ClusterVersion{Version: c.version, PreserveDowngradeOption: c.preserve}
+	return status, nil
+}
+
+func (c *fakeCluster) ExecContext(_ context.Context, query string, _ ...interface{}) (sql.Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statements = append(c.statements, query)
+	switch {
+	case strings.HasPrefix(query, "SET CLUSTER SETTING "+preserveDowngradeOption):
+		_, value, _ := strings.Cut(query, "= ")
+		c.preserve = strings.Trim(value, "'")
+	case query == "RESET CLUSTER SETTING "+preserveDowngradeOption:
+		c.preserve = ""
+	}
+	return nil, nil
+}
+
+// newUpgradeTestClient returns a client whose StatefulSet is reconciled as by the StatefulSet controller: the
+// pods from the partition of the rolling update are recreated at the update revision. The partitions set are
+// recorded.
+func newUpgradeTestClient(t *testing.T, replicas int32) (client.Client, *[]int32) {
+	var partitions []int32
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "crdb",
+			Namespace:   upgradeTestNamespace,
+			Annotations: map[string]string{helmReleaseNameAnnotation: "crdb"},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:       &replicas,
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType},
+			Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "db", Image: previousImage},
+			}}},
+		},
+		Status: appsv1.StatefulSetStatus{UpdateRevision: revision(previousImage)},
+	}
+	objects := []client.Object{sts}
+	for i := int32(0); i < replicas; i++ {
+		objects = append(objects, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("crdb-%d", i),
+				Namespace: upgradeTestNamespace,
+				Labels:    map[string]string{appsv1.ControllerRevisionHashLabelKey: revision(previousImage)},
+			},
+			Spec:   corev1.PodSpec{Containers: []corev1.Container{{Name: "db", Image: previousImage}}},
+			Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}},
+		})
+	}
+
+	cl := fakeclient.NewClientBuilder().WithObjects(objects...).WithInterceptorFuncs(interceptor.Funcs{
+		Patch: func(ctx context.Context, cl client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if err := cl.Patch(ctx, obj, patch, opts...); err != nil {
+				return err
+			}
+			sts, ok := obj.(*appsv1.StatefulSet)
+			if !ok {
+				return nil
+			}
+
+			partition := int32(0)
+			if rollingUpdate := sts.Spec.UpdateStrategy.RollingUpdate; rollingUpdate != nil && rollingUpdate.Partition != nil {
+				partition = *rollingUpdate.Partition
+				partitions = append(partitions, partition)
+			}
+			image := sts.Spec.Template.Spec.Containers[0].Image
+			sts.Status.UpdateRevision = revision(image)
+			sts.Status.ObservedGeneration = sts.Generation
+			if err := cl.Status().Update(ctx, sts); err != nil {
+				return err
+			}
+
+			for i := partition; i < *sts.Spec.Replicas; i++ {
+				var pod corev1.Pod
+				require.NoError(t, cl.Get(ctx, types.NamespacedName{Namespace: upgradeTestNamespace, Name: fmt.Sprintf("crdb-%d", i)}, &pod))
+				if pod.Labels[appsv1.ControllerRevisionHashLabelKey] == sts.Status.UpdateRevision {
+					continue
+				}
+				pod.Labels[appsv1.ControllerRevisionHashLabelKey] = sts.Status.UpdateRevision
+				pod.Spec.Containers[0].Image = image
+				require.NoError(t, cl.Update(ctx, &pod))
+			}
+			return nil
+		},
+	}).Build()
+	return cl, &partitions
+}
+
+func revision(image string) string {
+	return "crdb-" + strings.NewReplacer(":", "-", ".", "-", "/", "-").Replace(image)
+}
+
+func newTestUpgrader(cl client.Client, cluster *fakeCluster, opts Options) *Upgrader {
+	opts.StatefulSetName = "crdb"
+	opts.Namespace = upgradeTestNamespace
+	opts.PodUpdateTimeout = 2 * time.Second
+	opts.HealthTimeout = 200 * time.Millisecond
+	opts.FinalizeTimeout = 2 * time.Second
+	return &Upgrader{client: cl, cluster: cluster, db: cluster, opts: opts, pollInterval: 10 * time.Millisecond}
+}
+
+func podImages(t *testing.T, cl client.Client) []string {
+	var pods corev1.PodList
+	require.NoError(t, cl.List(context.Background(), &pods))
+	sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Name < pods.Items[j].Name })
+	var images []string
+	for _, pod := range pods.Items {
+		images = append(images, pod.Spec.Containers[0].Image)
+	}
+	return images
+}
+
+func requireStrategyRestored(t *testing.T, cl client.Client, image string) {
+	var sts appsv1.StatefulSet
+	require.NoError(t, cl.Get(context.Background(), types.NamespacedName{Namespace: upgradeTestNamespace, Name: "crdb"}, &sts))
+	assert.Equal(t, appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType}, sts.Spec.UpdateStrategy)
+	assert.Equal(t, image, sts.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestUpgradeMajorVersion(t *testing.T) {
+	newImage := "cockroachdb/cockroach:v24.1.3"
+
+	t.Run("finalized", func(t *testing.T) {
+		cl, partitions := newUpgradeTestClient(t, 3)
+		cluster := &fakeCluster{client: cl, version: "23.2"}
+		u := newTestUpgrader(cl, cluster, Options{ConfirmReleaseImage: true, Version: "v24.1.3", PreserveDowngrade: true, Finalize: true, Rollback: true})
+
+		require.NoError(t, u.Run(context.Background()))
+		assert.Equal(t, []string{newImage, newImage, newImage}, podImages(t, cl))
+		// The pods are rolled from the highest ordinal.
+		assert.Equal(t, []int32{3, 2, 1, 0}, *partitions)
+		assert.Equal(t, []string{
+			"SET CLUSTER SETTING cluster.preserve_downgrade_option = '23.2'",
+			"RESET CLUSTER SETTING cluster.preserve_downgrade_option",
+		}, cluster.statements)
+		assert.Equal(t, "24.1", cluster.version)
+		requireStrategyRestored(t, cl, newImage)
+
+		// Running the upgrade again is a no-op.
+		require.NoError(t, u.Run(context.Background()))
+		assert.Len(t, cluster.statements, 2)
+	})
+
+	t.Run("not finalized", func(t *testing.T) {
+		cl, _ := newUpgradeTestClient(t, 3)
+		cluster := &fakeCluster{client: cl, version: "23.2"}
+		u := newTestUpgrader(cl, cluster, Options{ConfirmReleaseImage: true, Version: "v24.1.3", PreserveDowngrade: true})
+
+		require.NoError(t, u.Run(context.Background()))
+		assert.Equal(t, "23.2", cluster.version)
+		assert.Equal(t, "23.2", cluster.preserve)
+
+		// The next upgrade requires the previous one to be finalized.
+		u.opts.Version = "v24.1.4"
+		assert.ErrorContains(t, u.Run(context.Background()), "previous upgrade is pending-finalization, finalize it first")
+	})
+
+	t.Run("rolled back", func(t *testing.T) {
+		cl, partitions := newUpgradeTestClient(t, 3)
+		cluster := &fakeCluster{client: cl, version: "23.2", broken: map[string]bool{"v24.1.3": true}}
+		u := newTestUpgrader(cl, cluster, Options{ConfirmReleaseImage: true, Version: "v24.1.3", PreserveDowngrade: true, Finalize: true, Rollback: true})
+
+		err := u.Run(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "after restarting pod crdb-2")
+		assert.Contains(t, err.Error(), "rolled back to "+previousImage)
+		assert.Equal(t, []string{previousImage, previousImage, previousImage}, podImages(t, cl))
+		assert.Equal(t, []int32{3, 2, 3, 2, 1, 0}, *partitions)
+		assert.Equal(t, "", cluster.preserve)
+		assert.Equal(t, "23.2", cluster.version)
+		requireStrategyRestored(t, cl, previousImage)
+	})
+
+	t.Run("not rolled back", func(t *testing.T) {
+		cl, _ := newUpgradeTestClient(t, 3)
+		cluster := &fakeCluster{client: cl, version: "23.2", broken: map[string]bool{"v24.1.3": true}}
+		u := newTestUpgrader(cl, cluster, Options{ConfirmReleaseImage: true, Version: "v24.1.3", PreserveDowngrade: true, Finalize: true})
+
+		assert.ErrorContains(t, u.Run(context.Background()), "the pods were not rolled back")
+		assert.Equal(t, []string{previousImage, previousImage, newImage}, podImages(t, cl))
+		// The partition is left in place, so that the other pods are not recreated.
+		var sts appsv1.StatefulSet
+		require.NoError(t, cl.Get(context.Background(), types.NamespacedName{Namespace: upgradeTestNamespace, Name: "crdb"}, &sts))
+		assert.Equal(t, int32(2), *sts.Spec.UpdateStrategy.RollingUpdate.Partition)
+
+		// The upgrade can be rolled back by rolling the pods to the previous version.
+		cluster.broken = nil
+		u.opts.Version = "v23.2.9"
+		require.NoError(t, u.Run(context.Background()))
+		assert.Equal(t, []string{previousImage, previousImage, previousImage}, podImages(t, cl))
+		requireStrategyRestored(t, cl, previousImage)
+	})
+}
+
+func TestUpgradeChecks(t *testing.T) {
+	tests := []struct {
+		name    string
+		cluster *fakeCluster
+		opts    Options
+		wantErr string
+	}{
+		{
+			name:    "version skip",
+			cluster: &fakeCluster{version: "23.2"},
+			opts:    Options{ConfirmReleaseImage: true, Version: "v24.3.1"},
+			wantErr: "the cluster must be upgraded to 24.1 before 24.3",
+		},
+		{
+			name:    "downgrade",
+			cluster: &fakeCluster{version: "23.2"},
+			opts:    Options{ConfirmReleaseImage: true, Version: "v23.1.11"},
+			wantErr: "downgrades are not supported",
+		},
+		{
+			name:    "helm release image",
+			cluster: &fakeCluster{version: "23.2"},
+			opts:    Options{Version: "v24.1.3"},
+			wantErr: "statefulset crdb is managed by helm release crdb, whose image isn't updated by the upgrade",
+		},
+		{
+			name:    "unhealthy",
+			cluster: &fakeCluster{version: "23.2", unhealthy: true},
+			opts:    Options{ConfirmReleaseImage: true, Version: "v24.1.3"},
+			wantErr: "refusing to upgrade: cluster is unhealthy: 3 ranges are under-replicated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl, partitions := newUpgradeTestClient(t, 3)
+			cluster := tt.cluster
+			cluster.client = cl
+			u := newTestUpgrader(cl, cluster, tt.opts)
+
+			assert.ErrorContains(t, u.Run(context.Background()), tt.wantErr)
+			assert.Empty(t, *partitions)
+			assert.Empty(t, cluster.statements)
+		})
+	}
+}
+
+func TestUpgradePatchVersion(t *testing.T) {
+	cl, _ := newUpgradeTestClient(t, 3)
+	cluster := &fakeCluster{client: cl, version: "23.2"}
+	u := newTestUpgrader(cl, cluster, Options{ConfirmReleaseImage: true, Version: "v23.2.10", Image: "registry.local:5000/cockroach:v23.2.10", PreserveDowngrade: true, Finalize: true})
+
+	require.NoError(t, u.Run(context.Background()))
+	image := "registry.local:5000/cockroach:v23.2.10"
+	assert.Equal(t, []string{image, image, image}, podImages(t, cl))
+	// Patch upgrades don't change the cluster version.
+	assert.Empty(t, cluster.statements)
+}
+
+func TestCheckUpgradeState(t *testing.T) {
+	mixed := health.Status{
+		Nodes:   []health.Node{{ID: 1, BuildTag: "v23.2.9"}, {ID: 2, BuildTag: "v24.1.3"}},
+		Version: health.ClusterVersion{Version: "23.2", PreserveDowngradeOption: "23.2"},
+	}
+	// The upgrade is resumed, or rolled back.
+	assert.NoError(t, checkUpgradeState(mixed, "v24.1.4"))
+	assert.NoError(t, checkUpgradeState(mixed, "v23.2.9"))
+	assert.ErrorContains(t, checkUpgradeState(mixed, "v24.3.0"), "whose nodes run v24.1.3")
+
+	pending := health.Status{
+		Nodes:   []health.Node{{ID: 1, BuildTag: "v24.1.3"}},
+		Version: health.ClusterVersion{Version: "23.2", PreserveDowngradeOption: "23.2"},
+	}
+	assert.ErrorContains(t, checkUpgradeState(pending, "v24.3.0"), "previous upgrade is pending-finalization, finalize it first")
+}
@@ -0,0 +1,94 @@
+package upgrade
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/helm-charts/pkg/database/health"
+)
+
+// release is a release series of CockroachDB.
+type release struct {
+	series string
+	// innovation releases are optional, upgrades can skip them.
+	innovation bool
+}
+
+// releases are the release series of CockroachDB in order. A cluster can be upgraded to the next release series,
+// or to the one after it by skipping an innovation release.
+var releases = []release{
+	{series: "22.1"},
+	{series: "22.2"},
+	{series: "23.1"},
+	{series: "23.2"},
+	{series: "24.1"},
+	{series: "24.2", innovation: true},
+	{series: "24.3"},
+	{series: "25.1", innovation: true},
+	{series: "25.2"},
+	{series: "25.3", innovation: true},
+	{series: "25.4"},
+}
+
+var versionRegexp = regexp.MustCompile(`^v\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?$`)
+
+// ValidateVersion returns an error if the version isn't the build tag of a CockroachDB release, such as v24.1.3.
+func ValidateVersion(version string) error {
+	if !versionRegexp.MatchString(version) {
+		return errors.Newf("invalid version %q, expected a release such as v24.1.3", version)
+	}
+	return nil
+}
+
+// CheckVersionSkip returns an error if a cluster at the given cluster version can't be upgraded to the release
+// series of the target version in a single upgrade. Patch upgrades within a release series are always allowed,
+// downgrades never are.
+func CheckVersionSkip(clusterVersion, targetVersion string) error {
+	from := health.ReleaseSeries(clusterVersion)
+	to := health.ReleaseSeries(targetVersion)
+	if from == to {
+		return nil
+	}
+
+	fromIndex, toIndex := releaseIndex(from), releaseIndex(to)
+	if fromIndex < 0 || toIndex < 0 {
+		return errors.Newf("the upgrade from %s to %s can't be checked against the known release series, "+
+			"pass --skip-version-check once the upgrade is confirmed to be supported", from, to)
+	}
+	if toIndex < fromIndex {
+		return errors.Newf("%s is older than the cluster version %s, downgrades are not supported", to, from)
+	}
+	for _, r := range releases[fromIndex+1 : toIndex] {
+		if !r.innovation {
+			return errors.Newf("the cluster must be upgraded to %s before %s, only innovation releases can be skipped", r.series, to)
+		}
+	}
+	return nil
+}
+
+// isMajorUpgrade returns whether the target version is of another release series than the cluster version, in
+// which case the cluster version must be finalized.
+func isMajorUpgrade(clusterVersion, targetVersion string) bool {
+	return health.ReleaseSeries(clusterVersion) != health.ReleaseSeries(targetVersion)
+}
+
+func releaseIndex(series string) int {
+	for i, r := range releases {
+		if r.series == series {
+			return i
+		}
+	}
+	return -1
+}
+
+// imageWithVersion replaces the tag, or the digest, of the image by the version. The colon of a registry port
+// is not a tag separator.
+func imageWithVersion(image, version string) string {
+	repository, _, _ := strings.Cut(image, "@")
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+	return fmt.Sprintf("%s:%s", repository, version)
+}
@@ -0,0 +1,56 @@
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckVersionSkip(t *testing.T) {
+	tests := []struct {
+		from, to string
+		wantErr  string
+	}{
+		{from: "23.2", to: "v23.2.10"},
+		{from: "23.2", to: "v24.1.3"},
+		// Innovation releases can be skipped, but not upgraded from to a later release.
+		{from: "24.1", to: "v24.3.0"},
+		{from: "24.1", to: "v24.2.4"},
+		{from: "24.2", to: "v24.3.0"},
+		{from: "24.2", to: "v25.1.0", wantErr: "the cluster must be upgraded to 24.3 before 25.1"},
+		{from: "24.1", to: "v25.2.0", wantErr: "the cluster must be upgraded to 24.3 before 25.2"},
+		{from: "24.3", to: "v24.1.3", wantErr: "24.1 is older than the cluster version 24.3"},
+		{from: "25.4", to: "v26.1.0", wantErr: "pass --skip-version-check"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			err := CheckVersionSkip(tt.from, tt.to)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidateVersion(t *testing.T) {
+	for _, version := range []string{"v24.1.3", "v24.2.0-beta.1"} {
+		assert.NoError(t, ValidateVersion(version), version)
+	}
+	for _, version := range []string{"24.1.3", "v24.1", "latest-v24.1", ""} {
+		assert.Error(t, ValidateVersion(version), version)
+	}
+}
+
+func TestImageWithVersion(t *testing.T) {
+	for image, want := range map[string]string{
+		"cockroachdb/cockroach:v23.2.9":               "cockroachdb/cockroach:v24.1.3",
+		"cockroachdb/cockroach":                       "cockroachdb/cockroach:v24.1.3",
+		"registry.local:5000/cockroach":               "registry.local:5000/cockroach:v24.1.3",
+		"registry.local:5000/cockroach:v23.2.9":       "registry.local:5000/cockroach:v24.1.3",
+		"cockroachdb/cockroach@sha256:0123456789abcd": "cockroachdb/cockroach:v24.1.3",
+	} {
+		assert.Equal(t, want, imageWithVersion(image, "v24.1.3"), image)
+	}
+}
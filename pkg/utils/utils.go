@@ -17,7 +17,14 @@ limitations under the License.
 package util
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+
+	"github.com/cockroachdb/errors"
 )
 
 // CreateTempDir creates a temporary directory and returns
@@ -34,3 +41,42 @@ func CreateTempDir(baseDirectory string) (string, func()) {
 		}
 	}
 }
+
+// Approve prints the question and reads the answer from in, and returns true only if the answer is yes.
+func Approve(in *bufio.Reader, question string) bool {
+	fmt.Printf("%s [y/N]: ", question)
+	answer, err := in.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// LoadCheckpoint decodes the JSON checkpoint at path into checkpoint, and returns false if there is no checkpoint
+// yet.
+func LoadCheckpoint(path string, checkpoint interface{}) (bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "reading checkpoint")
+	}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return false, errors.Wrap(err, "decoding checkpoint")
+	}
+	return true, nil
+}
+
+// SaveCheckpoint writes the checkpoint as JSON to path.
+func SaveCheckpoint(path string, checkpoint interface{}) error {
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding checkpoint")
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return errors.Wrap(err, "writing checkpoint")
+	}
+	return nil
+}
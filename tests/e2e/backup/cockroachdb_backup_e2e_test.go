@@ -0,0 +1,135 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/helm-charts/pkg/backup"
+	"github.com/cockroachdb/helm-charts/pkg/database"
+	"github.com/cockroachdb/helm-charts/pkg/kube"
+	"github.com/cockroachdb/helm-charts/pkg/provision"
+	"github.com/cockroachdb/helm-charts/tests/testutil"
+	"github.com/cockroachdb/helm-charts/tests/testutil/migration"
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/k8s"
+	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	cfg            = ctrl.GetConfigOrDie()
+	k8sClient, _   = client.New(cfg, client.Options{})
+	k3dClusterName = "k3d-chart-testing-cluster"
+)
+
+const (
+	// collection is the nodelocal collection of the backups, which stands in for an S3 bucket. The backups are
+	// written to the extern directory of the store of the first node.
+	collection       = "nodelocal://1/backups"
+	restoredDB       = "test_db_restored"
+	sqlPort    int32 = 26257
+)
+
+// TestBackupAndRestore schedules, takes, lists and restores the backups of an insecure cluster, as a disaster
+// recovery drill would.
+func TestBackupAndRestore(t *testing.T) {
+	h := &migration.HelmInstall{
+		Namespace: "cockroach" + strings.ToLower(random.UniqueId()),
+	}
+	h.CrdbCluster = testutil.CockroachCluster{
+		Cfg:             cfg,
+		K8sClient:       k8sClient,
+		StatefulSetName: fmt.Sprintf("%s-cockroachdb", migration.ReleaseName),
+		Namespace:       h.Namespace,
+		Context:         k3dClusterName,
+		DesiredNodes:    3,
+	}
+	h.HelmOptions = &helm.Options{
+		SetValues: testutil.PatchHelmValues(map[string]string{
+			"operator.enabled": "false",
+			"tls.enabled":      "false",
+		}),
+	}
+
+	h.InstallHelm(t)
+	defer func() {
+		h.Uninstall(t)
+		k8s.DeleteNamespace(t, k8s.NewKubectlOptions("", "", h.Namespace), h.Namespace)
+	}()
+	// The validation creates the test_db database, with two rows in its accounts table.
+	h.ValidateCRDB(t)
+
+	kubeconfig, err := k8s.GetKubeConfigPathE(t)
+	require.NoError(t, err)
+	ctx := context.Background()
+	m, err := backup.NewManager(ctx, kubeconfig, backup.Options{StatefulSetConnection: database.StatefulSetConnection{
+		StatefulSetName: h.CrdbCluster.StatefulSetName,
+		Namespace:       h.Namespace,
+		SQLPort:         sqlPort,
+		PortForward:     kube.PortForwardWebSocketWithFallback,
+	}})
+	require.NoError(t, err)
+	defer m.Close()
+
+	t.Log("Scheduling the backups of test_db twice")
+	spec := provision.Spec{Databases: []provision.Database{{
+		Name:   "test_db",
+		Backup: &provision.Backup{Into: "nodelocal://1/schedules", Recurring: "@hourly", FullBackup: "@daily"},
+	}}}
+	changes, err := m.ApplySchedules(ctx, spec, false, false)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	changes, err = m.ApplySchedules(ctx, spec, false, false)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	t.Log("Backing up test_db with an incremental backup")
+	_, err = m.Backup(ctx, backup.BackupOptions{Databases: []string{"test_db"}, Into: collection, Wait: true})
+	require.NoError(t, err)
+	_, err = m.Backup(ctx, backup.BackupOptions{Databases: []string{"test_db"}, Into: collection, Incremental: true, Wait: true})
+	require.NoError(t, err)
+
+	backups, err := m.Backups(ctx, collection)
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, 2, backups[0].Layers)
+	assert.Equal(t, []string{"test_db"}, backups[0].Databases)
+
+	t.Log("Restoring test_db as", restoredDB)
+	_, err = m.Restore(ctx, backup.RestoreOptions{
+		Databases: []string{"test_db"},
+		In:        collection,
+		From:      backups[0].Path,
+		Options:   []string{fmt.Sprintf("new_db_name = '%s'", restoredDB)},
+		Wait:      true,
+	})
+	require.NoError(t, err)
+
+	jobs, err := m.Jobs(ctx, 10)
+	require.NoError(t, err)
+	require.NotEmpty(t, jobs)
+	assert.Equal(t, "RESTORE", jobs[0].Type)
+	assert.Equal(t, backup.JobSucceeded, jobs[0].Status)
+
+	port := sqlPort
+	db, err := database.NewDbConnection(&database.DBConnection{
+		Ctx:             ctx,
+		Client:          k8sClient,
+		RestConfig:      cfg,
+		StatefulSetName: h.CrdbCluster.StatefulSetName,
+		Namespace:       h.Namespace,
+		Port:            &port,
+		DatabaseName:    restoredDB,
+	})
+	require.NoError(t, err)
+	defer db.Close()
+	var count int
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT count(*) FROM accounts").Scan(&count))
+	assert.Equal(t, 2, count)
+}
@@ -1131,6 +1131,55 @@ func TestHelmDatabaseProvisioning(t *testing.T) {
 	}
 }
 
+// TestHelmInitJobProvisioner tests that the init job provisions the cluster with the migration helper instead of
+// SQL statements, from a spec without the passwords.
+func TestHelmInitJobProvisioner(t *testing.T) {
+	t.Parallel()
+
+	options := &helm.Options{
+		KubectlOptions: k8s.NewKubectlOptions("", "", namespaceName),
+		SetValues: map[string]string{
+			"operator.enabled":                                "false",
+			"init.provisioning.enabled":                       "true",
+			"init.provisioning.provisioner.enabled":           "true",
+			"init.provisioning.users[0].name":                 "testUser",
+			"init.provisioning.users[0].password":             "testPassword",
+			"init.provisioning.databases[0].name":             "testDatabase",
+			"init.provisioning.databases[0].owners[0]":        "testUser",
+			"init.provisioning.databases[0].backup.into":      "s3://backups/testDatabase",
+			"init.provisioning.databases[0].backup.recurring": "@always",
+		},
+	}
+
+	output := helm.RenderTemplate(t, options, helmChartPath, releaseName, []string{"templates/job.init.yaml"})
+	var job batchv1.Job
+	helm.UnmarshalK8SYaml(t, output, &job)
+
+	containers := job.Spec.Template.Spec.Containers
+	require.Len(t, containers, 2)
+	require.Equal(t, "cluster-init", containers[0].Name)
+	require.Contains(t, containers[0].Command[2], "initCluster;")
+	require.NotContains(t, containers[0].Command[2], "provisionCluster;")
+
+	require.Equal(t, "provision", containers[1].Name)
+	require.Contains(t, containers[1].Command[2], "until /migration-helper provision --spec-file=/provisioning/spec.yaml "+
+		"--statefulset-name="+releaseName+"-cockroachdb --namespace="+namespaceName)
+	require.Contains(t, containers[1].Command[2], "--client-secret="+releaseName+"-cockroachdb-client-secret;")
+	require.Equal(t, "testUser_PASSWORD", containers[1].Env[0].Name)
+	require.Equal(t, releaseName+"-cockroachdb-provisioning", job.Spec.Template.Spec.Volumes[0].ConfigMap.Name)
+
+	output = helm.RenderTemplate(t, options, helmChartPath, releaseName, []string{"templates/configmap.init.yaml"})
+	var configMap corev1.ConfigMap
+	helm.UnmarshalK8SYaml(t, output, &configMap)
+
+	require.Contains(t, configMap.Data["spec.yaml"], "name: testUser")
+	require.Contains(t, configMap.Data["spec.yaml"], "recurring: '@always'")
+	require.NotContains(t, configMap.Data["spec.yaml"], "testPassword")
+
+	output = helm.RenderTemplate(t, options, helmChartPath, releaseName, []string{"templates/role.yaml"})
+	require.Contains(t, output, "statefulsets")
+}
+
 func TestHelmServiceMonitor(t *testing.T) {
 	t.Parallel()
 	testCases := []struct {